@@ -61,7 +61,7 @@ build() {
     
     GOOS=$os GOARCH=$arch go build -o "${output_path}/${output_name}" \
         -ldflags="-s -w -X main.Version=${VERSION}" \
-        main.go
+        .
     
     if [ $? -eq 0 ]; then
         print_success "Built ${os}/${arch}"
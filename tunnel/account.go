@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Portal API endpoint describing the account a token belongs to
+const AccountURL = "https://api.comzy.io/v1/account"
+
+// How long token verification may take before it counts as a network failure
+const VerifyTimeout = 10 * time.Second
+
+// Account details returned for a valid token
+type accountInfo struct {
+	Email     string    `json:"email"`
+	Plan      string    `json:"plan"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+func (a *accountInfo) String() string {
+	s := a.Email
+	if a.Plan != "" {
+		s += fmt.Sprintf(" (%s plan)", a.Plan)
+	}
+	if !a.ExpiresAt.IsZero() {
+		s += fmt.Sprintf(", token expires %s", a.ExpiresAt.Local().Format("2006-01-02"))
+	}
+	return s
+}
+
+// The API rejected the token, as opposed to not being reachable
+type tokenRejectedError struct {
+	reason string // expired, revoked or invalid
+}
+
+func (e *tokenRejectedError) Error() string {
+	return fmt.Sprintf("token is %s", e.reason)
+}
+
+// Ask the API whether a token is valid. A *tokenRejectedError means it
+// isn't; any other error means the answer couldn't be had.
+func verifyToken(token string) (*accountInfo, error) {
+	req, err := http.NewRequest("GET", AccountURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := apiClient(VerifyTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var account accountInfo
+		if err := json.NewDecoder(resp.Body).Decode(&account); err != nil {
+			return nil, fmt.Errorf("unexpected response from %s: %v", AccountURL, err)
+		}
+		return &account, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		var body struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		switch body.Error {
+		case "expired", "revoked":
+			return nil, &tokenRejectedError{reason: body.Error}
+		}
+		return nil, &tokenRejectedError{reason: "invalid"}
+	}
+	return nil, fmt.Errorf("%s: %s", AccountURL, resp.Status)
+}
+
+// Verify a token, printing the account it belongs to. Only a rejection is
+// returned as an error; if the API can't be reached a warning is printed.
+func checkToken(token string) error {
+	account, err := verifyToken(token)
+	var rejected *tokenRejectedError
+	switch {
+	case errors.As(err, &rejected):
+		return err
+	case err != nil:
+		logWarning(fmt.Sprintf("Could not verify token: %v", err))
+	default:
+		logDim(fmt.Sprintf("Account: %s", account))
+	}
+	return nil
+}
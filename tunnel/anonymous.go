@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connected time allowed to an anonymous session
+var AnonymousLimit = time.Hour
+
+// How often an anonymous session is reminded of its remaining time
+const AnonymousReminderEvery = 10 * time.Minute
+
+// Connected time left at which an anonymous session is warned it will end
+var AnonymousWarnings = []time.Duration{10 * time.Minute, time.Minute}
+
+// Connected time left to an anonymous session. One clock is owned by the
+// tunnel group: it runs while any tunnel is registered anonymously and
+// pauses while they are all reconnecting, so a reconnect neither costs
+// time nor starts a second countdown.
+type anonymousClock struct {
+	mu        sync.Mutex
+	used      time.Duration
+	since     time.Time // when the clock last resumed
+	connected int       // tunnels currently registered anonymously
+	timer     *time.Timer
+	expire    func()
+
+	// Each of AnonymousWarnings is given once, while the clock runs
+	warnings []*time.Timer
+	warned   map[time.Duration]bool
+	warn     func(left time.Duration)
+}
+
+func newAnonymousClock(expire func(), warn func(left time.Duration)) *anonymousClock {
+	return &anonymousClock{expire: expire, warn: warn, warned: make(map[time.Duration]bool)}
+}
+
+// A tunnel registered anonymously
+func (c *anonymousClock) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected++
+	if c.connected == 1 {
+		c.since = time.Now()
+		left := max(AnonymousLimit-c.used, 0)
+		c.timer = time.AfterFunc(left, c.expire)
+		for _, at := range AnonymousWarnings {
+			if c.warned[at] || left <= at {
+				continue
+			}
+			c.warnings = append(c.warnings, time.AfterFunc(left-at, func() {
+				c.mu.Lock()
+				warned := c.warned[at]
+				c.warned[at] = true
+				c.mu.Unlock()
+				if !warned {
+					c.warn(at)
+				}
+			}))
+		}
+	}
+}
+
+// An anonymously registered tunnel disconnected
+func (c *anonymousClock) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected--
+	if c.connected == 0 {
+		c.used += time.Since(c.since)
+		c.timer.Stop()
+		c.timer = nil
+		for _, timer := range c.warnings {
+			timer.Stop()
+		}
+		c.warnings = nil
+	}
+}
+
+// Connected time left, and whether the clock is running
+func (c *anonymousClock) remaining() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	used := c.used
+	if c.connected > 0 {
+		used += time.Since(c.since)
+	}
+	return max(AnonymousLimit-used, 0), c.connected > 0
+}
+
+// Describe the remaining time, e.g. "42m"
+func (c *anonymousClock) String() string {
+	left, _ := c.remaining()
+	if left >= time.Minute {
+		return left.Truncate(time.Minute).String()
+	}
+	return left.Round(time.Second).String()
+}
+
+// Called when the anonymous clock runs out. Logging in while the tunnels
+// run lifts the limit, so check for a token before ending the session.
+func (g *tunnelGroup) anonymousExpired() {
+	if getToken() != "" {
+		logInfo("Logged in, reconnecting with your account")
+		for _, t := range g.tunnels {
+			t.close()
+		}
+		return
+	}
+	// In-flight requests are answered and the connections closed
+	// properly before exiting with ExitAnonymousExpired
+	banner := strings.Repeat("!", 64)
+	fmt.Fprintln(console)
+	logWarning(banner)
+	logWarning(fmt.Sprintf("ANONYMOUS SESSION EXPIRED: the %s limit was reached", formatLimit(AnonymousLimit)))
+	logWarning(fmt.Sprintf("Get a token at %s and run \"comzy login\"", portalURL))
+	logWarning("for tunnels without a time limit")
+	logWarning(banner)
+	go g.shutdown(errAnonymousExpired)
+}
+
+// Warn an anonymous session that it will end in left, unless it has
+// logged in meanwhile
+func (g *tunnelGroup) anonymousEnding(left time.Duration) {
+	if getToken() != "" {
+		return
+	}
+	fmt.Fprintln(console)
+	logWarning(fmt.Sprintf("Anonymous session ends in %s: the tunnels will stop and their URLs go away", formatLimit(left)))
+	logInfo(fmt.Sprintf("Log in to keep them running: get a token at %s and run \"comzy login\" in another terminal", portalURL))
+}
+
+// A duration such as 1h0m0s as people write it, e.g. "1 hour"
+func formatLimit(d time.Duration) string {
+	switch {
+	case d == time.Hour:
+		return "1 hour"
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	case d == time.Minute:
+		return "1 minute"
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	}
+	return d.String()
+}
+
+// AnonymousWarnings for the startup banner, e.g. "10 minutes and 1 minute"
+func anonymousWarningTimes() string {
+	var times []string
+	for _, at := range AnonymousWarnings {
+		times = append(times, formatLimit(at))
+	}
+	if len(times) < 2 {
+		return strings.Join(times, "")
+	}
+	return strings.Join(times[:len(times)-1], ", ") + " and " + times[len(times)-1]
+}
+
+// Print the remaining anonymous time periodically until the group stops
+func (g *tunnelGroup) remindAnonymous() {
+	ticker := time.NewTicker(AnonymousReminderEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, running := g.anonymous.remaining(); running && getToken() == "" {
+				logDim(fmt.Sprintf("Anonymous session: %s of connected time left", g.anonymous))
+			}
+		case <-g.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run f with stdout going to a file, returning what was written
+func captureStdout(t *testing.T, path string, f func()) string {
+	t.Helper()
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = out
+	f()
+	os.Stdout = saved
+	out.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// A daemon of an anonymous session runs out of time, shuts down with its
+// exit code and leaves a record "comzy status" explains the stop with
+func TestAnonymousDaemonExpires(t *testing.T) {
+	savedDir, savedUser, savedLimit, savedWarnings := comzyDir, userFile, AnonymousLimit, AnonymousWarnings
+	t.Cleanup(func() {
+		comzyDir, userFile, AnonymousLimit, AnonymousWarnings = savedDir, savedUser, savedLimit, savedWarnings
+		setupLogging(defaultOptions())
+	})
+	comzyDir = t.TempDir()
+	userFile = comzyDir + "/.user"
+	AnonymousLimit, AnonymousWarnings = time.Second, nil
+	t.Setenv(TokenEnv, "")
+	const id = "expiring"
+	t.Setenv(daemonEnv, id)
+	if err := os.MkdirAll(runDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	edge := newFakeEdge(t)
+	// Started as "comzy start --daemon" starts the background process,
+	// with its output in the daemon log
+	var code int
+	started := time.Now()
+	log := captureStdout(t, daemonFile(id, ".log"), func() {
+		code = Main([]string{"3000", "--server", edge.wsURL(), "--no-inspect", "--daemon", "--color", "never"})
+	})
+
+	if code != ExitAnonymousExpired {
+		t.Errorf("exit code %d, want %d\n%s", code, ExitAnonymousExpired, log)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %s to expire after a 1s limit", elapsed)
+	}
+	if !strings.Contains(log, "ANONYMOUS SESSION EXPIRED") {
+		t.Errorf("the daemon log doesn't say the session expired:\n%s", log)
+	}
+	if _, err := os.Stat(daemonFile(id, ".json")); !os.IsNotExist(err) {
+		t.Errorf("the daemon's state was left behind: %v", err)
+	}
+	if loadCurrent() != nil {
+		t.Error("the session is still recorded as running")
+	}
+
+	status := captureStdout(t, comzyDir+"/status.txt", func() {
+		if err := showStatus(nil); err != nil {
+			t.Error(err)
+		}
+	})
+	if !strings.Contains(status, "Last session stopped") || !strings.Contains(status, errAnonymousExpired.Error()) {
+		t.Errorf("comzy status doesn't say why the tunnel stopped:\n%s", status)
+	}
+	report := captureStdout(t, comzyDir+"/status.json", func() {
+		if err := showStatus([]string{"--json"}); err != nil {
+			t.Error(err)
+		}
+	})
+	var parsed statusReport
+	if err := json.Unmarshal([]byte(report), &parsed); err != nil {
+		t.Fatalf("comzy status --json: %v\n%s", err, report)
+	}
+	if s := parsed.LastSession; s == nil || s.ExitCode != ExitAnonymousExpired || s.Reason != errAnonymousExpired.Error() {
+		t.Errorf("comzy status --json last_session = %+v", s)
+	}
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Credentials required of incoming requests when --basic-auth is set.
+// Only hashes are kept so every comparison takes the same time.
+type basicAuth struct {
+	hashes [][sha256.Size]byte
+}
+
+// nil when there are no credentials, which lets every request through
+func newBasicAuth(credentials []string) *basicAuth {
+	if len(credentials) == 0 {
+		return nil
+	}
+	a := &basicAuth{}
+	for _, cred := range credentials {
+		a.hashes = append(a.hashes, sha256.Sum256([]byte(cred)))
+	}
+	return a
+}
+
+// Check an Authorization header. Every credential is compared, with no
+// early exit, so timing doesn't reveal which one came close.
+func (a *basicAuth) allows(authorization string) bool {
+	if a == nil {
+		return true
+	}
+	scheme, encoded, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(decoded)
+	match := 0
+	for _, h := range a.hashes {
+		match |= subtle.ConstantTimeCompare(sum[:], h[:])
+	}
+	return match == 1
+}
+
+// Check that a --basic-auth value has the form user:pass
+func validateCredential(cred string) error {
+	user, _, ok := strings.Cut(cred, ":")
+	if !ok || user == "" {
+		return fmt.Errorf("invalid --basic-auth %q (use user:pass)", maskCredential(cred))
+	}
+	return nil
+}
+
+// Hide the password of a user:pass credential
+func maskCredential(cred string) string {
+	if user, _, ok := strings.Cut(cred, ":"); ok {
+		return user + ":*****"
+	}
+	return "*****"
+}
+
+// Reply 401 to a request without valid credentials. Unauthorized requests
+// never reach the local app or the inspector.
+func sendUnauthorized(ws *tunnelConn, id MessageID) {
+	sendRejection(ws, id, 401, "Unauthorized", HeaderMap{
+		"www-authenticate": {`Basic realm="comzy"`},
+	})
+}
+
+// Reply to a request the client refuses to forward
+func sendRejection(ws *tunnelConn, id MessageID, status int, message string, headers HeaderMap) {
+	if headers == nil {
+		headers = HeaderMap{}
+	}
+	headers.Set("content-type", "text/plain; charset=utf-8")
+	response := ResponseMessage{
+		ID:      id,
+		Status:  status,
+		Headers: headers,
+		Body:    message,
+	}
+	if err := ws.WriteJSON(response); err != nil {
+		ws.log.Error(fmt.Sprintf("Failed to send response: %v", err))
+	}
+}
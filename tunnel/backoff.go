@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Reconnect delays
+const (
+	ReconnectBaseDelay = time.Second
+	ReconnectMaxDelay  = 60 * time.Second
+	ReconnectJitter    = 0.2 // +/- fraction applied to each delay
+
+	// Connections that last this long reset the backoff
+	StableConnection = time.Minute
+)
+
+// Exponential backoff with jitter, so clients that lost the server at the
+// same moment don't all reconnect in lockstep
+type backoff struct {
+	base, max time.Duration
+	attempt   int
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{base: base, max: max}
+}
+
+// Next delay: base, 2*base, 4*base ... capped at max, with jitter
+func (b *backoff) Next() time.Duration {
+	delay := b.max
+	if b.attempt < 32 {
+		if d := b.base << b.attempt; d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	b.attempt++
+
+	jitter := 1 + ReconnectJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(delay) * jitter)
+}
+
+// Reset starts again from the base delay
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
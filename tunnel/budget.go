@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// What a tunnel does once it has used up its --budget
+const (
+	BudgetPause = "pause" // answer requests with 503 until the session ends
+	BudgetExit  = "exit"  // let in-flight requests finish and end the session
+)
+
+// Requests refused once a tunnel has used up its --budget with
+// --budget-action pause
+var errBudgetSpent = errors.New("bandwidth budget used up")
+
+// Ends the session when a tunnel used up its --budget with --budget-action
+// exit
+var errBudgetExit = errors.New("bandwidth budget used up, tunnel stopped")
+
+// Body bytes a tunnel may move in a session, both ways together
+type bandwidthBudget struct {
+	limit  int64
+	action string
+	spent  atomic.Bool
+
+	// Called once when the budget is used up, if set
+	onSpent func()
+}
+
+// nil when no --budget is given
+func newBandwidthBudget(opts *Options) *bandwidthBudget {
+	if opts.Budget <= 0 {
+		return nil
+	}
+	return &bandwidthBudget{limit: int64(opts.Budget), action: opts.BudgetAction}
+}
+
+// Check a --budget-action
+func validateBudgetAction(action string) error {
+	switch action {
+	case BudgetPause, BudgetExit:
+		return nil
+	}
+	return fmt.Errorf("invalid --budget-action %q (use pause or exit)", action)
+}
+
+// Whether requests should be refused. Safe to call on a nil budget.
+func (b *bandwidthBudget) exhausted() bool {
+	return b != nil && b.spent.Load()
+}
+
+// Compare the tunnel's session totals with the budget, warning and acting
+// the first time they reach it. Safe to call on a nil budget.
+func (b *bandwidthBudget) check(totals *sessionTotals, log Logger) {
+	if b == nil {
+		return
+	}
+	used := totals.bytesIn.Load() + totals.bytesOut.Load()
+	if used < b.limit || b.spent.Swap(true) {
+		return
+	}
+	banner := strings.Repeat("!", 64)
+	log.Warning(banner)
+	log.Warning(fmt.Sprintf("BUDGET USED UP: %s of --budget %s moved (%s in, %s out)",
+		formatBytes(used), ByteSize(b.limit), formatBytes(totals.bytesIn.Load()), formatBytes(totals.bytesOut.Load())))
+	if b.action == BudgetExit {
+		log.Warning("Stopping the tunnel (--budget-action exit)")
+	} else {
+		log.Warning("PAUSED: requests are answered with 503 until comzy is restarted")
+	}
+	log.Warning(banner)
+	if b.onSpent != nil {
+		b.onSpent()
+	}
+}
+
+// Budget left, for metrics
+func (b *bandwidthBudget) remaining(totals *sessionTotals) int64 {
+	return max(b.limit-totals.bytesIn.Load()-totals.bytesOut.Load(), 0)
+}
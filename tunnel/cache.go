@@ -0,0 +1,238 @@
+package tunnel
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for --cache-size and --cache-ttl
+const (
+	DefaultCacheSize = 64 << 20
+	DefaultCacheTTL  = 60 * time.Second
+)
+
+// Header added to responses served from the --cache
+const cacheHeader = "x-comzy-cache"
+
+// Request headers that pick between representations, part of the cache
+// key. Responses that Vary on anything else aren't cached. The verified
+// email of a portal login is one too, so each signed-in visitor only ever
+// gets the pages built for them.
+var cacheKeyHeaders = []string{"accept", "accept-encoding", "accept-language", "cookie", "origin", strings.ToLower(ForwardedEmailHeader)}
+
+// Responses the local app sent to GET and HEAD requests, kept in memory
+// for --cache-ttl so repeated requests for the same asset don't make the
+// round trip. The least recently used are evicted once the bodies pass
+// --cache-size.
+type responseCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	ttl     time.Duration
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+}
+
+type cachedResponse struct {
+	key     string
+	status  int
+	headers HeaderMap
+	body    []byte
+	expires time.Time
+}
+
+// nil unless --cache is set
+func newResponseCache(opts *Options) *responseCache {
+	if !opts.Cache {
+		return nil
+	}
+	return &responseCache{
+		maxSize: int64(opts.CacheSize),
+		ttl:     opts.CacheTTL,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// Key of a request, "" if it mustn't be served from the cache: only GET
+// and HEAD without credentials are, unless the client asks to revalidate
+func cacheKey(request IncomingRequest) string {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return ""
+	}
+	if request.Headers.Get("authorization") != "" {
+		return ""
+	}
+	directives := cacheDirectives(request.Headers)
+	if directives["no-cache"] || directives["no-store"] {
+		return ""
+	}
+	var key strings.Builder
+	key.WriteString(request.Method + " " + request.Path)
+	for _, name := range cacheKeyHeaders {
+		key.WriteString("\n" + strings.Join(request.Headers[name], ", "))
+	}
+	return key.String()
+}
+
+// Cached response for key, nil on a miss. Safe to call on a nil cache.
+func (c *responseCache) get(key string) *cachedResponse {
+	if c == nil || key == "" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		traffic.cacheMisses.Add(1)
+		return nil
+	}
+	entry := e.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		traffic.cacheMisses.Add(1)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	traffic.cacheHits.Add(1)
+	return entry
+}
+
+// Keep a response to the request of key if it may be reused: a 200 the
+// local app didn't mark private, uncacheable or user-specific
+func (c *responseCache) put(key string, status int, headers HeaderMap, body []byte) {
+	if c == nil || key == "" || status != 200 {
+		return
+	}
+	ttl, ok := cacheLifetime(headers, c.ttl)
+	if !ok || int64(len(body)) > c.maxSize {
+		return
+	}
+	entry := &cachedResponse{key: key, status: status, headers: headers, body: body, expires: time.Now().Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += int64(len(body))
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// How long a response may be reused, at most ttl. max-age and s-maxage
+// shorten it; no-store, no-cache, private, Set-Cookie and Vary on headers
+// outside the key rule it out.
+func cacheLifetime(headers HeaderMap, ttl time.Duration) (time.Duration, bool) {
+	directives := cacheDirectives(headers)
+	if directives["no-store"] || directives["no-cache"] || directives["private"] {
+		return 0, false
+	}
+	if len(headers["set-cookie"]) > 0 {
+		return 0, false
+	}
+	for _, value := range headers["vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" && !isCacheKeyHeader(name) {
+				return 0, false
+			}
+		}
+	}
+	for _, value := range headers["cache-control"] {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, found := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(name)
+			if !found || (name != "max-age" && name != "s-maxage") {
+				continue
+			}
+			seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+			if err != nil {
+				continue
+			}
+			ttl = min(ttl, time.Duration(seconds)*time.Second)
+		}
+	}
+	return ttl, ttl > 0
+}
+
+// Whether an If-None-Match header lists etag, compared weakly as RFC 9110
+// asks for GET and HEAD
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isCacheKeyHeader(name string) bool {
+	for _, h := range cacheKeyHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Directives of the Cache-Control and Pragma headers, lowercased, without
+// their arguments
+func cacheDirectives(headers HeaderMap) map[string]bool {
+	directives := map[string]bool{}
+	for _, name := range []string{"cache-control", "pragma"} {
+		for _, value := range headers[name] {
+			for _, directive := range strings.Split(value, ",") {
+				name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+				directives[strings.ToLower(name)] = true
+			}
+		}
+	}
+	return directives
+}
+
+// Answer a request with a cached response, marked with X-Comzy-Cache: HIT.
+// A browser revalidating the same ETag gets 304 Not Modified.
+func sendCached(ws *tunnelConn, request IncomingRequest, target *localTarget, hit *cachedResponse, inspect bool) {
+	headers := make(HeaderMap, len(hit.headers)+1)
+	for key, values := range hit.headers {
+		headers[key] = values
+	}
+	headers.Set(cacheHeader, "HIT")
+	status, body := hit.status, hit.body
+	if etag := headers.Get("etag"); etag != "" && etagMatches(request.Headers.Get("if-none-match"), etag) {
+		status, body = http.StatusNotModified, nil
+	}
+	if inspect {
+		inspector.Begin(target, request, nil, "").Finish(status, headers, body)
+	}
+	response := ResponseMessage{
+		ID:      request.ID,
+		Status:  status,
+		Headers: headers,
+	}
+	if !isBodiless(request.Method, status) {
+		response.Body = responseBody(headers, body)
+	}
+	if err := ws.WriteJSON(response); err == errResponseExpired {
+		ws.abandon(request.ID)
+	} else if err != nil {
+		ws.log.Error(fmt.Sprintf("Failed to send response: %v", err))
+	}
+}
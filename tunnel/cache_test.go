@@ -0,0 +1,53 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A page the local app builds for one signed-in visitor is never served
+// from the cache to another
+func TestCacheKeepsPortalIdentitiesApart(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	keys := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"keys":[{"kid":"k1","key":%q}]}`, base64.StdEncoding.EncodeToString(public))
+	}))
+	t.Cleanup(keys.Close)
+	saved := IdentityKeysURL
+	IdentityKeysURL = keys.URL
+	t.Cleanup(func() { IdentityKeysURL = saved })
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "<p>Signed in as %s</p>", r.Header.Get(ForwardedEmailHeader))
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--cache", "--oauth-allow-domain", "example.com")
+
+	// Identity header the portal would add for email
+	identity := func(email string) string {
+		claims, _ := json.Marshal(identityClaims{KeyID: "k1", Email: email,
+			Host: strings.TrimPrefix(publicURL("test"), "https://"), Expires: time.Now().Add(time.Hour).Unix()})
+		payload := base64.RawURLEncoding.EncodeToString(claims)
+		return payload + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(payload)))
+	}
+	for i, email := range []string{"ana@example.com", "ben@example.com", "ana@example.com", "ben@example.com"} {
+		conn.request(i+1, "GET", "/account", HeaderMap{IdentityHeader: {identity(email)}}, nil)
+		resp, _ := conn.response(i+1, false)
+		if want := "<p>Signed in as " + email + "</p>"; resp.Status != 200 || string(resp.Body) != want {
+			t.Errorf("request %d as %s: %d %q, want %q", i+1, email, resp.Status, resp.Body, want)
+		}
+		if hit := resp.Headers.Get(cacheHeader) == "HIT"; hit != (i >= 2) {
+			t.Errorf("request %d as %s: cache hit %v", i+1, email, hit)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// How long "comzy check" waits for an answer or, with nothing running,
+// for a tunnel to register
+const DefaultCheckTimeout = 10 * time.Second
+
+// Health of one tunnel, as served on /healthz
+type tunnelHealth struct {
+	Name       string `json:"name,omitempty"`
+	Connected  bool   `json:"connected"`
+	Registered bool   `json:"registered"`
+	URL        string `json:"url,omitempty"`
+	// Seconds since the server last sent anything, pings and pongs included
+	LastMessageAge float64 `json:"last_message_age_seconds"`
+	Inflight       int64   `json:"inflight"`
+
+	healthy bool
+}
+
+// Body of /healthz: all tunnels together, and each one when there are
+// several
+type healthReport struct {
+	tunnelHealth
+	Healthy bool           `json:"healthy"`
+	Tunnels []tunnelHealth `json:"tunnels,omitempty"`
+}
+
+// A tunnel is healthy while registered on a connection the server hasn't
+// gone silent on
+func (t *tunnel) health() tunnelHealth {
+	h := tunnelHealth{Name: t.opts.Name, URL: t.publicEndpoint(), Inflight: t.active.Load()}
+	t.mu.Lock()
+	ws := t.ws
+	t.mu.Unlock()
+	if ws == nil {
+		return h
+	}
+	silent := ws.sinceLastMessage()
+	h.Connected = !ws.closed()
+	h.Registered = h.Connected && ws.getPublicHost() != ""
+	h.LastMessageAge = math.Round(silent.Seconds()*1000) / 1000
+	h.healthy = h.Registered && (ws.pongWait <= 0 || silent < ws.pongWait)
+	return h
+}
+
+func (g *tunnelGroup) health() healthReport {
+	report := healthReport{Healthy: len(g.tunnels) > 0 && !g.draining.Load()}
+	report.Connected, report.Registered = report.Healthy, report.Healthy
+	for _, t := range g.tunnels {
+		h := t.health()
+		report.Connected = report.Connected && h.Connected
+		report.Registered = report.Registered && h.Registered
+		report.Healthy = report.Healthy && h.healthy
+		if report.URL == "" {
+			report.URL = h.URL
+		}
+		report.LastMessageAge = max(report.LastMessageAge, h.LastMessageAge)
+		report.Inflight += h.Inflight
+		report.Tunnels = append(report.Tunnels, h)
+	}
+	if len(report.Tunnels) < 2 {
+		report.Tunnels = nil
+	}
+	return report
+}
+
+// GET /healthz on the inspector and metrics listeners: 200 while every
+// tunnel is healthy, 503 otherwise, for container health checks
+func (g *tunnelGroup) serveHealth(w http.ResponseWriter, r *http.Request) {
+	report := g.health()
+	status := http.StatusOK
+	if !report.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+// Handle "comzy check": ask the running instance's /healthz whether its
+// tunnels are up, or with nothing running, connect, register and
+// disconnect once. Fails unless healthy, for readiness scripts.
+func handleCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	healthURL := fs.String("url", "", "Health endpoint to query (default: the running instance's)")
+	timeout := fs.Duration("timeout", DefaultCheckTimeout, "Give up after this long")
+	asJSON := fs.Bool("json", false, "Print the health report as JSON")
+	checkArgs, rest := splitSoakArgs(fs, args)
+	if err := parseFlags(fs, checkArgs); err != nil {
+		return err
+	}
+	if *timeout <= 0 {
+		return &usageError{fmt.Errorf("--timeout must be positive"), fs}
+	}
+
+	if *healthURL == "" {
+		if current := loadCurrent(); current != nil {
+			if current.Health == "" {
+				return fmt.Errorf("comzy is running (pid %d) without an inspector or metrics listener, so its health can't be queried", current.PID)
+			}
+			*healthURL = current.Health
+		}
+	}
+	if *healthURL != "" {
+		if len(rest) > 0 {
+			return &usageError{fmt.Errorf("tunnel options are only used when nothing is running, got %s", rest[0]), fs}
+		}
+		return checkRunning(*healthURL, *timeout, *asJSON)
+	}
+	return checkConnect(rest, *timeout, *asJSON)
+}
+
+// Query a running instance's health endpoint
+func checkRunning(url string, timeout time.Duration, asJSON bool) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	}
+	defer resp.Body.Close()
+	var report healthReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("unexpected response from %s (%s): %v", url, resp.Status, err)
+	}
+	if asJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		switch {
+		case !report.Connected:
+			return fmt.Errorf("unhealthy: not connected to the tunnel server")
+		case !report.Registered:
+			return fmt.Errorf("unhealthy: connected but not registered")
+		}
+		return fmt.Errorf("unhealthy: nothing heard from the tunnel server in %.0fs", report.LastMessageAge)
+	}
+	if !asJSON {
+		logSuccess(fmt.Sprintf("Healthy: %s (last message %.0fs ago, %d in flight)", report.URL, report.LastMessageAge, report.Inflight))
+	}
+	return nil
+}
+
+// Register a tunnel with the server and disconnect right away, to check
+// that a tunnel can be opened with the given options
+func checkConnect(args []string, timeout time.Duration, asJSON bool) error {
+	opts, err := parseOptions(args, "")
+	if err != nil {
+		return err
+	}
+	opts.NoInspect, opts.UI, opts.Wait, opts.MetricsAddr = true, false, false, ""
+	opts.Notify, opts.NotifyWebhook = false, ""
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 1
+	}
+	if opts.source("log-level") == SourceDefault {
+		opts.LogLevel = LevelWarn.String()
+	}
+	if err := setupLogging(opts); err != nil {
+		return err
+	}
+
+	run := &soakRun{registered: make(chan struct{})}
+	group := newTunnelGroup()
+	group.observe = run.observe
+	if err := prepareGroup(group, []*Options{opts}); err != nil {
+		return err
+	}
+	ctx, stop := interruptOnSignal(group)
+	defer stop()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- runGroup(ctx, group)
+	}()
+
+	select {
+	case <-run.registered:
+	case err := <-finished:
+		return fmt.Errorf("could not register a tunnel: %w", err)
+	case <-time.After(timeout):
+		group.stop(errCheckFinished)
+		<-finished
+		return fmt.Errorf("tunnel did not register within %s", timeout)
+	}
+	report := group.health()
+	group.stop(errCheckFinished)
+	<-finished
+
+	if asJSON {
+		return printJSON(report)
+	}
+	fmt.Printf("%sRegistered %s with %s and disconnected%s\n", ColorGreen, report.URL, opts.Server, ColorReset)
+	return nil
+}
@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default time between pings; the connection is considered dead when
+// nothing arrives for twice this long
+const DefaultPingInterval = 20 * time.Second
+
+// Record that the server was heard from, and give it until pongWait from
+// now to send something again
+func (c *tunnelConn) extendDeadline() {
+	atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+	if c.pongWait <= 0 {
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(c.pongWait))
+}
+
+// ReadMessage reads the next message, extending the read deadline since
+// any message shows the connection is alive. Messages over the frame
+// limit are returned as an *oversizeMessage.
+func (c *tunnelConn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.readFrame()
+	var oversize *oversizeMessage
+	if err == nil || errors.As(err, &oversize) {
+		c.extendDeadline()
+	}
+	return messageType, data, err
+}
+
+// Answer pings from the server. WriteControl may run alongside the writer
+// goroutine, so the pong doesn't wait behind queued responses.
+func (c *tunnelConn) handlePing(payload string) error {
+	c.extendDeadline()
+	err := c.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second))
+	if errors.Is(err, websocket.ErrCloseSent) || isDeadConnection(err) {
+		return nil
+	}
+	return err
+}
+
+// Time since the server last sent anything. Pings and pongs count, so
+// this grows on a connection that has silently died.
+func (c *tunnelConn) sinceLastMessage() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastMessage)))
+}
+
+// Check whether a read failed because the server went silent
+func isDeadConnection(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Send a ping carrying its send time so the pong yields the round trip
+func (c *tunnelConn) sendPing() error {
+	payload := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return c.WriteMessage(websocket.PingMessage, []byte(payload))
+}
+
+// Record the round trip from a pong echoing a sendPing payload
+func (c *tunnelConn) handlePong(payload string) error {
+	c.extendDeadline()
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err == nil {
+		atomic.StoreInt64(&c.rtt, int64(time.Since(time.Unix(0, sent))))
+	}
+	return nil
+}
+
+// Latest measured round trip to the tunnel server
+func (c *tunnelConn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Estimate the server clock offset from a server timestamp (ms) that was
+// sent about half a round trip ago
+func (c *tunnelConn) setServerTime(serverMillis int64) {
+	sentAt := time.Now().Add(-c.RTT() / 2)
+	offset := time.UnixMilli(serverMillis).Sub(sentAt)
+	atomic.StoreInt64(&c.clockOffset, int64(offset))
+}
+
+// Time a request spent between arriving at the edge and reaching this
+// client, adjusted for clock skew. ok is false when the server didn't
+// send an arrival timestamp.
+func (c *tunnelConn) edgeDelay(receivedAtMillis int64) (delay time.Duration, ok bool) {
+	if receivedAtMillis <= 0 {
+		return 0, false
+	}
+	offset := time.Duration(atomic.LoadInt64(&c.clockOffset))
+	arrived := time.UnixMilli(receivedAtMillis).Add(-offset)
+	delay = time.Since(arrived)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
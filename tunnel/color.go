@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// When to color console output, set with --color
+const (
+	ColorAuto   = "auto"   // only on a terminal, unless NO_COLOR is set
+	ColorAlways = "always" // also when piped, for tools that understand ANSI
+	ColorNever  = "never"
+)
+
+// Environment variable that turns colors off when set to anything, see
+// https://no-color.org
+const NoColorEnv = "NO_COLOR"
+
+// Take --color MODE, --color=MODE and --no-color out of args. They apply
+// to every command, so they are handled before the command is parsed.
+func colorFlag(args []string) (rest []string, mode string, err error) {
+	mode = ColorAuto
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--no-color" || arg == "-no-color":
+			mode = ColorNever
+		case arg == "--color" || arg == "-color":
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("--color needs a value: auto, always or never")
+			}
+			i++
+			mode = args[i]
+		case strings.HasPrefix(arg, "--color=") || strings.HasPrefix(arg, "-color="):
+			_, mode, _ = strings.Cut(arg, "=")
+		default:
+			rest = append(rest, arg)
+			continue
+		}
+		if mode != ColorAuto && mode != ColorAlways && mode != ColorNever {
+			return nil, "", fmt.Errorf("invalid --color %q (use auto, always or never)", mode)
+		}
+	}
+	return rest, mode, nil
+}
+
+// Decide whether the console gets colors
+func useColors(mode string) bool {
+	switch mode {
+	case ColorAlways:
+		// Best effort on old Windows consoles; the user asked for escapes
+		enableANSI()
+		return true
+	case ColorNever:
+		return false
+	}
+	if os.Getenv(NoColorEnv) != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	if !term.IsTerminal(int(os.Stdout.Fd())) {
+		return false
+	}
+	return enableANSI()
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// Default limits on requests handled at once, and waiting for a turn
+const (
+	DefaultMaxConcurrent = 50
+	DefaultQueueSize     = 100
+)
+
+// Seconds a client refused by a full queue is told to wait
+const queueRetryAfter = "1"
+
+// Every slot is taken and the queue is full
+var errQueueFull = errors.New("over --max-concurrent and the queue is full")
+
+// Bounds the requests of one tunnel handed to the local app at once.
+// Requests over the limit wait their turn in a queue of bounded length;
+// past that they are refused, so a burst can't pile goroutines up without
+// end or swamp a dev server.
+type requestLimiter struct {
+	slots     chan struct{} // nil when unlimited
+	queueSize int64
+	queued    atomic.Int64
+}
+
+// Limit to max requests at once with up to queueSize waiting; zero max
+// means no limit
+func newRequestLimiter(max, queueSize int) *requestLimiter {
+	l := &requestLimiter{queueSize: int64(queueSize)}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// Wait for a slot until ctx is done. The returned func gives it back.
+func (l *requestLimiter) acquire(ctx context.Context) (func(), error) {
+	if l.slots == nil {
+		return l.admitted(), nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.admitted(), nil
+	default:
+	}
+
+	if l.queued.Add(1) > l.queueSize {
+		l.queued.Add(-1)
+		return nil, errQueueFull
+	}
+	traffic.queued.Add(1)
+	defer func() {
+		l.queued.Add(-1)
+		traffic.queued.Add(-1)
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return l.admitted(), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *requestLimiter) admitted() func() {
+	traffic.inFlight.Add(1)
+	return func() {
+		traffic.inFlight.Add(-1)
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+}
+
+// Requests waiting for a slot
+func (l *requestLimiter) waiting() int64 {
+	return l.queued.Load()
+}
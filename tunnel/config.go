@@ -0,0 +1,866 @@
+package tunnel
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Setting sources reported by print-config
+const (
+	SourceDefault  = "default"
+	SourceFlag     = "flag"
+	SourceArgument = "argument"
+	SourceEnv      = "environment"
+)
+
+// Flags that can't be set from the config file. --allow and --deny are
+// written there as a rules: list, which keeps them in order.
+var commandLineOnly = map[string]bool{"config": true, "token": true, "daemon": true, "allow": true, "deny": true, "print-rules": true}
+
+// Options holds the effective settings for a tunnel invocation
+type Options struct {
+	Scheme             string
+	Host               string
+	Port               int
+	InsecureSkipVerify bool
+	MaxConnsPerHost    int
+	MaxIdleConns       int
+	MaxConcurrent      int
+	QueueSize          int
+	DisableKeepAlive   bool
+	ChunkThreshold     ByteSize
+	ChunkSize          ByteSize
+	MaxOutboundRate    ByteSize
+	MaxBodySize        ByteSize
+	ResponseExpiry     time.Duration
+	PingInterval       time.Duration
+	PongTimeout        time.Duration
+	DrainTimeout       time.Duration
+	Timeout            time.Duration
+	MaxRequestAge      time.Duration
+	ForwardedHeaders   string
+	NoProxyHeaders     bool
+	Daemon             bool
+	HostHeader         string
+	LogLevel           string
+	LogFormat          string
+	LogFile            string
+	Quiet              bool
+	LogBodies          bool
+	LogFilter          stringList
+	Proxy              string
+	ProxyAll           bool
+	ProxyLocal         bool
+	Subdomain          string
+	Region             string
+	MaxRetries         int
+	InspectPort        int
+	InspectBodyLimit   ByteSize
+	NoInspect          bool
+	UI                 bool
+	Latency            Latency
+	Bandwidth          Bandwidth
+	MetricsAddr        string
+	Server             string
+	ServerInsecure     bool
+	Portal             string
+	Capture            string
+	CaptureFormat      string
+	CaptureBodyLimit   ByteSize
+	Protocol           string
+	Serve              string
+	Unix               string
+	SPA                bool
+	DebugPprof         bool
+	NoMIMEWarnings     bool
+	FixMIME            bool
+	Yes                bool
+	Wait               bool
+	Copy               bool
+	QR                 bool
+	Notify             bool
+	NotifyWebhook      string
+	ErrorPage          string
+	ConfigFile         string
+	Token              string
+	BasicAuth          stringList
+	VerifyWebhook      string
+	CORS               bool
+	CORSOrigin         stringList
+	AllowCIDR          stringList
+	DenyCIDR           stringList
+	OAuthAllow         stringList
+	OAuthAllowDomain   stringList
+	RateLimit          RequestRate
+	RateLimitGlobal    RequestRate
+	RateBurst          int
+	Cache              bool
+	CacheSize          ByteSize
+	CacheTTL           time.Duration
+	Route              stringList
+	RouteMethod        stringList
+	Rules              stringList
+	PrintRules         bool
+	RequestHeader      stringList
+	ResponseHeader     stringList
+	Budget             ByteSize
+	BudgetAction       string
+
+	// Name of the tunnel entry in the config file, "" for none
+	Name string
+
+	// Short name on log lines, metrics and inspector entries, see tags.go
+	tag string
+
+	// log tags output with the tunnel's tag when several tunnels or routes run
+	log Logger
+
+	// sources records where each setting came from, keyed by setting name
+	sources map[string]string
+
+	// Set by New for tunnels embedded in another program: a hook for each
+	// finished request
+	onRequest func(r *requestLog)
+}
+
+// Default options used when nothing else is specified
+func defaultOptions() *Options {
+	return &Options{
+		Scheme:           "http",
+		Host:             "localhost",
+		Port:             3000,
+		ChunkThreshold:   DefaultChunkThreshold,
+		MaxBodySize:      DefaultMaxBodySize,
+		ChunkSize:        DefaultChunkSize,
+		ResponseExpiry:   DefaultResponseExpiry,
+		PingInterval:     DefaultPingInterval,
+		DrainTimeout:     DefaultDrainTimeout,
+		Timeout:          DefaultLocalTimeout,
+		MaxConcurrent:    DefaultMaxConcurrent,
+		QueueSize:        DefaultQueueSize,
+		ForwardedHeaders: ForwardedXFF,
+		HostHeader:       HostHeaderRewrite,
+		Protocol:         ProtocolHTTP,
+		LogLevel:         LevelInfo.String(),
+		LogFormat:        LogFormatText,
+		Server:           WSServerURL,
+		Portal:           LoginURL,
+		CaptureFormat:    CaptureFormatHAR,
+		CacheSize:        DefaultCacheSize,
+		CacheTTL:         DefaultCacheTTL,
+		CaptureBodyLimit: DefaultCaptureBodyLimit,
+		InspectPort:      DefaultInspectPort,
+		InspectBodyLimit: DefaultInspectBodyLimit,
+		BudgetAction:     BudgetPause,
+		ConfigFile:       defaultConfigFile(),
+		sources:          map[string]string{},
+	}
+}
+
+// Source of a setting, falling back to the built-in default
+func (o *Options) source(key string) string {
+	if src, ok := o.sources[key]; ok {
+		return src
+	}
+	return SourceDefault
+}
+
+// Flag set bound to the fields of o. Config file keys are the flag names.
+func (o *Options) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("comzy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.StringVar(&o.Host, "host", o.Host, "Host to forward requests to")
+	fs.IntVar(&o.Port, "port", o.Port, "Port to forward requests to")
+	fs.StringVar(&o.Protocol, "protocol", o.Protocol, "Tunnel http requests, or raw tcp connections")
+	fs.StringVar(&o.Serve, "serve", o.Serve, "Serve files from this directory instead of forwarding to a local app")
+	fs.StringVar(&o.Unix, "unix", o.Unix, "Forward to the Unix domain socket at this path instead of a TCP port")
+	fs.BoolVar(&o.SPA, "spa", o.SPA, "With --serve, answer unknown paths with index.html")
+	fs.StringVar(&o.Scheme, "scheme", o.Scheme, "Scheme of the local target (http or https)")
+	fs.BoolVar(&o.InsecureSkipVerify, "insecure-skip-verify", o.InsecureSkipVerify, "Accept self-signed certificates from the local target")
+	fs.StringVar(&o.Region, "region", o.Region, "Region of the tunnel server to use, or auto for the fastest")
+	fs.StringVar(&o.Token, "token", o.Token, "Authentication token, overriding COMZY_TOKEN and the saved login")
+	fs.StringVar(&o.Subdomain, "subdomain", o.Subdomain, "Subdomain to request for the public URL")
+	fs.BoolVar(&o.ProxyLocal, "proxy-local", o.ProxyLocal, "Send requests to the local target through the system proxy")
+	fs.IntVar(&o.MaxRetries, "max-retries", o.MaxRetries, "Exit after this many consecutive connection failures (0 = retry forever)")
+	fs.StringVar(&o.Proxy, "proxy", o.Proxy, "HTTP or SOCKS5 proxy for the tunnel connection, or direct to ignore HTTPS_PROXY")
+	fs.BoolVar(&o.ProxyAll, "proxy-all", o.ProxyAll, "Send API calls and notification webhooks through --proxy too")
+	fs.IntVar(&o.InspectPort, "inspect-port", o.InspectPort, "Port of the local request inspector")
+	fs.Var(&o.InspectBodyLimit, "inspect-body-limit", "Bytes of each body kept by the inspector (0 = none)")
+	fs.BoolVar(&o.DebugPprof, "debug-pprof", o.DebugPprof, "Serve pprof and state endpoints on the inspector port")
+	fs.BoolVar(&o.NoInspect, "no-inspect", o.NoInspect, "Disable the request inspector")
+	fs.Var(&o.Latency, "latency", "Delay added to each request before it is forwarded, e.g. 200ms or 200ms±50ms")
+	fs.Var(&o.Bandwidth, "bandwidth", "Rate each response is released at, e.g. 512kbps (0 = unlimited)")
+	fs.BoolVar(&o.UI, "ui", o.UI, "Show a full-screen dashboard of the tunnels and requests instead of the log")
+	fs.BoolVar(&o.NoMIMEWarnings, "no-mime-warnings", o.NoMIMEWarnings, "Don't warn about assets served with the wrong Content-Type")
+	fs.BoolVar(&o.FixMIME, "fix-mime", o.FixMIME, "Correct the Content-Type of common web assets")
+	fs.StringVar(&o.ErrorPage, "error-page", o.ErrorPage, "HTML page shown to browsers when the local app can't be reached")
+	fs.BoolVar(&o.Wait, "wait", o.Wait, "Don't register the tunnel until the local port accepts connections")
+	fs.BoolVar(&o.Yes, "yes", o.Yes, "Expose non-loopback targets without asking")
+	fs.BoolVar(&o.Copy, "copy", o.Copy, "Copy the public URL to the clipboard once the tunnel is established")
+	fs.BoolVar(&o.QR, "qr", o.QR, "Show a QR code of the public URL, for opening it on a phone")
+	fs.BoolVar(&o.Notify, "notify", o.Notify, "Show a desktop notification for long disconnects and URL changes")
+	fs.StringVar(&o.NotifyWebhook, "notify-webhook", o.NotifyWebhook, "POST a JSON payload to this URL for long disconnects and URL changes")
+	fs.IntVar(&o.MaxConnsPerHost, "max-conns-per-host", o.MaxConnsPerHost, "Maximum connections to the local target (0 = automatic)")
+	fs.IntVar(&o.MaxIdleConns, "max-idle-conns", o.MaxIdleConns, "Idle connections to keep open to the local target (0 = same as the connection limit)")
+	fs.IntVar(&o.MaxConcurrent, "max-concurrent", o.MaxConcurrent, "Requests handed to the local app at once (0 = unlimited)")
+	fs.IntVar(&o.QueueSize, "queue-size", o.QueueSize, "Requests that may wait for --max-concurrent before the rest get 429")
+	fs.BoolVar(&o.DisableKeepAlive, "disable-keepalive", o.DisableKeepAlive, "Open a new connection to the local target for every request")
+	fs.Var(&o.ChunkThreshold, "chunk-threshold", "Stream response bodies larger than this")
+	fs.Var(&o.ChunkSize, "chunk-size", "Body bytes per streamed chunk")
+	fs.DurationVar(&o.ResponseExpiry, "response-expiry", o.ResponseExpiry, "Abandon responses the tunnel hasn't accepted within this time")
+	fs.DurationVar(&o.PingInterval, "ping-interval", o.PingInterval, "Time between pings to the tunnel server")
+	fs.DurationVar(&o.PongTimeout, "pong-timeout", o.PongTimeout, "Reconnect if the server is silent this long (0 = twice the ping interval)")
+	fs.StringVar(&o.ForwardedHeaders, "forwarded-headers", o.ForwardedHeaders, "Forwarding headers to add: xff, rfc7239, both or none")
+	fs.BoolVar(&o.NoProxyHeaders, "no-proxy-headers", o.NoProxyHeaders, "Send no X-Forwarded-*, X-Real-IP, Forwarded or X-Request-Id headers to the local app")
+	fs.StringVar(&o.HostHeader, "host-header", o.HostHeader, "Host header for the local app: rewrite, preserve or a host name")
+	fs.Var(&o.RequestHeader, "request-header", "Set a request header, \"Key: Value\", or remove one with -Key (repeatable)")
+	fs.Var(&o.ResponseHeader, "response-header", "Set a response header, \"Key: Value\", or remove one with -Key (repeatable)")
+	fs.DurationVar(&o.Timeout, "timeout", o.Timeout, "Give up on the local app if it doesn't respond within this time (0 = never)")
+	fs.DurationVar(&o.MaxRequestAge, "max-request-age", o.MaxRequestAge, "Refuse requests older than this with 408 (0 = off)")
+	fs.DurationVar(&o.DrainTimeout, "drain-timeout", o.DrainTimeout, "On shutdown, wait this long for in-flight requests to finish")
+	fs.Var(&o.MaxOutboundRate, "max-outbound-rate", "Cap on bytes per second sent through the tunnel (0 = unlimited)")
+	fs.Var(&o.MaxBodySize, "max-body-size", "Refuse request bodies larger than this with 413 (0 = unlimited)")
+	fs.Var(&o.BasicAuth, "basic-auth", "Require user:pass on every request (repeatable)")
+	fs.StringVar(&o.VerifyWebhook, "verify-webhook", o.VerifyWebhook, "Reject webhooks without a valid signature, e.g. provider=github,secret-env=GITHUB_SECRET")
+	fs.BoolVar(&o.CORS, "cors", o.CORS, "Allow cross-origin requests from any origin")
+	fs.Var(&o.CORSOrigin, "cors-origin", "Allow cross-origin requests from this origin (repeatable)")
+	fs.Var(&o.AllowCIDR, "allow-cidr", "Only accept clients from this CIDR (repeatable)")
+	fs.Var(&o.DenyCIDR, "deny-cidr", "Refuse clients from this CIDR (repeatable)")
+	fs.Var(&o.OAuthAllow, "oauth-allow", "Require portal login and only let this email in (repeatable)")
+	fs.Var(&o.OAuthAllowDomain, "oauth-allow-domain", "Require portal login and let anyone with an email at this domain in (repeatable)")
+	fs.Var(&o.RateLimit, "rate-limit", "Requests each client IP may make, e.g. 10/s or 600/m (0 = unlimited)")
+	fs.Var(&o.RateLimitGlobal, "rate-limit-global", "Requests all clients together may make, e.g. 100/s (0 = unlimited)")
+	fs.IntVar(&o.RateBurst, "rate-burst", o.RateBurst, "Requests allowed at once above the rate limits (0 = one second's worth)")
+	fs.BoolVar(&o.Cache, "cache", o.Cache, "Answer repeated GET and HEAD requests from memory")
+	fs.Var(&o.CacheSize, "cache-size", "Most response bytes --cache keeps")
+	fs.DurationVar(&o.CacheTTL, "cache-ttl", o.CacheTTL, "Longest --cache keeps a response")
+	fs.Var(&o.Route, "route", "Send requests under a path prefix elsewhere, e.g. /api=8080 or /api=8080,strip (repeatable)")
+	fs.Var(&o.RouteMethod, "route-method", "Send requests with these methods elsewhere, e.g. GET,HEAD=3001 (repeatable)")
+	fs.Var(ruleFlag{&o.Rules, "allow"}, "allow", "Forward requests matching this rule, e.g. 'GET /api/*' (repeatable)")
+	fs.Var(ruleFlag{&o.Rules, "deny"}, "deny", "Answer requests matching this rule with 403, e.g. 'DELETE *' (repeatable)")
+	fs.Var(&o.Rules, "rule", "An allow or deny rule, e.g. 'deny /admin/*' (repeatable)")
+	fs.BoolVar(&o.PrintRules, "print-rules", o.PrintRules, "Print the effective --allow and --deny rules and exit")
+	fs.Var(&o.Budget, "budget", "Body bytes the tunnel may move in a session, both ways together (0 = unlimited)")
+	fs.StringVar(&o.BudgetAction, "budget-action", o.BudgetAction, "What to do once --budget is used up: pause or exit")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", o.MetricsAddr, "Serve Prometheus metrics on this address (default: off)")
+	fs.StringVar(&o.Server, "server", o.Server, "Tunnel server to connect to, ws:// or wss:// (also "+ServerEnv+")")
+	fs.BoolVar(&o.ServerInsecure, "server-insecure", o.ServerInsecure, "Accept a self-signed certificate from the tunnel server")
+	fs.StringVar(&o.Portal, "portal", o.Portal, "Portal where tokens are issued, shown in login hints (also "+PortalEnv+")")
+	fs.StringVar(&o.Capture, "capture", o.Capture, "Write every request and response to this file (default: off)")
+	fs.StringVar(&o.CaptureFormat, "capture-format", o.CaptureFormat, "Format of the --capture file: har or ndjson")
+	fs.Var(&o.CaptureBodyLimit, "capture-body-limit", "Bytes of each body written to the --capture file (0 = all)")
+	fs.StringVar(&o.LogLevel, "log-level", o.LogLevel, "Least severe log level shown: debug, info, warn or error")
+	fs.StringVar(&o.LogFormat, "log-format", o.LogFormat, "Log as text or json (one object per line)")
+	fs.StringVar(&o.LogFile, "log-file", o.LogFile, "Also append log lines to this file")
+	fs.BoolVar(&o.Quiet, "quiet", o.Quiet, "Don't log to stdout (use with --log-file)")
+	fs.BoolVar(&o.LogBodies, "log-bodies", o.LogBodies, "Add a one-line preview of text request and response bodies to each request's log line")
+	fs.Var(&o.LogFilter, "log-filter", "Only log lines of one tunnel or route, as tag=NAME (repeatable)")
+	fs.StringVar(&o.ConfigFile, "config", o.ConfigFile, "Config file to read defaults and named tunnels from")
+	fs.BoolVar(&o.Daemon, "daemon", o.Daemon, "Run in the background, see comzy ps, comzy logs and comzy stop")
+	return fs
+}
+
+// Parse a start invocation: flags may appear before or after the port.
+// Settings come from, in increasing priority: built-in defaults, the
+// config file, the named tunnel's entry in it, then the command line.
+func parseOptions(args []string, tunnel string) (*Options, error) {
+	opts := defaultOptions()
+	opts.Name = tunnel
+	fs := opts.flagSet()
+
+	var positional []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		opts.sources[f.Name] = SourceFlag
+		// --allow and --deny add to the rule list, which the config file
+		// then leaves alone
+		if _, ok := f.Value.(ruleFlag); ok {
+			opts.sources["rule"] = SourceFlag
+		}
+	})
+
+	if len(positional) > 1 {
+		return nil, fmt.Errorf("unexpected argument: %s", positional[1])
+	}
+	if len(positional) == 1 {
+		spec, err := parseTargetSpec(positional[0])
+		if err != nil {
+			return nil, err
+		}
+		if spec.scheme != "" {
+			opts.Scheme = spec.scheme
+			opts.sources["scheme"] = SourceArgument
+		}
+		if spec.host != "" {
+			opts.Host = spec.host
+			opts.sources["host"] = SourceArgument
+		}
+		opts.Port = spec.port
+		opts.sources["port"] = SourceArgument
+	}
+
+	if err := loadConfigFile(fs, opts, tunnel); err != nil {
+		return nil, err
+	}
+	opts.applyEnv()
+	if opts.Serve != "" && len(positional) == 1 {
+		return nil, fmt.Errorf("--serve replaces the local target, remove %s", positional[0])
+	}
+	if opts.Unix != "" && len(positional) == 1 {
+		return nil, fmt.Errorf("--unix replaces the local port, remove %s", positional[0])
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// Check and normalize options once every source has been applied
+func (opts *Options) validate() error {
+	// One token serves the whole process
+	if opts.Token = strings.TrimSpace(opts.Token); opts.Token != "" {
+		flagToken = opts.Token
+	}
+
+	if opts.Proxy != "" && opts.Proxy != ProxyDirect {
+		if _, err := validateProxyURL(opts.Proxy); err != nil {
+			return err
+		}
+	}
+	if opts.ProxyAll {
+		if opts.Proxy == "" {
+			return fmt.Errorf("--proxy-all needs --proxy")
+		}
+		// One API client serves the whole process
+		transport, err := newProxyTransport(opts.Proxy)
+		if err != nil {
+			return err
+		}
+		apiTransport = transport
+	}
+
+	if opts.Subdomain != "" {
+		opts.Subdomain = strings.ToLower(opts.Subdomain)
+		if err := validateSubdomain(opts.Subdomain); err != nil {
+			return err
+		}
+	}
+
+	for _, cred := range opts.BasicAuth {
+		if err := validateCredential(cred); err != nil {
+			return err
+		}
+	}
+
+	if _, err := newIPFilter(opts.AllowCIDR, opts.DenyCIDR); err != nil {
+		return err
+	}
+	if _, err := newRequestFilter(opts.Rules); err != nil {
+		return err
+	}
+	for _, email := range opts.OAuthAllow {
+		if err := validateIdentity("oauth-allow", email, true); err != nil {
+			return err
+		}
+	}
+	for _, domain := range opts.OAuthAllowDomain {
+		if err := validateIdentity("oauth-allow-domain", domain, false); err != nil {
+			return err
+		}
+	}
+	if opts.RateBurst < 0 {
+		return fmt.Errorf("--rate-burst cannot be negative")
+	}
+	if opts.Cache && (opts.CacheSize <= 0 || opts.CacheTTL <= 0) {
+		return fmt.Errorf("--cache needs a positive --cache-size and --cache-ttl")
+	}
+	if opts.NotifyWebhook != "" {
+		if err := validateNotifyWebhook(opts.NotifyWebhook); err != nil {
+			return err
+		}
+	}
+	if opts.Budget < 0 {
+		return fmt.Errorf("--budget cannot be negative")
+	}
+	opts.BudgetAction = strings.ToLower(opts.BudgetAction)
+	if err := validateBudgetAction(opts.BudgetAction); err != nil {
+		return err
+	}
+
+	if opts.ErrorPage != "" {
+		if err := validateErrorPage(opts.ErrorPage); err != nil {
+			return err
+		}
+	}
+
+	if _, err := parseWebhookVerifier(opts.VerifyWebhook); err != nil {
+		return err
+	}
+
+	for _, origin := range opts.CORSOrigin {
+		if err := validateOrigin(origin); err != nil {
+			return err
+		}
+	}
+
+	pathRoutes, err := parsePathRoutes(opts.Route)
+	if err != nil {
+		return err
+	}
+	if _, err := parseMethodRoutes(opts.RouteMethod); err != nil {
+		return err
+	}
+	// Path routes are tried first, and one for / matches everything
+	for _, r := range pathRoutes {
+		if r.prefix == "/" && len(opts.RouteMethod) > 0 {
+			return fmt.Errorf("--route %q matches every path, so --route-method would never be used", r.rule)
+		}
+	}
+
+	opts.Protocol = strings.ToLower(opts.Protocol)
+	if err := validateProtocol(opts.Protocol); err != nil {
+		return err
+	}
+
+	if opts.Protocol == ProtocolTCP && len(opts.OAuthAllow)+len(opts.OAuthAllowDomain) > 0 {
+		return fmt.Errorf("--oauth-allow only works with --protocol http")
+	}
+	if opts.Protocol == ProtocolTCP && opts.Budget > 0 {
+		return fmt.Errorf("--budget counts HTTP bodies and only works with --protocol http")
+	}
+
+	if opts.Serve != "" {
+		if opts.Protocol == ProtocolTCP {
+			return fmt.Errorf("--serve only works with --protocol http")
+		}
+		dir, err := staticDir(opts.Serve)
+		if err != nil {
+			return err
+		}
+		opts.Serve = dir
+	} else if opts.SPA {
+		return fmt.Errorf("--spa needs --serve")
+	}
+
+	if opts.UI && opts.NoInspect {
+		return fmt.Errorf("--ui shows the requests the inspector records, remove --no-inspect")
+	}
+
+	if opts.Unix != "" {
+		if opts.Serve != "" {
+			return fmt.Errorf("--unix and --serve cannot be combined")
+		}
+		socket, err := checkUnixSocket(opts.Unix, opts.Wait)
+		if err != nil {
+			return err
+		}
+		opts.Unix = socket
+	}
+
+	if opts.MetricsAddr != "" {
+		addr, err := metricsAddr(opts.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		opts.MetricsAddr = addr
+	}
+
+	if err := validateServerURL(opts.Server); err != nil {
+		return err
+	}
+	if err := validatePortalURL(opts.Portal); err != nil {
+		return err
+	}
+	// One portal serves the whole process, as the token does
+	portalURL = opts.Portal
+
+	opts.CaptureFormat = strings.ToLower(opts.CaptureFormat)
+	if err := validateCaptureFormat(opts.CaptureFormat); err != nil {
+		return err
+	}
+
+	opts.LogLevel = strings.ToLower(opts.LogLevel)
+	if _, err := parseLogLevel(opts.LogLevel); err != nil {
+		return err
+	}
+	opts.LogFormat = strings.ToLower(opts.LogFormat)
+	if err := validateLogFormat(opts.LogFormat); err != nil {
+		return err
+	}
+	if _, err := parseLogFilter(opts.LogFilter); err != nil {
+		return err
+	}
+
+	opts.ForwardedHeaders = strings.ToLower(opts.ForwardedHeaders)
+	if err := validateForwardedMode(opts.ForwardedHeaders); err != nil {
+		return err
+	}
+
+	if opts.HostHeader != HostHeaderRewrite && opts.HostHeader != HostHeaderPreserve {
+		if err := validateHostHeader(opts.HostHeader); err != nil {
+			return err
+		}
+	}
+	if _, err := parseHeaderRules("request-header", opts.RequestHeader); err != nil {
+		return err
+	}
+	if _, err := parseHeaderRules("response-header", opts.ResponseHeader); err != nil {
+		return err
+	}
+
+	opts.Region = strings.ToLower(opts.Region)
+	if opts.Region != "" {
+		if err := validateRegion(opts.Region); err != nil {
+			return err
+		}
+	}
+
+	if opts.PingInterval <= 0 {
+		return fmt.Errorf("--ping-interval must be positive")
+	}
+	if opts.PongTimeout < 0 {
+		return fmt.Errorf("--pong-timeout cannot be negative")
+	}
+	if opts.PongTimeout == 0 {
+		opts.PongTimeout = 2 * opts.PingInterval
+	}
+
+	if opts.MaxRequestAge < 0 {
+		return fmt.Errorf("--max-request-age cannot be negative")
+	}
+
+	if opts.MaxIdleConns < 0 {
+		return fmt.Errorf("--max-idle-conns cannot be negative")
+	}
+
+	if opts.MaxConcurrent < 0 {
+		return fmt.Errorf("--max-concurrent cannot be negative")
+	}
+	if opts.QueueSize < 0 {
+		return fmt.Errorf("--queue-size cannot be negative")
+	}
+
+	if opts.ChunkSize <= 0 {
+		return fmt.Errorf("chunk size must be positive")
+	}
+
+	if opts.Port < 1 || opts.Port > 65535 {
+		return fmt.Errorf("Invalid port number. Use a port between 1-65535")
+	}
+
+	opts.Scheme = strings.ToLower(opts.Scheme)
+	if opts.Scheme != "http" && opts.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q (use http or https)", opts.Scheme)
+	}
+
+	opts.Host = strings.TrimSuffix(strings.TrimPrefix(opts.Host, "["), "]")
+	if err := validateHost(opts.Host); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Check that a subdomain is a single DNS label
+func validateSubdomain(name string) error {
+	if strings.Contains(name, ".") || validateHost(name) != nil || net.ParseIP(name) != nil {
+		return fmt.Errorf("invalid subdomain %q (use letters, digits and hyphens)", name)
+	}
+	return nil
+}
+
+// A local target as given on the command line. Parts that weren't given
+// are left empty.
+type targetSpec struct {
+	scheme string
+	host   string
+	port   int
+}
+
+// Parse a bare port, host:port or scheme://host[:port]
+func parseTargetSpec(arg string) (targetSpec, error) {
+	var spec targetSpec
+	portArg := arg
+	if strings.Contains(portArg, "://") {
+		u, err := url.Parse(portArg)
+		if err != nil || u.Host == "" {
+			return spec, fmt.Errorf("invalid target URL %q", arg)
+		}
+		spec.scheme = u.Scheme
+		portArg = u.Host
+		if u.Port() == "" {
+			portArg = net.JoinHostPort(u.Hostname(), defaultSchemePort(u.Scheme))
+		}
+	}
+	if host, port, err := net.SplitHostPort(portArg); err == nil {
+		spec.host = host
+		portArg = port
+	}
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port < 1 || port > 65535 {
+		return spec, fmt.Errorf("Invalid port number. Use a port between 1-65535")
+	}
+	spec.port = port
+	return spec, nil
+}
+
+// Port implied by a URL scheme without an explicit port
+func defaultSchemePort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// Check that a host is an IP address or a syntactically valid hostname.
+// Names are resolved per request, so this catches typos without DNS.
+func validateHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" || len(host) > 253 {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid host %q", host)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return fmt.Errorf("invalid host %q", host)
+			}
+		}
+	}
+	return nil
+}
+
+// Mask a secret so it can be shown without leaking it
+func maskSecret(secret string) string {
+	if len(secret) > 8 {
+		return secret[:8] + "..."
+	}
+	return strings.Repeat("*", len(secret))
+}
+
+// Hide the password in a proxy URL
+func maskProxy(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+// Print the effective configuration as YAML, one comment per key naming its
+// source. The output can be passed back with --config; values that can't be
+// set from a config file, or are masked, are printed as comments.
+func printConfig(w io.Writer, opts *Options) {
+	tokenValue, tokenSource := "", SourceDefault
+	if token, source := activeToken(); token != "" {
+		tokenValue, tokenSource = maskSecret(token), source
+	}
+
+	entries := []struct {
+		key     string
+		value   interface{}
+		source  string
+		comment bool
+	}{
+		{"server", opts.Server, opts.source("server"), false},
+		{"server-insecure", opts.ServerInsecure, opts.source("server-insecure"), false},
+		{"portal", opts.Portal, opts.source("portal"), false},
+		{"config", opts.ConfigFile, opts.source("config"), true},
+		{"protocol", opts.Protocol, opts.source("protocol"), false},
+		{"scheme", opts.Scheme, opts.source("scheme"), false},
+		{"host", opts.Host, opts.source("host"), false},
+		{"port", opts.Port, opts.source("port"), false},
+		{"serve", opts.Serve, opts.source("serve"), false},
+		{"unix", opts.Unix, opts.source("unix"), false},
+		{"spa", opts.SPA, opts.source("spa"), false},
+		{"insecure-skip-verify", opts.InsecureSkipVerify, opts.source("insecure-skip-verify"), false},
+		{"subdomain", opts.Subdomain, opts.source("subdomain"), false},
+		{"region", opts.Region, opts.source("region"), false},
+		{"max-retries", opts.MaxRetries, opts.source("max-retries"), false},
+		{"proxy", maskProxy(opts.Proxy), opts.source("proxy"), maskProxy(opts.Proxy) != opts.Proxy},
+		{"proxy-all", opts.ProxyAll, opts.source("proxy-all"), false},
+		{"proxy-local", opts.ProxyLocal, opts.source("proxy-local"), false},
+		{"inspect-port", opts.InspectPort, opts.source("inspect-port"), false},
+		{"inspect-body-limit", opts.InspectBodyLimit.String(), opts.source("inspect-body-limit"), false},
+		{"no-inspect", opts.NoInspect, opts.source("no-inspect"), false},
+		{"ui", opts.UI, opts.source("ui"), false},
+		{"latency", opts.Latency.String(), opts.source("latency"), false},
+		{"bandwidth", opts.Bandwidth.String(), opts.source("bandwidth"), false},
+		{"debug-pprof", opts.DebugPprof, opts.source("debug-pprof"), false},
+		{"no-mime-warnings", opts.NoMIMEWarnings, opts.source("no-mime-warnings"), false},
+		{"fix-mime", opts.FixMIME, opts.source("fix-mime"), false},
+		{"yes", opts.Yes, opts.source("yes"), false},
+		{"wait", opts.Wait, opts.source("wait"), false},
+		{"copy", opts.Copy, opts.source("copy"), false},
+		{"qr", opts.QR, opts.source("qr"), false},
+		{"notify", opts.Notify, opts.source("notify"), false},
+		{"notify-webhook", maskNotifyWebhook(opts.NotifyWebhook), opts.source("notify-webhook"), maskNotifyWebhook(opts.NotifyWebhook) != opts.NotifyWebhook},
+		{"error-page", opts.ErrorPage, opts.source("error-page"), false},
+		{"max-conns-per-host", opts.MaxConnsPerHost, opts.source("max-conns-per-host"), false},
+		{"max-idle-conns", opts.MaxIdleConns, opts.source("max-idle-conns"), false},
+		{"max-concurrent", opts.MaxConcurrent, opts.source("max-concurrent"), false},
+		{"queue-size", opts.QueueSize, opts.source("queue-size"), false},
+		{"disable-keepalive", opts.DisableKeepAlive, opts.source("disable-keepalive"), false},
+		{"chunk-threshold", opts.ChunkThreshold.String(), opts.source("chunk-threshold"), false},
+		{"chunk-size", opts.ChunkSize.String(), opts.source("chunk-size"), false},
+		{"max-outbound-rate", opts.MaxOutboundRate.String(), opts.source("max-outbound-rate"), false},
+		{"max-body-size", opts.MaxBodySize.String(), opts.source("max-body-size"), false},
+		{"response-expiry", opts.ResponseExpiry.String(), opts.source("response-expiry"), false},
+		{"ping-interval", opts.PingInterval.String(), opts.source("ping-interval"), false},
+		{"pong-timeout", opts.PongTimeout.String(), opts.source("pong-timeout"), false},
+		{"forwarded-headers", opts.ForwardedHeaders, opts.source("forwarded-headers"), false},
+		{"no-proxy-headers", opts.NoProxyHeaders, opts.source("no-proxy-headers"), false},
+		{"host-header", opts.HostHeader, opts.source("host-header"), false},
+		{"request-header", []string(opts.RequestHeader), opts.source("request-header"), false},
+		{"response-header", []string(opts.ResponseHeader), opts.source("response-header"), false},
+		{"metrics-addr", opts.MetricsAddr, opts.source("metrics-addr"), false},
+		{"capture", opts.Capture, opts.source("capture"), false},
+		{"capture-format", opts.CaptureFormat, opts.source("capture-format"), false},
+		{"capture-body-limit", opts.CaptureBodyLimit.String(), opts.source("capture-body-limit"), false},
+		{"log-level", opts.LogLevel, opts.source("log-level"), false},
+		{"log-format", opts.LogFormat, opts.source("log-format"), false},
+		{"log-file", opts.LogFile, opts.source("log-file"), false},
+		{"quiet", opts.Quiet, opts.source("quiet"), false},
+		{"log-bodies", opts.LogBodies, opts.source("log-bodies"), false},
+		{"log-filter", []string(opts.LogFilter), opts.source("log-filter"), false},
+		{"timeout", opts.Timeout.String(), opts.source("timeout"), false},
+		{"max-request-age", opts.MaxRequestAge.String(), opts.source("max-request-age"), false},
+		{"drain-timeout", opts.DrainTimeout.String(), opts.source("drain-timeout"), false},
+		{"verify-webhook", maskWebhookSpec(opts.VerifyWebhook), opts.source("verify-webhook"), maskWebhookSpec(opts.VerifyWebhook) != opts.VerifyWebhook},
+		{"cors", opts.CORS, opts.source("cors"), false},
+		{"cors-origin", []string(opts.CORSOrigin), opts.source("cors-origin"), false},
+		{"allow-cidr", []string(opts.AllowCIDR), opts.source("allow-cidr"), false},
+		{"deny-cidr", []string(opts.DenyCIDR), opts.source("deny-cidr"), false},
+		{"oauth-allow", []string(opts.OAuthAllow), opts.source("oauth-allow"), false},
+		{"oauth-allow-domain", []string(opts.OAuthAllowDomain), opts.source("oauth-allow-domain"), false},
+		{"rate-limit", opts.RateLimit.String(), opts.source("rate-limit"), false},
+		{"rate-limit-global", opts.RateLimitGlobal.String(), opts.source("rate-limit-global"), false},
+		{"rate-burst", opts.RateBurst, opts.source("rate-burst"), false},
+		{"cache", opts.Cache, opts.source("cache"), false},
+		{"cache-size", opts.CacheSize.String(), opts.source("cache-size"), false},
+		{"cache-ttl", opts.CacheTTL.String(), opts.source("cache-ttl"), false},
+		{"route", []string(opts.Route), opts.source("route"), false},
+		{"route-method", []string(opts.RouteMethod), opts.source("route-method"), false},
+		{"rule", []string(opts.Rules), opts.source("rule"), false},
+		{"budget", opts.Budget.String(), opts.source("budget"), false},
+		{"budget-action", opts.BudgetAction, opts.source("budget-action"), false},
+		{"basic-auth", opts.BasicAuth.masked(), opts.source("basic-auth"), len(opts.BasicAuth) > 0},
+		{"token", tokenValue, tokenSource, true},
+	}
+
+	fmt.Fprintln(w, "# Effective comzy configuration")
+	for _, e := range entries {
+		value := fmt.Sprintf("%v", e.value)
+		switch v := e.value.(type) {
+		case string:
+			value = strconv.Quote(v)
+		case []string:
+			quoted := make([]string, len(v))
+			for i, s := range v {
+				quoted[i] = strconv.Quote(s)
+			}
+			value = "[" + strings.Join(quoted, ", ") + "]"
+		}
+		prefix := ""
+		if e.comment {
+			prefix = "# "
+		}
+		fmt.Fprintf(w, "%s%s: %s # %s\n", prefix, e.key, value, e.source)
+	}
+}
+
+// Handle the print-config command. It accepts the same arguments as a
+// start invocation, including "start NAME" for a named tunnel.
+func handlePrintConfig(args []string) error {
+	tunnel := ""
+	if len(args) >= 2 && args[0] == "start" {
+		tunnel, args = args[1], args[2:]
+	}
+	opts, err := parseOptions(args, tunnel)
+	if err != nil {
+		return err
+	}
+	printConfig(os.Stdout, opts)
+	return nil
+}
+
+// stringList is a flag value that collects every occurrence of a repeated flag
+type stringList []string
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l stringList) String() string {
+	return strings.Join(l, ",")
+}
+
+// Credentials with their passwords hidden
+func (l stringList) masked() []string {
+	out := make([]string, len(l))
+	for i, cred := range l {
+		out[i] = maskCredential(cred)
+	}
+	return out
+}
+
+// ByteSize is a flag value accepting sizes like "512KB", "1MB" or "1048576"
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *ByteSize) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = ByteSize(n * float64(multiplier))
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for _, unit := range byteUnits {
+		if unit.size > 1 && int64(b) >= unit.size && int64(b)%unit.size == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", int64(b))
+}
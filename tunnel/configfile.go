@@ -0,0 +1,259 @@
+package tunnel
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default location of the config file. Credentials stay in .user.
+func defaultConfigFile() string {
+	return filepath.Join(comzyDir, "config.yml")
+}
+
+// Project config, read from the working directory on top of the user's
+// config file so a repository can carry its own settings
+const ProjectConfigFile = ".comzy.yml"
+
+// Config files to read, lowest priority first. A file named with --config
+// replaces both the user and the project file.
+func configFiles(path string, explicit bool) []string {
+	if explicit {
+		return []string{path}
+	}
+	return []string{path, ProjectConfigFile}
+}
+
+// A parsed config file
+type configDoc struct {
+	path    string
+	root    *yaml.Node // top-level mapping, nil if the file is empty
+	tunnels *yaml.Node // the tunnels: mapping, nil if absent
+}
+
+// Read and parse a config file. A missing file is only an error if required.
+func readConfigDoc(path string, required bool) (*configDoc, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cfg := &configDoc{path: path}
+	if len(doc.Content) == 0 {
+		return cfg, nil
+	}
+	cfg.root = doc.Content[0]
+	if cfg.root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of settings", path, cfg.root.Line)
+	}
+	for i := 0; i < len(cfg.root.Content); i += 2 {
+		key, value := cfg.root.Content[i], cfg.root.Content[i+1]
+		if key.Value != "tunnels" {
+			continue
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s:%d: tunnels must map names to settings", path, value.Line)
+		}
+		cfg.tunnels = value
+	}
+	return cfg, nil
+}
+
+// Read every config file that applies, lowest priority first
+func readConfigDocs(path string, explicit bool) ([]*configDoc, error) {
+	var docs []*configDoc
+	for _, p := range configFiles(path, explicit) {
+		doc, err := readConfigDoc(p, explicit)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+// Apply the config files' top-level settings and, if tunnel is set, that
+// entry of their tunnels maps to opts. Settings already given on the
+// command line are left alone. Every entry is checked, not just the one in
+// use, so a typo is reported the first time the file is read.
+func loadConfigFile(fs *flag.FlagSet, opts *Options, tunnel string) error {
+	docs, err := readConfigDocs(opts.ConfigFile, opts.source("config") != SourceDefault)
+	if err != nil {
+		return err
+	}
+
+	explicit := map[string]bool{}
+	for key, src := range opts.sources {
+		explicit[key] = src != SourceDefault
+	}
+
+	for _, doc := range docs {
+		if doc.root == nil {
+			continue
+		}
+		for i := 0; i < len(doc.root.Content); i += 2 {
+			key, value := doc.root.Content[i], doc.root.Content[i+1]
+			if key.Value == "tunnels" {
+				continue
+			}
+			if err := applySetting(fs, opts, explicit, key, value, doc.path, doc.path); err != nil {
+				return err
+			}
+		}
+	}
+
+	found := tunnel == ""
+	var searched []string
+	for _, doc := range docs {
+		searched = append(searched, doc.path)
+		if doc.tunnels == nil {
+			continue
+		}
+		for i := 0; i < len(doc.tunnels.Content); i += 2 {
+			name, settings := doc.tunnels.Content[i], doc.tunnels.Content[i+1]
+			if settings.Kind != yaml.MappingNode {
+				return fmt.Errorf("%s:%d: tunnel %q must be a mapping of settings", doc.path, settings.Line, name.Value)
+			}
+
+			// Entries other than the selected one are applied to a scratch
+			// copy purely to validate them
+			target, targetFS := opts, fs
+			if name.Value != tunnel {
+				target = defaultOptions()
+				targetFS = target.flagSet()
+			} else {
+				found = true
+			}
+			source := fmt.Sprintf("%s (tunnels.%s)", doc.path, name.Value)
+			for j := 0; j < len(settings.Content); j += 2 {
+				if err := applySetting(targetFS, target, explicit, settings.Content[j], settings.Content[j+1], doc.path, source); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if !found {
+		if len(searched) == 0 {
+			return fmt.Errorf("tunnel %q not found: %s does not exist", tunnel, opts.ConfigFile)
+		}
+		return fmt.Errorf("tunnel %q is not defined in %s", tunnel, strings.Join(searched, " or "))
+	}
+	return nil
+}
+
+// Apply one key/value pair from the config file through its flag
+func applySetting(fs *flag.FlagSet, opts *Options, explicit map[string]bool, key, value *yaml.Node, path, source string) error {
+	if key.Value == "routes" {
+		rules, err := routeRules(value, path)
+		if err != nil {
+			return err
+		}
+		key, value = &yaml.Node{Kind: yaml.ScalarNode, Value: "route", Line: key.Line}, rules
+	}
+	// rules: is the list of --allow and --deny rules, e.g. "deny DELETE *"
+	if key.Value == "rules" {
+		key = &yaml.Node{Kind: yaml.ScalarNode, Value: "rule", Line: key.Line}
+	}
+	if fs.Lookup(key.Value) == nil || commandLineOnly[key.Value] {
+		return fmt.Errorf("%s:%d: unknown setting %q", path, key.Line, key.Value)
+	}
+	// Repeatable options take a list
+	items := []*yaml.Node{value}
+	if _, repeatable := fs.Lookup(key.Value).Value.(*stringList); repeatable && value.Kind == yaml.SequenceNode {
+		items = value.Content
+	}
+	for _, item := range items {
+		if item.Kind != yaml.ScalarNode {
+			return fmt.Errorf("%s:%d: %s must be a single value", path, item.Line, key.Value)
+		}
+	}
+	if explicit[key.Value] {
+		return nil
+	}
+	// A list replaces one from a lower-priority file instead of adding to it
+	if list, repeatable := fs.Lookup(key.Value).Value.(*stringList); repeatable {
+		*list = nil
+	}
+	for _, item := range items {
+		if err := fs.Set(key.Value, item.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, item.Line, item.Value, key.Value, err)
+		}
+	}
+	opts.sources[key.Value] = source
+	return nil
+}
+
+// Turn routes:, a list of {prefix, port, host, url, strip_prefix} mappings,
+// into the equivalent --route rules
+func routeRules(value *yaml.Node, path string) (*yaml.Node, error) {
+	if value.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s:%d: routes must be a list", path, value.Line)
+	}
+	rules := &yaml.Node{Kind: yaml.SequenceNode, Line: value.Line}
+	for _, entry := range value.Content {
+		// A rule may also be written as on the command line
+		if entry.Kind == yaml.ScalarNode {
+			rules.Content = append(rules.Content, entry)
+			continue
+		}
+		if entry.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s:%d: a route must be a mapping such as {prefix: /api, port: 8080}", path, entry.Line)
+		}
+		fields := map[string]string{}
+		for i := 0; i < len(entry.Content); i += 2 {
+			k, v := entry.Content[i], entry.Content[i+1]
+			switch k.Value {
+			case "prefix", "port", "host", "url", "strip_prefix":
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown route setting %q", path, k.Line, k.Value)
+			}
+			if v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%s:%d: %s must be a single value", path, v.Line, k.Value)
+			}
+			fields[k.Value] = v.Value
+		}
+
+		target := fields["url"]
+		if target != "" && (fields["port"] != "" || fields["host"] != "") {
+			return nil, fmt.Errorf("%s:%d: a route takes either url or host and port", path, entry.Line)
+		}
+		if target == "" {
+			switch {
+			case fields["port"] == "":
+				return nil, fmt.Errorf("%s:%d: a route needs a port or url", path, entry.Line)
+			case fields["host"] != "":
+				target = net.JoinHostPort(fields["host"], fields["port"])
+			default:
+				target = fields["port"]
+			}
+		}
+		if fields["prefix"] == "" {
+			return nil, fmt.Errorf("%s:%d: a route needs a prefix", path, entry.Line)
+		}
+		rule := fields["prefix"] + "=" + target
+		switch strings.ToLower(fields["strip_prefix"]) {
+		case "", "false", "no":
+		case "true", "yes":
+			rule += ",strip"
+		default:
+			return nil, fmt.Errorf("%s:%d: strip_prefix must be true or false", path, entry.Line)
+		}
+		rules.Content = append(rules.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: rule, Line: entry.Line})
+	}
+	return rules, nil
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File remembering which non-loopback targets the user agreed to expose
+func confirmedTargetsFile() string {
+	return filepath.Join(comzyDir, "confirmed-targets.json")
+}
+
+func loadConfirmedTargets() map[string]bool {
+	confirmed := map[string]bool{}
+	data, err := os.ReadFile(confirmedTargetsFile())
+	if err != nil {
+		return confirmed
+	}
+	var targets []string
+	if err := json.Unmarshal(data, &targets); err != nil {
+		logWarning(fmt.Sprintf("Ignoring unreadable %s: %v", confirmedTargetsFile(), err))
+		return confirmed
+	}
+	for _, t := range targets {
+		confirmed[t] = true
+	}
+	return confirmed
+}
+
+func saveConfirmedTarget(addr string) error {
+	confirmed := loadConfirmedTargets()
+	confirmed[addr] = true
+
+	targets := make([]string, 0, len(confirmed))
+	for t := range confirmed {
+		targets = append(targets, t)
+	}
+	data, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ensureComzyDir(); err != nil {
+		return err
+	}
+	return os.WriteFile(confirmedTargetsFile(), data, 0600)
+}
+
+// Check whether stdin is an interactive terminal
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Require confirmation before publishing a target that isn't on this machine.
+// Loopback targets, --yes and previously confirmed targets pass straight through.
+func confirmExposure(opts *Options, target *localTarget) error {
+	if isLoopbackHost(target.Host) || target.Dir != "" || target.Socket != "" || opts.Yes {
+		return nil
+	}
+	addr := target.Addr()
+	if loadConfirmedTargets()[addr] {
+		return nil
+	}
+
+	fmt.Println()
+	logWarning("WARNING: you are about to expose a service that is not on this machine")
+	fmt.Printf("%s%sAnyone with the public URL will be able to reach %s%s\n", ColorBright, ColorYellow, target.URL("/"), ColorReset)
+	logWarning("This includes every path served there, not just the pages you intend to share.")
+	logDim("Only continue if the service is safe to publish, or put an authenticating")
+	logDim("proxy in front of it and tunnel to that instead.")
+	fmt.Println()
+
+	if !stdinIsTerminal() {
+		return fmt.Errorf("refusing to expose %s without confirmation (use --yes to skip this check)", addr)
+	}
+
+	fmt.Printf("Expose %s publicly? [y/N]: ", addr)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("aborted: %s was not exposed", addr)
+	}
+
+	if err := saveConfirmedTarget(addr); err != nil {
+		logWarning(fmt.Sprintf("Could not remember confirmation: %v", err))
+	}
+	return nil
+}
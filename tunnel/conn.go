@@ -0,0 +1,431 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default framing for large responses
+const (
+	DefaultChunkThreshold = 1 << 20   // bodies above this are streamed
+	DefaultChunkSize      = 256 << 10 // raw bytes per response-chunk frame
+)
+
+var (
+	errConnClosed      = errors.New("tunnel connection closed")
+	errResponseExpired = errors.New("response expired waiting for the tunnel to accept it")
+)
+
+// Default time a frame may wait to be written before its response is abandoned
+const DefaultResponseExpiry = 60 * time.Second
+
+// Queue key for control messages and single-frame responses
+const controlQueue = ""
+
+// WebSocket connection to the tunnel server. All writes go through a single
+// writer goroutine that serves per-response queues round-robin, so a large
+// streamed download can't starve small responses sent at the same time.
+type tunnelConn struct {
+	*websocket.Conn
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues map[string]*outboundQueue
+	order  []*outboundQueue
+	next   int
+	err    error
+
+	limiter *byteRateLimiter
+
+	// Frames not written within expiry are dropped; abandoned counts the
+	// responses given up on that way
+	expiry    time.Duration
+	abandoned int64
+
+	// In-flight requests, and the bodies of chunked ones, keyed by request ID
+	cancelMu sync.Mutex
+	inflight map[string]*inflightRequest
+	uploads  map[string]*requestUpload
+
+	// Messages larger than this are drained unread, see readFrame
+	maxFrame int64
+
+	// Round trip and server clock offset in nanoseconds, see clock.go
+	rtt         int64
+	clockOffset int64
+
+	// When the server last sent anything, pings and pongs included, in
+	// Unix nanoseconds
+	lastMessage int64
+
+	chunkThreshold int64
+	chunkSize      int
+
+	// Capabilities the server acknowledged at registration
+	capsMu       sync.Mutex
+	capabilities map[string]bool
+
+	// Plan limits from the server, nil if it sent none
+	limits   atomic.Pointer[PlanLimits]
+	requests int64
+
+	// Public hostname from registration, for forwarded headers
+	publicHost atomic.Value
+
+	// How long the server may stay silent before the connection is dead
+	pongWait time.Duration
+
+	log Logger
+}
+
+// Message waiting for the writer goroutine
+type outboundFrame struct {
+	messageType int
+	data        []byte
+	done        chan error
+}
+
+// Pending frames of one response (or of the control queue)
+type outboundQueue struct {
+	key    string
+	frames []*outboundFrame
+}
+
+func newTunnelConn(ws *websocket.Conn, opts *Options) *tunnelConn {
+	c := &tunnelConn{
+		Conn:           ws,
+		queues:         map[string]*outboundQueue{},
+		inflight:       map[string]*inflightRequest{},
+		uploads:        map[string]*requestUpload{},
+		maxFrame:       maxFrameSize(opts.MaxBodySize),
+		expiry:         opts.ResponseExpiry,
+		chunkThreshold: int64(opts.ChunkThreshold),
+		chunkSize:      int(opts.ChunkSize),
+		log:            opts.log,
+		pongWait:       opts.PongTimeout,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	c.extendDeadline()
+	ws.SetPongHandler(c.handlePong)
+	ws.SetPingHandler(c.handlePing)
+	if opts.MaxOutboundRate > 0 {
+		c.limiter = newByteRateLimiter(float64(opts.MaxOutboundRate))
+	}
+	go c.writeLoop()
+	return c
+}
+
+// WriteJSON sends one message on the control queue
+func (c *tunnelConn) WriteJSON(v interface{}) error {
+	return c.writeJSON(controlQueue, v)
+}
+
+// WriteMessage sends one raw message on the control queue
+func (c *tunnelConn) WriteMessage(messageType int, data []byte) error {
+	return c.enqueue(controlQueue, messageType, data)
+}
+
+// Send one message on a response's own queue and wait until it is written
+func (c *tunnelConn) writeJSON(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(key, websocket.TextMessage, data)
+}
+
+func (c *tunnelConn) enqueue(key string, messageType int, data []byte) error {
+	frame := &outboundFrame{messageType: messageType, data: data, done: make(chan error, 1)}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	q := c.queues[key]
+	if q == nil {
+		q = &outboundQueue{key: key}
+		c.queues[key] = q
+		c.order = append(c.order, q)
+	}
+	q.frames = append(q.frames, frame)
+	c.cond.Signal()
+	c.mu.Unlock()
+
+	if c.expiry <= 0 {
+		return <-frame.done
+	}
+	timer := time.NewTimer(c.expiry)
+	defer timer.Stop()
+	select {
+	case err := <-frame.done:
+		return err
+	case <-timer.C:
+		if !c.dropFrame(key, frame) {
+			// Already handed to the writer, which enforces its own deadline
+			return <-frame.done
+		}
+		return errResponseExpired
+	}
+}
+
+// Remove a frame that is still waiting in its queue
+func (c *tunnelConn) dropFrame(key string, frame *outboundFrame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q := c.queues[key]
+	if q == nil {
+		return false
+	}
+	for i, f := range q.frames {
+		if f == frame {
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			if len(q.frames) == 0 {
+				c.removeQueue(q)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Drop an empty queue from the rotation
+func (c *tunnelConn) removeQueue(q *outboundQueue) {
+	delete(c.queues, q.key)
+	for i, o := range c.order {
+		if o == q {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			if i < c.next {
+				c.next--
+			}
+			return
+		}
+	}
+}
+
+// Count a response given up on because the remote side stopped reading
+func (c *tunnelConn) abandon(id MessageID) {
+	atomic.AddInt64(&c.abandoned, 1)
+	c.log.Warning(fmt.Sprintf("Response %v abandoned: the tunnel stopped accepting data", id))
+}
+
+// Take the next frame, visiting queues round-robin
+func (c *tunnelConn) nextFrame() (*outboundFrame, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if c.next >= len(c.order) {
+		c.next = 0
+	}
+	q := c.order[c.next]
+	frame := q.frames[0]
+	q.frames = q.frames[1:]
+	if len(q.frames) == 0 {
+		c.removeQueue(q)
+	} else {
+		c.next++
+	}
+	return frame, nil
+}
+
+func (c *tunnelConn) writeLoop() {
+	for {
+		frame, err := c.nextFrame()
+		if err != nil {
+			return
+		}
+		if c.limiter != nil {
+			c.limiter.wait(len(frame.data))
+		}
+		// A peer that stops reading fails the write instead of blocking forever
+		if c.expiry > 0 {
+			c.Conn.SetWriteDeadline(time.Now().Add(c.expiry))
+		}
+		err = c.Conn.WriteMessage(frame.messageType, frame.data)
+		frame.done <- err
+		if err != nil {
+			traffic.wsWriteFails.Add(1)
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// Stop the writer and fail every pending and future write with err
+func (c *tunnelConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+	for _, q := range c.order {
+		for _, frame := range q.frames {
+			frame.done <- c.err
+		}
+	}
+	c.order = nil
+	c.queues = map[string]*outboundQueue{}
+	c.cond.Broadcast()
+}
+
+// Record the capabilities the server acknowledged
+func (c *tunnelConn) setCapabilities(caps []string) {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	c.capabilities = map[string]bool{}
+	for _, capability := range caps {
+		c.capabilities[capability] = true
+	}
+}
+
+// Whether streamed bodies carry sequence numbers and a checksum
+func (c *tunnelConn) checksums() bool {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	return c.capabilities[CapStreamChecksum]
+}
+
+// Whether requests carry their body bytes as received
+func (c *tunnelConn) rawBodies() bool {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	return c.capabilities[CapRawBody]
+}
+
+// Whether the server makes visitors log in to the portal and signs their
+// identity into requests
+func (c *tunnelConn) portalAuth() bool {
+	c.capsMu.Lock()
+	defer c.capsMu.Unlock()
+	return c.capabilities[CapPortalAuth]
+}
+
+// Whether the connection has been closed or failed
+func (c *tunnelConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// Close stops the writer, cancels in-flight requests and closes the
+// underlying connection
+func (c *tunnelConn) Close() error {
+	c.fail(errConnClosed)
+
+	c.cancelMu.Lock()
+	for key, req := range c.inflight {
+		req.cancel()
+		delete(c.inflight, key)
+	}
+	for key, u := range c.uploads {
+		u.end(errConnClosed)
+		delete(c.uploads, key)
+	}
+	c.cancelMu.Unlock()
+
+	return c.Conn.Close()
+}
+
+// Say goodbye with a normal close frame, then close
+func (c *tunnelConn) shutdown() error {
+	c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "client shutting down"))
+	return c.Close()
+}
+
+var errCancelledByPeer = errors.New("cancelled by peer")
+
+// A request being handled. It is registered so a "cancel" message can
+// stop it, and so at most one response is ever sent for its ID.
+type inflightRequest struct {
+	cancel    context.CancelFunc
+	cancelled atomic.Bool // by a "cancel" message
+	responded atomic.Bool
+}
+
+// Claim the right to respond. False once the peer has cancelled the
+// request or a response has already been sent.
+func (r *inflightRequest) respond() bool {
+	return !r.cancelled.Load() && !r.responded.Swap(true)
+}
+
+// Register an in-flight request. The returned function unregisters it;
+// ok is false if a request with the same ID is already in flight.
+func (c *tunnelConn) trackRequest(id MessageID, cancel context.CancelFunc) (req *inflightRequest, release func(), ok bool) {
+	key := id.String()
+	c.cancelMu.Lock()
+	defer c.cancelMu.Unlock()
+	if _, dup := c.inflight[key]; dup {
+		return nil, nil, false
+	}
+	req = &inflightRequest{cancel: cancel}
+	c.inflight[key] = req
+
+	return req, func() {
+		c.cancelMu.Lock()
+		if c.inflight[key] == req {
+			delete(c.inflight, key)
+		}
+		c.cancelMu.Unlock()
+		cancel()
+	}, true
+}
+
+// Cancel an in-flight request after the remote client went away; its
+// response is then suppressed. Unknown or finished IDs are ignored.
+func (c *tunnelConn) cancelRequest(id MessageID) bool {
+	key := id.String()
+	c.cancelMu.Lock()
+	req, ok := c.inflight[key]
+	delete(c.inflight, key)
+	c.cancelMu.Unlock()
+
+	if ok {
+		req.cancelled.Store(true)
+		req.cancel()
+	}
+	return ok
+}
+
+// Token bucket capping outbound bytes per second. Only used by the writer
+// goroutine, so it needs no locking.
+type byteRateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newByteRateLimiter(rate float64) *byteRateLimiter {
+	return &byteRateLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// Block until n bytes may be sent. Frames larger than the bucket go into
+// debt so they are never stuck, and later frames pay it back.
+func (l *byteRateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
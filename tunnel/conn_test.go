@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSmallResponseOvertakesLargeDownload(t *testing.T) {
+	const large = 64 << 20
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/me" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"small"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(large))
+		io.Copy(w, &patternReader{left: large})
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	// At 8 MB/s the download takes 8 seconds
+	conn := startEdgeTunnel(t, edge, local.URL, "--max-outbound-rate", "8MB")
+
+	conn.request(1, "GET", "/build.tar", HeaderMap{}, nil)
+	time.Sleep(500 * time.Millisecond)
+	sent := time.Now()
+	conn.request(2, "GET", "/api/me", HeaderMap{}, nil)
+	small, _ := conn.response(2, false)
+	waited := small.finished.Sub(sent)
+
+	if small.Status != 200 || string(small.Body) != `{"name":"small"}` {
+		t.Fatalf("small response: %d %q", small.Status, small.Body)
+	}
+	if waited > time.Second {
+		t.Errorf("small response took %s behind the download", waited)
+	}
+	var chunks int
+	for _, m := range conn.held["1"] {
+		if m.Type == "response-end" {
+			t.Fatal("the download ended before the small response, so nothing was shown")
+		}
+		if m.Type == "response-chunk" {
+			chunks++
+		}
+	}
+	if chunks == 0 {
+		t.Fatal("the download had not started when the small request was sent")
+	}
+	t.Logf("small response took %s with %d chunks of the download sent", waited, chunks)
+}
+
+func TestStalledEdgeAbandonsStreamsInBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for responses to expire")
+	}
+	const streams = 4
+	var served atomic.Int64
+	var running sync.WaitGroup
+	running.Add(streams)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer running.Done()
+		// Endless, until the client stops reading
+		w.Header().Set("Content-Type", "application/octet-stream")
+		chunk := make([]byte, 64<<10)
+		for {
+			n, err := w.Write(chunk)
+			served.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	// The edge reads the start of the first response, then nothing more
+	stall := make(chan struct{})
+	t.Cleanup(func() { close(stall) })
+	var reads atomic.Int64
+	edge.onMessage = func([]byte) {
+		if reads.Add(1) > 2 {
+			<-stall
+		}
+	}
+	conn := startEdgeTunnel(t, edge, local.URL, "--response-expiry", "1s")
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := sampleHeap()
+	for id := 1; id <= streams; id++ {
+		conn.request(id, "GET", "/stream/"+strconv.Itoa(id), HeaderMap{}, nil)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("local responses still being read after 10s, %s served", ByteSize(served.Load()))
+	}
+	grown := int64(peak()) - int64(before.HeapInuse)
+
+	if grown > 48<<20 {
+		t.Errorf("heap grew by %s with the edge stalled", ByteSize(grown))
+	}
+	if served.Load() > 256<<20 {
+		t.Errorf("local app served %s to a stalled edge", ByteSize(served.Load()))
+	}
+	t.Logf("heap grew by %s, local app served %s before the responses were abandoned", ByteSize(grown), ByteSize(served.Load()))
+}
+
+// Send body as a chunked request, in chunks of size bytes
+func sendUpload(conn *edgeConn, id int, path string, body []byte, size int) {
+	conn.send(map[string]interface{}{
+		"type": MsgRequest, "id": id, "method": "POST", "path": path, "chunked": true,
+		"headers": HeaderMap{"content-length": {strconv.Itoa(len(body))}, "content-type": {"application/octet-stream"}},
+	})
+	for start := 0; start < len(body); start += size {
+		end := min(start+size, len(body))
+		conn.send(map[string]interface{}{"type": MsgRequestChunk, "id": id, "data": base64.StdEncoding.EncodeToString(body[start:end])})
+	}
+	conn.send(map[string]interface{}{"type": MsgRequestEnd, "id": id})
+}
+
+func TestChunkedUploadArrivesWhole(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+	received := make(chan []byte, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received <- data
+	}))
+	t.Cleanup(local.Close)
+	conn := startEdgeTunnel(t, newFakeEdge(t), local.URL)
+
+	sendUpload(conn, 1, "/upload", body, 1000)
+	if resp, _ := conn.response(1, false); resp.Status != 200 {
+		t.Fatalf("upload answered with %d", resp.Status)
+	}
+	if data := <-received; !bytes.Equal(data, body) {
+		t.Errorf("local app got %d bytes, want the %d sent", len(data), len(body))
+	}
+}
+
+// A local app that stops reading an upload gives up that upload alone,
+// without holding up the messages behind it
+func TestStalledUploadDelaysNoOtherRequest(t *testing.T) {
+	release := make(chan struct{})
+	readErr := make(chan error, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			<-release
+			_, err := io.Copy(io.Discard, r.Body)
+			readErr <- err
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(local.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	conn := startEdgeTunnel(t, newFakeEdge(t), local.URL)
+
+	// Twice what the upload may queue
+	body := bytes.Repeat([]byte{'x'}, 2*uploadQueueLimit)
+	sent := time.Now()
+	sendUpload(conn, 1, "/upload", body, 256<<10)
+	conn.request(2, "GET", "/health", HeaderMap{}, nil)
+	resp, _ := conn.response(2, false)
+	if resp.Status != 200 || string(resp.Body) != "ok" {
+		t.Fatalf("other request: %d %q", resp.Status, resp.Body)
+	}
+	if waited := resp.finished.Sub(sent); waited > uploadStallTimeout {
+		t.Errorf("other request took %s behind the stalled upload", waited)
+	}
+
+	close(release)
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("the stalled upload was read to the end")
+		}
+	case <-time.After(edgeTimeout):
+		t.Fatal("the stalled upload was never ended")
+	}
+}
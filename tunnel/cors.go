@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// How long browsers may cache a preflight answered by the client
+const CORSMaxAge = "600"
+
+// Cross-origin policy from --cors and --cors-origin, nil when off. The
+// client answers preflights for allowed origins itself and adds
+// Access-Control-Allow-Origin to responses that lack it.
+type corsPolicy struct {
+	all     bool
+	origins map[string]bool
+}
+
+func newCORSPolicy(all bool, origins []string) *corsPolicy {
+	if !all && len(origins) == 0 {
+		return nil
+	}
+	p := &corsPolicy{all: all, origins: map[string]bool{}}
+	for _, origin := range origins {
+		p.origins[normalizeOrigin(origin)] = true
+	}
+	return p
+}
+
+// Check a --cors-origin: a scheme and host with an optional port, no path
+func validateOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid --cors-origin %q (use scheme://host[:port], e.g. https://app.example.com)", origin)
+	}
+	return nil
+}
+
+// Origins compare case-insensitively and without a trailing slash
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+}
+
+func (p *corsPolicy) allows(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	return p.all || p.origins[normalizeOrigin(origin)]
+}
+
+// Whether a request is a CORS preflight this policy should answer
+func (p *corsPolicy) preflight(method string, headers HeaderMap) bool {
+	return strings.EqualFold(method, "OPTIONS") &&
+		headers.Get("access-control-request-method") != "" &&
+		p.allows(headers.Get("origin"))
+}
+
+// Answer a preflight without involving the local app. Preflights carry no
+// credentials, so this happens before --basic-auth is checked.
+func (p *corsPolicy) sendPreflight(ws *tunnelConn, id MessageID, request HeaderMap) {
+	headers := HeaderMap{
+		"access-control-allow-origin":      {request.Get("origin")},
+		"access-control-allow-credentials": {"true"},
+		"access-control-allow-methods":     {request.Get("access-control-request-method")},
+		"access-control-max-age":           {CORSMaxAge},
+		"vary":                             {"Origin, Access-Control-Request-Method, Access-Control-Request-Headers"},
+	}
+	if requested := request.Get("access-control-request-headers"); requested != "" {
+		headers.Set("access-control-allow-headers", requested)
+	}
+	response := ResponseMessage{ID: id, Status: 204, Headers: headers}
+	if err := ws.WriteJSON(response); err != nil {
+		ws.log.Error(fmt.Sprintf("Failed to send response: %v", err))
+	}
+}
+
+// Allow the request's origin on a proxied response, unless the local app
+// already sent its own CORS headers
+func (p *corsPolicy) apply(headers HeaderMap, request HeaderMap) {
+	origin := request.Get("origin")
+	if !p.allows(origin) || headers.Get("access-control-allow-origin") != "" {
+		return
+	}
+	headers.Set("access-control-allow-origin", origin)
+	headers.Set("access-control-allow-credentials", "true")
+	headers["vary"] = append(headers["vary"], "Origin")
+}
@@ -0,0 +1,482 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Set in the environment of a tunnel started with --daemon, holding its ID
+const daemonEnv = "COMZY_DAEMON_ID"
+
+// How long --daemon waits for the tunnel to register before returning
+const daemonStartTimeout = 30 * time.Second
+
+// How often a daemon checks whether "comzy stop" asked it to stop
+const daemonStopPoll = 500 * time.Millisecond
+
+// How long "comzy stop" waits for daemons to finish draining
+const daemonStopTimeout = DefaultDrainTimeout + 5*time.Second
+
+// Lines "comzy logs" prints by default
+const defaultLogLines = 50
+
+var errStopped = errors.New("stopped by comzy stop")
+
+// Arguments of this invocation, repeated by --daemon to start the tunnel
+// in the background
+var invocation []string
+
+// A tunnel running in the background, recorded in run/<id>.json while it
+// runs. Its output goes to run/<id>.log, which is kept after it stops.
+type daemonState struct {
+	ID  string `json:"id"`
+	Log string `json:"log"`
+	currentSession
+}
+
+func runDir() string {
+	return filepath.Join(comzyDir, "run")
+}
+
+func daemonFile(id, ext string) string {
+	return filepath.Join(runDir(), id+ext)
+}
+
+var unsafeIDChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// ID of a new daemon: its first tunnel's name or port and a random suffix
+func newDaemonID(opts *Options) string {
+	label := opts.Name
+	if label == "" {
+		label = strconv.Itoa(opts.Port)
+	}
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return unsafeIDChars.ReplaceAllString(label, "-") + "-" + hex.EncodeToString(suffix)
+}
+
+// Start this invocation again as a detached process logging to a file,
+// and return once its tunnels have registered
+func startDaemon(list []*Options) int {
+	if err := os.MkdirAll(runDir(), 0755); err != nil {
+		logError(fmt.Sprintf("Could not create %s: %v", runDir(), err))
+		return 1
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		logError(fmt.Sprintf("Could not find the comzy executable: %v", err))
+		return 1
+	}
+	id := newDaemonID(list[0])
+	logPath := daemonFile(id, ".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logError(fmt.Sprintf("Could not open the log file: %v", err))
+		return 1
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, invocation...)
+	cmd.Env = append(os.Environ(), daemonEnv+"="+id)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		logError(fmt.Sprintf("Could not start the tunnel in the background: %v", err))
+		return 1
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timeout := time.After(daemonStartTimeout)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-exited:
+			logError(fmt.Sprintf("The tunnel stopped right after starting (%v). Its log:", err))
+			tailFile(os.Stderr, logPath, 20)
+			return 1
+		case <-timeout:
+			logWarning(fmt.Sprintf("The tunnel is running in the background (%s) but hasn't registered yet", id))
+			logDim(fmt.Sprintf("See what it's doing with: comzy logs %s", id))
+			return 0
+		case <-tick.C:
+		}
+		state := loadDaemon(id)
+		if state == nil || !state.registered(len(list)) {
+			continue
+		}
+		logSuccess(fmt.Sprintf("Tunnel running in the background (pid %d)", state.PID))
+		for _, t := range state.Tunnels {
+			fmt.Printf("%sPublic URL:     %s%s%s -> %s\n", ColorBright, ColorCyan, t.URL, ColorReset, t.Local)
+		}
+		logDim(fmt.Sprintf("Logs: comzy logs %s    Stop: comzy stop %s", id, id))
+		return 0
+	}
+}
+
+// Whether each of n tunnels has a public URL
+func (s *daemonState) registered(n int) bool {
+	if len(s.Tunnels) < n {
+		return false
+	}
+	for _, t := range s.Tunnels {
+		if t.URL == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Record the state of the daemon running group, called at startup and on
+// every registration
+func saveDaemon(id string, group *tunnelGroup, startedAt time.Time) error {
+	state := daemonState{ID: id, Log: daemonFile(id, ".log")}
+	state.PID, state.StartedAt = os.Getpid(), startedAt
+	for _, t := range group.tunnels {
+		state.Tunnels = append(state.Tunnels, currentTunnel{Name: t.opts.Name, URL: t.publicEndpoint(), Local: forwardingTo(t.opts, t.target)})
+	}
+	if err := os.MkdirAll(runDir(), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(daemonFile(id, ".json"), data, 0644)
+}
+
+// A daemon's state as recorded, whether or not it is still running
+func readDaemon(path string) (*daemonState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state daemonState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Run in the daemon: stop group once "comzy stop" leaves a stop file, and
+// forget the daemon's state when it ends. The returned func is called once
+// group has stopped, and waits for the stop file to be no longer watched.
+func serveDaemon(id string, group *tunnelGroup) func() {
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		tick := time.NewTicker(daemonStopPoll)
+		defer tick.Stop()
+		for {
+			select {
+			case <-group.done:
+				return
+			case <-tick.C:
+			}
+			if _, err := os.Stat(daemonFile(id, ".stop")); err == nil {
+				logInfo("Stop requested, shutting down...")
+				group.shutdown(errStopped)
+				return
+			}
+		}
+	}()
+	return func() {
+		<-watching
+		os.Remove(daemonFile(id, ".json"))
+		os.Remove(daemonFile(id, ".stop"))
+	}
+}
+
+// A daemon's state, nil if it isn't running
+func loadDaemon(id string) *daemonState {
+	state, err := readDaemon(daemonFile(id, ".json"))
+	if err != nil || !processRunning(state.PID) {
+		return nil
+	}
+	return state
+}
+
+// Running daemons, oldest first. State left behind by daemons that died
+// without cleaning up is removed.
+func listDaemons() []*daemonState {
+	paths, _ := filepath.Glob(filepath.Join(runDir(), "*.json"))
+	var daemons []*daemonState
+	for _, path := range paths {
+		state, err := readDaemon(path)
+		if err != nil {
+			continue
+		}
+		if !processRunning(state.PID) {
+			os.Remove(path)
+			os.Remove(daemonFile(state.ID, ".stop"))
+			continue
+		}
+		daemons = append(daemons, state)
+	}
+	sort.Slice(daemons, func(i, j int) bool { return daemons[i].StartedAt.Before(daemons[j].StartedAt) })
+	return daemons
+}
+
+// Whether a daemon is the one meant by ref: its ID, or a tunnel's name,
+// local port, public alias or URL
+func (s *daemonState) matches(ref string) bool {
+	if s.ID == ref {
+		return true
+	}
+	for _, t := range s.Tunnels {
+		if t.Name == ref || t.URL == ref || strings.HasSuffix(t.Local, ":"+ref) {
+			return true
+		}
+		if u, err := url.Parse(t.URL); err == nil && u.Hostname() != "" {
+			if alias, _, _ := strings.Cut(u.Hostname(), "."); alias == ref {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Running daemons meant by ref, every one for "all"
+func findDaemons(ref string) []*daemonState {
+	var found []*daemonState
+	for _, state := range listDaemons() {
+		if ref == "all" || state.matches(ref) {
+			found = append(found, state)
+		}
+	}
+	return found
+}
+
+// Handle "comzy ps": list the tunnels running in the background
+func handlePS(args []string) error {
+	fs := flag.NewFlagSet("ps", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := addListFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	table := newListing("id", "pid", "name", "url", "local", "uptime")
+	for _, state := range listDaemons() {
+		uptime := time.Since(state.StartedAt).Round(time.Second).String()
+		for _, t := range state.Tunnels {
+			table.add(state.ID, strconv.Itoa(state.PID), t.Name, cmp.Or(t.URL, "(connecting)"), t.Local, uptime)
+		}
+	}
+	if len(table.rows) == 0 && format.Format == FormatTable {
+		logDim("No tunnels are running in the background")
+		return nil
+	}
+	return table.write(os.Stdout, format)
+}
+
+// Handle "comzy stop": ask daemons to shut down gracefully and wait for
+// them to finish
+func handleStop(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return &usageError{fmt.Errorf("Usage: comzy stop <id|name|port|alias|all>"), fs}
+	}
+	ref := fs.Arg(0)
+	daemons := findDaemons(ref)
+	if len(daemons) == 0 {
+		if ref == "all" {
+			logDim("No tunnels are running in the background")
+			return nil
+		}
+		return fmt.Errorf("no tunnel running in the background matches %q (see comzy ps)", ref)
+	}
+
+	for _, state := range daemons {
+		if err := os.WriteFile(daemonFile(state.ID, ".stop"), nil, 0644); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(daemonStopTimeout)
+	for len(daemons) > 0 {
+		var running []*daemonState
+		for _, state := range daemons {
+			if processRunning(state.PID) {
+				running = append(running, state)
+			} else {
+				os.Remove(daemonFile(state.ID, ".stop"))
+				logSuccess(fmt.Sprintf("Stopped %s", state.describe()))
+			}
+		}
+		daemons = running
+		if len(daemons) > 0 && time.Now().After(deadline) {
+			return fmt.Errorf("%s is still shutting down after %s", daemons[0].describe(), daemonStopTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// The daemon's ID and public URLs, for messages
+func (s *daemonState) describe() string {
+	var urls []string
+	for _, t := range s.Tunnels {
+		if t.URL != "" {
+			urls = append(urls, t.URL)
+		}
+	}
+	if len(urls) == 0 {
+		return s.ID
+	}
+	return s.ID + " (" + strings.Join(urls, ", ") + ")"
+}
+
+// Handle "comzy logs": print the end of a daemon's log, and follow it
+// with --follow
+func handleLogs(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	follow := fs.Bool("follow", false, "Keep printing lines as they are written, until Ctrl-C")
+	fs.BoolVar(follow, "f", false, "Same as --follow")
+	lines := fs.Int("lines", defaultLogLines, "Lines to print from the end of the log")
+	fs.IntVar(lines, "n", defaultLogLines, "Same as --lines")
+	// Flags may come after the tunnel, as in "comzy logs api -f"
+	var refs []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		refs = append(refs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(refs) != 1 {
+		return &usageError{fmt.Errorf("Usage: comzy logs <id|name|port|alias> [--follow]"), fs}
+	}
+
+	path, err := daemonLog(refs[0])
+	if err != nil {
+		return err
+	}
+	offset, err := tailFile(os.Stdout, path, *lines)
+	if err != nil || !*follow {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	tick := time.NewTicker(daemonStopPoll)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+		if offset, err = copyFrom(os.Stdout, path, offset); err != nil {
+			return err
+		}
+	}
+}
+
+// Log file of the daemon meant by ref. Logs of daemons that have stopped
+// are found by ID, or by the name or port the ID starts with.
+func daemonLog(ref string) (string, error) {
+	daemons := findDaemons(ref)
+	switch {
+	case len(daemons) == 1:
+		return daemons[0].Log, nil
+	case len(daemons) > 1:
+		ids := make([]string, len(daemons))
+		for i, state := range daemons {
+			ids[i] = state.ID
+		}
+		return "", fmt.Errorf("%q matches several tunnels, pick one of: %s", ref, strings.Join(ids, ", "))
+	}
+	if _, err := os.Stat(daemonFile(ref, ".log")); err == nil {
+		return daemonFile(ref, ".log"), nil
+	}
+	// The most recent log of a stopped daemon started for ref
+	paths, _ := filepath.Glob(filepath.Join(runDir(), unsafeIDChars.ReplaceAllString(ref, "-")+"-*.log"))
+	var newest string
+	var newestTime time.Time
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newestTime) {
+			newest, newestTime = path, info.ModTime()
+		}
+	}
+	if newest == "" {
+		return "", fmt.Errorf("no tunnel log matches %q (see comzy ps)", ref)
+	}
+	return newest, nil
+}
+
+// Bytes of a log read to find its last lines
+const tailWindow = 1 << 20
+
+// Print the last n lines of a file, returning the offset of its end
+func tailFile(w io.Writer, path string, n int) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	start := max(info.Size()-tailWindow, 0)
+	data := make([]byte, info.Size()-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return 0, err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines[max(len(lines)-n, 0):] {
+		w.Write(line)
+	}
+	return info.Size(), nil
+}
+
+// Print what was written to a file after offset, returning the new end.
+// A file that shrank was rotated or truncated and is printed from the start.
+func copyFrom(w io.Writer, path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() < offset {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(w, f)
+	return offset + n, err
+}
@@ -0,0 +1,423 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// How often the dashboard is redrawn, picking up new requests and a
+// resized terminal
+const dashboardRefresh = 500 * time.Millisecond
+
+// Span the request rate is averaged over
+const dashboardRateWindow = 5 * time.Second
+
+// Escape sequences for the full-screen display
+const (
+	screenEnter   = "\x1b[?1049h\x1b[?25l" // alternate screen, cursor hidden
+	screenLeave   = "\x1b[?25h\x1b[?1049l"
+	screenHome    = "\x1b[H"
+	screenEOL     = "\x1b[K" // clear to the end of the line
+	screenEOS     = "\x1b[J" // clear to the end of the screen
+	screenReverse = "\x1b[7m"
+)
+
+// Full-screen view shown by --ui in place of the scrolling log: the
+// tunnels, the requests the inspector recorded and running totals. It
+// reads the inspector's ring buffer rather than keeping its own.
+type dashboard struct {
+	group *tunnelGroup
+
+	mu       sync.Mutex
+	state    map[*tunnel]string // last connection event of each tunnel
+	selected int64              // inspector ID of the selected request, 0 to follow the newest
+	expanded bool               // whether the selected request's details are open
+	lastLog  string
+	samples  []rateSample
+}
+
+type rateSample struct {
+	at       time.Time
+	requests int64
+}
+
+// Take over the terminal with the dashboard until the returned func is
+// called. Without a terminal on stdin and stdout it logs as usual, with
+// the pause keys of watchPauseKeys.
+func runDashboard(group *tunnelGroup) func() {
+	if !stdinIsTerminal() || terminalWidth(os.Stdout) == 0 {
+		logDim("--ui needs a terminal, logging instead")
+		return watchPauseKeys(group)
+	}
+	restoreKeys, err := keypressMode()
+	if err != nil {
+		logWarning(fmt.Sprintf("--ui unavailable, logging instead: %v", err))
+		return func() {}
+	}
+
+	d := &dashboard{group: group, state: map[*tunnel]string{}}
+	observe := group.observe
+	group.observe = func(t *tunnel, event, detail string) {
+		if observe != nil {
+			observe(t, event, detail)
+		}
+		d.mu.Lock()
+		d.state[t] = event
+		d.mu.Unlock()
+	}
+	restoreConsole := captureConsole(func(level logLevel, line string) {
+		d.mu.Lock()
+		d.lastLog = line
+		d.mu.Unlock()
+	})
+	os.Stdout.WriteString(screenEnter)
+
+	keys := make(chan string)
+	go readKeys(keys)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(dashboardRefresh)
+		defer ticker.Stop()
+		for {
+			d.draw()
+			select {
+			case <-done:
+				return
+			case <-group.done:
+				return
+			case <-ticker.C:
+			case key := <-keys:
+				d.handleKey(key)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		os.Stdout.WriteString(screenLeave)
+		restoreConsole()
+		restoreKeys()
+	}
+}
+
+// Send the keys typed on stdin: "up", "down", "enter" or the character
+func readKeys(keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			key := string(buf[i])
+			switch {
+			case buf[i] == '\x1b' && i+2 < n && buf[i+1] == '[':
+				switch buf[i+2] {
+				case 'A':
+					key = "up"
+				case 'B':
+					key = "down"
+				}
+				i += 2
+			case buf[i] == '\r' || buf[i] == '\n':
+				key = "enter"
+			}
+			keys <- key
+		}
+	}
+}
+
+func (d *dashboard) handleKey(key string) {
+	switch key {
+	case "q", "Q":
+		go d.group.shutdown(errInterrupted)
+	case "p", "P":
+		d.group.setPaused(!d.group.paused())
+	case "r", "R":
+		d.group.setPaused(false)
+	case "c", "C":
+		inspector.clear()
+		d.mu.Lock()
+		d.selected, d.expanded = 0, false
+		d.mu.Unlock()
+	case "up", "k":
+		d.move(-1)
+	case "down", "j":
+		d.move(1)
+	case "enter":
+		d.mu.Lock()
+		d.expanded = !d.expanded
+		d.mu.Unlock()
+	}
+}
+
+// Select the request delta rows down, newest first
+func (d *dashboard) move(delta int) {
+	entries := inspector.list()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+	i := max(0, d.selectedIndex(entries)+delta)
+	if i >= len(entries) {
+		i = len(entries) - 1
+	}
+	if i == 0 {
+		d.selected = 0
+	} else {
+		d.selected = entries[i].ID
+	}
+}
+
+// Row of the selected request, the newest when it's gone from the buffer
+func (d *dashboard) selectedIndex(entries []Capture) int {
+	for i, c := range entries {
+		if c.ID == d.selected {
+			return i
+		}
+	}
+	return 0
+}
+
+// Requests per second over the last few seconds
+func (d *dashboard) rate(requests int64) float64 {
+	now := time.Now()
+	d.samples = append(d.samples, rateSample{now, requests})
+	for len(d.samples) > 2 && now.Sub(d.samples[1].at) >= dashboardRateWindow {
+		d.samples = d.samples[1:]
+	}
+	first := d.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(requests-first.requests) / elapsed
+}
+
+// Redraw the whole screen, fitted to the terminal's current size
+func (d *dashboard) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	entries := inspector.list()
+	snap := traffic.snapshot()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var top, bottom []string
+
+	paused := ""
+	if d.group.paused() {
+		paused = "   " + ColorYellow + ColorBright + "PAUSED" + ColorReset
+	}
+	// Anonymous sessions end once their connected time runs out
+	anonymous := ""
+	if getToken() == "" {
+		left, running := d.group.anonymous.remaining()
+		color := ColorDim
+		if left <= AnonymousWarnings[0] {
+			color = ColorYellow + ColorBright
+		}
+		anonymous = "   " + color + "anonymous: " + d.group.anonymous.String() + " left"
+		if !running {
+			anonymous += " (paused)"
+		}
+		anonymous += ColorReset
+	}
+	top = append(top, ColorBright+"comzy "+Version+ColorReset+ColorDim+"   up "+snap.Uptime+ColorReset+paused+anonymous)
+	for _, t := range d.group.tunnels {
+		endpoint := t.publicEndpoint()
+		if endpoint == "" {
+			endpoint = "(not registered yet)"
+		}
+		top = append(top, fmt.Sprintf("%s%s%s -> %s  %s", ColorCyan, endpoint, ColorReset, forwardingTo(t.opts, t.target), d.connectionState(t)))
+	}
+	top = append(top, "", ColorDim+fmt.Sprintf("  %-7s %-6s %9s %9s  %s", "METHOD", "STATUS", "DURATION", "SIZE", "PATH")+ColorReset)
+
+	bottom = append(bottom, fmt.Sprintf("%.1f req/s   p95 %.0fms   %s in   %s out   %d requests",
+		d.rate(snap.Requests), snap.P95Ms, formatBytes(snap.BytesIn), formatBytes(snap.BytesOut), snap.Requests))
+	if d.lastLog != "" {
+		bottom = append(bottom, ColorDim+d.lastLog+ColorReset)
+	}
+	bottom = append(bottom, ColorDim+"up/down select   enter details   p pause/resume   c clear   q quit"+ColorReset)
+
+	selected := d.selectedIndex(entries)
+	var details []string
+	if d.expanded && len(entries) > 0 {
+		details = captureDetails(entries[selected])
+	}
+	// The table gets what's left, at least a few rows; details give way
+	rows := height - len(top) - len(bottom) - 1
+	if len(details) > 0 {
+		keep := max(0, min(len(details), rows-min(5, len(entries))))
+		details = details[:keep]
+		rows -= len(details)
+	}
+	rows = max(0, rows)
+
+	// Scroll so the selected row stays in view
+	first := max(0, selected-rows+1)
+	var table []string
+	for i := first; i < len(entries) && len(table) < rows; i++ {
+		line := captureRow(entries[i])
+		if i == selected && (d.selected != 0 || d.expanded) {
+			line = "> " + line
+			if ColorReset != "" {
+				line = screenReverse + strings.ReplaceAll(fitWidth(line, width), ColorReset, ColorReset+screenReverse)
+			}
+		} else {
+			line = "  " + line
+		}
+		table = append(table, line)
+	}
+	if len(entries) == 0 {
+		table = append(table, ColorDim+"  Waiting for requests..."+ColorReset)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(screenHome)
+	lines := append(append(top, table...), details...)
+	for len(lines) < height-len(bottom) {
+		lines = append(lines, "")
+	}
+	for i, line := range append(lines, bottom...) {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString(fitWidth(line, width) + ColorReset + screenEOL)
+	}
+	buf.WriteString(screenEOS)
+	os.Stdout.Write(buf.Bytes())
+}
+
+func (d *dashboard) connectionState(t *tunnel) string {
+	switch d.state[t] {
+	case EventRegistered:
+		return ColorGreen + "online" + ColorReset
+	case EventDisconnected:
+		return ColorYellow + "reconnecting" + ColorReset
+	}
+	return ColorDim + "connecting" + ColorReset
+}
+
+// One row of the request table
+func captureRow(c Capture) string {
+	status, duration, size := "...", "", ""
+	switch {
+	case c.Pending:
+	case c.Error != "":
+		status = ColorRed + "error " + ColorReset
+	default:
+		status = statusColor(c.Status) + fmt.Sprintf("%-6d", c.Status) + ColorReset
+	}
+	if !c.Pending {
+		duration = fmt.Sprintf("%.0fms", c.DurationMs)
+	}
+	if c.ResponseBody != nil {
+		size = formatBytes(int64(c.ResponseBody.Size))
+	} else if c.Streamed {
+		size = "streamed"
+	}
+	if len(status) == 3 {
+		status += "   "
+	}
+	return fmt.Sprintf("%-7s %s %9s %9s  %s", c.Method, status, duration, size, c.Path)
+}
+
+func statusColor(status int) string {
+	switch {
+	case status >= 500:
+		return ColorRed
+	case status >= 400:
+		return ColorYellow
+	case status >= 300:
+		return ColorCyan
+	}
+	return ColorGreen
+}
+
+// Headers and the start of the bodies of a request, as lines
+func captureDetails(c Capture) []string {
+	lines := []string{"", ColorBright + c.Method + " " + c.Path + ColorReset}
+	if c.Error != "" {
+		lines = append(lines, ColorRed+"Error: "+c.Error+ColorReset)
+	}
+	lines = append(lines, headerLines(c.RequestHeaders)...)
+	lines = append(lines, bodyPreview(c.RequestBody)...)
+	if c.Status != 0 {
+		lines = append(lines, "", ColorBright+fmt.Sprintf("%d", c.Status)+ColorReset)
+		lines = append(lines, headerLines(c.ResponseHeaders)...)
+		lines = append(lines, bodyPreview(c.ResponseBody)...)
+	}
+	return lines
+}
+
+func headerLines(headers HeaderMap) []string {
+	var lines []string
+	for _, h := range harHeaders(headers) {
+		lines = append(lines, ColorDim+h.Name+": "+ColorReset+h.Value)
+	}
+	return lines
+}
+
+// A few lines of a recorded body
+func bodyPreview(body *CapturedBody) []string {
+	const previewLines = 8
+	switch {
+	case body == nil:
+		return nil
+	case body.Binary:
+		return []string{ColorDim + fmt.Sprintf("(%s of %s)", formatBytes(int64(body.Size)), body.ContentType) + ColorReset}
+	}
+	lines := strings.Split(strings.TrimRight(body.Text, "\n"), "\n")
+	if len(lines) > previewLines {
+		lines = append(lines[:previewLines], ColorDim+"..."+ColorReset)
+	} else if body.Truncated {
+		lines = append(lines, ColorDim+fmt.Sprintf("... (%s in all)", formatBytes(int64(body.Size)))+ColorReset)
+	}
+	return append([]string{""}, lines...)
+}
+
+// Cut a line to width visible characters, leaving escape sequences whole
+func fitWidth(line string, width int) string {
+	var out strings.Builder
+	visible := 0
+	for i := 0; i < len(line); {
+		if line[i] == '\x1b' {
+			end := strings.IndexFunc(line[i+1:], func(r rune) bool { return r >= '@' && r <= '~' && r != '[' })
+			if end < 0 {
+				break
+			}
+			out.WriteString(line[i : i+end+2])
+			i += end + 2
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		if visible >= width {
+			i += size
+			continue
+		}
+		if r == '\t' || r < ' ' {
+			r = ' '
+		}
+		out.WriteRune(r)
+		visible++
+		i += size
+	}
+	return out.String()
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// CPU profile length taken by "comzy debug snapshot" by default
+const DefaultCPUProfile = 10 * time.Second
+
+// Add pprof and state endpoints to the inspector's mux. Only registered
+// with --debug-pprof; the inspector listens on loopback only.
+func registerDebugHandlers(mux *http.ServeMux, group *tunnelGroup, started time.Time) {
+	mux.Handle("/debug/pprof/", loopbackOnly(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", loopbackOnly(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", loopbackOnly(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", loopbackOnly(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", loopbackOnly(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("GET /debug/state", loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, debugState(group, started))
+	})))
+	mux.Handle("GET /debug/config", loopbackOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		for i, t := range group.tunnels {
+			if i > 0 {
+				fmt.Fprintln(w, "---")
+			}
+			// printConfig masks the token, credentials and proxy password
+			printConfig(w, t.opts)
+		}
+	})))
+}
+
+// Refuse requests addressed to anything but loopback, so a web page
+// can't reach the profiler through DNS rebinding
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !isLoopbackHost(strings.Trim(host, "[]")) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Snapshot of the running client for debugging
+func debugState(group *tunnelGroup, started time.Time) map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var tunnels []map[string]interface{}
+	for _, t := range group.tunnels {
+		state := map[string]interface{}{
+			"name":            t.opts.Name,
+			"target":          t.target.URL(""),
+			"activeRequests":  t.active.Load(),
+			"unknownMessages": t.unknown.count(),
+			"staleRequests":   t.target.staleRequests.Load(),
+			"connected":       false,
+		}
+		if backends := t.target.backends(); len(backends) > 1 {
+			served := map[string]int64{}
+			for _, b := range backends {
+				key := b.URL("")
+				if route := b.routeName(); route != "" {
+					key += " " + route
+				}
+				served[key] = b.served.Load()
+			}
+			state["backends"] = served
+		}
+		if endpoint := t.publicEndpoint(); endpoint != "" {
+			state["publicUrl"] = endpoint
+		}
+		t.mu.Lock()
+		if t.ws != nil {
+			state["connected"] = true
+			state["rttMs"] = t.ws.RTT().Milliseconds()
+		}
+		t.mu.Unlock()
+		tunnels = append(tunnels, state)
+	}
+
+	return map[string]interface{}{
+		"uptime":     time.Since(started).Round(time.Second).String(),
+		"goVersion":  runtime.Version(),
+		"os":         runtime.GOOS + "/" + runtime.GOARCH,
+		"goroutines": runtime.NumGoroutine(),
+		"heapAlloc":  ByteSize(mem.HeapAlloc).String(),
+		"sys":        ByteSize(mem.Sys).String(),
+		"numGC":      mem.NumGC,
+		"draining":   group.draining.Load(),
+		"tunnels":    tunnels,
+		"stats":      traffic.snapshot(),
+	}
+}
+
+// Handle "comzy debug snapshot": collect profiles and state from a running
+// client started with --debug-pprof into one archive
+func handleDebug(args []string) error {
+	if len(args) == 0 || args[0] != "snapshot" {
+		return fmt.Errorf("usage: comzy debug snapshot [--inspect-port PORT] [--output FILE] [--cpu DUR]")
+	}
+	fs := flag.NewFlagSet("debug snapshot", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.Int("inspect-port", DefaultInspectPort, "Port of the running inspector")
+	output := fs.String("output", "", "Archive to write (default: comzy-debug-TIME.tar.gz)")
+	cpu := fs.Duration("cpu", DefaultCPUProfile, "Length of the CPU profile")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+	if *output == "" {
+		*output = fmt.Sprintf("comzy-debug-%s.tar.gz", time.Now().Format("20060102-150405"))
+	}
+
+	base := fmt.Sprintf("http://127.0.0.1:%d", *port)
+	files := []struct {
+		name string
+		path string
+	}{
+		{"state.json", "/debug/state"},
+		{"config.yml", "/debug/config"},
+		{"goroutines.txt", "/debug/pprof/goroutine?debug=2"},
+		{"heap.pprof", "/debug/pprof/heap"},
+		{"cpu.pprof", fmt.Sprintf("/debug/pprof/profile?seconds=%d", max(int(cpu.Seconds()), 1))},
+	}
+
+	client := &http.Client{Timeout: *cpu + 30*time.Second}
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if f.name == "cpu.pprof" {
+			logInfo(fmt.Sprintf("Collecting a %s CPU profile...", *cpu))
+		}
+		data, err := fetchDebug(client, base+f.path)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, archive.Bytes(), 0600); err != nil {
+		return err
+	}
+	logSuccess(fmt.Sprintf("Debug snapshot written to %s", *output))
+	return nil
+}
+
+func fetchDebug(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("no running comzy inspector at %s (is a tunnel running?)", strings.SplitN(url, "/debug", 2)[0])
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("debug endpoints are disabled, restart the tunnel with --debug-pprof")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,280 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Portal API endpoint for the subdomains the account has reserved
+const DomainsURL = "https://api.comzy.io/v1/domains"
+
+// A subdomain reserved in the portal, which only its owner can register
+type reservedDomain struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+}
+
+// An error answer from the portal API, for people
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// Call the portal API with the stored token, decoding a JSON answer into
+// out unless it is nil. A rejected token is a *tokenRejectedError, and
+// other failures an *apiError with a readable message.
+func portalRequest(method, endpoint string, body, out interface{}) error {
+	token := getToken()
+	if token == "" {
+		return fmt.Errorf("this needs an authenticated session, use \"comzy login\" first")
+	}
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, endpoint, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := apiClient(VerifyTimeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach the portal API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Error answers are {"error": code, "message": text}, or not JSON at
+	// all from a proxy on the way
+	var failure struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if out == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("unexpected response from the portal API: %v", err)
+		}
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized:
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+		switch failure.Error {
+		case "expired", "revoked":
+			return &tokenRejectedError{reason: failure.Error}
+		}
+		return &tokenRejectedError{reason: "invalid"}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		message := "the portal API is rate limiting requests, try again"
+		if wait := resp.Header.Get("Retry-After"); wait != "" {
+			message += " in " + wait + "s"
+		} else {
+			message += " shortly"
+		}
+		return &apiError{resp.StatusCode, message}
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+	message := cmp.Or(failure.Message, failure.Error)
+	if message == "" {
+		message = fmt.Sprintf("the portal API answered %s", resp.Status)
+	}
+	return &apiError{resp.StatusCode, message}
+}
+
+// Run call, and when the portal rejects the token and there's a terminal
+// to ask on, offer to log in again and run it once more
+func withRelogin(call func() error) error {
+	err := call()
+	var rejected *tokenRejectedError
+	if !errors.As(err, &rejected) {
+		return err
+	}
+	// Logging in again wouldn't replace a token given by --token or in
+	// the environment
+	if _, source := activeToken(); source != userFile {
+		return fmt.Errorf("%w (from %s)", err, source)
+	}
+	if !stdinIsTerminal() {
+		return fmt.Errorf("%w, use \"comzy login\" to log in again", err)
+	}
+	logWarning(fmt.Sprintf("The portal says your %v", err))
+	fmt.Print("Log in again now? [y/N]: ")
+	answer, readErr := bufio.NewReader(os.Stdin).ReadString('\n')
+	if readErr != nil {
+		return err
+	}
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("%w, use \"comzy login\" to log in again", err)
+	}
+	token, readErr := readToken()
+	if readErr != nil {
+		return readErr
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return fmt.Errorf("no token given")
+	}
+	if err := saveLogin(token, false); err != nil {
+		return err
+	}
+	return call()
+}
+
+// Subdomains reserved by the account
+func fetchReservedDomains() ([]reservedDomain, error) {
+	var list struct {
+		Domains []reservedDomain `json:"domains"`
+	}
+	if err := portalRequest("GET", DomainsURL, nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Domains, nil
+}
+
+// Check, before registering, that an authenticated session owns the
+// --subdomain it asks for. If the portal can't say, the server decides.
+func checkSubdomainOwned(name string, log Logger) error {
+	domains, err := fetchReservedDomains()
+	var rejected *tokenRejectedError
+	switch {
+	case errors.As(err, &rejected):
+		return fmt.Errorf("could not check --subdomain %s: %w, use \"comzy login\" to log in again", name, err)
+	case err != nil:
+		log.Dim(fmt.Sprintf("Could not check that you own subdomain %q: %v", name, err))
+		return nil
+	}
+	var owned []string
+	for _, d := range domains {
+		if strings.EqualFold(d.Name, name) {
+			return nil
+		}
+		owned = append(owned, d.Name)
+	}
+	if len(owned) == 0 {
+		return fmt.Errorf("you don't own subdomain %q; reserve it first with \"comzy domains reserve %s\"", name, name)
+	}
+	return fmt.Errorf("you don't own subdomain %q (yours: %s); reserve it first with \"comzy domains reserve %s\"",
+		name, strings.Join(owned, ", "), name)
+}
+
+// Handle "comzy domains [list|reserve NAME|release NAME]": manage the
+// subdomains reserved in the portal
+func handleDomains(args []string) error {
+	fs := flag.NewFlagSet("domains", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	format := addListFlags(fs)
+	// Flags may come after the action, as in "comzy domains list --json"
+	var words []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	usage := &usageError{fmt.Errorf("Usage: comzy domains [list], comzy domains reserve <name> or comzy domains release <name>"), fs}
+
+	action := "list"
+	if len(words) > 0 {
+		action = words[0]
+	}
+	var name string
+	switch {
+	case action == "list" && len(words) <= 1:
+	case (action == "reserve" || action == "release") && len(words) == 2:
+		name = strings.ToLower(words[1])
+		if err := validateSubdomain(name); err != nil {
+			return err
+		}
+	default:
+		return usage
+	}
+
+	var domains []reservedDomain
+	var reserved reservedDomain
+	err := withRelogin(func() error {
+		var err error
+		switch action {
+		case "reserve":
+			err = portalRequest("POST", DomainsURL, map[string]string{"name": name}, &reserved)
+		case "release":
+			err = portalRequest("DELETE", DomainsURL+"/"+url.PathEscape(name), nil, nil)
+		default:
+			domains, err = fetchReservedDomains()
+		}
+		return err
+	})
+	var failed *apiError
+	switch {
+	case errors.As(err, &failed) && failed.status == http.StatusConflict:
+		return fmt.Errorf("subdomain %q is already taken", name)
+	case errors.As(err, &failed) && failed.status == http.StatusNotFound && action == "release":
+		return fmt.Errorf("you have no reserved subdomain %q", name)
+	case err != nil:
+		return err
+	}
+
+	switch action {
+	case "reserve":
+		reserved.Name = cmp.Or(reserved.Name, name)
+		if *asJSON {
+			return printJSON(reserved)
+		}
+		logSuccess(fmt.Sprintf("Reserved %s, use it with --subdomain %s", publicURL(reserved.Name), reserved.Name))
+		return nil
+	case "release":
+		if *asJSON {
+			return printJSON(map[string]string{"released": name})
+		}
+		logSuccess(fmt.Sprintf("Released %s", name))
+		return nil
+	}
+
+	if *asJSON {
+		if domains == nil {
+			domains = []reservedDomain{}
+		}
+		return printJSON(domains)
+	}
+	table := newListing("name", "url", "reserved")
+	for _, d := range domains {
+		created := ""
+		if !d.CreatedAt.IsZero() {
+			created = d.CreatedAt.Local().Format("2006-01-02")
+		}
+		table.add(d.Name, publicURL(d.Name), created)
+	}
+	if len(table.rows) == 0 && format.Format == FormatTable {
+		logDim("No reserved subdomains; reserve one with \"comzy domains reserve <name>\"")
+		return nil
+	}
+	return table.write(os.Stdout, format)
+}
@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Longest a test waits for the client to answer
+const edgeTimeout = 10 * time.Second
+
+// A stand-in for the tunnel server. It acknowledges every capability the
+// client announces and hands each registered connection to the test.
+type fakeEdge struct {
+	*httptest.Server
+	conns chan *edgeConn
+
+	// Called with each message the client sends before it is queued,
+	// e.g. to stall the connection; nil to read as fast as possible
+	onMessage func(message []byte)
+}
+
+func newFakeEdge(t *testing.T) *fakeEdge {
+	edge := &fakeEdge{conns: make(chan *edgeConn, 4)}
+	upgrader := websocket.Upgrader{}
+	edge.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		var register RegisterMessage
+		if err := ws.ReadJSON(&register); err != nil {
+			ws.Close()
+			return
+		}
+		c := &edgeConn{t: t, ws: ws, messages: make(chan edgeMessage, 64), held: map[string][]edgeMessage{}}
+		c.send(map[string]interface{}{"type": MsgRegistered, "alias": "test", "capabilities": register.Capabilities})
+		go c.readLoop(edge.onMessage)
+		edge.conns <- c
+	}))
+	t.Cleanup(edge.Close)
+	return edge
+}
+
+func (e *fakeEdge) wsURL() string {
+	return "ws" + strings.TrimPrefix(e.URL, "http")
+}
+
+// Wait for the client to register
+func (e *fakeEdge) accept(t *testing.T) *edgeConn {
+	t.Helper()
+	select {
+	case c := <-e.conns:
+		return c
+	case <-time.After(edgeTimeout):
+		t.Fatal("the client did not register")
+		return nil
+	}
+}
+
+// One registered client connection as the edge sees it
+type edgeConn struct {
+	t        *testing.T
+	ws       *websocket.Conn
+	writeMu  sync.Mutex
+	messages chan edgeMessage
+	held     map[string][]edgeMessage // read while waiting for another request
+}
+
+type edgeMessage struct {
+	ResponseFrame
+	Body   json.RawMessage `json:"body"`
+	Reason string          `json:"reason"` // of "ws-close"
+
+	at time.Time
+}
+
+func (c *edgeConn) readLoop(onMessage func([]byte)) {
+	defer close(c.messages)
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if onMessage != nil {
+			onMessage(data)
+		}
+		var m edgeMessage
+		if json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		m.at = time.Now()
+		c.messages <- m
+	}
+}
+
+func (c *edgeConn) send(v interface{}) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteJSON(v); err != nil {
+		c.t.Errorf("sending to the client: %v", err)
+	}
+}
+
+// Send a request whose body is given as raw bytes, as the edge does once
+// the client supports CapRawBody
+func (c *edgeConn) request(id int, method, path string, headers HeaderMap, body []byte) {
+	message := map[string]interface{}{"type": MsgRequest, "id": id, "method": method, "path": path, "headers": headers}
+	if body != nil {
+		message["rawBody"] = base64.StdEncoding.EncodeToString(body)
+	}
+	c.send(message)
+}
+
+// A response put back together from what the client sent
+type edgeResponse struct {
+	Status   int
+	Headers  HeaderMap
+	Body     []byte
+	Streamed bool
+	Error    string // of "response-end"
+
+	// When each body chunk arrived, and when the response was complete
+	chunkTimes []time.Time
+	finished   time.Time
+}
+
+// Read the response to request id and the size of its body. With discard
+// the body is only counted, so huge bodies aren't held by the test.
+func (c *edgeConn) response(id int, discard bool) (*edgeResponse, int64) {
+	c.t.Helper()
+	resp := &edgeResponse{}
+	var size int64
+	deadline := time.After(edgeTimeout)
+	for {
+		m := c.next(id, deadline)
+		switch m.Type {
+		case "response-start":
+			resp.Status, resp.Headers, resp.Streamed = m.Status, m.Headers, true
+		case "response-chunk":
+			data, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				c.t.Fatalf("bad chunk: %v", err)
+			}
+			size += int64(len(data))
+			if !discard {
+				resp.Body = append(resp.Body, data...)
+			}
+			resp.chunkTimes = append(resp.chunkTimes, m.at)
+		case "response-end":
+			resp.Error, resp.finished = m.Error, m.at
+			return resp, size
+		case "":
+			resp.Status, resp.Headers, resp.finished = m.Status, m.Headers, m.at
+			resp.Body = singleMessageBody(c.t, m.Body)
+			return resp, int64(len(resp.Body))
+		}
+	}
+}
+
+// Next message the client sent about request id
+func (c *edgeConn) next(id int, deadline <-chan time.Time) edgeMessage {
+	c.t.Helper()
+	key := strconv.Itoa(id)
+	if held := c.held[key]; len(held) > 0 {
+		c.held[key] = held[1:]
+		return held[0]
+	}
+	for {
+		select {
+		case m, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed while waiting for request %d", id)
+			}
+			if m.ID.String() == key {
+				return m
+			}
+			c.held[m.ID.String()] = append(c.held[m.ID.String()], m)
+		case <-deadline:
+			c.t.Fatalf("nothing more about request %d within %s", id, edgeTimeout)
+		}
+	}
+}
+
+// Bytes of the body of a single-message response: a string, base64 data
+// of a binary one, or re-encoded JSON
+func singleMessageBody(t *testing.T, raw json.RawMessage) []byte {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return []byte(text)
+	}
+	var binary BinaryResponse
+	if json.Unmarshal(raw, &binary) == nil && binary.Type == "binary" {
+		data, err := base64.StdEncoding.DecodeString(binary.Data)
+		if err != nil {
+			t.Fatalf("bad binary body: %v", err)
+		}
+		return data
+	}
+	return raw
+}
+
+// Start a tunnel to the local server at addr through edge, with further
+// command line options, and wait for it to register. It is closed when
+// the test ends.
+func startEdgeTunnel(t *testing.T, edge *fakeEdge, addr string, args ...string) *edgeConn {
+	t.Helper()
+	saved, savedUser := comzyDir, userFile
+	comzyDir = t.TempDir()
+	userFile = comzyDir + "/.user"
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(addr, "http://"))
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("bad local address %q", addr)
+	}
+	tun, err := New(Config{Port: n, Host: host, Token: "test-token-0123456789", ServerURL: edge.wsURL(), Args: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		tun.Start(context.Background())
+		close(done)
+	}()
+	t.Cleanup(func() {
+		tun.group.stop(ErrClosed)
+		<-done
+		comzyDir, userFile = saved, savedUser
+		inspector = nil
+	})
+	return edge.accept(t)
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error codes in JSON error responses, telling tunnel failures apart from
+// errors the app itself returned
+const (
+	CodeUpstreamUnreachable = "tunnel_upstream_unreachable"
+	CodeUpstreamTimeout     = "tunnel_upstream_timeout"
+	CodeUpstreamError       = "tunnel_upstream_error"
+	CodeRequestTooOld       = "request_too_old"
+	CodePlanLimit           = "tunnel_plan_limit"
+	CodeBodyTooLarge        = "request_too_large"
+	CodePaused              = "tunnel_paused"
+	CodeBudgetSpent         = "tunnel_budget_exceeded"
+)
+
+// Requests refused without dialing because the target is known to be down
+var errTargetDown = errors.New("local target is not accepting connections yet")
+
+// What to tell the remote client about a request the tunnel couldn't serve
+type errorReply struct {
+	status  int
+	title   string
+	code    string
+	message string // for people, on the HTML page and in JSON
+	fields  map[string]interface{}
+	refresh bool // the page should reload, as the problem may pass
+}
+
+// Describe err for the client, logging it as the old handler did
+func classifyError(ws *tunnelConn, err error, target *localTarget) errorReply {
+	addr := target.Describe()
+	var limit *limitError
+	var stale *staleError
+	var timeout *timeoutError
+	var tooLarge *bodyTooLargeError
+	switch {
+	case errors.As(err, &limit):
+		ws.log.Warning(limit.Error())
+		return errorReply{status: limit.status, title: http.StatusText(limit.status), code: CodePlanLimit, message: limit.message}
+	case errors.As(err, &tooLarge):
+		return errorReply{status: 413, title: "Payload Too Large", code: CodeBodyTooLarge,
+			message: "The request body is larger than this tunnel accepts.",
+			fields:  map[string]interface{}{"maxBytes": tooLarge.limit}}
+	case err == errPaused:
+		return errorReply{status: 503, title: "Service Unavailable", code: CodePaused,
+			message: "This tunnel has been paused by its operator and will be back shortly.", refresh: true}
+	case err == errBudgetSpent:
+		return errorReply{status: 503, title: "Service Unavailable", code: CodeBudgetSpent,
+			message: "This tunnel has used up the bandwidth its operator allowed it and is paused."}
+	case errors.As(err, &stale):
+		return errorReply{status: 408, title: "Request Timeout", code: CodeRequestTooOld,
+			message: "The request took too long to reach this machine and was not forwarded.",
+			fields:  map[string]interface{}{"ageMs": stale.age.Milliseconds(), "maxAgeMs": stale.maxAge.Milliseconds()}}
+	case errors.As(err, &timeout):
+		ws.log.Warning(timeout.Error())
+		return errorReply{status: 504, title: "Gateway Timeout", code: CodeUpstreamTimeout,
+			message: fmt.Sprintf("The tunnel is up, but %s did not respond within %s.", timeout.target, timeout.limit),
+			fields:  map[string]interface{}{"target": timeout.target, "elapsedMs": timeout.elapsed.Milliseconds()}}
+	case err == errTargetDown || isDialError(err):
+		return errorReply{status: 502, title: "Bad Gateway", code: CodeUpstreamUnreachable,
+			message: fmt.Sprintf("The tunnel is up, but %s refused the connection. Is the app running?", addr),
+			fields:  map[string]interface{}{"target": addr}, refresh: true}
+	default:
+		ws.log.Error(fmt.Sprintf("Proxy error: %v", err))
+		return errorReply{status: 502, title: "Bad Gateway", code: CodeUpstreamError,
+			message: fmt.Sprintf("The tunnel is up, but the request to %s failed.", addr),
+			fields:  map[string]interface{}{"target": addr}}
+	}
+}
+
+// Whether the remote client would rather read a page than JSON
+func wantsHTML(headers HeaderMap) bool {
+	return strings.Contains(strings.ToLower(headers.Get("accept")), "text/html")
+}
+
+// Check an --error-page file, which must be readable
+func validateErrorPage(path string) error {
+	if _, err := os.ReadFile(path); err != nil {
+		return fmt.Errorf("--error-page: %v", err)
+	}
+	return nil
+}
+
+// Page shown when --error-page isn't set. An --error-page file may use the
+// same {{placeholders}}; their values are HTML-escaped.
+const defaultErrorPage = `<!doctype html>
+<html><head><meta charset="utf-8">{{refresh}}
+<title>{{status}} {{title}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:36em;margin:4em auto;padding:0 1em;color:#222}
+h1{font-size:1.4em}.dim{color:#888;font-size:.9em}</style></head>
+<body><h1>{{status}} {{title}}</h1>
+<p>{{message}}</p>
+<p class="dim">Comzy tunnel {{alias}} · {{time}}</p></body></html>
+`
+
+// Fill in an error page
+func renderErrorPage(page string, reply errorReply, alias string, now time.Time) string {
+	refresh, message := "", reply.message
+	if reply.refresh {
+		refresh = `<meta http-equiv="refresh" content="2">`
+		message += " This page reloads by itself until it is."
+	}
+	return strings.NewReplacer(
+		"{{refresh}}", refresh,
+		"{{status}}", strconv.Itoa(reply.status),
+		"{{title}}", html.EscapeString(reply.title),
+		"{{message}}", html.EscapeString(message),
+		"{{code}}", html.EscapeString(reply.code),
+		"{{alias}}", html.EscapeString(alias),
+		"{{time}}", now.UTC().Format(time.RFC1123),
+	).Replace(page)
+}
+
+// Error page for a target: the --error-page file, or the built-in one if
+// none was given or it can no longer be read
+func (t *localTarget) errorPageHTML() string {
+	if t.errorPage != "" {
+		if page, err := os.ReadFile(t.errorPage); err == nil {
+			return string(page)
+		}
+	}
+	return defaultErrorPage
+}
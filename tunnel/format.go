@@ -0,0 +1,286 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats shared by every listing command
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatYAML  = "yaml"
+	FormatTSV   = "tsv"
+)
+
+// Narrowest a column is truncated to when a table doesn't fit the terminal
+const minColumnWidth = 8
+
+// Listing options, registered on a command's flag set with addListFlags
+type listOptions struct {
+	Format   string
+	NoHeader bool
+	Columns  string
+}
+
+func addListFlags(fs *flag.FlagSet) *listOptions {
+	l := &listOptions{}
+	fs.StringVar(&l.Format, "format", FormatTable, "Output format: table, json, yaml or tsv")
+	fs.BoolVar(&l.NoHeader, "no-header", false, "Omit the header row of table and tsv output")
+	fs.StringVar(&l.Columns, "columns", "", "Comma-separated columns to show")
+	return l
+}
+
+// A listing is a set of rows with named columns, in display order
+type listing struct {
+	columns []string
+	rows    [][]string
+}
+
+func newListing(columns ...string) *listing {
+	return &listing{columns: columns}
+}
+
+// Add a row, one value per column
+func (l *listing) add(values ...string) {
+	l.rows = append(l.rows, values)
+}
+
+// Write the listing to w as requested by opts
+func (l *listing) write(w io.Writer, opts *listOptions) error {
+	columns, err := l.selectColumns(opts.Columns)
+	if err != nil {
+		return err
+	}
+	switch opts.Format {
+	case FormatTable:
+		return l.writeTable(w, columns, !opts.NoHeader, terminalWidth(w))
+	case FormatTSV:
+		return l.writeTSV(w, columns, !opts.NoHeader)
+	case FormatJSON:
+		return l.writeJSON(w, columns)
+	case FormatYAML:
+		return l.writeYAML(w, columns)
+	}
+	return fmt.Errorf("unknown format %q (use table, json, yaml or tsv)", opts.Format)
+}
+
+// Indexes of the requested columns, or of all of them
+func (l *listing) selectColumns(spec string) ([]int, error) {
+	if spec == "" {
+		all := make([]int, len(l.columns))
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+	var selected []int
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for i, column := range l.columns {
+			if column == name {
+				selected = append(selected, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q (available: %s)", name, strings.Join(l.columns, ", "))
+		}
+	}
+	return selected, nil
+}
+
+// Aligned columns. When writing to a terminal narrower than the table,
+// the widest columns are truncated; piped output always keeps full values.
+func (l *listing) writeTable(w io.Writer, columns []int, header bool, width int) error {
+	const gap = 3
+	widths := make([]int, len(columns))
+	measure := func(row []string) {
+		for i, c := range columns {
+			widths[i] = max(widths[i], len([]rune(row[c])))
+		}
+	}
+	if header {
+		measure(l.columns)
+	}
+	for _, row := range l.rows {
+		measure(row)
+	}
+
+	if width > 0 {
+		total := func() int {
+			sum := gap * (len(widths) - 1)
+			for _, n := range widths {
+				sum += n
+			}
+			return sum
+		}
+		for total() > width {
+			widest := 0
+			for i := range widths {
+				if widths[i] > widths[widest] {
+					widest = i
+				}
+			}
+			if widths[widest] <= minColumnWidth {
+				break
+			}
+			widths[widest]--
+		}
+	}
+
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, gap, ' ', 0)
+	writeRow := func(row []string) {
+		cells := make([]string, len(columns))
+		for i, c := range columns {
+			cells[i] = truncate(row[c], widths[i])
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	if header {
+		upper := make([]string, len(l.columns))
+		for i, name := range l.columns {
+			upper[i] = strings.ToUpper(name)
+		}
+		writeRow(upper)
+	}
+	for _, row := range l.rows {
+		writeRow(row)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Padding after an empty last cell is noise
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shorten s to n runes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:n])
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// Tab-separated values, with tabs and newlines inside values escaped
+func (l *listing) writeTSV(w io.Writer, columns []int, header bool) error {
+	escape := strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n")
+	writeRow := func(row []string) error {
+		cells := make([]string, len(columns))
+		for i, c := range columns {
+			cells[i] = escape.Replace(row[c])
+		}
+		_, err := fmt.Fprintln(w, strings.Join(cells, "\t"))
+		return err
+	}
+	if header {
+		if err := writeRow(l.columns); err != nil {
+			return err
+		}
+	}
+	for _, row := range l.rows {
+		if err := writeRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Array of objects with keys in column order
+func (l *listing) writeJSON(w io.Writer, columns []int) error {
+	var b strings.Builder
+	b.WriteString("[")
+	for r, row := range l.rows {
+		if r > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n  {")
+		for i, c := range columns {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			key, _ := json.Marshal(l.columns[c])
+			value, _ := json.Marshal(row[c])
+			fmt.Fprintf(&b, "%s: %s", key, value)
+		}
+		b.WriteString("}")
+	}
+	if len(l.rows) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("]\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Sequence of mappings with keys in column order
+func (l *listing) writeYAML(w io.Writer, columns []int) error {
+	seq := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, row := range l.rows {
+		m := &yaml.Node{Kind: yaml.MappingNode}
+		for _, c := range columns {
+			m.Content = append(m.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: l.columns[c]},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: row[c]})
+		}
+		seq.Content = append(seq.Content, m)
+	}
+	if len(seq.Content) == 0 {
+		_, err := io.WriteString(w, "[]\n")
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(seq); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Width of the terminal w writes to, 0 when it isn't a terminal
+func terminalWidth(w io.Writer) int {
+	f, ok := w.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return 0
+	}
+	width, _, err := term.GetSize(int(f.Fd()))
+	if err != nil {
+		return 0
+	}
+	return width
+}
+
+// Write v to stdout as indented JSON
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
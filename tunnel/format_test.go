@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Compare got with testdata/name, or rewrite it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs:\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+func TestTunnelsListingGolden(t *testing.T) {
+	for _, format := range []string{FormatTable, FormatJSON, FormatTSV} {
+		t.Run(format, func(t *testing.T) {
+			out := captureStdout(t, filepath.Join(t.TempDir(), "out"), func() {
+				if err := handleTunnels([]string{"--config", "testdata/tunnels.yml", "--format", format}); err != nil {
+					t.Error(err)
+				}
+			})
+			checkGolden(t, "tunnels."+format, out)
+		})
+	}
+}
+
+func TestRegionsListingGolden(t *testing.T) {
+	regions := []*regionEdge{
+		{Name: "eu-west", Host: "eu-west.comzy.io", latency: 18 * time.Millisecond},
+		{Name: "us-east", Host: "us-east.comzy.io", latency: 92 * time.Millisecond},
+		{Name: "ap-southeast", Host: "ap-southeast.comzy.io:8443", err: errors.New("timeout")},
+	}
+	for _, format := range []string{FormatTable, FormatJSON, FormatTSV} {
+		t.Run(format, func(t *testing.T) {
+			out := captureStdout(t, filepath.Join(t.TempDir(), "out"), func() {
+				if err := regionListing(regions).write(os.Stdout, &listOptions{Format: format}); err != nil {
+					t.Error(err)
+				}
+			})
+			checkGolden(t, "regions."+format, out)
+		})
+	}
+}
+
+// Header and column options apply to every format alike
+func TestListingOptionsGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts listOptions
+	}{
+		{"no-header.table", listOptions{Format: FormatTable, NoHeader: true}},
+		{"no-header.tsv", listOptions{Format: FormatTSV, NoHeader: true}},
+		{"columns.table", listOptions{Format: FormatTable, Columns: "latency,region"}},
+		{"columns.json", listOptions{Format: FormatJSON, Columns: "latency,region"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			table := newListing("region", "host", "latency")
+			table.add("eu-west", "eu-west.comzy.io", "18ms")
+			table.add("us-east", "us-east.comzy.io", "92ms")
+			out := captureStdout(t, filepath.Join(t.TempDir(), "out"), func() {
+				if err := table.write(os.Stdout, &tc.opts); err != nil {
+					t.Error(err)
+				}
+			})
+			checkGolden(t, "regions."+tc.name, out)
+		})
+	}
+}
+
+// A table wider than the terminal has its widest columns cut
+func TestNarrowTerminalTableGolden(t *testing.T) {
+	table := newListing("name", "url", "local")
+	table.add("api", "https://acme-api-staging.comzy.io", "http://localhost:8080/v1")
+	table.add("docs", "https://acme-docs.comzy.io", "http://192.168.1.20:4000")
+	var out strings.Builder
+	if err := table.writeTable(&out, []int{0, 1, 2}, true, 48); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "narrow.table", out.String())
+}
@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Header families added to requests for the local app
+const (
+	ForwardedXFF     = "xff"     // X-Forwarded-Proto and X-Forwarded-Host
+	ForwardedRFC7239 = "rfc7239" // Forwarded
+	ForwardedBoth    = "both"
+	ForwardedNone    = "none"
+)
+
+func validateForwardedMode(mode string) error {
+	switch mode {
+	case ForwardedXFF, ForwardedRFC7239, ForwardedBoth, ForwardedNone:
+		return nil
+	}
+	return fmt.Errorf("invalid --forwarded-headers %q (use xff, rfc7239, both or none)", mode)
+}
+
+// Record the public hostname the tunnel was registered under
+func (c *tunnelConn) setPublicHost(host string) {
+	c.publicHost.Store(host)
+}
+
+func (c *tunnelConn) getPublicHost() string {
+	host, _ := c.publicHost.Load().(string)
+	return host
+}
+
+// Describe the tunnel hop to the local app. X-Forwarded-For keeps what
+// the edge sent, gaining the client address only if the edge left it out.
+func addForwardedHeaders(dst http.Header, incoming HeaderMap, mode, publicHost string) {
+	if mode == ForwardedXFF || mode == ForwardedBoth {
+		if ip, ok := clientIP(incoming); ok {
+			if entries := dst.Values("X-Forwarded-For"); len(entries) == 0 {
+				dst.Set("X-Forwarded-For", ip.String())
+			} else if last, _ := clientIP(HeaderMap{"x-forwarded-for": entries}); last != ip {
+				dst.Set("X-Forwarded-For", strings.Join(entries, ", ")+", "+ip.String())
+			}
+			dst.Set("X-Real-IP", ip.String())
+		}
+		if dst.Get("X-Forwarded-Proto") == "" {
+			dst.Set("X-Forwarded-Proto", "https")
+		}
+		if dst.Get("X-Forwarded-Host") == "" && publicHost != "" {
+			dst.Set("X-Forwarded-Host", publicHost)
+		}
+	}
+	if mode == ForwardedRFC7239 || mode == ForwardedBoth {
+		ip, ok := clientIP(incoming)
+		element := forwardedElement(ip, ok, publicHost)
+		var chain []string
+		for _, existing := range dst.Values("Forwarded") {
+			// A malformed chain would make the whole header unusable
+			if validForwarded(existing) {
+				chain = append(chain, existing)
+			}
+		}
+		chain = append(chain, element)
+		dst.Set("Forwarded", strings.Join(chain, ", "))
+	}
+}
+
+// One Forwarded element for this hop, as in RFC 7239 section 4
+func forwardedElement(ip netip.Addr, ok bool, host string) string {
+	node := "unknown"
+	if ok && ip.Is6() {
+		node = `"[` + ip.String() + `]"`
+	} else if ok {
+		node = ip.String()
+	}
+	element := "for=" + node + ";proto=https"
+	if host != "" {
+		element += ";host=" + forwardedValue(host)
+	}
+	return element
+}
+
+// Headers --no-proxy-headers keeps from the local app, the edge's included
+var proxyHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Real-IP"}
+
+func removeProxyHeaders(dst http.Header) {
+	for _, name := range proxyHeaders {
+		dst.Del(name)
+	}
+}
+
+// ID the local app sees in X-Request-Id: the client's own, or else the
+// tunnel's ID for the request, as shown in the inspector
+func requestIDFor(request IncomingRequest) string {
+	if id := request.Headers.Get("x-request-id"); id != "" {
+		return id
+	}
+	return request.ID.String()
+}
+
+// A value as a token, or a quoted string if it has other characters
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !isTokenChar(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// RFC 7230 tchar
+func isTokenChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// Check a Forwarded header value: comma-separated elements of
+// semicolon-separated token=value pairs, values being tokens or quoted strings
+func validForwarded(v string) bool {
+	s := strings.TrimSpace(v)
+	if s == "" {
+		return false
+	}
+	for {
+		// token
+		i := 0
+		for i < len(s) && isTokenChar(rune(s[i])) {
+			i++
+		}
+		if i == 0 || i >= len(s) || s[i] != '=' {
+			return false
+		}
+		s = s[i+1:]
+
+		// value
+		if strings.HasPrefix(s, `"`) {
+			j, escaped := 1, false
+			for ; j < len(s); j++ {
+				if escaped {
+					escaped = false
+				} else if s[j] == '\\' {
+					escaped = true
+				} else if s[j] == '"' {
+					break
+				}
+			}
+			if j >= len(s) {
+				return false
+			}
+			s = s[j+1:]
+		} else {
+			j := 0
+			for j < len(s) && isTokenChar(rune(s[j])) {
+				j++
+			}
+			if j == 0 {
+				return false
+			}
+			s = s[j:]
+		}
+
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return true
+		}
+		if s[0] != ';' && s[0] != ',' {
+			return false
+		}
+		s = strings.TrimLeft(s[1:], " \t")
+	}
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidForwarded(t *testing.T) {
+	for value, want := range map[string]bool{
+		`for=192.0.2.60;proto=http;by=203.0.113.43`: true,
+		`for="[2001:db8:cafe::17]:4711"`:            true,
+		`for=192.0.2.43, for=198.51.100.17`:         true,
+		`for="_gazonk"; proto=https`:                true,
+		`for="quoted \"escape\""`:                   true,
+		``:                                          false,
+		`   `:                                       false,
+		`for`:                                       false,
+		`for=`:                                      false,
+		`=192.0.2.60`:                               false,
+		`for="unterminated`:                         false,
+		`for=192.0.2.60;`:                           false,
+		`for=192.0.2.60,,for=198.51.100.17`:         false,
+		`for=[2001:db8::1]`:                         false, // brackets must be quoted
+		`for=192.0.2.60 proto=http`:                 false,
+		`for=a=b`:                                   false,
+		"for=192.0.2.60\x00":                        false,
+	} {
+		if got := validForwarded(value); got != want {
+			t.Errorf("validForwarded(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+// Malformed Forwarded values from the client are dropped and valid ones
+// kept ahead of this hop's element
+func TestForwardedChainWithMalformedValues(t *testing.T) {
+	incoming := HeaderMap{"x-forwarded-for": {"198.51.100.7, 2001:db8::1"}}
+	dst := http.Header{}
+	dst.Add("Forwarded", `for=192.0.2.60;proto=http`)
+	dst.Add("Forwarded", `for="unterminated`)
+	dst.Add("Forwarded", `garbage`)
+	dst.Add("Forwarded", `for=192.0.2.61, for=`)
+	dst.Add("Forwarded", `for="[2001:db8:cafe::17]"`)
+
+	addForwardedHeaders(dst, incoming, ForwardedRFC7239, "app.comzy.io")
+
+	want := `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]", for="[2001:db8::1]";proto=https;host=app.comzy.io`
+	if got := dst.Values("Forwarded"); len(got) != 1 || got[0] != want {
+		t.Errorf("Forwarded = %q\nwant %q", got, want)
+	}
+	if !validForwarded(dst.Get("Forwarded")) {
+		t.Errorf("the resulting chain is not valid: %q", dst.Get("Forwarded"))
+	}
+	if dst.Get("X-Forwarded-Proto") != "" {
+		t.Error("rfc7239 mode added X-Forwarded-Proto")
+	}
+}
+
+func TestForwardedElementWithoutClientIP(t *testing.T) {
+	dst := http.Header{}
+	dst.Set("Forwarded", "for=;;")
+	addForwardedHeaders(dst, HeaderMap{"x-forwarded-for": {"not an address"}}, ForwardedBoth, "")
+
+	if got := dst.Get("Forwarded"); got != "for=unknown;proto=https" {
+		t.Errorf("Forwarded = %q", got)
+	}
+	if got := dst.Get("X-Forwarded-For"); got != "" {
+		t.Errorf("X-Forwarded-For = %q with no client address", got)
+	}
+	if got := dst.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+}
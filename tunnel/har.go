@@ -0,0 +1,351 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats of --capture files
+const (
+	CaptureFormatHAR    = "har"    // one HAR 1.2 document, valid after every entry
+	CaptureFormatNDJSON = "ndjson" // one HAR entry per line
+)
+
+// Default for --capture-body-limit
+const DefaultCaptureBodyLimit = 1 << 20
+
+func validateCaptureFormat(format string) error {
+	if format != CaptureFormatHAR && format != CaptureFormatNDJSON {
+		return fmt.Errorf("invalid --capture-format %q (use har or ndjson)", format)
+	}
+	return nil
+}
+
+// HAR 1.2 structures, as far as comzy fills them in. Fields starting with
+// an underscore are custom ones, which the spec allows.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Tunnel          string      `json:"_tunnel,omitempty"`
+	RequestID       MessageID   `json:"_requestId,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType  string `json:"mimeType"`
+	Text      string `json:"text"`
+	Encoding  string `json:"_encoding,omitempty"` // base64 for binary bodies
+	Truncated bool   `json:"_truncated,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Process-wide --capture file, nil when not capturing
+var captureLog *captureWriter
+
+// Appends exchanges to a --capture file as they finish. Each entry is
+// written straight to the file, and a HAR document is closed again after
+// every entry, so the file stays complete if comzy is killed.
+type captureWriter struct {
+	mu        sync.Mutex
+	file      *os.File
+	format    string
+	bodyLimit int64
+	end       int64 // where the next HAR entry goes, before the closing brackets
+	entries   int
+	failed    bool
+}
+
+// The tail rewritten after every HAR entry
+const harClose = "\n]}}\n"
+
+// Create or truncate path for captures in format
+func openCaptureFile(path, format string, bodyLimit ByteSize) (*captureWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &captureWriter{file: file, format: format, bodyLimit: int64(bodyLimit)}
+	if format == CaptureFormatHAR {
+		head, _ := json.Marshal(harCreator{Name: "comzy", Version: Version})
+		start := fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, head)
+		if _, err := file.WriteString(start + harClose); err != nil {
+			file.Close()
+			return nil, err
+		}
+		w.end = int64(len(start))
+	}
+	return w, nil
+}
+
+func (w *captureWriter) write(entry *harEntry) {
+	data, err := json.Marshal(entry)
+	if err == nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.format == CaptureFormatNDJSON {
+			_, err = w.file.Write(append(data, '\n'))
+		} else {
+			sep := "\n"
+			if w.entries > 0 {
+				sep = ",\n"
+			}
+			record := append([]byte(sep), data...)
+			if _, err = w.file.WriteAt(append(record, harClose...), w.end); err == nil {
+				w.end += int64(len(record))
+				w.entries++
+			}
+		}
+	}
+	if err != nil && !w.failed {
+		w.failed = true
+		logWarning(fmt.Sprintf("Could not write to the capture file: %v", err))
+	}
+}
+
+// One request on its way to the local app, written to the capture file
+// once it has an outcome
+type capturedExchange struct {
+	writer      *captureWriter
+	entry       harEntry
+	started     time.Time
+	respondedAt time.Time
+}
+
+// Start recording a request forwarded to target. The headers recorded are
+// those of sent, the request built for the local app, so a rebuilt body
+// keeps its Content-Type; sent is nil if it couldn't be built. body is nil
+// when it was streamed instead of kept. Safe to call on a nil writer.
+func (w *captureWriter) begin(target *localTarget, request IncomingRequest, sent *http.Request, publicHost string, body []byte) *capturedExchange {
+	if w == nil {
+		return nil
+	}
+	headers := request.Headers
+	if sent != nil {
+		headers = headerMapFrom(sent.Header)
+	}
+	x := &capturedExchange{writer: w, started: time.Now()}
+	u := &url.URL{Scheme: "https", Host: publicHost}
+	if parsed, err := url.ParseRequestURI(request.Path); err == nil {
+		u.Path, u.RawPath, u.RawQuery = parsed.Path, parsed.RawPath, parsed.RawQuery
+	}
+	x.entry = harEntry{
+		StartedDateTime: x.started,
+		Tunnel:          target.Tag,
+		RequestID:       request.ID,
+		Request: harRequest{
+			Method:      request.Method,
+			URL:         u.String(),
+			HTTPVersion: "HTTP/1.1",
+			Cookies:     harCookies((&http.Request{Header: httpHeader(headers)}).Cookies()),
+			Headers:     harHeaders(headers),
+			QueryString: harQuery(u.Query()),
+			HeadersSize: -1,
+			BodySize:    int64(len(body)),
+		},
+	}
+	if size := request.bodySize(); body == nil && size > 0 {
+		x.entry.Request.BodySize = size
+		x.entry.Request.PostData = &harPostData{
+			MimeType:  headers.Get("content-type"),
+			Truncated: true,
+			Comment:   "streamed to the local app, not recorded",
+		}
+	} else if len(body) > 0 {
+		x.entry.Request.PostData = w.postData(body, headers.Get("content-type"))
+	}
+	return x
+}
+
+// Mark the arrival of the response headers, for the timings
+func (x *capturedExchange) responded() {
+	if x != nil {
+		x.respondedAt = time.Now()
+	}
+}
+
+// Record the response sent back
+func (x *capturedExchange) finish(status int, headers HeaderMap, body []byte) {
+	if x == nil {
+		return
+	}
+	x.entry.Response = x.response(status, headers)
+	x.entry.Response.BodySize = int64(len(body))
+	x.entry.Response.Content = x.writer.content(body, headers)
+	x.write()
+}
+
+// Record a response whose body was streamed, not kept
+func (x *capturedExchange) finishStream(status int, headers HeaderMap) {
+	if x == nil {
+		return
+	}
+	x.entry.Response = x.response(status, headers)
+	x.entry.Response.BodySize = -1
+	x.entry.Response.Content = harContent{Size: -1, MimeType: headers.Get("content-type"), Comment: "streamed, not recorded"}
+	x.write()
+}
+
+// Record a request that never got a response from the local app
+func (x *capturedExchange) fail(err error) {
+	if x == nil {
+		return
+	}
+	x.entry.Error = err.Error()
+	x.entry.Response = harResponse{HTTPVersion: "HTTP/1.1", Cookies: []harCookie{}, Headers: []harNameValue{}, HeadersSize: -1, BodySize: -1}
+	x.write()
+}
+
+func (x *capturedExchange) response(status int, headers HeaderMap) harResponse {
+	return harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     harCookies((&http.Response{Header: httpHeader(headers)}).Cookies()),
+		Headers:     harHeaders(headers),
+		RedirectURL: headers.Get("location"),
+		HeadersSize: -1,
+	}
+}
+
+func (x *capturedExchange) write() {
+	now := time.Now()
+	x.entry.Time = milliseconds(now.Sub(x.started))
+	if x.respondedAt.IsZero() {
+		x.entry.Timings.Wait = x.entry.Time
+	} else {
+		x.entry.Timings.Wait = milliseconds(x.respondedAt.Sub(x.started))
+		x.entry.Timings.Receive = milliseconds(now.Sub(x.respondedAt))
+	}
+	x.writer.write(&x.entry)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Body text for the capture, base64 encoded when it isn't text and cut at
+// --capture-body-limit
+func (w *captureWriter) encodeBody(data []byte, contentType string, binary bool) (text, encoding, comment string) {
+	if w.bodyLimit > 0 && int64(len(data)) > w.bodyLimit {
+		comment = fmt.Sprintf("truncated to %s of %s", ByteSize(w.bodyLimit), ByteSize(len(data)))
+		data = data[:w.bodyLimit]
+	}
+	if binary || isBinaryContentType(contentType) || !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), "base64", comment
+	}
+	return string(data), "", comment
+}
+
+func (w *captureWriter) postData(body []byte, contentType string) *harPostData {
+	text, encoding, comment := w.encodeBody(body, contentType, false)
+	return &harPostData{MimeType: contentType, Text: text, Encoding: encoding, Truncated: comment != "", Comment: comment}
+}
+
+func (w *captureWriter) content(body []byte, headers HeaderMap) harContent {
+	contentType := headers.Get("content-type")
+	text, encoding, comment := w.encodeBody(body, contentType, isEncoded(headers))
+	return harContent{Size: int64(len(body)), MimeType: contentType, Text: text, Encoding: encoding, Comment: comment}
+}
+
+func httpHeader(headers HeaderMap) http.Header {
+	h := make(http.Header, len(headers))
+	for key, values := range headers {
+		h[http.CanonicalHeaderKey(key)] = values
+	}
+	return h
+}
+
+// Headers as HAR name/value pairs, sorted by name
+func harHeaders(headers HeaderMap) []harNameValue {
+	pairs := []harNameValue{}
+	for name, values := range headers {
+		for _, value := range values {
+			pairs = append(pairs, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].Name < pairs[j].Name })
+	return pairs
+}
+
+func harQuery(query url.Values) []harNameValue {
+	return harHeaders(HeaderMap(query))
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	list := []harCookie{}
+	for _, c := range cookies {
+		list = append(list, harCookie{Name: c.Name, Value: c.Value})
+	}
+	return list
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// HeaderMap carries headers that may have several values per key.
+// Single values serialize as plain strings so older servers keep working;
+// repeated headers (e.g. Set-Cookie) serialize as arrays.
+type HeaderMap map[string][]string
+
+// Headers managed by the tunnel rather than copied between hops: those
+// that only concern one connection (RFC 9110, section 7.6.1) and those
+// framing the body. Each hop has its own connection, and bodies may be
+// rebuilt on the way, so net/http and the edge frame what they actually
+// send. Content-Length is dropped as well, except on streamed responses
+// whose bytes pass through unchanged.
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// Remove the hop-by-hop headers, and any others Connection names
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// Build a HeaderMap from an http.Header, lowercasing keys
+func headerMapFrom(h http.Header) HeaderMap {
+	headers := make(HeaderMap, len(h))
+	for key, values := range h {
+		lower := strings.ToLower(key)
+		for _, v := range values {
+			headers[lower] = append(headers[lower], headerValue(v))
+		}
+	}
+	return headers
+}
+
+// JSON can only carry UTF-8, and would replace other bytes with U+FFFD.
+// Values that aren't UTF-8 (e.g. a Latin-1 filename in Content-Disposition)
+// are sent as one character per byte instead, which a server writing
+// headers as Latin-1 turns back into the original bytes.
+func headerValue(v string) string {
+	if utf8.ValidString(v) {
+		return v
+	}
+	runes := make([]rune, len(v))
+	for i := 0; i < len(v); i++ {
+		runes[i] = rune(v[i])
+	}
+	return string(runes)
+}
+
+// Get the first value for a key
+func (h HeaderMap) Get(key string) string {
+	if values := h[strings.ToLower(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Set replaces all values for a key
+func (h HeaderMap) Set(key, value string) {
+	h[strings.ToLower(key)] = []string{value}
+}
+
+// Apply adds every header value to an http.Header
+func (h HeaderMap) Apply(dst http.Header) {
+	for key, values := range h {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+func (h HeaderMap) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{}, len(h))
+	for key, values := range h {
+		if len(values) == 1 {
+			out[key] = values[0]
+		} else {
+			out[key] = values
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (h *HeaderMap) UnmarshalJSON(data []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	headers := make(HeaderMap, len(raw))
+	for key, value := range raw {
+		lower := strings.ToLower(key)
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range v {
+				headers[lower] = append(headers[lower], fmt.Sprintf("%v", item))
+			}
+		default:
+			headers[lower] = append(headers[lower], fmt.Sprintf("%v", v))
+		}
+	}
+	*h = headers
+	return nil
+}
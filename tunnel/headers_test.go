@@ -0,0 +1,225 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownloadKeepsFilename(t *testing.T) {
+	const disposition = `attachment; filename="Q3 \"final\" 報告書.pdf"; filename*=UTF-8''Q3%20%22final%22%20%E5%A0%B1%E5%91%8A%E6%9B%B8.pdf`
+	// A small file goes in one message, a large one is streamed
+	files := [][]byte{make([]byte, 4<<10), make([]byte, 3<<20)}
+	for _, file := range files {
+		for i := range file {
+			file[i] = byte(i * 7 / 5)
+		}
+	}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", disposition)
+		file := files[0]
+		if r.URL.Path == "/large" {
+			file = files[1]
+		}
+		w.Write(file)
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	for i, path := range []string{"/small", "/large"} {
+		conn.request(i+1, "GET", path, HeaderMap{}, nil)
+		resp, _ := conn.response(i+1, false)
+
+		if resp.Status != 200 || resp.Error != "" {
+			t.Fatalf("%s: %d, error %q", path, resp.Status, resp.Error)
+		}
+		if got := resp.Headers["content-disposition"]; len(got) != 1 || got[0] != disposition {
+			t.Errorf("%s: content-disposition = %q, want %q", path, got, disposition)
+		}
+		if !bytes.Equal(resp.Body, files[i]) {
+			t.Errorf("%s: body of %d bytes differs from the %d served", path, len(resp.Body), len(files[i]))
+		}
+		if path == "/large" && !resp.Streamed {
+			t.Errorf("%s: not streamed", path)
+		}
+	}
+}
+
+func TestSetCookieHeadersKeepTheirOrder(t *testing.T) {
+	cookies := []string{
+		"session=abc123; Path=/; HttpOnly; Secure",
+		"theme=dark; Path=/; Max-Age=31536000",
+		"csrf=x9, y8; Path=/; SameSite=Strict",
+	}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, cookie := range cookies {
+			w.Header().Add("Set-Cookie", cookie)
+		}
+		if r.URL.Path == "/large" {
+			w.Write(make([]byte, 3<<20))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	// In one message and streamed
+	for i, path := range []string{"/small", "/large"} {
+		conn.request(i+1, "GET", path, HeaderMap{}, nil)
+		resp, _ := conn.response(i+1, true)
+
+		if resp.Status != 200 || resp.Error != "" {
+			t.Fatalf("%s: %d, error %q", path, resp.Status, resp.Error)
+		}
+		if path == "/large" && !resp.Streamed {
+			t.Errorf("%s: not streamed", path)
+		}
+		got := resp.Headers["set-cookie"]
+		if len(got) != len(cookies) {
+			t.Fatalf("%s: set-cookie %q, want %q", path, got, cookies)
+		}
+		for j := range cookies {
+			if got[j] != cookies[j] {
+				t.Errorf("%s: set-cookie %q, want %q", path, got, cookies)
+				break
+			}
+		}
+	}
+}
+
+func TestGzippedBodiesPassThroughUnchanged(t *testing.T) {
+	const payload = `{"items":[{"id":1,"name":"gzip"},{"id":2,"name":"json"}]}`
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(payload))
+	zw.Close()
+	gzipped := compressed.Bytes()
+
+	type received struct {
+		encoding string
+		body     []byte
+	}
+	uploads := make(chan received, 2)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			body, _ := io.ReadAll(r.Body)
+			uploads <- received{r.Header.Get("Content-Encoding"), body}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped)
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	// What the local app got for a request the edge has a response to
+	upload := func() received {
+		select {
+		case up := <-uploads:
+			return up
+		default:
+			t.Fatal("the upload never reached the local app")
+			return received{}
+		}
+	}
+
+	conn.request(1, "GET", "/items", HeaderMap{"accept-encoding": {"gzip"}}, nil)
+	resp, _ := conn.response(1, false)
+	if resp.Status != 200 || resp.Headers.Get("content-encoding") != "gzip" {
+		t.Fatalf("response: %d, headers %v", resp.Status, resp.Headers)
+	}
+	if !bytes.Equal(resp.Body, gzipped) {
+		t.Fatalf("body %q, want the %d gzipped bytes served", resp.Body, len(gzipped))
+	}
+
+	// A raw request body is still compressed, a parsed one no longer is
+	conn.request(2, "POST", "/items", HeaderMap{"content-type": {"application/json"}, "content-encoding": {"gzip"}}, gzipped)
+	conn.response(2, false)
+	if up := upload(); up.encoding != "gzip" || !bytes.Equal(up.body, gzipped) {
+		t.Errorf("raw upload arrived as %q encoded %q", up.body, up.encoding)
+	}
+	conn.send(map[string]interface{}{"type": MsgRequest, "id": 3, "method": "POST", "path": "/items",
+		"headers": HeaderMap{"content-type": {"application/json"}, "content-encoding": {"gzip"}},
+		"body":    json.RawMessage(payload)})
+	conn.response(3, false)
+	if up := upload(); up.encoding != "" || string(up.body) != payload {
+		t.Errorf("parsed upload arrived as %q encoded %q", up.body, up.encoding)
+	}
+}
+
+// Framing headers the client declared describe its own connection, not
+// the body the local app is sent, which net/http frames itself
+func TestMismatchedDeclaredLengthsAreReframed(t *testing.T) {
+	type received struct {
+		length   int64
+		encoding []string
+		body     string
+		hop      string
+	}
+	uploads := make(chan received, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the request body: %v", err)
+		}
+		uploads <- received{r.ContentLength, r.TransferEncoding, string(body), r.Header.Get("X-Hop")}
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "local")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--timeout", "3s")
+
+	for i, tc := range []struct {
+		name    string
+		headers HeaderMap
+		raw     []byte
+		parsed  string // JSON body the edge parsed, re-encoded by the client
+		want    string
+	}{
+		{"longer than sent", HeaderMap{"content-length": {"4096"}}, []byte("short"), "", "short"},
+		{"shorter than sent", HeaderMap{"content-length": {"2"}}, []byte("not so short"), "", "not so short"},
+		{"chunked", HeaderMap{"transfer-encoding": {"chunked"}}, []byte("5\r\nwrong"), "", "5\r\nwrong"},
+		{"both", HeaderMap{"content-length": {"1"}, "transfer-encoding": {"chunked"}}, []byte("body"), "", "body"},
+		{"re-encoded", HeaderMap{"content-type": {"application/json"}, "content-length": {"27"}}, nil, `{ "a" : 1 }`, `{"a":1}`},
+		{"hop headers", HeaderMap{"connection": {"keep-alive, X-Hop"}, "x-hop": {"edge"}, "keep-alive": {"timeout=5"}}, []byte("hop"), "", "hop"},
+	} {
+		if tc.headers.Get("content-type") == "" {
+			tc.headers.Set("content-type", "text/plain")
+		}
+		message := map[string]interface{}{"type": MsgRequest, "id": i + 1, "method": "POST", "path": "/upload", "headers": tc.headers}
+		if tc.parsed != "" {
+			message["body"] = json.RawMessage(tc.parsed)
+		} else {
+			message["rawBody"] = base64.StdEncoding.EncodeToString(tc.raw)
+		}
+		conn.send(message)
+		resp, _ := conn.response(i+1, false)
+		if resp.Status != 200 {
+			t.Errorf("%s: status %d, %s", tc.name, resp.Status, resp.Body)
+			continue
+		}
+		for _, name := range []string{"content-length", "transfer-encoding", "connection", "x-hop"} {
+			if v, ok := resp.Headers[name]; ok {
+				t.Errorf("%s: response has %s: %q", tc.name, name, v)
+			}
+		}
+		up := <-uploads
+		if up.body != tc.want || up.length != int64(len(tc.want)) || len(up.encoding) > 0 || up.hop != "" {
+			t.Errorf("%s: local app got %q, length %d, encoding %v, x-hop %q; want %q", tc.name, up.body, up.length, up.encoding, up.hop, tc.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Probing of a local target that isn't accepting connections yet
+const (
+	HealthCheckInterval = time.Second            // at most one probe per interval
+	HealthDialTimeout   = 300 * time.Millisecond // a local port answers fast or not at all
+)
+
+// Whether a local target is accepting connections. Targets are assumed up
+// until a probe or a refused request says otherwise, so a healthy app is
+// never probed.
+type targetHealth struct {
+	down atomic.Bool
+
+	mu        sync.Mutex
+	lastProbe time.Time
+}
+
+// Whether requests should be forwarded to the target now. A target that
+// is down is dialed again at most once per HealthCheckInterval.
+func (t *localTarget) ready() bool {
+	if t.Dir != "" || !t.health.down.Load() {
+		return true
+	}
+	t.health.mu.Lock()
+	due := time.Since(t.health.lastProbe) >= HealthCheckInterval
+	t.health.mu.Unlock()
+	return due && t.probe()
+}
+
+// Dial the target now, recording and reporting any change
+func (t *localTarget) probe() bool {
+	t.health.mu.Lock()
+	t.health.lastProbe = time.Now()
+	t.health.mu.Unlock()
+
+	conn, err := net.DialTimeout(t.network(), t.Addr(), HealthDialTimeout)
+	if err != nil {
+		t.markDown()
+		return false
+	}
+	conn.Close()
+	if t.health.down.CompareAndSwap(true, false) {
+		t.log.Success(fmt.Sprintf("%s is accepting connections", t.Addr()))
+	}
+	return true
+}
+
+// Record that the target refused a connection
+func (t *localTarget) markDown() {
+	if t.health.down.CompareAndSwap(false, true) {
+		t.log.Warning(fmt.Sprintf("Waiting for %s...", t.Addr()))
+	}
+}
+
+// Probe once per interval until the target is up or done is closed
+func (t *localTarget) waitUntilUp(done <-chan struct{}) bool {
+	for !t.probe() {
+		select {
+		case <-done:
+			return false
+		case <-time.After(HealthCheckInterval):
+		}
+	}
+	return true
+}
+
+// Whether a request failed because nothing accepted the connection, as
+// opposed to the app failing once connected
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,268 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Sessions kept in history.jsonl; older ones are dropped
+const HistoryLimit = 500
+
+// How often a running session saves its checkpoint, which a later run
+// turns into a history entry if this one never finishes
+const historyCheckpointInterval = 30 * time.Second
+
+// Reason recorded for a session whose process ended without shutting down
+const historyCrashReason = "ended unexpectedly"
+
+// One tunnel of a finished session, a line of history.jsonl
+type historyEntry struct {
+	Name      string    `json:"name,omitempty"`
+	URL       string    `json:"url,omitempty"` // "" if it never registered
+	Local     string    `json:"local"`
+	StartedAt time.Time `json:"startedAt"`
+	EndedAt   time.Time `json:"endedAt"`
+	Requests  int64     `json:"requests"`
+	BytesIn   int64     `json:"bytesIn"`
+	BytesOut  int64     `json:"bytesOut"`
+	Reason    string    `json:"reason"`
+	PID       int       `json:"pid"`
+}
+
+// Traffic through one tunnel over its session, for its history entry
+type sessionTotals struct {
+	requests atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+func (s *sessionTotals) record(r *requestLog) {
+	s.requests.Add(1)
+	s.bytesIn.Add(r.bytesIn)
+	s.bytesOut.Add(r.bytesOut)
+}
+
+func historyFile() string {
+	return filepath.Join(comzyDir, "history.jsonl")
+}
+
+func checkpointFile(pid int) string {
+	return filepath.Join(comzyDir, fmt.Sprintf("history-%d.checkpoint", pid))
+}
+
+// Entries for the tunnels of group as they stand
+func historyEntries(group *tunnelGroup, startedAt time.Time, reason string) []historyEntry {
+	var entries []historyEntry
+	now := time.Now()
+	for _, t := range group.tunnels {
+		entries = append(entries, historyEntry{
+			Name:      t.opts.Name,
+			URL:       t.publicEndpoint(),
+			Local:     forwardingTo(t.opts, t.target),
+			StartedAt: startedAt,
+			EndedAt:   now,
+			Requests:  t.target.totals.requests.Load(),
+			BytesIn:   t.target.totals.bytesIn.Load(),
+			BytesOut:  t.target.totals.bytesOut.Load(),
+			Reason:    reason,
+			PID:       os.Getpid(),
+		})
+	}
+	return entries
+}
+
+// Save a checkpoint of group now and then until the returned func is
+// called. Checkpoints of sessions that crashed are recorded first.
+func checkpointHistory(group *tunnelGroup, startedAt time.Time) func() {
+	recoverCheckpoints()
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(historyCheckpointInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				writeCheckpoint(historyEntries(group, startedAt, historyCrashReason))
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(checkpointFile(os.Getpid()))
+	}
+}
+
+func writeCheckpoint(entries []historyEntry) {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return
+	}
+	path := checkpointFile(os.Getpid())
+	if err := os.WriteFile(path+".tmp", data, 0644); err == nil {
+		os.Rename(path+".tmp", path)
+	}
+}
+
+// Record the checkpoints left by processes that are no longer running
+func recoverCheckpoints() {
+	paths, _ := filepath.Glob(filepath.Join(comzyDir, "history-*.checkpoint"))
+	for _, path := range paths {
+		pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "history-"), ".checkpoint"))
+		if err != nil || pid == os.Getpid() || processRunning(pid) {
+			continue
+		}
+		var entries []historyEntry
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &entries) == nil {
+			appendHistory(entries)
+		}
+		os.Remove(path)
+	}
+}
+
+// Add entries to history.jsonl, dropping the oldest beyond HistoryLimit
+func appendHistory(entries []historyEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if err := ensureComzyDir(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(data, '\n'))
+	}
+	f, err := os.OpenFile(historyFile(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return trimHistory()
+}
+
+// Rewrite history.jsonl with only its last HistoryLimit lines, if longer
+func trimHistory() error {
+	data, err := os.ReadFile(historyFile())
+	if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= HistoryLimit {
+		return nil
+	}
+	kept := bytes.Join(lines[len(lines)-HistoryLimit:], nil)
+	tmp := historyFile() + ".tmp"
+	if err := os.WriteFile(tmp, kept, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, historyFile())
+}
+
+// Recorded sessions, oldest first. Lines that can't be read are skipped.
+func loadHistory() ([]historyEntry, error) {
+	f, err := os.Open(historyFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry historyEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Handle "comzy history": list recent sessions, newest first, or with
+// "clear" forget them
+func handleHistory(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	limit := fs.Int("n", 20, "Number of sessions to show (0 = all)")
+	asJSON := fs.Bool("json", false, "Print the sessions as JSON")
+	format := addListFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	switch {
+	case fs.NArg() == 1 && fs.Arg(0) == "clear":
+		if err := os.Remove(historyFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logSuccess("Session history cleared")
+		return nil
+	case fs.NArg() > 0:
+		return &usageError{fmt.Errorf("Usage: comzy history [-n N] [--json] or comzy history clear"), fs}
+	}
+
+	recoverCheckpoints()
+	entries, err := loadHistory()
+	if err != nil {
+		return err
+	}
+	if *limit > 0 && len(entries) > *limit {
+		entries = entries[len(entries)-*limit:]
+	}
+	// Newest first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if *asJSON {
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		return printJSON(entries)
+	}
+
+	table := newListing("started", "duration", "name", "url", "local", "requests", "in", "out", "reason")
+	for _, e := range entries {
+		table.add(
+			e.StartedAt.Local().Format("2006-01-02 15:04"),
+			e.EndedAt.Sub(e.StartedAt).Round(time.Second).String(),
+			e.Name,
+			cmp.Or(e.URL, "(never registered)"),
+			e.Local,
+			strconv.FormatInt(e.Requests, 10),
+			formatBytes(e.BytesIn),
+			formatBytes(e.BytesOut),
+			e.Reason,
+		)
+	}
+	if len(table.rows) == 0 && format.Format == FormatTable {
+		logDim("No sessions recorded yet")
+		return nil
+	}
+	return table.write(os.Stdout, format)
+}
@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capability under which the server makes visitors log in to the portal
+// before a tunnel registered with an access policy, and signs who they are
+// into IdentityHeader
+const CapPortalAuth = "portal-auth"
+
+// Portal API endpoint listing the keys identity headers are signed with
+var IdentityKeysURL = "https://api.comzy.io/v1/identity-keys"
+
+// Header the server adds to requests of a --oauth-allow tunnel:
+// base64url(JSON claims) "." base64url(Ed25519 signature of the first
+// part). It is checked here and never passed on.
+const IdentityHeader = "x-comzy-identity"
+
+// Header that tells the local app who made a request
+const ForwardedEmailHeader = "X-Forwarded-Email"
+
+// Leeway for the claims' expiry, as this machine's clock may be off
+const IdentityClockSkew = 2 * time.Minute
+
+// Least time between fetches of the keys, when a header names a key that
+// isn't known yet
+const identityKeysRefresh = time.Minute
+
+// Who may use a tunnel, sent at registration so the server asks visitors
+// to log in
+type accessPolicy struct {
+	Emails  []string `json:"emails,omitempty"`
+	Domains []string `json:"domains,omitempty"`
+}
+
+// Signed claims of IdentityHeader
+type identityClaims struct {
+	KeyID   string `json:"kid"`
+	Email   string `json:"email"`
+	Host    string `json:"host"` // public host the visitor logged in for
+	Expires int64  `json:"exp"`  // Unix seconds
+}
+
+// Checks the identity of each request against --oauth-allow and
+// --oauth-allow-domain
+type identityVerifier struct {
+	policy accessPolicy
+
+	mu        sync.Mutex
+	keys      map[string]ed25519.PublicKey
+	fetchedAt time.Time
+}
+
+// nil when no identities are given, which leaves the tunnel open
+func newIdentityVerifier(emails, domains []string) *identityVerifier {
+	if len(emails) == 0 && len(domains) == 0 {
+		return nil
+	}
+	v := &identityVerifier{}
+	for _, email := range emails {
+		v.policy.Emails = append(v.policy.Emails, strings.ToLower(strings.TrimSpace(email)))
+	}
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.TrimSpace(domain), "@")
+		v.policy.Domains = append(v.policy.Domains, strings.ToLower(domain))
+	}
+	return v
+}
+
+// Check an --oauth-allow or --oauth-allow-domain value
+func validateIdentity(flag, value string, email bool) error {
+	value = strings.TrimSpace(value)
+	local, domain, hasAt := strings.Cut(value, "@")
+	switch {
+	case email && (!hasAt || local == "" || !strings.Contains(domain, ".")):
+		return fmt.Errorf("invalid --%s %q (use an email address such as user@company.com)", flag, value)
+	case !email && (strings.Contains(strings.TrimPrefix(value, "@"), "@") || !strings.Contains(value, ".")):
+		return fmt.Errorf("invalid --%s %q (use a domain such as company.com)", flag, value)
+	}
+	return nil
+}
+
+// The request's verified email, or why it may not go through. The
+// identity header is removed either way.
+func (v *identityVerifier) verify(headers HeaderMap, publicHost string) (string, error) {
+	value := headers.Get(IdentityHeader)
+	delete(headers, IdentityHeader)
+	if value == "" {
+		return "", errors.New("no portal identity")
+	}
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", errors.New("malformed portal identity")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errors.New("malformed portal identity")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", errors.New("malformed portal identity")
+	}
+	var claims identityClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", errors.New("malformed portal identity")
+	}
+	key, err := v.key(claims.KeyID)
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(key, []byte(payload), sig) {
+		return "", errors.New("portal identity has a bad signature")
+	}
+	if time.Unix(claims.Expires, 0).Add(IdentityClockSkew).Before(time.Now()) {
+		return "", fmt.Errorf("portal identity of %s has expired", claims.Email)
+	}
+	if publicHost != "" && !strings.EqualFold(claims.Host, publicHost) {
+		return "", fmt.Errorf("portal identity of %s is for %s", claims.Email, claims.Host)
+	}
+	if !v.allows(claims.Email) {
+		return "", fmt.Errorf("%s is not allowed", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+func (v *identityVerifier) allows(email string) bool {
+	email = strings.ToLower(email)
+	for _, allowed := range v.policy.Emails {
+		if email == allowed {
+			return true
+		}
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range v.policy.Domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Public key the portal signs with under id, fetching the keys again if
+// it's one not seen before
+func (v *identityVerifier) key(id string) (ed25519.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[id]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < identityKeysRefresh {
+		return nil, fmt.Errorf("portal identity signed with unknown key %q", id)
+	}
+	if err := v.fetchKeys(); err != nil {
+		return nil, fmt.Errorf("could not check the portal identity: %v", err)
+	}
+	if key, ok := v.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("portal identity signed with unknown key %q", id)
+}
+
+// Fetch the keys ahead of the first request, so a problem shows at startup
+func (v *identityVerifier) prefetch() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fetchKeys()
+}
+
+// Replace the known keys with the portal's current ones. Called with mu
+// held.
+func (v *identityVerifier) fetchKeys() error {
+	v.fetchedAt = time.Now()
+	client := apiClient(VerifyTimeout)
+	resp, err := client.Get(IdentityKeysURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", IdentityKeysURL, resp.Status)
+	}
+	var body struct {
+		Keys []struct {
+			ID  string `json:"kid"`
+			Key string `json:"key"` // base64
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("unexpected response from %s: %v", IdentityKeysURL, err)
+	}
+	keys := map[string]ed25519.PublicKey{}
+	for _, k := range body.Keys {
+		raw, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			continue
+		}
+		keys[k.ID] = ed25519.PublicKey(raw)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s listed no usable keys", IdentityKeysURL)
+	}
+	v.keys = keys
+	return nil
+}
+
+// Describe who may use the tunnel, for the startup banner
+func (p accessPolicy) String() string {
+	var who []string
+	who = append(who, p.Emails...)
+	for _, domain := range p.Domains {
+		who = append(who, "*@"+domain)
+	}
+	return strings.Join(who, ", ")
+}
@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Directory for per-project run state, kept out of version control
+const ProjectStateDir = ".comzy"
+
+// Lines comzy init adds to .gitignore
+var gitignoreEntries = []string{ProjectStateDir + "/"}
+
+// Contents of a fresh .comzy.yml
+func projectConfig(host string, port int, subdomain string) string {
+	var b strings.Builder
+	b.WriteString("# comzy project configuration, read whenever comzy runs in this directory.\n")
+	b.WriteString("# Keys are the long option names from \"comzy help\"; flags override them.\n")
+	if host != "" {
+		fmt.Fprintf(&b, "host: %s\n", host)
+	}
+	fmt.Fprintf(&b, "port: %d\n", port)
+	if subdomain != "" {
+		fmt.Fprintf(&b, "subdomain: %s\n", subdomain)
+	}
+	b.WriteString(`
+# Require credentials on every request:
+# basic-auth: ["user:pass"]
+
+# Named tunnels, started with "comzy start NAME" or "comzy start --all":
+# tunnels:
+#   web:
+#     port: 5173
+#   api:
+#     port: 8080
+#     subdomain: myapp-api
+`)
+	return b.String()
+}
+
+// Handle the init command: scaffold .comzy.yml and .gitignore entries.
+// Running it again changes nothing unless --force is given.
+func handleInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.Int("port", 3000, "Port of the local app")
+	host := fs.String("host", "", "Host of the local app")
+	subdomain := fs.String("subdomain", "", "Subdomain to request")
+	force := fs.Bool("force", false, "Overwrite an existing .comzy.yml")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	if *port < 1 || *port > 65535 {
+		return fmt.Errorf("Invalid port number. Use a port between 1-65535")
+	}
+	if *host != "" {
+		if err := validateHost(*host); err != nil {
+			return err
+		}
+	}
+	*subdomain = strings.ToLower(*subdomain)
+	if *subdomain != "" {
+		if err := validateSubdomain(*subdomain); err != nil {
+			return err
+		}
+	}
+
+	content := projectConfig(*host, *port, *subdomain)
+	existing, err := os.ReadFile(ProjectConfigFile)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.WriteFile(ProjectConfigFile, []byte(content), 0644); err != nil {
+			return err
+		}
+		logSuccess(fmt.Sprintf("Created %s", ProjectConfigFile))
+	case err != nil:
+		return err
+	case string(existing) == content:
+		logDim(fmt.Sprintf("%s is up to date", ProjectConfigFile))
+	default:
+		printDiff(os.Stdout, string(existing), content)
+		if !*force {
+			return fmt.Errorf("%s already exists and differs as shown; re-run with --force to overwrite it", ProjectConfigFile)
+		}
+		if err := os.WriteFile(ProjectConfigFile, []byte(content), 0644); err != nil {
+			return err
+		}
+		logSuccess(fmt.Sprintf("Overwrote %s", ProjectConfigFile))
+	}
+
+	if inGitRepo() {
+		added, err := ensureGitignore(".gitignore", gitignoreEntries)
+		if err != nil {
+			return err
+		}
+		if len(added) > 0 {
+			logSuccess(fmt.Sprintf("Added %s to .gitignore", strings.Join(added, ", ")))
+		}
+	}
+
+	fmt.Println()
+	logInfo("Next steps:")
+	fmt.Printf("  1. Start your app on port %d\n", *port)
+	fmt.Println("  2. Run \"comzy\" in this directory to open the tunnel")
+	fmt.Printf("  3. Commit %s so teammates get the same settings\n", ProjectConfigFile)
+	return nil
+}
+
+// Whether the working directory is inside a git repository
+func inGitRepo() bool {
+	dir, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// Append the entries missing from a .gitignore file, returning those added
+func ensureGitignore(path string, entries []string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+
+	var added []string
+	var b bytes.Buffer
+	for _, entry := range entries {
+		if present[entry] {
+			continue
+		}
+		if len(added) == 0 {
+			if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+				b.WriteString("\n")
+			}
+			b.WriteString("# comzy local state\n")
+		}
+		b.WriteString(entry + "\n")
+		added = append(added, entry)
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = f.Write(b.Bytes())
+	return added, err
+}
+
+// Print a line diff from old to new, marking removed lines with - and added ones with +
+func printDiff(w io.Writer, old, new string) {
+	a := strings.Split(strings.TrimSuffix(old, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(new, "\n"), "\n")
+
+	// Longest common subsequence table, filled from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintln(w, strings.TrimRight("  "+a[i], " "))
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(w, "%s- %s%s\n", ColorRed, a[i], ColorReset)
+			i++
+		default:
+			fmt.Fprintf(w, "%s+ %s%s\n", ColorGreen, b[j], ColorReset)
+			j++
+		}
+	}
+}
@@ -0,0 +1,523 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Inspector defaults
+const (
+	DefaultInspectPort      = 4040
+	DefaultInspectHistory   = 100
+	DefaultInspectBodyLimit = 64 << 10 // bytes of each body kept for display
+	ReplayTimeout           = 60 * time.Second
+)
+
+// Request seen through the tunnel together with the response sent back
+type Capture struct {
+	ID              int64         `json:"id"`
+	RequestID       MessageID     `json:"requestId"`
+	Time            time.Time     `json:"time"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	RequestHeaders  HeaderMap     `json:"requestHeaders"`
+	RequestBody     *CapturedBody `json:"requestBody,omitempty"`
+	RequestStreamed bool          `json:"requestStreamed,omitempty"`
+	Status          int           `json:"status,omitempty"`
+	ResponseHeaders HeaderMap     `json:"responseHeaders,omitempty"`
+	ResponseBody    *CapturedBody `json:"responseBody,omitempty"`
+	DurationMs      float64       `json:"durationMs"`
+	Pending         bool          `json:"pending"`
+	Streamed        bool          `json:"streamed,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	Replayable      bool          `json:"replayable"`
+	Replay          bool          `json:"replay,omitempty"`
+	ReplayOf        int64         `json:"replayOf,omitempty"`
+	Tunnel          string        `json:"tunnel,omitempty"`
+	Route           string        `json:"route,omitempty"`   // --route that chose the backend
+	Webhook         string        `json:"webhook,omitempty"` // "verified", or why the signature was refused
+	RateLimited     bool          `json:"rateLimited,omitempty"`
+
+	inspector *Inspector
+	target    *localTarget // where replays are sent
+	started   time.Time
+	request   *IncomingRequest // kept for replay unless the body was truncated
+
+	// Bounded copies of bodies streamed rather than kept, nil otherwise
+	requestTee  *bodyTee
+	responseTee *bodyTee
+}
+
+// Body kept for display, at most --inspect-body-limit of it. Size is that
+// of the whole body. Binary bodies are described, not stored.
+type CapturedBody struct {
+	Size        int    `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+	Binary      bool   `json:"binary,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Truncated   bool   `json:"truncated,omitempty"`
+}
+
+// Record data, the first bytes of a body of size bytes. The text is a
+// copy, so the bytes forwarded are never shared with the inspector.
+func (in *Inspector) captureBody(data []byte, size int, contentType string) *CapturedBody {
+	if size == 0 {
+		return nil
+	}
+	body := &CapturedBody{Size: size, ContentType: contentType}
+	if len(data) > in.bodyLimit {
+		data = data[:in.bodyLimit]
+	}
+	if isBinaryContentType(contentType) || !utf8.Valid(data) {
+		body.Binary = true
+		return body
+	}
+	body.Text = string(data)
+	body.Truncated = size > len(data)
+	return body
+}
+
+// Inspector keeps the most recent requests in a ring buffer and serves
+// them on a local port as an HTML page and a JSON API
+type Inspector struct {
+	mu      sync.Mutex
+	entries []*Capture
+	next    int
+	lastID  int64
+
+	// Bytes of each body kept, per --inspect-body-limit
+	bodyLimit int
+
+	// Tunnels whose state the debug endpoints report, nil to leave the
+	// endpoints out
+	debug *tunnelGroup
+
+	// Tunnels paused and resumed through the API, nil to leave it out
+	control *tunnelGroup
+}
+
+// Process-wide inspector, nil when disabled
+var inspector *Inspector
+
+func newInspector(history int, bodyLimit ByteSize) *Inspector {
+	if history <= 0 {
+		history = DefaultInspectHistory
+	}
+	return &Inspector{entries: make([]*Capture, 0, history), bodyLimit: int(bodyLimit)}
+}
+
+// Begin recording a request forwarded to target. Safe to call on a nil inspector.
+func (in *Inspector) Begin(target *localTarget, request IncomingRequest, body []byte, contentType string) *Capture {
+	if in == nil {
+		return nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.lastID++
+	c := &Capture{
+		ID:             in.lastID,
+		RequestID:      request.ID,
+		Time:           time.Now(),
+		Method:         request.Method,
+		Path:           request.Path,
+		RequestHeaders: request.Headers,
+		RequestBody:    in.captureBody(body, len(body), contentType),
+		Pending:        true,
+		Tunnel:         target.Tag,
+		Route:          target.routeName(),
+		inspector:      in,
+		target:         target,
+		started:        time.Now(),
+	}
+	if len(body) <= in.bodyLimit {
+		c.Replayable = true
+		c.request = &request
+	}
+	if len(in.entries) < cap(in.entries) {
+		in.entries = append(in.entries, c)
+	} else {
+		in.entries[in.next] = c
+		in.next = (in.next + 1) % len(in.entries)
+	}
+	return c
+}
+
+// Finish records the response that was sent back
+func (c *Capture) Finish(status int, headers HeaderMap, body []byte) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.Status = status
+	c.ResponseHeaders = headers
+	c.ResponseBody = c.inspector.captureBody(body, len(body), headers.Get("content-type"))
+	c.done()
+}
+
+// Finish with a body that was only partly read
+func (c *Capture) finishPartial(status int, headers HeaderMap, prefix []byte, size int) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.Status = status
+	c.ResponseHeaders = headers
+	c.ResponseBody = c.inspector.captureBody(prefix, size, headers.Get("content-type"))
+	c.done()
+}
+
+// FinishStream records a response whose body was streamed, not kept
+func (c *Capture) FinishStream(status int, headers HeaderMap) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.Status = status
+	c.ResponseHeaders = headers
+	c.Streamed = true
+	c.done()
+}
+
+// MarkWebhook records the outcome of the --verify-webhook check
+func (c *Capture) MarkWebhook(result string) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.Webhook = result
+}
+
+// MarkRequestStreamed records a request body of size bytes that was
+// streamed to the local app rather than kept, so it can't be replayed
+func (c *Capture) MarkRequestStreamed(size int64) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.RequestStreamed = true
+	c.RequestBody = &CapturedBody{Size: int(size), ContentType: c.RequestHeaders.Get("content-type")}
+	c.Replayable = false
+	c.request = nil
+}
+
+// MarkRateLimited records that the request was refused by a rate limit
+func (c *Capture) MarkRateLimited() {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.RateLimited = true
+}
+
+// Fail records a request that never got a response from the local app
+func (c *Capture) Fail(err error) {
+	if c == nil {
+		return
+	}
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.Error = err.Error()
+	c.done()
+}
+
+func (c *Capture) done() {
+	if c.requestTee != nil {
+		prefix, size := c.requestTee.snapshot()
+		if c.RequestBody != nil {
+			size = max(size, c.RequestBody.Size)
+		}
+		c.RequestBody = c.inspector.captureBody(prefix, size, c.RequestHeaders.Get("content-type"))
+	}
+	c.Pending = false
+	c.DurationMs = float64(time.Since(c.started).Microseconds()) / 1000
+}
+
+// Forget every entry recorded so far
+func (in *Inspector) clear() {
+	if in == nil {
+		return
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.entries = in.entries[:0]
+	in.next = 0
+}
+
+// Snapshot of all entries, newest first
+func (in *Inspector) list() []Capture {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	n := len(in.entries)
+	out := make([]Capture, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, *in.entries[(in.next+n-1-i)%n])
+	}
+	return out
+}
+
+// Find one entry by ID
+func (in *Inspector) get(id int64) (Capture, bool) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, c := range in.entries {
+		if c.ID == id {
+			return *c, true
+		}
+	}
+	return Capture{}, false
+}
+
+// Errors returned by Replay
+var (
+	errCaptureNotFound = errors.New("request not found")
+	errNotReplayable   = errors.New("request body was truncated when recorded, refusing to replay a partial body")
+)
+
+// Replay re-sends a recorded request to the local target and records the
+// result as a new entry marked as a replay of the original
+func (in *Inspector) Replay(id int64) (Capture, error) {
+	in.mu.Lock()
+	var original *Capture
+	for _, c := range in.entries {
+		if c.ID == id {
+			original = c
+		}
+	}
+	in.mu.Unlock()
+
+	if original == nil {
+		return Capture{}, errCaptureNotFound
+	}
+	if original.request == nil {
+		return Capture{}, errNotReplayable
+	}
+	request, target := *original.request, original.target
+
+	target.log.Dim(fmt.Sprintf("Replaying request %d: %s %s -> %s", id, request.Method, request.Path, target.Addr()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), ReplayTimeout)
+	defer cancel()
+
+	httpReq, reqBytes, err := buildLocalRequest(ctx, request, target)
+	capture := in.Begin(target, request, reqBytes, request.Headers.Get("content-type"))
+	in.mu.Lock()
+	capture.Replay = true
+	capture.ReplayOf = id
+	in.mu.Unlock()
+
+	if err == nil {
+		var resp *http.Response
+		if resp, err = target.client.Do(httpReq); err == nil {
+			defer resp.Body.Close()
+			prefix, _ := io.ReadAll(io.LimitReader(resp.Body, int64(in.bodyLimit)))
+			rest, _ := io.Copy(io.Discard, resp.Body)
+			capture.finishPartial(resp.StatusCode, headerMapFrom(resp.Header), prefix, len(prefix)+int(rest))
+		}
+	}
+	if err != nil {
+		capture.Fail(err)
+	}
+
+	result, _ := in.get(capture.ID)
+	return result, nil
+}
+
+// Serve the inspector on a loopback port
+func (in *Inspector) Serve(port int) (string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return "", err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", in.handlePage)
+	mux.HandleFunc("GET /api/requests", in.handleList)
+	mux.HandleFunc("GET /api/requests/{id}", in.handleGet)
+	mux.HandleFunc("POST /api/requests/{id}/replay", in.handleReplay)
+	mux.HandleFunc("GET /api/stats", in.handleStats)
+	if in.control != nil {
+		mux.HandleFunc("POST /api/pause", in.handlePause)
+		mux.HandleFunc("POST /api/resume", in.handleResume)
+		mux.HandleFunc("GET /api/shaping", in.handleShaping)
+		mux.HandleFunc("PUT /api/shaping", in.handleShaping)
+		mux.HandleFunc("GET /healthz", in.control.serveHealth)
+	}
+	if in.debug != nil {
+		registerDebugHandlers(mux, in.debug, time.Now())
+	}
+
+	go http.Serve(listener, mux)
+	return "http://" + listener.Addr().String(), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// ?tag=NAME keeps the requests of one tunnel or route, as --log-filter does
+func (in *Inspector) handleList(w http.ResponseWriter, r *http.Request) {
+	list := in.list()
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		list = slices.DeleteFunc(list, func(c Capture) bool {
+			return c.Tunnel != tag && routeTag(c.Route) != tag
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (in *Inspector) handleGet(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request id"})
+		return
+	}
+	c, ok := in.get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("request %d not found", id)})
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (in *Inspector) handleReplay(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request id"})
+		return
+	}
+	c, err := in.Replay(id)
+	switch {
+	case err == errCaptureNotFound:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("request %d not found", id)})
+	case err != nil:
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case c.Error != "":
+		writeJSON(w, http.StatusBadGateway, c)
+	default:
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+func (in *Inspector) handlePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, inspectorPage)
+}
+
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Comzy Inspector</title>
+<style>
+  body { font-family: -apple-system, Segoe UI, sans-serif; margin: 2rem; color: #222; }
+  h1 { font-size: 1.3rem; }
+  details { border-bottom: 1px solid #eee; padding: .4rem 0; }
+  summary { cursor: pointer; font-family: monospace; }
+  .s2 { color: #1a7f37; } .s3 { color: #0969da; } .s4 { color: #9a6700; } .s5, .err { color: #cf222e; }
+  .dim { color: #888; }
+  .tag { font-size: .75rem; background: #ddf4ff; color: #0969da; border-radius: 3px; padding: 0 .3rem; }
+  button { font-size: .8rem; }
+  pre { background: #f6f8fa; padding: .6rem; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>Comzy Inspector</h1>
+<p class="dim">Most recent requests through the tunnel. JSON at <a href="/api/requests">/api/requests</a>; add ?tag=NAME for one tunnel or route.</p>
+<p class="dim" id="load"></p>
+<div id="requests"></div>
+<script>
+const open = new Set();
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;'}[c]));
+}
+
+function headers(h) {
+  if (!h) return '';
+  return Object.keys(h).sort().map(k => [].concat(h[k]).map(v => esc(k) + ': ' + esc(v)).join('\n')).join('\n');
+}
+
+function body(b) {
+  if (!b) return '<span class="dim">(empty)</span>';
+  if (b.binary) return '<span class="dim">' + b.size + ' bytes of ' + esc(b.contentType || 'binary data') + '</span>';
+  return '<pre>' + esc(b.text) + (b.truncated ? '\n… truncated, ' + b.size + ' bytes total' : '') + '</pre>';
+}
+
+function status(r) {
+  if (r.pending) return '<span class="dim">…</span>';
+  if (r.error) return '<span class="err">ERR</span>';
+  return '<span class="s' + String(r.status)[0] + '">' + r.status + '</span>';
+}
+
+async function refresh() {
+  const stats = await (await fetch('/api/stats')).json();
+  document.getElementById('load').innerHTML = (stats.paused ? '<span class="err">PAUSED</span> · ' : '') +
+    stats.inFlight + ' in flight · ' + stats.queued + ' queued' +
+    (stats.cacheHits + stats.cacheMisses ? ' · cache hits ' + Math.round(100 * stats.cacheHits / (stats.cacheHits + stats.cacheMisses)) + '%' : '');
+  const res = await fetch('/api/requests' + location.search);
+  const list = await res.json();
+  document.getElementById('requests').innerHTML = list.map(r =>
+    '<details data-id="' + r.id + '"' + (open.has(r.id) ? ' open' : '') + '>' +
+    '<summary>' + (r.tunnel ? '<span class="tag">' + esc(r.tunnel) + '</span> ' : '') +
+    status(r) + ' ' + esc(r.method) + ' ' + esc(r.path) +
+    (r.route ? ' <span class="tag">route ' + esc(r.route) + '</span>' : '') +
+    (r.webhook ? ' <span class="' + (r.webhook === 'verified' ? 'tag' : 'err') + '">webhook ' + esc(r.webhook) + '</span>' : '') +
+    (r.rateLimited ? ' <span class="err">rate-limited</span>' : '') +
+    (r.replay ? ' <span class="tag">replay of #' + r.replayOf + '</span>' : '') +
+    ' <span class="dim">' + r.durationMs.toFixed(1) + 'ms · ' + new Date(r.time).toLocaleTimeString() + '</span></summary>' +
+    (r.error ? '<p class="err">' + esc(r.error) + '</p>' : '') +
+    (r.replayable ? '<p><button onclick="replay(' + r.id + ')">Replay</button></p>' : '<p class="dim">Body ' + (r.requestStreamed ? 'streamed' : 'truncated') + ', cannot replay.</p>') +
+    '<h4>Request headers</h4><pre>' + headers(r.requestHeaders) + '</pre>' +
+    '<h4>Request body</h4>' + (r.requestStreamed ? '<span class="dim">(' + (r.requestBody.size ? r.requestBody.size + ' bytes, ' : '') + 'streamed, not recorded)</span>' : body(r.requestBody)) +
+    '<h4>Response headers</h4><pre>' + headers(r.responseHeaders) + '</pre>' +
+    '<h4>Response body</h4>' + (r.streamed ? '<span class="dim">(streamed, not recorded)</span>' : body(r.responseBody)) +
+    '</details>').join('') || '<p class="dim">No requests yet.</p>';
+  document.querySelectorAll('details').forEach(d => d.addEventListener('toggle', () => {
+    const id = Number(d.dataset.id);
+    d.open ? open.add(id) : open.delete(id);
+  }));
+}
+
+async function replay(id) {
+  const res = await fetch('/api/requests/' + id + '/replay', {method: 'POST'});
+  if (res.status === 404 || res.status === 409) alert((await res.json()).error);
+  refresh();
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
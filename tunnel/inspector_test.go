@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// What the local app receives and the edge gets back is the same whether
+// the inspector keeps copies of the bodies or not
+func TestInspectorLeavesTrafficUnchanged(t *testing.T) {
+	upload := bytes.Repeat([]byte("line of an uploaded log file\n"), 8<<10)
+	page := bytes.Repeat([]byte("<p>a long page</p>\n"), 16<<10)
+	download := make([]byte, 1<<20)
+	for i := range download {
+		download[i] = byte(i * 13 / 7)
+	}
+
+	received := make(chan string, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var headers []string
+		for key, values := range r.Header {
+			headers = append(headers, key+": "+strings.Join(values, ", "))
+		}
+		sort.Strings(headers)
+		received <- fmt.Sprintf("%s %s\n%s\n%q", r.Method, r.URL, strings.Join(headers, "\n"), body)
+
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write(page)
+		case "/download":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(download)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"stored":%d}`, len(body))
+		}
+	}))
+	t.Cleanup(local.Close)
+
+	requests := []struct {
+		method, path string
+		headers      HeaderMap
+		body         []byte
+	}{
+		{"POST", "/logs?source=app", HeaderMap{"content-type": {"text/plain"}, "x-request-id": {"abc"}}, upload},
+		{"GET", "/page", HeaderMap{"accept": {"text/html"}}, nil},
+		{"GET", "/download", HeaderMap{}, nil},
+	}
+	// Everything the local app and the edge saw, with the inspector
+	// recording or not
+	traffic := func(t *testing.T, args ...string) []string {
+		edge := newFakeEdge(t)
+		conn := startEdgeTunnel(t, edge, local.URL, args...)
+		var seen []string
+		for i, r := range requests {
+			conn.request(i+1, r.method, r.path, r.headers, r.body)
+			resp, _ := conn.response(i+1, false)
+			delete(resp.Headers, "date")
+			seen = append(seen, <-received, fmt.Sprintf("%d %v %v\n%q", resp.Status, resp.Headers, resp.Error, resp.Body))
+		}
+		return seen
+	}
+
+	var inspected []string
+	t.Run("inspected", func(t *testing.T) {
+		inspected = traffic(t, "--no-inspect=false", "--inspect-port", "0", "--inspect-body-limit", "1KB")
+		captures := inspector.list()
+		if len(captures) != len(requests) {
+			t.Fatalf("the inspector recorded %d requests, want %d", len(captures), len(requests))
+		}
+		var truncated int
+		for _, c := range captures {
+			for _, body := range []*CapturedBody{c.RequestBody, c.ResponseBody} {
+				if body != nil && len(body.Text) > 1<<10 {
+					t.Errorf("%s %s: kept %d bytes of a body over the 1KB limit", c.Method, c.Path, len(body.Text))
+				}
+				if body != nil && body.Truncated {
+					truncated++
+				}
+			}
+		}
+		// The upload and the page
+		if truncated != 2 {
+			t.Errorf("%d bodies marked truncated, want 2", truncated)
+		}
+	})
+	t.Run("not inspected", func(t *testing.T) {
+		plain := traffic(t, "--no-inspect")
+		if len(inspected) != len(plain) {
+			t.Fatal("the inspected run failed")
+		}
+		for i := range plain {
+			if inspected[i] != plain[i] {
+				t.Errorf("traffic differs with the inspector on:\n%.2000s\nand off:\n%.2000s", inspected[i], plain[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Client IP policy from --allow-cidr and --deny-cidr. Deny rules win over
+// allow rules; with any allow rule, everything else is denied.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// nil when no rules are given, which lets every request through
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = parsePrefixes("--allow-cidr", allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes("--deny-cidr", deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Parse CIDRs, accepting a bare address as a single-host prefix
+func parsePrefixes(flag string, values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s %q (use a CIDR such as 10.0.0.0/8 or 2001:db8::/32)", flag, value)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Check a client address. ok is false when the edge sent no usable address,
+// which is only allowed when there is no allowlist.
+func (f *ipFilter) allows(ip netip.Addr, ok bool) bool {
+	if f == nil {
+		return true
+	}
+	if !ok {
+		return len(f.allow) == 0
+	}
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Address that connected to the edge: the last X-Forwarded-For entry,
+// which the edge appends, else X-Real-IP. Earlier entries come from the
+// client and can say anything, so the IP filter, rate limits and
+// forwarded headers all go by this one.
+func clientIP(headers HeaderMap) (netip.Addr, bool) {
+	if values := headers["x-forwarded-for"]; len(values) > 0 {
+		entries := strings.Split(values[len(values)-1], ",")
+		if addr, ok := parseClientIP(entries[len(entries)-1]); ok {
+			return addr, true
+		}
+	}
+	return parseClientIP(headers.Get("x-real-ip"))
+}
+
+func parseClientIP(value string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.Trim(strings.TrimSpace(value), "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Describe a client address for logs
+func describeIP(ip netip.Addr, ok bool) string {
+	if !ok {
+		return "unknown client IP"
+	}
+	return ip.String()
+}
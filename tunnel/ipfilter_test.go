@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientIPIsTheEdgeAppendedEntry(t *testing.T) {
+	for _, tc := range []struct {
+		headers HeaderMap
+		want    string
+	}{
+		{HeaderMap{"x-forwarded-for": {"203.0.113.7"}}, "203.0.113.7"},
+		// The client wrote the first entries, the edge the last one
+		{HeaderMap{"x-forwarded-for": {"10.0.0.1, 127.0.0.1, 203.0.113.7"}}, "203.0.113.7"},
+		{HeaderMap{"x-forwarded-for": {"10.0.0.1", "203.0.113.7"}}, "203.0.113.7"},
+		{HeaderMap{"x-forwarded-for": {"[2001:db8::1]"}}, "2001:db8::1"},
+		{HeaderMap{"x-forwarded-for": {"::ffff:203.0.113.7"}}, "203.0.113.7"},
+		{HeaderMap{"x-forwarded-for": {"10.0.0.1, garbage"}, "x-real-ip": {"198.51.100.2"}}, "198.51.100.2"},
+		{HeaderMap{"x-real-ip": {"198.51.100.2"}}, "198.51.100.2"},
+		{HeaderMap{}, ""},
+	} {
+		ip, ok := clientIP(tc.headers)
+		if got := ip.String(); !ok && tc.want != "" || ok && got != tc.want {
+			t.Errorf("clientIP(%v) = %v, %v; want %q", tc.headers, ip, ok, tc.want)
+		}
+	}
+}
+
+// A denied client can't get in by putting an allowed address first in
+// X-Forwarded-For, over HTTP or WebSocket
+func TestSpoofedForwardedForIsDenied(t *testing.T) {
+	var reached atomic.Int64
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--allow-cidr", "10.0.0.0/8")
+	spoofed := HeaderMap{"x-forwarded-for": {"10.1.2.3, 203.0.113.7"}}
+
+	conn.request(1, "GET", "/", spoofed, nil)
+	if resp, _ := conn.response(1, false); resp.Status != http.StatusForbidden {
+		t.Errorf("HTTP: status %d, want 403", resp.Status)
+	}
+
+	conn.send(WSMessage{Type: "ws-open", ID: "2", Path: "/socket", Headers: spoofed})
+	if m := conn.next(2, time.After(edgeTimeout)); m.Type != "ws-close" || m.Reason != "forbidden" {
+		t.Errorf("WebSocket: got %q %q, want ws-close forbidden", m.Type, m.Reason)
+	}
+	if n := reached.Load(); n > 0 {
+		t.Errorf("the local app was reached %d times", n)
+	}
+}
@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Config for a tunnel embedded in another Go program
+type Config struct {
+	Port int    // local port to expose
+	Host string // local host, "localhost" when empty
+
+	// Token to authenticate with, used by every tunnel in the process as
+	// --token is. Empty falls back to COMZY_TOKEN, then the saved login,
+	// then an anonymous session.
+	Token string
+
+	ServerURL string // tunnel server; COMZY_SERVER_URL, then WSServerURL when empty
+	Subdomain string
+	Region    string
+
+	// Further command line options, e.g. {"--basic-auth", "user:pass"}.
+	// Embedded tunnels default to --quiet, --yes and --no-inspect, which
+	// Args can turn back off. Logging options apply to the whole process.
+	// Config files aren't read.
+	Args []string
+
+	// Called on each Event. It runs on the tunnel's goroutines, so it
+	// should return quickly.
+	OnEvent func(Event)
+}
+
+// Something that happened to a running tunnel
+type Event struct {
+	Type string // EventConnected, EventRegistered, EventURLChanged, EventDisconnected, EventReconnecting or EventRequest
+	Time time.Time
+
+	URL         string // EventRegistered and EventURLChanged: the public URL
+	PreviousURL string // EventURLChanged: the public URL until now
+	Reason      string // EventDisconnected: why the connection ended
+
+	// EventRequest: a request that has been answered, or refused
+	Method   string
+	Path     string
+	Status   int // 0 when no response was sent
+	Duration time.Duration
+}
+
+// Returned by Start after Close
+var ErrClosed = errors.New("tunnel closed")
+
+// A tunnel embedded in another Go program
+type Tunnel struct {
+	group   *tunnelGroup
+	tunnel  *tunnel
+	started atomic.Bool
+}
+
+// Check cfg and prepare a tunnel, which isn't connected until Start
+func New(cfg Config) (*Tunnel, error) {
+	if comzyDirErr != nil {
+		return nil, comzyDirErr
+	}
+
+	opts := defaultOptions()
+	opts.Quiet, opts.Yes, opts.NoInspect = true, true, true
+	fs := opts.flagSet()
+	if err := fs.Parse(cfg.Args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument in Config.Args: %s", fs.Arg(0))
+	}
+	opts.Port = cfg.Port
+	if cfg.Host != "" {
+		opts.Host = cfg.Host
+	}
+	if cfg.Token != "" {
+		opts.Token = cfg.Token
+	}
+	if cfg.Subdomain != "" {
+		opts.Subdomain = cfg.Subdomain
+	}
+	if cfg.Region != "" {
+		opts.Region = cfg.Region
+	}
+	fs.Visit(func(f *flag.Flag) { opts.sources[f.Name] = SourceFlag })
+	if cfg.ServerURL != "" {
+		opts.Server, opts.sources["server"] = cfg.ServerURL, SourceFlag
+	}
+	opts.applyEnv()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := setupLogging(opts); err != nil {
+		return nil, err
+	}
+
+	group := newTunnelGroup()
+	if cfg.OnEvent != nil {
+		group.observe = func(t *tunnel, event, detail string) {
+			e := Event{Type: event, Time: time.Now()}
+			switch event {
+			case EventRegistered:
+				e.URL = t.publicEndpoint()
+			case EventURLChanged:
+				e.URL, e.PreviousURL = t.publicEndpoint(), publicURL(detail)
+			case EventDisconnected:
+				e.Reason = detail
+			}
+			cfg.OnEvent(e)
+		}
+		opts.onRequest = func(r *requestLog) {
+			cfg.OnEvent(Event{
+				Type:     EventRequest,
+				Time:     time.Now(),
+				Method:   r.method,
+				Path:     r.path,
+				Status:   r.status,
+				Duration: time.Since(r.start),
+			})
+		}
+	}
+	if err := prepareGroup(group, []*Options{opts}); err != nil {
+		return nil, err
+	}
+	return &Tunnel{group: group, tunnel: group.tunnels[0]}, nil
+}
+
+// Connect and serve requests, reconnecting as the command line does,
+// until ctx is done or Close is called. Returns the context's error or
+// ErrClosed then, or the error that ended the tunnel.
+func (t *Tunnel) Start(ctx context.Context) error {
+	if t.started.Swap(true) {
+		return fmt.Errorf("tunnel already started")
+	}
+	return runGroup(ctx, t.group)
+}
+
+// Public URL of the tunnel, "" until it has registered. It can change
+// when the tunnel registers again after a reconnect.
+func (t *Tunnel) URL() string {
+	return t.tunnel.publicEndpoint()
+}
+
+// Stop the tunnel, letting in-flight requests finish as on Ctrl-C
+func (t *Tunnel) Close() error {
+	t.group.shutdown(ErrClosed)
+	return nil
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Limits of the account's plan, sent by the server with "registered".
+// Zero means no limit.
+type PlanLimits struct {
+	MaxBodySize int64 `json:"maxBodySize,omitempty"` // bytes, request and response bodies
+	MaxRequests int64 `json:"maxRequests,omitempty"` // requests per registration
+}
+
+// Describe the limits for humans
+func (l *PlanLimits) String() string {
+	var parts []string
+	if l.MaxBodySize > 0 {
+		parts = append(parts, fmt.Sprintf("max body size %s", ByteSize(l.MaxBodySize)))
+	}
+	if l.MaxRequests > 0 {
+		parts = append(parts, fmt.Sprintf("max %d requests per session", l.MaxRequests))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Request or response refused locally because it would exceed a plan limit
+type limitError struct {
+	status  int
+	message string
+}
+
+func (e *limitError) Error() string {
+	return fmt.Sprintf("%s; login at %s for higher limits", e.message, portalURL)
+}
+
+// Limits from the most recent registration, kept for "comzy status"
+func limitsFile() string {
+	return filepath.Join(comzyDir, "limits.json")
+}
+
+// Remember the latest limits, or forget them if the server sent none
+func saveLimits(limits *PlanLimits) error {
+	if limits == nil || limits.String() == "" {
+		if err := os.Remove(limitsFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := ensureComzyDir(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(limits)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(limitsFile(), data, 0644)
+}
+
+// Limits saved by the last tunnel session, nil if there are none
+func loadLimits() *PlanLimits {
+	data, err := os.ReadFile(limitsFile())
+	if err != nil {
+		return nil
+	}
+	var limits PlanLimits
+	if err := json.Unmarshal(data, &limits); err != nil {
+		return nil
+	}
+	return &limits
+}
+
+// Apply the limits from a registration and reset the request count
+func (c *tunnelConn) setLimits(limits *PlanLimits) {
+	c.limits.Store(limits)
+	atomic.StoreInt64(&c.requests, 0)
+}
+
+// Count an incoming request and check it against the plan
+func (c *tunnelConn) checkRequest(bodySize int) error {
+	n := atomic.AddInt64(&c.requests, 1)
+	limits := c.limits.Load()
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxRequests > 0 && n > limits.MaxRequests {
+		return &limitError{http.StatusTooManyRequests,
+			fmt.Sprintf("plan limit reached: max %d requests per session", limits.MaxRequests)}
+	}
+	if limits.MaxBodySize > 0 && int64(bodySize) > limits.MaxBodySize {
+		return &limitError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("request body of %s exceeds the plan's max body size of %s", ByteSize(bodySize), ByteSize(limits.MaxBodySize))}
+	}
+	return nil
+}
+
+// Check a response body size against the plan. Negative sizes are unknown.
+func (c *tunnelConn) checkResponse(size int64) error {
+	limits := c.limits.Load()
+	if limits == nil || limits.MaxBodySize <= 0 || size <= limits.MaxBodySize {
+		return nil
+	}
+	return &limitError{http.StatusBadGateway,
+		fmt.Sprintf("response body of %s exceeds the plan's max body size of %s", ByteSize(size), ByteSize(limits.MaxBodySize))}
+}
@@ -0,0 +1,332 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Log levels, in increasing severity
+type logLevel int
+
+const (
+	LevelDebug logLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid --log-level %q (use debug, info, warn or error)", name)
+}
+
+// Log formats
+const (
+	LogFormatText = "text" // colored lines on the console, timestamped in files
+	LogFormatJSON = "json" // one JSON object per line
+)
+
+func validateLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("invalid --log-format %q (use text or json)", format)
+	}
+	return nil
+}
+
+// Where log lines go. Configured once at startup by setupLogging.
+type logSink struct {
+	mu     sync.Mutex
+	level  logLevel
+	format string
+	stdout bool
+	file   io.Writer
+
+	// Receives console lines instead of stdout while set, see captureConsole
+	tap func(level logLevel, line string)
+
+	// Tunnel and route tags kept by --log-filter, nil for all
+	tags []string
+}
+
+var logs = &logSink{level: LevelInfo, format: LogFormatText, stdout: true}
+
+// Banners, tables and spacing meant for a person at a terminal. Discarded
+// when the console gets JSON or nothing at all.
+var console io.Writer = os.Stdout
+
+// Whether the console is showing banners rather than just log lines
+func showBanners() bool {
+	return console != io.Discard
+}
+
+// Hand log lines to tap and discard console output while a full-screen
+// display owns the terminal. Lines below --log-level are still dropped and
+// --log-file still gets every line. The returned func undoes it.
+func captureConsole(tap func(level logLevel, line string)) func() {
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	saved := console
+	logs.tap, console = tap, io.Discard
+	return func() {
+		logs.mu.Lock()
+		defer logs.mu.Unlock()
+		logs.tap, console = nil, saved
+	}
+}
+
+// Apply the logging options of a tunnel run
+func setupLogging(opts *Options) error {
+	level, err := parseLogLevel(opts.LogLevel)
+	if err != nil {
+		return err
+	}
+	tags, err := parseLogFilter(opts.LogFilter)
+	if err != nil {
+		return err
+	}
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+	logs.level = level
+	logs.format = opts.LogFormat
+	logs.tags = tags
+	logs.stdout = !opts.Quiet
+	if opts.LogFile != "" {
+		f, err := os.OpenFile(opts.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		logs.file = f
+	}
+	if !logs.stdout || logs.format != LogFormatText {
+		console = io.Discard
+	}
+	return nil
+}
+
+// A structured value attached to a log line
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func (s *logSink) write(level logLevel, name, prefix, message, color string, fields []logField) {
+	s.writeDetail(level, name, prefix, message, color, fields, nil)
+}
+
+// Write a line followed by indented detail lines in one go, so lines
+// logged meanwhile can't come between them. JSON lines carry the detail
+// in their fields instead.
+func (s *logSink) writeDetail(level logLevel, name, prefix, message, color string, fields []logField, detail []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if level < s.level || !s.shows(name, fields) {
+		return
+	}
+
+	now := time.Now()
+	var structured []byte
+	if s.format == LogFormatJSON {
+		structured = jsonLine(now, level, name, message, fields)
+	}
+	if s.tap != nil {
+		s.tap(level, prefix+message)
+	} else if s.stdout {
+		if structured != nil {
+			os.Stdout.Write(structured)
+		} else {
+			var out strings.Builder
+			fmt.Fprintf(&out, "%s%s%s%s\n", color, prefix, message, ColorReset)
+			for _, line := range detail {
+				fmt.Fprintf(&out, "%s%s  %s%s\n", ColorGray, prefix, line, ColorReset)
+			}
+			os.Stdout.WriteString(out.String())
+		}
+	}
+	if s.file != nil {
+		if structured == nil {
+			var out strings.Builder
+			fmt.Fprintf(&out, "%s %-5s %s%s\n", now.Format(time.RFC3339), strings.ToUpper(level.String()), prefix, message)
+			for _, line := range detail {
+				fmt.Fprintf(&out, "%s  %s\n", prefix, line)
+			}
+			structured = []byte(out.String())
+		}
+		s.file.Write(structured)
+	}
+}
+
+// Encode one log line, keeping the common keys first
+func jsonLine(now time.Time, level logLevel, name, message string, fields []logField) []byte {
+	if name != "" {
+		fields = append([]logField{{"tunnel", name}}, fields...)
+	}
+	fields = append([]logField{
+		{"timestamp", now.Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"msg", message},
+	}, fields...)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONValue(&buf, f.key)
+		buf.WriteByte(':')
+		if err := writeJSONValue(&buf, f.value); err != nil {
+			writeJSONValue(&buf, fmt.Sprint(f.value))
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// Append v as JSON, leaving characters such as > unescaped for grep
+func writeJSONValue(buf *bytes.Buffer, v interface{}) error {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	buf.Write(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return nil
+}
+
+// Outcome of one tunneled request, logged when it finishes
+type requestLog struct {
+	id        MessageID
+	requestID string // X-Request-Id sent to the local app
+	method    string
+	path      string
+	backend   string // "" when rejected before reaching a backend
+	route     string // --route that chose the backend, "" for none
+	status    int    // 0 when no response was sent
+	note      string // why it was rejected or failed
+	user      string // portal identity, with --oauth-allow
+	start     time.Time
+
+	bytesIn  int64 // request body
+	bytesOut int64 // response body
+
+	// Start of the bodies, with --log-bodies; "" for none or binary
+	requestBody  string
+	responseBody string
+}
+
+// Characters of a body shown with --log-bodies
+const LogBodyPreview = 120
+
+// The start of a text body on one line, "" for an empty or binary one
+func previewBody(data []byte, contentType string) string {
+	if len(data) == 0 || isBinaryContentType(contentType) {
+		return ""
+	}
+	// Enough bytes for the preview, without a rune cut in half
+	prefix := data[:min(len(data), LogBodyPreview*utf8.UTFMax)]
+	for i := 0; i < utf8.UTFMax && len(prefix) < len(data) && !utf8.Valid(prefix); i++ {
+		prefix = prefix[:len(prefix)-1]
+	}
+	if !utf8.Valid(prefix) {
+		return ""
+	}
+	text := strings.Join(strings.Fields(string(prefix)), " ")
+	if runes := []rune(text); len(runes) > LogBodyPreview {
+		return string(runes[:LogBodyPreview]) + "..."
+	}
+	if len(prefix) < len(data) {
+		text += "..."
+	}
+	return text
+}
+
+// Log a finished request with its status and latency
+func (l Logger) Request(r *requestLog) {
+	elapsed := time.Since(r.start)
+	message := r.method + " " + r.path + " ->"
+	if r.backend != "" {
+		message += " " + r.backend
+	}
+	if r.route != "" {
+		message += " [" + r.route + "]"
+	}
+	if r.status != 0 {
+		message += fmt.Sprintf(" %d", r.status)
+	} else {
+		message += " no response"
+	}
+	message += fmt.Sprintf(" in %dms", elapsed.Milliseconds())
+	if r.requestID != "" {
+		message += " #" + r.requestID
+	}
+	if r.bytesOut > 0 {
+		message += ", " + formatBytes(r.bytesOut)
+	}
+	if r.user != "" {
+		message += " by " + r.user
+	}
+	if r.note != "" {
+		message += " (" + r.note + ")"
+	}
+	var detail []string
+	if r.requestBody != "" {
+		detail = append(detail, "> "+r.requestBody)
+	}
+	if r.responseBody != "" {
+		detail = append(detail, "< "+r.responseBody)
+	}
+
+	fields := []logField{
+		{"id", r.id},
+		{"request_id", r.requestID},
+		{"method", r.method},
+		{"path", r.path},
+		{"status", r.status},
+		{"duration_ms", elapsed.Milliseconds()},
+		{"bytes_in", r.bytesIn},
+		{"bytes_out", r.bytesOut},
+	}
+	if r.backend != "" {
+		fields = append(fields, logField{"backend", r.backend})
+	}
+	if r.route != "" {
+		fields = append(fields, logField{"route", r.route})
+	}
+	if r.user != "" {
+		fields = append(fields, logField{"user", r.user})
+	}
+	if r.note != "" {
+		fields = append(fields, logField{"note", r.note})
+	}
+	if r.requestBody != "" {
+		fields = append(fields, logField{"request_body", r.requestBody})
+	}
+	if r.responseBody != "" {
+		fields = append(fields, logField{"response_body", r.responseBody})
+	}
+	// Colored by status class, so failures stand out; no response at all
+	// is a failure too
+	color := ColorRed
+	if r.status != 0 {
+		color = statusColor(r.status)
+	}
+	logs.writeDetail(LevelInfo, l.name, l.prefix, message, color, fields, detail)
+}
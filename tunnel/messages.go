@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message types sent by the tunnel server
+const (
+	MsgRegistered = "registered"
+	MsgRequest    = "request" // also "" from servers that predate the field
+	MsgError      = "error"
+	MsgCancel     = "cancel"
+	MsgReconnect  = "reconnect"
+
+	msgWebSocket = "ws-*"  // every ws- message, see wsproxy.go
+	msgTCP       = "tcp-*" // every tcp- message, see tcpproxy.go
+)
+
+// ID of a message, kept as the JSON token the server sent so it goes back
+// exactly as received: a string, a number too large for a float64 to hold,
+// or anything else. "" when the message has none.
+type MessageID string
+
+func (id MessageID) MarshalJSON() ([]byte, error) {
+	if id == "" {
+		return []byte("null"), nil
+	}
+	return []byte(id), nil
+}
+
+func (id *MessageID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*id = ""
+		return nil
+	}
+	*id = MessageID(data)
+	return nil
+}
+
+// The ID for logs and for keying per-request state: a string without its
+// quotes, anything else as sent
+func (id MessageID) String() string {
+	var s string
+	if json.Unmarshal([]byte(id), &s) == nil {
+		return s
+	}
+	return string(id)
+}
+
+// Kind of a server message as dispatched by the read loop. Types this
+// client doesn't know are returned as is.
+func messageKind(messageType string) string {
+	switch {
+	case messageType == "":
+		return MsgRequest
+	case strings.HasPrefix(messageType, "ws-"):
+		return msgWebSocket
+	case strings.HasPrefix(messageType, "tcp-"):
+		return msgTCP
+	}
+	return messageType
+}
+
+// The server asked the client to reconnect, e.g. before a restart
+type reconnectRequest struct {
+	reason string
+}
+
+func (e *reconnectRequest) Error() string {
+	if e.reason == "" {
+		return "server requested a reconnect"
+	}
+	return "server requested a reconnect: " + e.reason
+}
+
+// Most of a message that can't be handled logged at debug level
+const loggedMessageLimit = 512
+
+// Answer to a message with an ID that can't be handled, when no other
+// answer fits its type
+type NackMessage struct {
+	Type   string    `json:"type"` // "nack"
+	ID     MessageID `json:"id"`
+	Reason string    `json:"reason"`
+}
+
+// Type and ID of a message, read even when the rest of it doesn't parse
+func peekMessage(message []byte) (messageType string, id MessageID) {
+	var fields struct {
+		Type string    `json:"type"`
+		ID   MessageID `json:"id"`
+	}
+	json.Unmarshal(message, &fields)
+	return fields.Type, fields.ID
+}
+
+// Log a message that couldn't be parsed, and answer it
+func (t *tunnel) malformedMessage(ws *tunnelConn, message []byte, err error) {
+	messageType, id := peekMessage(message)
+	described := "message"
+	if messageType != "" {
+		described = fmt.Sprintf("%q message", messageType)
+	}
+	if id != "" {
+		described += " " + id.String()
+	}
+	t.log.Error(fmt.Sprintf("Failed to parse %s: %v", described, err))
+	t.refuseMessage(ws, message, "malformed message")
+}
+
+// Log a message at debug level and, if it has an ID, tell the server it
+// won't be handled so nothing is left waiting on it
+func (t *tunnel) refuseMessage(ws *tunnelConn, message []byte, reason string) {
+	t.log.Debug(fmt.Sprintf("Unhandled message: %s", truncate(string(message), loggedMessageLimit)))
+	messageType, id := peekMessage(message)
+	if id == "" {
+		return
+	}
+	switch messageKind(messageType) {
+	case MsgRequest:
+		sendRejection(ws, id, 400, "Bad Request: "+reason, nil)
+	case msgWebSocket:
+		ws.writeJSON(wsQueueKey(id.String()), WSMessage{Type: "ws-close", ID: id, Code: websocket.CloseProtocolError, Reason: reason})
+	case msgTCP:
+		ws.writeJSON(tcpQueueKey(id.String()), TCPMessage{Type: "tcp-close", ID: id, Reason: reason})
+	default:
+		ws.WriteJSON(NackMessage{Type: "nack", ID: id, Reason: reason})
+	}
+}
+
+// How often unknown message types are reported
+const UnknownMessageWarnEvery = time.Minute
+
+// Count of messages with types this client doesn't understand, reported
+// at most once per UnknownMessageWarnEvery so a newer server can't flood
+// the log
+type unknownMessages struct {
+	mu         sync.Mutex
+	total      int64
+	suppressed int64
+	lastWarn   time.Time
+}
+
+func (u *unknownMessages) record(messageType string, log Logger) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.total++
+	if time.Since(u.lastWarn) < UnknownMessageWarnEvery {
+		u.suppressed++
+		return
+	}
+	message := fmt.Sprintf("Ignoring %q message from the tunnel server, a newer comzy may support it", messageType)
+	if u.suppressed > 0 {
+		message += fmt.Sprintf(" (%d more unknown messages since the last warning)", u.suppressed)
+	}
+	log.Warning(message)
+	u.lastWarn = time.Now()
+	u.suppressed = 0
+}
+
+// Unknown messages received so far
+func (u *unknownMessages) count() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.total
+}
@@ -0,0 +1,183 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Check a --metrics-addr and bind to loopback when it names no host, so
+// metrics aren't exposed to the network by accident
+func metricsAddr(addr string) (string, error) {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid --metrics-addr %q (use HOST:PORT or :PORT)", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid --metrics-addr port %q", port)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Serve /metrics for group on addr, returning its URL
+func serveMetrics(addr string, group *tunnelGroup) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if !isLoopbackHost(host) {
+		logWarning(fmt.Sprintf("Metrics are served on %s, which other machines may reach", addr))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, group)
+	})
+	mux.HandleFunc("GET /healthz", group.serveHealth)
+	go http.Serve(listener, mux)
+	return "http://" + listener.Addr().String() + "/metrics", nil
+}
+
+// Write the metrics in the Prometheus text format. The request counters are
+// the ones behind the stats summary, so both agree.
+func writeMetrics(out io.Writer, group *tunnelGroup) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	s := traffic
+	s.mu.Lock()
+	requests := make([]methodStatus, 0, len(s.byMethod))
+	for key := range s.byMethod {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].method != requests[j].method {
+			return requests[i].method < requests[j].method
+		}
+		return requests[i].status < requests[j].status
+	})
+	metricHeader(w, "comzy_requests_total", "counter", "Requests received through the tunnel, by method and status (none when no response was sent)")
+	for _, key := range requests {
+		fmt.Fprintf(w, "comzy_requests_total{method=%s,status=%s} %d\n", labelValue(key.method), labelValue(statusLabel(key.status)), s.byMethod[key])
+	}
+	metricHeader(w, "comzy_request_duration_seconds", "histogram", "Round trip to the local app")
+	writeHistogram(w, "comzy_request_duration_seconds", s.latencyHist)
+	metricHeader(w, "comzy_response_size_bytes", "histogram", "Size of response bodies from the local app")
+	writeHistogram(w, "comzy_response_size_bytes", s.sizeHist)
+	metricHeader(w, "comzy_request_bytes_total", "counter", "Request body bytes forwarded to the local app")
+	fmt.Fprintf(w, "comzy_request_bytes_total %d\n", s.bytesIn)
+	metricHeader(w, "comzy_response_bytes_total", "counter", "Response body bytes sent back through the tunnel")
+	fmt.Fprintf(w, "comzy_response_bytes_total %d\n", s.bytesOut)
+	s.mu.Unlock()
+
+	metricHeader(w, "comzy_rate_limited_total", "counter", "Requests answered 429 by --rate-limit or --rate-limit-global")
+	fmt.Fprintf(w, "comzy_rate_limited_total %d\n", s.rateLimited.Load())
+
+	metricHeader(w, "comzy_local_retries_total", "counter", "Idempotent requests sent again after the local app refused or reset the connection")
+	fmt.Fprintf(w, "comzy_local_retries_total %d\n", s.localRetries.Load())
+	metricHeader(w, "comzy_local_retries_recovered_total", "counter", "Requests that got a response after being retried")
+	fmt.Fprintf(w, "comzy_local_retries_recovered_total %d\n", s.retriesRecovered.Load())
+
+	metricHeader(w, "comzy_cache_hits_total", "counter", "Requests answered from --cache")
+	fmt.Fprintf(w, "comzy_cache_hits_total %d\n", s.cacheHits.Load())
+	metricHeader(w, "comzy_cache_misses_total", "counter", "Cacheable requests --cache had no response for")
+	fmt.Fprintf(w, "comzy_cache_misses_total %d\n", s.cacheMisses.Load())
+
+	metricHeader(w, "comzy_websocket_write_errors_total", "counter", "Failed writes to the tunnel connection")
+	fmt.Fprintf(w, "comzy_websocket_write_errors_total %d\n", s.wsWriteFails.Load())
+
+	metricHeader(w, "comzy_tunnel_connected", "gauge", "Whether the tunnel is connected to the server")
+	for _, t := range group.tunnels {
+		t.mu.Lock()
+		connected := 0
+		if t.ws != nil {
+			connected = 1
+		}
+		t.mu.Unlock()
+		fmt.Fprintf(w, "comzy_tunnel_connected{tunnel=%s} %d\n", labelValue(t.opts.tag), connected)
+	}
+	metricHeader(w, "comzy_tunnel_reconnects_total", "counter", "Connections made after the first")
+	for _, t := range group.tunnels {
+		fmt.Fprintf(w, "comzy_tunnel_reconnects_total{tunnel=%s} %d\n", labelValue(t.opts.tag), max(t.connects.Load()-1, 0))
+	}
+	metricHeader(w, "comzy_inflight_requests", "gauge", "Requests being handled")
+	for _, t := range group.tunnels {
+		fmt.Fprintf(w, "comzy_inflight_requests{tunnel=%s} %d\n", labelValue(t.opts.tag), t.active.Load())
+	}
+	metricHeader(w, "comzy_tunnel_requests_total", "counter", "Requests received by the tunnel this session, as in comzy history")
+	for _, t := range group.tunnels {
+		fmt.Fprintf(w, "comzy_tunnel_requests_total{tunnel=%s} %d\n", labelValue(t.opts.tag), t.target.totals.requests.Load())
+	}
+	metricHeader(w, "comzy_tunnel_bytes_total", "counter", "Body bytes the tunnel moved this session, by direction, as counted against --budget")
+	for _, t := range group.tunnels {
+		fmt.Fprintf(w, "comzy_tunnel_bytes_total{tunnel=%s,direction=\"in\"} %d\n", labelValue(t.opts.tag), t.target.totals.bytesIn.Load())
+		fmt.Fprintf(w, "comzy_tunnel_bytes_total{tunnel=%s,direction=\"out\"} %d\n", labelValue(t.opts.tag), t.target.totals.bytesOut.Load())
+	}
+	metricHeader(w, "comzy_tunnel_budget_remaining_bytes", "gauge", "Bytes left of --budget")
+	for _, t := range group.tunnels {
+		if t.target.budget != nil {
+			fmt.Fprintf(w, "comzy_tunnel_budget_remaining_bytes{tunnel=%s} %d\n", labelValue(t.opts.tag), t.target.budget.remaining(&t.target.totals))
+		}
+	}
+	metricHeader(w, "comzy_queued_requests", "gauge", "Requests waiting for --max-concurrent")
+	for _, t := range group.tunnels {
+		fmt.Fprintf(w, "comzy_queued_requests{tunnel=%s} %d\n", labelValue(t.opts.tag), t.target.limiter.waiting())
+	}
+	metricHeader(w, "comzy_route_requests_total", "counter", "Requests forwarded to each --route backend")
+	for _, t := range group.tunnels {
+		for _, b := range t.target.backends() {
+			if route := b.routeName(); route != "" {
+				fmt.Fprintf(w, "comzy_route_requests_total{tunnel=%s,route=%s} %d\n", labelValue(t.opts.tag), labelValue(route), b.served.Load())
+			}
+		}
+	}
+	metricHeader(w, "comzy_local_pool_saturated", "gauge", "Whether requests to a backend are queued for a free connection")
+	for _, t := range group.tunnels {
+		for _, b := range t.target.backends() {
+			saturated := 0
+			if b.client.saturated.Load() {
+				saturated = 1
+			}
+			fmt.Fprintf(w, "comzy_local_pool_saturated{tunnel=%s,target=%s} %d\n", labelValue(t.opts.tag), labelValue(b.Describe()), saturated)
+		}
+	}
+	metricHeader(w, "comzy_local_pool_queued_total", "counter", "Requests that waited for a free connection to a backend")
+	for _, t := range group.tunnels {
+		for _, b := range t.target.backends() {
+			fmt.Fprintf(w, "comzy_local_pool_queued_total{tunnel=%s,target=%s} %d\n", labelValue(t.opts.tag), labelValue(b.Describe()), b.client.queued.Load())
+		}
+	}
+}
+
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name string, h *histogram) {
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// Quote a label value as the text format expects
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
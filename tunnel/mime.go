@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Content types browsers insist on for common web assets
+type assetType struct {
+	expected []string // acceptable media types, the first is used by --fix-mime
+	fixable  bool     // safe to rewrite with --fix-mime
+	effect   string   // what the browser does with the wrong type
+}
+
+var assetTypes = map[string]assetType{
+	".js":   {[]string{"text/javascript", "application/javascript", "application/x-javascript"}, true, "browsers refuse to execute it as a module script"},
+	".mjs":  {[]string{"text/javascript", "application/javascript"}, true, "browsers refuse to execute it as a module script"},
+	".css":  {[]string{"text/css"}, true, "browsers ignore the stylesheet"},
+	".wasm": {[]string{"application/wasm"}, true, "WebAssembly.instantiateStreaming fails"},
+	".svg":  {[]string{"image/svg+xml"}, true, "the image will not render"},
+	".json": {[]string{"application/json"}, false, "fetch().json() callers and strict clients may reject it"},
+	".html": {[]string{"text/html"}, false, "the page may be shown as plain text or downloaded"},
+}
+
+// Paths already warned about, so each mismatch is reported once
+var mimeWarned sync.Map
+
+// Compare a successful response's content type against the file extension
+// in the request path, warning once per path and optionally fixing it
+func checkMIME(requestPath string, status int, headers HeaderMap, opts *Options) {
+	if status < 200 || status >= 300 || (opts.NoMIMEWarnings && !opts.FixMIME) {
+		return
+	}
+
+	cleanPath := requestPath
+	if i := strings.IndexAny(cleanPath, "?#"); i >= 0 {
+		cleanPath = cleanPath[:i]
+	}
+	asset, ok := assetTypes[strings.ToLower(path.Ext(cleanPath))]
+	if !ok {
+		return
+	}
+
+	contentType := headers.Get("content-type")
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, expected := range asset.expected {
+		if mediaType == expected {
+			return
+		}
+	}
+
+	if opts.FixMIME && asset.fixable {
+		headers.Set("content-type", asset.expected[0])
+		return
+	}
+
+	if opts.NoMIMEWarnings {
+		return
+	}
+	if _, seen := mimeWarned.LoadOrStore(opts.Name+" "+cleanPath, true); seen {
+		return
+	}
+	if contentType == "" {
+		contentType = "no Content-Type"
+	}
+	opts.log.Warning(fmt.Sprintf("MIME mismatch: %s is served as %s, expected %s; %s. This comes from the local server, not the tunnel (use --fix-mime to rewrite it).",
+		cleanPath, contentType, asset.expected[0], asset.effect))
+}
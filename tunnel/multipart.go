@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Capability under which the server sends the form fields of a multipart
+// request as an ordered "fields" list, repeated names included
+const CapFormFields = "form-fields"
+
+// Multipart bodies up to this size are rebuilt in memory, so they can be
+// replayed from the inspector; larger ones are streamed
+const MultipartBufferLimit = 64 << 10
+
+// One form field of a multipart request
+type FormField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Form fields in the order the client sent them. Servers without
+// CapFormFields only send the parsed body, whose keys are then sorted so
+// the order is at least stable, with arrays sent as repeated fields.
+func formFields(request IncomingRequest) []FormField {
+	if request.Fields != nil {
+		return request.Fields
+	}
+	bodyMap, ok := request.Body.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(bodyMap))
+	for name := range bodyMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var fields []FormField
+	for _, name := range names {
+		values, ok := bodyMap[name].([]interface{})
+		if !ok {
+			values = []interface{}{bodyMap[name]}
+		}
+		for _, value := range values {
+			fields = append(fields, FormField{Name: name, Value: formValue(value)})
+		}
+	}
+	return fields
+}
+
+// Text of a parsed form value: numbers as written rather than in
+// exponent form, objects as JSON
+func formValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(data)
+	}
+}
+
+var quoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Write a multipart form of the request's fields and files, each file with
+// the Content-Type it was uploaded with
+func writeMultipart(writer *multipart.Writer, request IncomingRequest) error {
+	for _, field := range formFields(request) {
+		if err := writer.WriteField(field.Name, field.Value); err != nil {
+			return err
+		}
+	}
+	for _, file := range request.Files {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(file.Fieldname), quoteEscaper.Replace(file.Originalname)))
+		header.Set("Content-Type", cmp.Or(file.Mimetype, "application/octet-stream"))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, file.Buffer.Data.reader()); err != nil {
+			return fmt.Errorf("file %q: %v", file.Originalname, err)
+		}
+	}
+	return writer.Close()
+}
+
+// Multipart body of a request, built in memory when it's small and
+// streamed to the local app through a pipe otherwise. body is nil when
+// streamed.
+func multipartBody(request IncomingRequest) (reader io.Reader, body []byte, contentType string) {
+	if request.bodySize() <= MultipartBufferLimit {
+		buf := &bytes.Buffer{}
+		writer := multipart.NewWriter(buf)
+		writeMultipart(writer, request)
+		return buf, buf.Bytes(), writer.FormDataContentType()
+	}
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipart(writer, request))
+	}()
+	return pr, nil, writer.FormDataContentType()
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// One part of a multipart form as the local app read it
+type formPart struct {
+	name, filename, contentType string
+	data                        []byte
+}
+
+func (p formPart) String() string {
+	return fmt.Sprintf("%s %q %s (%d bytes)", p.name, p.filename, p.contentType, len(p.data))
+}
+
+func TestMultipartFormArrivesAsSent(t *testing.T) {
+	parts := make(chan []formPart, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var got []formPart
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			data, _ := io.ReadAll(part)
+			got = append(got, formPart{part.FormName(), part.FileName(), part.Header.Get("Content-Type"), data})
+		}
+		parts <- got
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	fields := []FormField{
+		{"title", "Holiday"},
+		{"tags[]", "beach"},
+		{"tags[]", "sunset"},
+		{"album", "2026"},
+		{"tags[]", "family"},
+	}
+	// A small image is rebuilt in memory, a large one streamed
+	for i, size := range []int{2 << 10, MultipartBufferLimit * 3} {
+		image := make([]byte, size)
+		copy(image, "\x89PNG\r\n\x1a\n")
+		for j := 8; j < size; j++ {
+			image[j] = byte(j * 31)
+		}
+		conn.send(map[string]interface{}{
+			"type": MsgRequest, "id": i + 1, "method": "POST", "path": "/photos",
+			"headers": HeaderMap{"content-type": {"multipart/form-data; boundary=client"}},
+			"fields":  fields,
+			"files": []map[string]interface{}{{
+				"fieldname": "photo", "originalname": "sunset.png", "mimetype": "image/png",
+				"buffer": map[string]string{"data": base64.StdEncoding.EncodeToString(image)},
+			}},
+		})
+		if resp, _ := conn.response(i+1, false); resp.Status != 200 {
+			t.Fatalf("%d byte image: status %d", size, resp.Status)
+		}
+
+		got := <-parts
+		want := make([]formPart, 0, len(fields)+1)
+		for _, f := range fields {
+			want = append(want, formPart{f.Name, "", "", []byte(f.Value)})
+		}
+		want = append(want, formPart{"photo", "sunset.png", "image/png", image})
+		if len(got) != len(want) {
+			t.Fatalf("%d byte image: got parts %v, want %v", size, got, want)
+		}
+		for j := range want {
+			if got[j].String() != want[j].String() || !bytes.Equal(got[j].data, want[j].data) {
+				t.Errorf("%d byte image: part %d is %v, want %v", size, j, got[j], want[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// A dropped connection is only notified once it has stayed down this
+	// long, so quick reconnects go unnoticed
+	NotifyDisconnectAfter = 5 * time.Second
+
+	// At most NotifyLimit notifications are sent per tunnel in any
+	// NotifyWindow; the rest are counted and mentioned in the next one
+	NotifyLimit  = 4
+	NotifyWindow = 5 * time.Minute
+
+	// Longest a --notify-webhook POST may take
+	NotifyTimeout = 5 * time.Second
+)
+
+// How long the desktop notification command may run. PowerShell has to
+// stay up while its balloon is shown.
+const notifyCommandTimeout = 15 * time.Second
+
+// Body POSTed to --notify-webhook. Text makes it a valid Slack message too.
+type notification struct {
+	Event       string    `json:"event"` // EventDisconnected, EventRegistered once back, or EventURLChanged
+	Tunnel      string    `json:"tunnel,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	PreviousURL string    `json:"previousUrl,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Down        float64   `json:"downSeconds,omitempty"`
+	HeldBack    int       `json:"heldBack,omitempty"` // notifications dropped by the rate limit since the last one
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host,omitempty"`
+	Text        string    `json:"text"`
+}
+
+// Sends a tunnel's --notify and --notify-webhook notifications
+type notifier struct {
+	t       *tunnel
+	desktop bool
+	webhook string
+	client  *http.Client
+
+	mu        sync.Mutex
+	downSince time.Time   // zero while registered
+	reason    string      // why the connection dropped
+	pending   *time.Timer // notifies the disconnect once it has lasted
+	notified  bool        // the disconnect was notified, so its end is too
+	sent      []time.Time // within the last NotifyWindow
+	held      int
+	failed    map[string]bool   // delivery errors already logged, by channel
+	queue     chan notification // delivered one at a time, in order
+}
+
+func newNotifier(t *tunnel) *notifier {
+	return &notifier{
+		t:       t,
+		desktop: t.opts.Notify,
+		webhook: t.opts.NotifyWebhook,
+		client:  apiClient(NotifyTimeout),
+		failed:  make(map[string]bool),
+	}
+}
+
+// Check a --notify-webhook URL
+func validateNotifyWebhook(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --notify-webhook %q (use an http:// or https:// URL)", raw)
+	}
+	return nil
+}
+
+// Hide the path and query of a --notify-webhook URL, which carry the
+// secret in Slack and Discord webhooks
+func maskNotifyWebhook(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Path == "" || u.Path == "/") && u.RawQuery == "" {
+		return raw
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+// Called with each connection lifecycle event of the tunnel
+func (n *notifier) event(event, detail string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch event {
+	case EventDisconnected:
+		// Shutting down closes the connection too
+		if n.t.group.stopped() || !n.downSince.IsZero() {
+			return
+		}
+		n.downSince, n.reason, n.notified = time.Now(), detail, false
+		n.pending = time.AfterFunc(NotifyDisconnectAfter, n.stillDown)
+	case EventRegistered:
+		if n.downSince.IsZero() {
+			return
+		}
+		n.pending.Stop()
+		down := time.Since(n.downSince)
+		if n.notified {
+			current := n.t.publicEndpoint()
+			n.send(notification{
+				Event: EventRegistered,
+				URL:   current,
+				Down:  down.Round(time.Second).Seconds(),
+				Text:  fmt.Sprintf("Tunnel %s is back after %s", current, down.Round(time.Second)),
+			})
+		}
+		n.downSince, n.reason, n.notified = time.Time{}, "", false
+	case EventURLChanged:
+		previous, current := publicURL(detail), n.t.publicEndpoint()
+		n.send(notification{
+			Event:       EventURLChanged,
+			URL:         current,
+			PreviousURL: previous,
+			Text:        fmt.Sprintf("Tunnel URL changed from %s to %s", previous, current),
+		})
+	}
+}
+
+// Notify a disconnect that has lasted NotifyDisconnectAfter
+func (n *notifier) stillDown() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.downSince.IsZero() || n.t.group.stopped() {
+		return
+	}
+	name := cmp.Or(n.t.publicEndpoint(), n.t.target.Describe())
+	n.notified = n.send(notification{
+		Event:  EventDisconnected,
+		URL:    n.t.publicEndpoint(),
+		Reason: n.reason,
+		Down:   time.Since(n.downSince).Round(time.Second).Seconds(),
+		Text:   fmt.Sprintf("Tunnel %s lost its connection to the tunnel server (%s), reconnecting", name, n.reason),
+	})
+}
+
+// Deliver a notification unless the rate limit holds it back, reporting
+// whether it went out. Called with n.mu held.
+func (n *notifier) send(note notification) bool {
+	now := time.Now()
+	recent := n.sent[:0]
+	for _, at := range n.sent {
+		if now.Sub(at) < NotifyWindow {
+			recent = append(recent, at)
+		}
+	}
+	n.sent = recent
+	if len(n.sent) >= NotifyLimit {
+		n.held++
+		n.t.log.Debug(fmt.Sprintf("Notification held back, %d in the last %s: %s", len(n.sent), NotifyWindow, note.Text))
+		return false
+	}
+	n.sent = append(n.sent, now)
+	if n.held > 0 {
+		note.HeldBack = n.held
+		note.Text += fmt.Sprintf(" (%d earlier notifications held back)", n.held)
+		n.held = 0
+	}
+	note.Tunnel, note.Time = n.t.opts.Name, now
+	note.Host, _ = os.Hostname()
+	if n.queue == nil {
+		n.queue = make(chan notification, NotifyLimit)
+		go n.deliverAll()
+	}
+	select {
+	case n.queue <- note:
+	default:
+	}
+	return true
+}
+
+func (n *notifier) deliverAll() {
+	for note := range n.queue {
+		n.deliver(note)
+	}
+}
+
+func (n *notifier) deliver(note notification) {
+	if n.desktop {
+		title := "comzy"
+		if note.Tunnel != "" {
+			title += " " + note.Tunnel
+		}
+		n.report("desktop", "show a desktop notification", showNotification(title, note.Text))
+	}
+	if n.webhook != "" {
+		n.report("webhook", "POST to --notify-webhook", n.post(note))
+	}
+}
+
+// Log the first failure of each channel; notifications that can't be
+// delivered shouldn't fill the log
+func (n *notifier) report(channel, what string, err error) {
+	if err == nil {
+		return
+	}
+	n.mu.Lock()
+	logged := n.failed[channel]
+	n.failed[channel] = true
+	n.mu.Unlock()
+	if !logged {
+		n.t.log.Dim(fmt.Sprintf("Could not %s: %v", what, err))
+	}
+}
+
+func (n *notifier) post(note notification) error {
+	body, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "comzy/"+Version)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", maskNotifyWebhook(n.webhook), resp.Status)
+	}
+	return nil
+}
+
+// Show a desktop notification with the platform's notification command
+func showNotification(title, message string) error {
+	command := notificationCommand(title, message)
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		return fmt.Errorf("%s not found", command[0])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyCommandTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, path, command[1:]...).CombinedOutput(); err != nil {
+		if msg := bytes.TrimSpace(out); len(msg) > 0 {
+			return fmt.Errorf("%s: %v: %s", command[0], err, msg)
+		}
+		return fmt.Errorf("%s: %v", command[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+// Requests refused while the operator has paused the tunnels
+var errPaused = errors.New("tunnel paused by operator")
+
+// Pause or resume every tunnel of the group, reporting whether that
+// changed anything. Connections stay up and aliases are kept; requests
+// are answered with 503 until resumed.
+func (g *tunnelGroup) setPaused(paused bool) bool {
+	changed := false
+	for _, t := range g.tunnels {
+		if t.target.paused.Swap(paused) != paused {
+			changed = true
+		}
+	}
+	if !changed {
+		return false
+	}
+	if paused {
+		logWarning("PAUSED: requests are answered with 503 until resumed (press r or POST /api/resume)")
+	} else {
+		logSuccess("Resumed: forwarding requests again")
+	}
+	return true
+}
+
+// Whether the tunnels are paused
+func (g *tunnelGroup) paused() bool {
+	for _, t := range g.tunnels {
+		if t.target.paused.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause on "p" and resume on "r" typed in the terminal. Without a terminal
+// on stdin this does nothing, leaving the inspector API as the only
+// control. The returned func puts the terminal back as it was.
+func watchPauseKeys(group *tunnelGroup) func() {
+	if !stdinIsTerminal() {
+		return func() {}
+	}
+	restore, err := keypressMode()
+	if err != nil {
+		return func() {}
+	}
+	logDim("Press p to pause requests, r to resume")
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				return
+			}
+			switch buf[0] {
+			case 'p', 'P':
+				group.setPaused(true)
+			case 'r', 'R':
+				group.setPaused(false)
+			}
+		}
+	}()
+	return restore
+}
+
+func (in *Inspector) handlePause(w http.ResponseWriter, r *http.Request) {
+	in.control.setPaused(true)
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (in *Inspector) handleResume(w http.ResponseWriter, r *http.Request) {
+	in.control.setPaused(false)
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
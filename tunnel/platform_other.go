@@ -0,0 +1,112 @@
+//go:build !windows
+
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// No limit on draining after SIGTERM
+const consoleCloseDrainLimit time.Duration = 0
+
+// Terminals handle escape sequences already
+func enableANSI() bool {
+	return true
+}
+
+// Directory for the token and state
+func defaultComzyDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".comzy"), nil
+}
+
+// Whether a process with this ID exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Run cmd in a session of its own, so it outlives the terminal that
+// started it
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// Run cmd in a process group of its own, so Ctrl-C in the terminal reaches
+// comzy only and "comzy run" passes it on once the tunnel is ready to stop
+func ownProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Send sig to the process group started by ownProcessGroup, reaching the
+// processes it started too, such as the server behind "npm start"
+func signalProcessGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		s = syscall.SIGINT
+	}
+	return syscall.Kill(-p.Pid, s)
+}
+
+// Whether the peer reset the connection
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// Stop the terminal on stdin from echoing and waiting for Enter, so keys
+// can be read as they are pressed. Output and Ctrl-C work as before. The
+// returned func restores the previous settings.
+func keypressMode() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// Commands that copy their input to the clipboard, in order of preference
+func clipboardCommands() [][]string {
+	if runtime.GOOS == "darwin" {
+		return [][]string{{"pbcopy"}}
+	}
+	var commands [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		commands = append(commands, []string{"wl-copy"})
+	}
+	return append(commands, []string{"xclip", "-selection", "clipboard"}, []string{"xsel", "--clipboard", "--input"})
+}
+
+// Command that shows a desktop notification
+func notificationCommand(title, message string) []string {
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(message), appleScriptString(title))
+		return []string{"osascript", "-e", script}
+	}
+	return []string{"notify-send", "--app-name=comzy", title, message}
+}
+
+// Quote s as an AppleScript string literal
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
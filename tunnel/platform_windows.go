@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// Closing the console window, logging off or shutting down arrive as
+// SIGTERM, and Windows ends the process about five seconds later, so the
+// drain has to finish sooner than that
+const consoleCloseDrainLimit = 4 * time.Second
+
+// Exit code GetExitCodeProcess reports for a process that hasn't exited
+const stillActive = 259
+
+// Turn on escape sequence handling in the console. Consoles older than
+// Windows 10 can't, and colors are then turned off.
+func enableANSI() bool {
+	handle := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		// Not a console, e.g. redirected or a mintty pipe
+		return true
+	}
+	return windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+}
+
+// Directory for the token and state. An existing .comzy in the user
+// profile keeps being used; otherwise it goes in %AppData%. HOME is never
+// consulted, since Git Bash and MSYS set it to paths of their own.
+func defaultComzyDir() (string, error) {
+	profile, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	legacy := filepath.Join(profile, ".comzy")
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy, nil
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return legacy, nil
+	}
+	return filepath.Join(config, "comzy"), nil
+}
+
+// Whether a process with this ID is still running
+func processRunning(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+	var code uint32
+	return windows.GetExitCodeProcess(handle, &code) == nil && code == stillActive
+}
+
+// Run cmd without a console, in a process group of its own, so it
+// outlives the console that started it
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// Processes started from the console get its Ctrl-C themselves, so "comzy
+// run" leaves its command in the console's group
+func ownProcessGroup(cmd *exec.Cmd) {}
+
+// The command already got the console's Ctrl-C; anything else ends it
+func signalProcessGroup(p *os.Process, sig os.Signal) error {
+	if sig == os.Interrupt {
+		return nil
+	}
+	return p.Kill()
+}
+
+// Whether the peer reset the connection
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.WSAECONNRESET)
+}
+
+// Stop the console from echoing and waiting for Enter, so keys can be read
+// as they are pressed. Ctrl-C works as before. The returned func restores
+// the previous mode.
+func keypressMode() (func(), error) {
+	handle := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return nil, err
+	}
+	if err := windows.SetConsoleMode(handle, mode&^(windows.ENABLE_LINE_INPUT|windows.ENABLE_ECHO_INPUT)); err != nil {
+		return nil, err
+	}
+	return func() { windows.SetConsoleMode(handle, mode) }, nil
+}
+
+// Commands that copy their input to the clipboard
+func clipboardCommands() [][]string {
+	return [][]string{{"clip"}}
+}
+
+// Command that shows a desktop notification: a balloon from a tray icon,
+// which needs no module and works from Windows 7 on. The icon is removed
+// once the balloon has had time to be read.
+func notificationCommand(title, message string) []string {
+	script := fmt.Sprintf("Add-Type -AssemblyName System.Windows.Forms, System.Drawing; "+
+		"$n = New-Object System.Windows.Forms.NotifyIcon; "+
+		"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; "+
+		"$n.ShowBalloonTip(10000, %s, %s, 'Info'); Start-Sleep -Seconds 10; $n.Dispose()",
+		powerShellString(title), powerShellString(message))
+	return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}
+}
+
+// Quote s as a PowerShell string literal
+func powerShellString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,136 @@
+package tunnel
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point comzyDir at dir for the test
+func useComzyDir(t *testing.T, dir string) {
+	saved, savedUser, savedFlag := comzyDir, userFile, flagToken
+	t.Cleanup(func() { comzyDir, userFile, flagToken = saved, savedUser, savedFlag })
+	comzyDir = dir
+	userFile = filepath.Join(dir, ".user")
+	flagToken = ""
+	t.Setenv(TokenEnv, "")
+}
+
+// Git Bash and MSYS set HOME to paths of their own, which must not decide
+// where the token goes
+func TestDefaultComzyDirIgnoresHome(t *testing.T) {
+	base := t.TempDir()
+	profile, appData := filepath.Join(base, "profile"), filepath.Join(base, "AppData", "Roaming")
+	t.Setenv("USERPROFILE", profile)
+	t.Setenv("APPDATA", appData)
+	t.Setenv("HOME", "/c/Users/msys")
+
+	dir, err := defaultComzyDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(appData, "comzy"); dir != want {
+		t.Errorf("defaultComzyDir() = %q, want %q", dir, want)
+	}
+
+	// An existing .comzy in the profile keeps being used
+	legacy := filepath.Join(profile, ".comzy")
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if dir, _ := defaultComzyDir(); dir != legacy {
+		t.Errorf("defaultComzyDir() = %q, want the existing %q", dir, legacy)
+	}
+}
+
+func TestTokenSaveAndLoad(t *testing.T) {
+	// Profiles often have spaces and non-ASCII characters in their names
+	useComzyDir(t, filepath.Join(t.TempDir(), "José Núñez", "comzy"))
+
+	if err := saveToken("  tok_0123456789abcdef\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := getToken(); got != "tok_0123456789abcdef" {
+		t.Errorf("getToken() = %q after saving", got)
+	}
+	data, err := os.ReadFile(userFile)
+	if err != nil || string(data) != "tok_0123456789abcdef" {
+		t.Errorf("token file holds %q, %v", data, err)
+	}
+
+	// As left by an editor that ends lines with CRLF
+	if err := os.WriteFile(userFile, []byte("tok_edited\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := getToken(); got != "tok_edited" {
+		t.Errorf("getToken() = %q from a CRLF file", got)
+	}
+}
+
+func TestStatePathsUseBackslashes(t *testing.T) {
+	dir := `C:\Users\Ana María\AppData\Roaming\comzy`
+	useComzyDir(t, dir)
+
+	for _, tc := range []struct{ got, want string }{
+		{userFile, dir + `\.user`},
+		{defaultConfigFile(), dir + `\config.yml`},
+		{historyFile(), dir + `\history.jsonl`},
+		{sessionFile(), dir + `\last-session.json`},
+		{daemonFile("3000", ".json"), dir + `\run\3000.json`},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("path %q, want %q", tc.got, tc.want)
+		}
+	}
+}
+
+// Output that isn't a console gets no escape sequences unless asked for
+func TestColorFallbackWhenRedirected(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "out.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	saved := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = saved }()
+	t.Setenv(NoColorEnv, "")
+
+	if !enableANSI() {
+		t.Error("enableANSI() refused output that isn't a console")
+	}
+	if useColors(ColorAuto) {
+		t.Error("colors on for redirected output")
+	}
+	if !useColors(ColorAlways) {
+		t.Error("--color always was not honored")
+	}
+	if useColors(ColorNever) {
+		t.Error("--color never was not honored")
+	}
+}
+
+func TestProcessRunning(t *testing.T) {
+	if !processRunning(os.Getpid()) {
+		t.Error("this process is not seen as running")
+	}
+	cmd := exec.Command("cmd", "/c", "exit", "0")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cmd: %v", err)
+	}
+	if processRunning(cmd.Process.Pid) {
+		t.Error("an exited process is seen as running")
+	}
+}
+
+func TestPowerShellStringQuotes(t *testing.T) {
+	if got := powerShellString(`it's "done"`); got != `'it''s "done"'` {
+		t.Errorf("powerShellString = %s", got)
+	}
+	command := notificationCommand("comzy", "Tunnel's down")
+	if command[0] != "powershell" || !strings.Contains(command[len(command)-1], `'Tunnel''s down'`) {
+		t.Errorf("notificationCommand = %q", command)
+	}
+}
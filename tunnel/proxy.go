@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/proxy"
+)
+
+// Error dialing the proxy itself, as opposed to the proxy refusing the destination
+type proxyUnreachableError struct {
+	err error
+}
+
+func (e *proxyUnreachableError) Error() string { return e.err.Error() }
+func (e *proxyUnreachableError) Unwrap() error { return e.err }
+
+// Dialer used to reach the proxy, tagging its failures
+type proxyForwardDialer struct {
+	net.Dialer
+}
+
+func (d *proxyForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *proxyForwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, &proxyUnreachableError{err: err}
+	}
+	return conn, nil
+}
+
+// --proxy value that ignores HTTPS_PROXY and friends
+const ProxyDirect = "direct"
+
+// Check a --proxy value
+func validateProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", raw)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h", "http":
+		return u, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q (use http://host:port or socks5://host:port)", u.Scheme)
+}
+
+// Proxy the environment (HTTPS_PROXY, NO_PROXY, ...) selects for the
+// tunnel server, nil for none
+func environmentProxy(server string) *url.URL {
+	server = strings.Replace(strings.Replace(server, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequest("GET", server, nil)
+	if err != nil {
+		return nil
+	}
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil {
+		return nil
+	}
+	return proxyURL
+}
+
+// Dialer for the tunnel server connection. It goes through --proxy when
+// set, otherwise through the proxy configured in the environment unless
+// --proxy is "direct". HTTP proxies are reached with CONNECT, sending the
+// URL's credentials as basic auth.
+func newTunnelDialer(opts *Options) (*websocket.Dialer, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: 45 * time.Second,
+	}
+	if opts.ServerInsecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	switch opts.Proxy {
+	case ProxyDirect:
+		return dialer, nil
+	case "":
+		dialer.Proxy = http.ProxyFromEnvironment
+		return dialer, nil
+	}
+
+	proxyURL, err := validateProxyURL(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(proxyURL.Scheme, "http") {
+		// The websocket dialer sends CONNECT itself and only uses
+		// NetDialContext to reach the proxy
+		forward := &net.Dialer{Timeout: 10 * time.Second}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := forward.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %s unreachable: %v", proxyURL.Host, err)
+			}
+			return conn, nil
+		}
+		return dialer, nil
+	}
+
+	dial, err := socksDialer(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer.NetDialContext = dial
+	return dialer, nil
+}
+
+// Dial function reaching addresses through a SOCKS5 proxy, with errors
+// telling a proxy that can't be reached from one refusing the destination
+func socksDialer(proxyURL *url.URL) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	forward := &proxyForwardDialer{Dialer: net.Dialer{Timeout: 10 * time.Second}}
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer := socks.(proxy.ContextDialer)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := contextDialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		var unreachable *proxyUnreachableError
+		if errors.As(err, &unreachable) {
+			return nil, fmt.Errorf("proxy %s unreachable: %v", proxyURL.Host, unreachable.err)
+		}
+		return nil, fmt.Errorf("proxy %s refused connection to %s: %v", proxyURL.Host, addr, err)
+	}, nil
+}
+
+// Transport of the API client, set by --proxy-all; nil leaves API calls
+// to the proxy configured in the environment, as for any HTTP client
+var apiTransport http.RoundTripper
+
+// HTTP client for calls beyond the tunnel connection: the comzy API, such
+// as token checks, identity keys and region lookups, and notification
+// webhooks
+func apiClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: apiTransport}
+}
+
+// Transport going through a --proxy value the way the tunnel connection
+// does: the proxy given, none for "direct", or the environment's for ""
+func newProxyTransport(setting string) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch setting {
+	case ProxyDirect:
+		transport.Proxy = nil
+		return transport, nil
+	case "":
+		return transport, nil
+	}
+	proxyURL, err := validateProxyURL(setting)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(proxyURL.Scheme, "http") {
+		transport.Proxy = http.ProxyURL(proxyURL)
+		return transport, nil
+	}
+	dial, err := socksDialer(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy, transport.DialContext = nil, dial
+	return transport, nil
+}
@@ -0,0 +1,445 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A QR code encoder for --qr, enough for a public URL: byte mode at error
+// correction level M, versions 1 to 10 (up to 213 bytes)
+
+// Codewords of one version at level M: error correction codewords per
+// block, and the data codewords of each block
+type qrVersion struct {
+	ecPerBlock int
+	blocks     []int
+}
+
+var qrVersions = []qrVersion{
+	1:  {10, []int{16}},
+	2:  {16, []int{28}},
+	3:  {26, []int{44}},
+	4:  {18, []int{32, 32}},
+	5:  {24, []int{43, 43}},
+	6:  {16, []int{27, 27, 27, 27}},
+	7:  {18, []int{31, 31, 31, 31}},
+	8:  {22, []int{38, 38, 39, 39}},
+	9:  {22, []int{36, 36, 36, 37, 37}},
+	10: {26, []int{43, 43, 43, 43, 44}},
+}
+
+// Centers of the alignment patterns along each axis
+var qrAlignment = [][]int{
+	2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30}, 6: {6, 34},
+	7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// A QR code as a square of modules, true for dark
+type qrCode struct {
+	size     int
+	dark     [][]bool
+	function [][]bool // finder, timing, alignment and format modules
+}
+
+// Encode text as a QR code
+func encodeQR(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		capacity := 0
+		for _, n := range qrVersions[v].blocks {
+			capacity += n
+		}
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*capacity {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("too long for a QR code (%d bytes)", len(data))
+	}
+
+	q := &qrCode{size: 4*version + 17}
+	q.dark = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.dark {
+		q.dark[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(data, version))
+
+	// Keep the mask that leaves the fewest confusing patterns
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q, nil
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.dark[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finders, with their light separators
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.size && y >= 0 && y < q.size {
+					dist := max(abs(dx), abs(dy))
+					q.set(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+
+	// Alignment patterns, except where the finders are
+	positions := qrAlignment[version]
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas until the mask is chosen
+	q.drawFormat(0)
+
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>i)&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// Draw both copies of the format information for level M and mask
+func (q *qrCode) drawFormat(mask int) {
+	data := mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>i)&1 == 1 }
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// Segment, pad and split data into blocks, then interleave the blocks and
+// their error correction codewords
+func qrCodewords(data []byte, version int) []byte {
+	v := qrVersions[version]
+	capacity := 0
+	for _, n := range v.blocks {
+		capacity += n
+	}
+
+	var bits []bool
+	put := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+	put(0b0100, 4)
+	if version >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	put(0, min(4, 8*capacity-len(bits)))
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 0x80 >> j
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	divisor := rsDivisor(v.ecPerBlock)
+	var blocks, ecc [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, codewords[:n])
+		ecc = append(ecc, rsRemainder(codewords[:n], divisor))
+		codewords = codewords[n:]
+	}
+	var out []byte
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, block := range ecc {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// Place the codewords in the two-module-wide zigzag from the bottom right
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.dark[y][x] = (codewords[i>>3]>>(7-i&7))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// Flip the data modules selected by mask; applying it twice undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.dark[y][x] = !q.dark[y][x]
+			}
+		}
+	}
+}
+
+// Penalty score of the symbol as the standard defines it; lower scans better
+func (q *qrCode) penalty() int {
+	at := func(x, y int, columns bool) bool {
+		if columns {
+			return q.dark[x][y]
+		}
+		return q.dark[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	score := 0
+	for _, columns := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x <= q.size; x++ {
+				if x < q.size && at(x, y, columns) == at(x-1, y, columns) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+
+			// Finder-like runs with four light modules on either side
+			for x := 0; x+7 <= q.size; x++ {
+				match := true
+				for i, dark := range finder {
+					if at(x+i, y, columns) != dark {
+						match = false
+						break
+					}
+				}
+				if match && (q.lightRun(x-4, x, y, columns) || q.lightRun(x+7, x+11, y, columns)) {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.dark[y][x] {
+				dark++
+			}
+			if x+1 < q.size && y+1 < q.size && q.dark[y][x] == q.dark[y][x+1] &&
+				q.dark[y][x] == q.dark[y+1][x] && q.dark[y][x] == q.dark[y+1][x+1] {
+				score += 3
+			}
+		}
+	}
+	percent := dark * 100 / (q.size * q.size)
+	score += abs(percent-50) / 5 * 10
+	return score
+}
+
+// Whether modules from to to along a row (or column) are light, counting
+// those outside the symbol, which the quiet zone makes light
+func (q *qrCode) lightRun(from, to, line int, columns bool) bool {
+	for i := from; i < to; i++ {
+		if i < 0 || i >= q.size {
+			continue
+		}
+		if (columns && q.dark[i][line]) || (!columns && q.dark[line][i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Draw the code for a terminal, two modules per line with half blocks and
+// a quiet zone around it. Light modules are drawn, so without colors the
+// code reads correctly on a dark background; with colors it is pinned to
+// white on black.
+func (q *qrCode) String() string {
+	const quiet = 4
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x < 0 || y < 0 || x >= q.size || y >= q.size || !q.dark[y][x]
+	}
+	var b strings.Builder
+	width := q.size + 2*quiet
+	for y := 0; y < width; y += 2 {
+		b.WriteString(ColorWhite + ColorOnBlack)
+		for x := 0; x < width; x++ {
+			top, bottom := light(x, y), y+1 < width && light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(ColorReset + "\n")
+	}
+	return b.String()
+}
+
+// Reed-Solomon over GF(256) with the QR polynomial x^8+x^4+x^3+x^2+1
+
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// Generator polynomial for degree error correction codewords, leading
+// coefficient omitted
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coefficient := range divisor {
+			result[i] ^= gfMultiply(coefficient, factor)
+		}
+	}
+	return result
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"cmp"
+	"container/list"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client addresses whose buckets are remembered; the least recently seen
+// are forgotten beyond this
+const rateLimitClients = 10000
+
+// Request rate such as 10/s, 600/m or 1000/h; zero is no limit
+type RequestRate struct {
+	Count float64
+	Per   time.Duration
+}
+
+var rateUnits = map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+
+func (r *RequestRate) Set(value string) error {
+	s := strings.ToLower(strings.TrimSpace(value))
+	count, unit, found := strings.Cut(s, "/")
+	per, ok := rateUnits[unit]
+	if !found {
+		per, ok = time.Second, true
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+	if !ok || err != nil || n < 0 {
+		return fmt.Errorf("invalid rate %q (use e.g. 10/s, 600/m or 1000/h)", value)
+	}
+	*r = RequestRate{Count: n, Per: per}
+	return nil
+}
+
+func (r RequestRate) String() string {
+	if r.Count == 0 {
+		return "0"
+	}
+	unit := "s"
+	for u, per := range rateUnits {
+		if per == r.Per {
+			unit = u
+		}
+	}
+	return strconv.FormatFloat(r.Count, 'f', -1, 64) + "/" + unit
+}
+
+// Requests per second
+func (r RequestRate) perSecond() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Count / r.Per.Seconds()
+}
+
+// Burst used when --rate-burst isn't set: one second's worth of requests,
+// at least one
+func (r RequestRate) defaultBurst() int {
+	return max(int(math.Ceil(r.perSecond())), 1)
+}
+
+// Token bucket holding up to burst requests, refilled at rate per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take a token, or report how long until one is available
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) (time.Duration, bool) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(burst))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+}
+
+// Limits from --rate-limit, per client IP, and --rate-limit-global, over
+// every client. Rejected requests never reach the local app.
+type requestRateLimit struct {
+	mu          sync.Mutex
+	rate        float64 // per client, 0 when only the global limit is set
+	burst       int
+	global      float64 // 0 when only the per-client limit is set
+	globalBurst int
+	total       tokenBucket
+
+	// Buckets by client address, most recently seen at the front
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+type clientBucket struct {
+	key string
+	tokenBucket
+}
+
+// nil when neither limit is set, which lets every request through. A
+// zero burst gives each limit its default.
+func newRequestRateLimit(perClient, global RequestRate, burst int) *requestRateLimit {
+	if perClient.Count == 0 && global.Count == 0 {
+		return nil
+	}
+	l := &requestRateLimit{
+		rate:        perClient.perSecond(),
+		burst:       cmp.Or(burst, perClient.defaultBurst()),
+		global:      global.perSecond(),
+		globalBurst: cmp.Or(burst, global.defaultBurst()),
+		clients:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+	l.total = tokenBucket{tokens: float64(l.globalBurst), last: time.Now()}
+	return l
+}
+
+// Check a request from ip; ok is false when the edge sent no address, and
+// such requests share one bucket. Returns how long the client should wait
+// when the request is over a limit.
+func (l *requestRateLimit) allow(ip netip.Addr, ok bool) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+
+	if l.rate > 0 {
+		key := ""
+		if ok {
+			key = ip.String()
+		}
+		if wait, allowed := l.client(key, now).take(now, l.rate, l.burst); !allowed {
+			return wait, false
+		}
+	}
+	if l.global > 0 {
+		return l.total.take(now, l.global, l.globalBurst)
+	}
+	return 0, true
+}
+
+// Bucket of one client, forgetting the least recently seen one when full
+func (l *requestRateLimit) client(key string, now time.Time) *tokenBucket {
+	if e, ok := l.clients[key]; ok {
+		l.lru.MoveToFront(e)
+		return &e.Value.(*clientBucket).tokenBucket
+	}
+	if l.lru.Len() >= rateLimitClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).key)
+	}
+	b := &clientBucket{key: key, tokenBucket: tokenBucket{tokens: float64(l.burst), last: now}}
+	l.clients[key] = l.lru.PushFront(b)
+	return &b.tokenBucket
+}
+
+// Retry-After value for a wait, in whole seconds
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1))
+}
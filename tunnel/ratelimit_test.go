@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The client bucket is the edge-appended address, so varying the entries
+// a client writes itself doesn't get it a fresh one
+func TestRateLimitIgnoresSpoofedForwardedFor(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--rate-limit", "2/m", "--rate-burst", "2")
+
+	for i, spoofed := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		conn.request(i+1, "GET", "/", HeaderMap{"x-forwarded-for": {spoofed + ", 203.0.113.7"}}, nil)
+		resp, _ := conn.response(i+1, false)
+		want := http.StatusOK
+		if i >= 2 {
+			want = http.StatusTooManyRequests
+		}
+		if resp.Status != want {
+			t.Errorf("request %d claiming %s: status %d, want %d", i+1, spoofed, resp.Status, want)
+		}
+	}
+
+	conn.request(5, "GET", "/", HeaderMap{"x-forwarded-for": {"198.51.100.9"}}, nil)
+	if resp, _ := conn.response(5, false); resp.Status != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", resp.Status)
+	}
+}
+
+// A rate-limited hit without credentials stays out of the inspector, as
+// one under the limit does
+func TestRateLimitedUnauthenticatedHitsAreNotInspected(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--rate-limit", "1/m", "--rate-burst", "1",
+		"--basic-auth", "admin:secret", "--no-inspect=false", "--inspect-port", "0")
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		conn.request(i+1, "GET", "/admin/keys", HeaderMap{}, nil)
+		if resp, _ := conn.response(i+1, false); resp.Status != want {
+			t.Errorf("request %d: status %d, want %d", i+1, resp.Status, want)
+		}
+	}
+	if captures := inspector.list(); len(captures) > 0 {
+		t.Errorf("the inspector recorded %s %s without credentials", captures[0].Method, captures[0].Path)
+	}
+
+	// With them, a rate-limited hit is recorded
+	credentials := HeaderMap{"authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))}}
+	conn.request(3, "GET", "/admin/keys", credentials, nil)
+	if resp, _ := conn.response(3, false); resp.Status != http.StatusTooManyRequests {
+		t.Errorf("request 3: status %d, want 429", resp.Status)
+	}
+	if captures := inspector.list(); len(captures) != 1 || !captures[0].RateLimited {
+		t.Errorf("the inspector recorded %d requests, want the rate-limited one", len(captures))
+	}
+}
+
+// Opening WebSockets counts against --rate-limit and stops once --budget
+// is spent, as requests do
+func TestWebSocketUpgradesAreLimited(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("more than the budget"))
+	}))
+	t.Cleanup(local.Close)
+
+	t.Run("rate-limit", func(t *testing.T) {
+		edge := newFakeEdge(t)
+		conn := startEdgeTunnel(t, edge, local.URL, "--rate-limit", "1/m", "--rate-burst", "1")
+		// The first is let through to the local app, which isn't a
+		// WebSocket server
+		for i, want := range []string{"local connection failed", "rate limited"} {
+			conn.send(WSMessage{Type: "ws-open", ID: MessageID(strconv.Itoa(i + 1)), Path: "/socket",
+				Headers: HeaderMap{"x-forwarded-for": {"203.0.113.7"}}})
+			if m := conn.next(i+1, time.After(edgeTimeout)); m.Type != "ws-close" || m.Reason != want {
+				t.Errorf("upgrade %d: got %q %q, want ws-close %s", i+1, m.Type, m.Reason, want)
+			}
+		}
+	})
+	t.Run("budget", func(t *testing.T) {
+		edge := newFakeEdge(t)
+		conn := startEdgeTunnel(t, edge, local.URL, "--budget", "10B")
+		conn.request(1, "GET", "/", HeaderMap{}, nil)
+		conn.response(1, false)
+		conn.send(WSMessage{Type: "ws-open", ID: "2", Path: "/socket", Headers: HeaderMap{}})
+		if m := conn.next(2, time.After(edgeTimeout)); m.Type != "ws-close" || m.Reason != "budget used up" {
+			t.Errorf("got %q %q, want ws-close budget used up", m.Type, m.Reason)
+		}
+	})
+}
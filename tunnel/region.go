@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Published list of regional edges, used by --region auto
+const RegionsURL = "https://api.comzy.io/regions"
+
+// Let the client pick the region with the lowest latency
+const RegionAuto = "auto"
+
+// Region probing
+const (
+	RegionProbes       = 3 // connections timed per region, the fastest counts
+	RegionProbeTimeout = 3 * time.Second
+)
+
+var regionPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+func validateRegion(region string) error {
+	if region == RegionAuto || regionPattern.MatchString(region) {
+		return nil
+	}
+	return fmt.Errorf("invalid region %q (e.g. us-east, ap-southeast or auto)", region)
+}
+
+// A regional edge from the published list
+type regionEdge struct {
+	Name string `json:"name"`
+	Host string `json:"host"` // host or host:port, port 443 if omitted
+
+	latency time.Duration // fastest probe, 0 if unreachable
+	err     error
+}
+
+// Fetch the published list of regions
+func fetchRegions() ([]*regionEdge, error) {
+	client := apiClient(10 * time.Second)
+	resp, err := client.Get(RegionsURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching region list: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching region list: %s", resp.Status)
+	}
+	var list struct {
+		Regions []*regionEdge `json:"regions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid region list: %v", err)
+	}
+	if len(list.Regions) == 0 {
+		return nil, fmt.Errorf("region list is empty")
+	}
+	return list.Regions, nil
+}
+
+// Time TCP connections to every region in parallel, fastest first
+func probeRegions(regions []*regionEdge) {
+	var wg sync.WaitGroup
+	for _, r := range regions {
+		wg.Add(1)
+		go func(r *regionEdge) {
+			defer wg.Done()
+			r.latency, r.err = probeRegion(r.Host)
+		}(r)
+	}
+	wg.Wait()
+
+	sort.SliceStable(regions, func(i, j int) bool {
+		a, b := regions[i], regions[j]
+		if (a.err == nil) != (b.err == nil) {
+			return a.err == nil
+		}
+		return a.latency < b.latency
+	})
+}
+
+func probeRegion(host string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	dialer := &net.Dialer{Timeout: RegionProbeTimeout}
+	var best time.Duration
+	var lastErr error
+	for i := 0; i < RegionProbes; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(context.Background(), "tcp", host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	if best == 0 {
+		return 0, lastErr
+	}
+	return best, nil
+}
+
+// Region to ask the server for. With "auto" the fastest published region
+// is picked; if none can be measured the server chooses.
+func resolveRegion(region string, log Logger) string {
+	if region != RegionAuto {
+		return region
+	}
+	regions, err := fetchRegions()
+	if err != nil {
+		log.Warning(fmt.Sprintf("Could not pick a region automatically: %v", err))
+		return ""
+	}
+	probeRegions(regions)
+	if regions[0].err != nil {
+		log.Warning("Could not reach any region, letting the server choose")
+		return ""
+	}
+	log.Dim(fmt.Sprintf("Picked region %s (%dms)", regions[0].Name, regions[0].latency.Milliseconds()))
+	return regions[0].Name
+}
+
+// Registration refused by the server. Retrying with the same settings
+// would fail the same way, so the tunnel stops.
+type registerError struct {
+	message string
+	valid   []string // accepted regions, if the server listed them
+}
+
+func (e *registerError) Error() string {
+	if len(e.valid) == 0 {
+		return e.message
+	}
+	return fmt.Sprintf("%s (valid regions: %s)", e.message, strings.Join(e.valid, ", "))
+}
+
+// Handle "comzy regions": list the published regions with their latency
+func handleRegions(args []string) error {
+	fs := flag.NewFlagSet("regions", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := addListFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	regions, err := fetchRegions()
+	if err != nil {
+		return err
+	}
+	probeRegions(regions)
+	return regionListing(regions).write(os.Stdout, format)
+}
+
+// Listing of probed regions, fastest first
+func regionListing(regions []*regionEdge) *listing {
+	table := newListing("region", "host", "latency")
+	for _, r := range regions {
+		latency := "unreachable"
+		if r.err == nil {
+			latency = fmt.Sprintf("%dms", r.latency.Milliseconds())
+		}
+		table.add(r.Name, r.Host, latency)
+	}
+	return table
+}
@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handle the replay command: ask the running inspector to replay a request
+func handleReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	port := fs.Int("inspect-port", DefaultInspectPort, "Port of the running inspector")
+
+	var positional []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("usage: comzy replay <id> [--inspect-port PORT]")
+	}
+	id, err := strconv.ParseInt(positional[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request id %q", positional[0])
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/api/requests/%d/replay", *port, id)
+	client := &http.Client{Timeout: ReplayTimeout + 5*time.Second}
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return fmt.Errorf("no running comzy inspector on 127.0.0.1:%d (is a tunnel running?)", *port)
+	}
+	defer resp.Body.Close()
+
+	// Errors come back as {"error": ...}, which shares Capture's error field
+	var result Capture
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response from inspector: %v", err)
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("cannot replay request %d: %s", id, result.Error)
+	}
+	if result.Error != "" {
+		return fmt.Errorf("replay of request %d failed: %s", id, result.Error)
+	}
+
+	logSuccess(fmt.Sprintf("Replayed request %d as %d: %s %s -> %d in %.0fms",
+		id, result.ID, result.Method, result.Path, result.Status, result.DurationMs))
+	return nil
+}
+
+// Handle "comzy replay-file": re-send the requests of a --capture file
+// to a local target, in the order they were recorded
+func handleReplayFile(args []string) error {
+	fs := flag.NewFlagSet("replay-file", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	filter := fs.String("filter", "", "Only replay requests matching \"METHOD /path/*\" or \"/path/*\"")
+	insecure := fs.Bool("insecure-skip-verify", false, "Accept self-signed certificates from the local target")
+
+	var positional []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		return fmt.Errorf("usage: comzy replay-file <file> [host:][port] [--filter \"POST /webhooks/*\"]")
+	}
+	match, err := parseReplayFilter(*filter)
+	if err != nil {
+		return err
+	}
+	entries, err := readCaptureFile(positional[0])
+	if err != nil {
+		return err
+	}
+
+	target := defaultOptions()
+	if len(positional) == 2 {
+		spec, err := parseTargetSpec(positional[1])
+		if err != nil {
+			return err
+		}
+		target.Scheme, target.Host, target.Port = cmp.Or(spec.scheme, target.Scheme), cmp.Or(spec.host, target.Host), spec.port
+	}
+	base := fmt.Sprintf("%s://%s", target.Scheme, net.JoinHostPort(target.Host, strconv.Itoa(target.Port)))
+	client := &http.Client{
+		Timeout:       ReplayTimeout,
+		Transport:     &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure}},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	replayed, failed, skipped := 0, 0, 0
+	for _, entry := range entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil || !match(entry.Request.Method, u.Path) {
+			continue
+		}
+		line := fmt.Sprintf("%s %s", entry.Request.Method, u.RequestURI())
+		req, err := replayRequest(entry, base+u.RequestURI())
+		if err != nil {
+			skipped++
+			logWarning(fmt.Sprintf("%s skipped: %v", line, err))
+			continue
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			failed++
+			logError(fmt.Sprintf("%s failed: %v", line, err))
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		replayed++
+		was := ""
+		if entry.Response.Status != 0 && entry.Response.Status != resp.StatusCode {
+			was = fmt.Sprintf(" (was %d)", entry.Response.Status)
+		}
+		fmt.Printf("%s -> %d in %dms%s\n", line, resp.StatusCode, time.Since(start).Milliseconds(), was)
+	}
+
+	if replayed+failed+skipped == 0 {
+		return fmt.Errorf("no requests in %s match", positional[0])
+	}
+	logDim(fmt.Sprintf("Replayed %d requests to %s, %d failed, %d skipped", replayed, base, failed, skipped))
+	if failed > 0 {
+		return fmt.Errorf("%d requests could not be sent", failed)
+	}
+	return nil
+}
+
+// Matcher for --filter: an optional method, then a path in which *
+// matches anything, "/" included
+func parseReplayFilter(filter string) (func(method, path string) bool, error) {
+	fields := strings.Fields(filter)
+	if len(fields) == 0 {
+		return func(string, string) bool { return true }, nil
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("invalid --filter %q (use e.g. \"POST /webhooks/*\")", filter)
+	}
+	method := ""
+	if len(fields) == 2 {
+		method = strings.ToUpper(fields[0])
+	}
+	pattern := fields[len(fields)-1]
+	re, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid --filter %q: %v", filter, err)
+	}
+	return func(m, path string) bool {
+		return (method == "" || method == "*" || method == m) && re.MatchString(path)
+	}, nil
+}
+
+// Entries of a HAR document or of one HAR entry per line
+func readCaptureFile(path string) ([]harEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Log *harLog `json:"log"`
+	}
+	if err := json.Unmarshal(data, &doc); err == nil && doc.Log != nil {
+		return doc.Log.Entries, nil
+	}
+	var entries []harEntry
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry harEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("%s is neither HAR nor one HAR entry per line (line %d: %v)", path, i+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Headers a replayed request gets from its new connection instead
+var replaySkipHeaders = map[string]bool{
+	"host": true, "content-length": true, "connection": true, "keep-alive": true,
+	"transfer-encoding": true, "te": true, "upgrade": true, "proxy-connection": true,
+}
+
+// Rebuild a recorded request for url. Requests whose body wasn't recorded
+// in full are refused rather than sent with part of it.
+func replayRequest(entry harEntry, url string) (*http.Request, error) {
+	var body io.Reader
+	if post := entry.Request.PostData; post != nil {
+		if post.Truncated {
+			return nil, fmt.Errorf("body was not recorded in full")
+		}
+		data := []byte(post.Text)
+		if post.Encoding == "base64" {
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(post.Text); err != nil {
+				return nil, fmt.Errorf("invalid body: %v", err)
+			}
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(entry.Request.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range entry.Request.Headers {
+		if !replaySkipHeaders[strings.ToLower(h.Name)] {
+			req.Header.Add(h.Name, h.Value)
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Delays before each retry of a request the local app refused or reset,
+// as it does for a moment while a dev server restarts
+var localRetryDelays = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+
+// Send req to the local app. A GET, HEAD or OPTIONS that found the app
+// refusing or resetting connections is tried again a few times, within
+// the request's deadline; other methods never are, as they may have had
+// an effect.
+func (t *localTarget) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	resp, err := t.client.Do(req)
+	if err == nil || !retryable(req) {
+		return resp, err
+	}
+	for attempt, delay := range localRetryDelays {
+		if !isDialError(err) && !isConnReset(err) {
+			break
+		}
+		t.log.Debug(fmt.Sprintf("%s %s: %v, retrying in %s (%d of %d)", req.Method, req.URL.RequestURI(), err, delay, attempt+1, len(localRetryDelays)))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		retry := req.Clone(ctx)
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		traffic.localRetries.Add(1)
+		if resp, err = t.client.Do(retry); err == nil {
+			traffic.retriesRecovered.Add(1)
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// Whether req may be sent again: an idempotent method whose body, if
+// any, can be read again
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Host header modes for --host-header; any other value is sent as is
+const (
+	HostHeaderRewrite  = "rewrite"  // the local target's host:port
+	HostHeaderPreserve = "preserve" // the public hostname the client used
+)
+
+func validateHostHeader(mode string) error {
+	if mode == "" || strings.ContainsAny(mode, " \t\r\n/") {
+		return fmt.Errorf("invalid --host-header %q (use rewrite, preserve or a host name)", mode)
+	}
+	return nil
+}
+
+// A --request-header or --response-header rule: "Key: Value" sets a
+// header, replacing any values it had, and "-Key" removes it
+type headerRule struct {
+	name   string
+	value  string
+	remove bool
+}
+
+type headerRules []headerRule
+
+func parseHeaderRules(flagName string, rules []string) (headerRules, error) {
+	parsed := make(headerRules, 0, len(rules))
+	for _, rule := range rules {
+		var r headerRule
+		if name, ok := strings.CutPrefix(strings.TrimSpace(rule), "-"); ok {
+			r = headerRule{name: strings.TrimSpace(name), remove: true}
+		} else {
+			name, value, ok := strings.Cut(rule, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid --%s %q (use \"Key: Value\", or -Key to remove)", flagName, rule)
+			}
+			r = headerRule{name: strings.TrimSpace(name), value: strings.TrimSpace(value)}
+		}
+		if !validHeaderName(r.name) {
+			return nil, fmt.Errorf("invalid --%s %q: bad header name %q", flagName, rule, r.name)
+		}
+		if strings.ContainsAny(r.value, "\r\n") {
+			return nil, fmt.Errorf("invalid --%s %q: value has a line break", flagName, rule)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !isTokenChar(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply the rules in order to request headers
+func (rules headerRules) apply(h http.Header) {
+	for _, r := range rules {
+		if r.remove {
+			h.Del(r.name)
+		} else {
+			h.Set(r.name, r.value)
+		}
+	}
+}
+
+// Apply the rules in order to response headers
+func (rules headerRules) applyMap(h HeaderMap) {
+	for _, r := range rules {
+		if r.remove {
+			delete(h, strings.ToLower(r.name))
+		} else {
+			h.Set(r.name, r.value)
+		}
+	}
+}
+
+// Host header the local app should see, "" to keep the target's own
+func (t *localTarget) hostHeader(incoming HeaderMap, publicHost string) string {
+	switch t.hostMode {
+	case HostHeaderRewrite:
+		return ""
+	case HostHeaderPreserve:
+		if host := incoming.Get("host"); host != "" {
+			return host
+		}
+		return publicHost
+	}
+	return t.hostMode
+}
+
+// Apply --host-header and --request-header to a request for the target
+func (t *localTarget) rewriteRequest(req *http.Request, incoming HeaderMap, publicHost string) {
+	if host := t.hostHeader(incoming, publicHost); host != "" {
+		req.Host = host
+	}
+	t.requestRules.apply(req.Header)
+	// A rule may set Host too, which Go only honors through req.Host
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+}
+
+// Point redirects at the local origin to the public URL instead, then
+// apply --response-header. Only the origin of a Location is replaced; its
+// path, query and fragment are kept byte for byte.
+func (t *localTarget) rewriteResponse(headers HeaderMap, publicHost string) {
+	if publicHost != "" {
+		if location := headers.Get("location"); location != "" {
+			if rest, ok := t.localOriginSuffix(location); ok {
+				headers.Set("location", "https://"+publicHost+rest)
+			}
+		}
+	}
+	t.responseRules.applyMap(headers)
+}
+
+// If location is an absolute URL on the local target, or on the host
+// given to --host-header, return what follows its origin
+func (t *localTarget) localOriginSuffix(location string) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultSchemePort(u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+
+	local := strings.EqualFold(host, t.Host) || isLoopbackHost(host) && isLoopbackHost(t.Host)
+	if local && (t.Socket != "" || port == strconv.Itoa(t.Port)) {
+		return originSuffix(location), true
+	}
+	if t.hostMode != HostHeaderRewrite && t.hostMode != HostHeaderPreserve {
+		wantHost, wantPort, err := net.SplitHostPort(t.hostMode)
+		if err != nil {
+			wantHost, wantPort = t.hostMode, defaultSchemePort(u.Scheme)
+		}
+		if strings.EqualFold(host, wantHost) && port == wantPort {
+			return originSuffix(location), true
+		}
+	}
+	return "", false
+}
+
+// Everything after scheme://host[:port] in an absolute URL
+func originSuffix(location string) string {
+	_, rest, _ := strings.Cut(location, "://")
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		return rest[i:]
+	}
+	return ""
+}
@@ -0,0 +1,300 @@
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Method name that matches requests no other --route-method rule claims
+const routeDefault = "default"
+
+// A parsed --route-method rule
+type methodRule struct {
+	methods []string // upper case; nil for the default rule
+	spec    targetSpec
+}
+
+// Parse --route-method rules of the form GET,HEAD=3001. The target is
+// anything accepted as the positional target; parts it leaves out are
+// taken from the main target.
+func parseMethodRoutes(rules []string) ([]methodRule, error) {
+	var parsed []methodRule
+	seen := map[string]string{}
+	for _, rule := range rules {
+		methodList, target, ok := strings.Cut(rule, "=")
+		if !ok || strings.TrimSpace(methodList) == "" || strings.TrimSpace(target) == "" {
+			return nil, fmt.Errorf("invalid --route-method %q (expected METHODS=TARGET, e.g. GET,HEAD=3001)", rule)
+		}
+		spec, err := parseRouteTarget(strings.TrimSpace(target))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --route-method %q: %v", rule, err)
+		}
+
+		r := methodRule{spec: spec}
+		for _, method := range strings.Split(methodList, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			if method == "" || !validMethod(method) {
+				return nil, fmt.Errorf("invalid --route-method %q: bad method %q", rule, method)
+			}
+			if previous, dup := seen[method]; dup {
+				return nil, fmt.Errorf("--route-method %q: %s is already routed by %q", rule, method, previous)
+			}
+			seen[method] = rule
+			if method == strings.ToUpper(routeDefault) {
+				if len(r.methods) > 0 || strings.Contains(methodList, ",") {
+					return nil, fmt.Errorf("invalid --route-method %q: %q can't be combined with methods", rule, routeDefault)
+				}
+				continue
+			}
+			r.methods = append(r.methods, method)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// Parse and check the target of a routing rule
+func parseRouteTarget(target string) (targetSpec, error) {
+	spec, err := parseTargetSpec(target)
+	if err != nil {
+		return spec, err
+	}
+	if spec.scheme != "" {
+		spec.scheme = strings.ToLower(spec.scheme)
+		if spec.scheme != "http" && spec.scheme != "https" {
+			return spec, fmt.Errorf("unsupported scheme %q", spec.scheme)
+		}
+	}
+	if spec.host != "" {
+		spec.host = strings.TrimSuffix(strings.TrimPrefix(spec.host, "["), "]")
+		if err := validateHost(spec.host); err != nil {
+			return spec, err
+		}
+	}
+	return spec, nil
+}
+
+// Whether s is a valid HTTP method token
+func validMethod(s string) bool {
+	for _, r := range s {
+		if !isTokenChar(r) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Build the backends for the --route-method rules, each sharing the main
+// target's options apart from where it points
+func newMethodRoutes(opts *Options) (routes map[string]*localTarget, fallback *localTarget) {
+	// Rules were validated when the options were parsed
+	rules, _ := parseMethodRoutes(opts.RouteMethod)
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	routes = map[string]*localTarget{}
+	for _, rule := range rules {
+		backendOpts := *opts
+		backendOpts.Route, backendOpts.RouteMethod = nil, nil
+		backendOpts.Serve, backendOpts.SPA, backendOpts.Unix = "", false, ""
+		if rule.spec.scheme != "" {
+			backendOpts.Scheme = rule.spec.scheme
+		}
+		if rule.spec.host != "" {
+			backendOpts.Host = rule.spec.host
+		}
+		backendOpts.Port = rule.spec.port
+		backend := newLocalTarget(&backendOpts)
+
+		if rule.methods == nil {
+			fallback = backend
+			continue
+		}
+		for _, method := range rule.methods {
+			routes[method] = backend
+		}
+	}
+	return routes, fallback
+}
+
+// Backend that serves a request: the longest --route prefix matching its
+// path, else a --route-method rule naming its method, else the default
+// rule, else the main target
+func (t *localTarget) route(method, path string) *localTarget {
+	for _, backend := range t.pathRoutes {
+		if matchesPrefix(backend.pathPrefix, path) {
+			return backend
+		}
+	}
+	if backend := t.methodRoutes[strings.ToUpper(method)]; backend != nil {
+		return backend
+	}
+	if t.defaultRoute != nil {
+		return t.defaultRoute
+	}
+	return t
+}
+
+// Every distinct backend requests may be routed to, the main target first
+func (t *localTarget) backends() []*localTarget {
+	list := []*localTarget{t}
+	seen := map[*localTarget]bool{t: true}
+	add := func(b *localTarget) {
+		if b != nil && !seen[b] {
+			seen[b] = true
+			list = append(list, b)
+		}
+	}
+	for _, b := range t.pathRoutes {
+		add(b)
+	}
+	add(t.defaultRoute)
+	for _, b := range t.methodRoutes {
+		add(b)
+	}
+	return list
+}
+
+// One line per --route and --route-method backend for the startup banner,
+// path routes first as they take precedence
+func (t *localTarget) routeSummary() []string {
+	var paths []string
+	for _, b := range t.pathRoutes {
+		line := fmt.Sprintf("%s -> %s", b.routeName(), b.URL(""))
+		if b.stripPrefix {
+			line += " (prefix stripped)"
+		}
+		paths = append(paths, line)
+	}
+
+	methods := map[*localTarget][]string{}
+	for method, b := range t.methodRoutes {
+		methods[b] = append(methods[b], method)
+	}
+	var lines []string
+	for _, b := range t.backends()[1:] {
+		if b.pathPrefix != "" {
+			continue
+		}
+		names := methods[b]
+		sort.Strings(names)
+		if b == t.defaultRoute {
+			names = append(names, "other methods")
+		}
+		lines = append(lines, fmt.Sprintf("%s -> %s", strings.Join(names, ", "), b.URL("")))
+	}
+	sort.Strings(lines)
+	return append(paths, lines...)
+}
+
+// A parsed --route rule, or an entry of routes: in the config file
+type pathRule struct {
+	prefix string // "/" or a path without a trailing slash
+	strip  bool
+	spec   targetSpec
+	rule   string
+}
+
+// Parse --route rules of the form /api=8080 or /api=8080,strip. A trailing
+// "/*" on the prefix is accepted and ignored. Two rules for one prefix are
+// an error, since only one of them could ever match.
+func parsePathRoutes(rules []string) ([]pathRule, error) {
+	var parsed []pathRule
+	seen := map[string]string{}
+	for _, rule := range rules {
+		var err error
+		prefix, target, ok := strings.Cut(rule, "=")
+		prefix, target = strings.TrimSpace(prefix), strings.TrimSpace(target)
+		if !ok || prefix == "" || target == "" {
+			return nil, fmt.Errorf("invalid --route %q (expected PREFIX=TARGET, e.g. /api=8080)", rule)
+		}
+		r := pathRule{rule: rule}
+		if t, ok := strings.CutSuffix(target, ",strip"); ok {
+			target, r.strip = strings.TrimSpace(t), true
+		}
+
+		prefix = strings.TrimSuffix(prefix, "*")
+		if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#* \t") {
+			return nil, fmt.Errorf("invalid --route %q: prefix must be a path such as /api", rule)
+		}
+		if prefix != "/" {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+		if prefix == "/" && r.strip {
+			return nil, fmt.Errorf("invalid --route %q: there is nothing to strip from /", rule)
+		}
+		if previous, dup := seen[prefix]; dup {
+			return nil, fmt.Errorf("--route %q overlaps %q: both match %s", rule, previous, prefix)
+		}
+		seen[prefix] = rule
+		r.prefix = prefix
+
+		if r.spec, err = parseRouteTarget(target); err != nil {
+			return nil, fmt.Errorf("invalid --route %q: %v", rule, err)
+		}
+		parsed = append(parsed, r)
+	}
+	// Longest prefix first, so the most specific rule wins
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return len(parsed[i].prefix) > len(parsed[j].prefix)
+	})
+	return parsed, nil
+}
+
+// Build the backends for the --route rules, longest prefix first
+func newPathRoutes(opts *Options) []*localTarget {
+	// Rules were validated when the options were parsed
+	rules, _ := parsePathRoutes(opts.Route)
+	var routes []*localTarget
+	for _, rule := range rules {
+		backendOpts := *opts
+		backendOpts.Route, backendOpts.RouteMethod = nil, nil
+		backendOpts.Serve, backendOpts.SPA, backendOpts.Unix = "", false, ""
+		if rule.spec.scheme != "" {
+			backendOpts.Scheme = rule.spec.scheme
+		}
+		if rule.spec.host != "" {
+			backendOpts.Host = rule.spec.host
+		}
+		backendOpts.Port = rule.spec.port
+		backend := newLocalTarget(&backendOpts)
+		backend.pathPrefix, backend.stripPrefix = rule.prefix, rule.strip
+		routes = append(routes, backend)
+	}
+	return routes
+}
+
+// Whether a request path, which may carry a query, falls under prefix
+func matchesPrefix(prefix, path string) bool {
+	if prefix == "/" {
+		return true
+	}
+	p, _, _ := strings.Cut(path, "?")
+	rest, ok := strings.CutPrefix(p, prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// Path to request from this backend: the public path, minus the route
+// prefix if the route strips it
+func (t *localTarget) localPath(path string) string {
+	if !t.stripPrefix {
+		return path
+	}
+	rest := strings.TrimPrefix(path, t.pathPrefix)
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return rest
+}
+
+// Route a backend was chosen by, for logs and the inspector
+func (t *localTarget) routeName() string {
+	if t.pathPrefix == "" {
+		return ""
+	}
+	if t.pathPrefix == "/" {
+		return "/*"
+	}
+	return t.pathPrefix + "/*"
+}
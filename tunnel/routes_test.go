@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Path routes are matched first, then method routes, then the default rule
+func TestPathRoutesTakePrecedenceOverMethods(t *testing.T) {
+	ports := map[string]string{}
+	backend := func(name string) string {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(local.Close)
+		u, _ := url.Parse(local.URL)
+		ports[name] = u.Port()
+		return local.URL
+	}
+	mainURL := backend("main")
+	backend("api")
+	backend("replica")
+	backend("writer")
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, mainURL,
+		"--route", "/api="+ports["api"],
+		"--route-method", "GET,HEAD="+ports["replica"],
+		"--route-method", "default="+ports["writer"])
+
+	for i, tc := range []struct{ method, path, want string }{
+		{"GET", "/api/orders", "api"},
+		{"POST", "/api/orders", "api"},
+		{"GET", "/api", "api"},
+		{"GET", "/apiary", "replica"},
+		{"GET", "/orders?page=2", "replica"},
+		{"POST", "/orders", "writer"},
+		{"DELETE", "/orders/7", "writer"},
+	} {
+		conn.request(i+1, tc.method, tc.path, HeaderMap{}, nil)
+		resp, _ := conn.response(i+1, false)
+		if resp.Status != 200 || string(resp.Body) != tc.want {
+			t.Errorf("%s %s went to %q (%d), want %s", tc.method, tc.path, resp.Body, resp.Status, tc.want)
+		}
+	}
+}
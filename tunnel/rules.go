@@ -0,0 +1,215 @@
+package tunnel
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// One --allow or --deny rule, written as "[METHOD] [PATH] [if|unless
+// HEADER[=VALUE]]", e.g. "DELETE *", "/admin/*" or "/admin/* unless
+// X-Admin-Key=secret". * in the path matches anything, "/" included.
+type filterRule struct {
+	text   string
+	allow  bool
+	method string
+	path   *regexp.Regexp
+
+	// Header condition: the rule only applies if the header has the value,
+	// or is present when no value is given, or with unless when it isn't
+	header string
+	value  string
+	unless bool
+}
+
+// Ordered --allow and --deny rules of a tunnel. The first rule that
+// matches decides; with any allow rule, a request no rule matches is
+// denied, as with --allow-cidr.
+type requestFilter struct {
+	rules    []*filterRule
+	hasAllow bool
+}
+
+// flag.Value for --allow and --deny, which add to one ordered list so the
+// rules are checked in the order given
+type ruleFlag struct {
+	rules  *stringList
+	action string
+}
+
+func (f ruleFlag) String() string {
+	if f.rules == nil {
+		return ""
+	}
+	return f.rules.String()
+}
+
+func (f ruleFlag) Set(value string) error {
+	return f.rules.Set(f.action + " " + strings.TrimSpace(value))
+}
+
+// nil when no rules are given, which lets every request through
+func newRequestFilter(rules []string) (*requestFilter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	f := &requestFilter{}
+	for _, text := range rules {
+		rule, err := parseFilterRule(text)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, rule)
+		f.hasAllow = f.hasAllow || rule.allow
+	}
+	return f, nil
+}
+
+func parseFilterRule(text string) (*filterRule, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid rule %q: %s (use e.g. \"deny DELETE *\" or \"allow GET /api/*\")", text, reason)
+	}
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, invalid("empty rule")
+	}
+	rule := &filterRule{text: strings.Join(fields, " ")}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return nil, invalid("must start with allow or deny")
+	}
+	fields = fields[1:]
+
+	for i, field := range fields {
+		keyword := strings.ToLower(field)
+		if keyword != "if" && keyword != "unless" {
+			continue
+		}
+		if len(fields) != i+2 {
+			return nil, invalid(keyword + " takes one HEADER or HEADER=VALUE")
+		}
+		name, value, _ := strings.Cut(fields[i+1], "=")
+		if name == "" {
+			return nil, invalid("missing header name")
+		}
+		rule.header, rule.value, rule.unless = strings.ToLower(name), value, keyword == "unless"
+		fields = fields[:i]
+		break
+	}
+
+	pattern := "*"
+	switch len(fields) {
+	case 0:
+	case 1:
+		// A lone word is a method unless it looks like a path
+		if strings.HasPrefix(fields[0], "/") || fields[0] == "*" {
+			pattern = fields[0]
+		} else {
+			rule.method = strings.ToUpper(fields[0])
+		}
+	case 2:
+		rule.method, pattern = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return nil, invalid("too many fields")
+	}
+	if rule.method == "*" {
+		rule.method = ""
+	}
+	if pattern != "*" && !strings.HasPrefix(pattern, "/") {
+		return nil, invalid("the path must start with /")
+	}
+	rule.path = regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+	return rule, nil
+}
+
+func (r *filterRule) matches(method, path string, headers HeaderMap) bool {
+	if r.method != "" && r.method != method {
+		return false
+	}
+	if !r.path.MatchString(path) {
+		return false
+	}
+	if r.header == "" {
+		return true
+	}
+	values, present := headers[r.header]
+	met := present
+	if r.value != "" {
+		met = false
+		for _, v := range values {
+			met = met || v == r.value
+		}
+	}
+	return met != r.unless
+}
+
+// Check a request, returning whether it may go through and the rule that
+// decided, nil when none matched
+func (f *requestFilter) allows(method, path string, headers HeaderMap) (bool, *filterRule) {
+	if f == nil {
+		return true, nil
+	}
+	path = filterPath(path)
+	for _, rule := range f.rules {
+		if rule.matches(strings.ToUpper(method), path, headers) {
+			return rule.allow, rule
+		}
+	}
+	return !f.hasAllow, nil
+}
+
+// Path of a request as the local app routes it, which rules are matched
+// against: without the query, percent-decoded, and with empty and dot
+// segments resolved, so /%61dmin/x, //admin/x and /x/../admin/x are all
+// /admin/x. A trailing slash is kept, so /admin/ still matches /admin/*.
+func filterPath(raw string) string {
+	raw, _, _ = strings.Cut(raw, "?")
+	if decoded, err := url.PathUnescape(raw); err == nil {
+		raw = decoded
+	}
+	cleaned := path.Clean("/" + raw)
+	if strings.HasSuffix(raw, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Why a request was denied, for the request log
+func describeDenial(rule *filterRule) string {
+	if rule == nil {
+		return "denied: no allow rule matches"
+	}
+	return fmt.Sprintf("denied by rule %q", rule.text)
+}
+
+// Print the effective rules of each tunnel in the order they're checked,
+// for --print-rules
+func printRules(list []*Options) {
+	for i, opts := range list {
+		if len(list) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", cmp.Or(opts.Name, fmt.Sprintf("tunnel %d", i+1)))
+		}
+		filter, _ := newRequestFilter(opts.Rules)
+		if filter == nil {
+			fmt.Println("  (no rules, every request is forwarded)")
+			continue
+		}
+		for n, rule := range filter.rules {
+			fmt.Printf("  %d. %s\n", n+1, rule.text)
+		}
+		if filter.hasAllow {
+			fmt.Println("  Requests no rule matches are denied")
+		} else {
+			fmt.Println("  Requests no rule matches are forwarded")
+		}
+	}
+}
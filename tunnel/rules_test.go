@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// --deny applies to WebSocket upgrades as it does to requests
+func TestDeniedPathRefusesWebSocket(t *testing.T) {
+	var reached atomic.Int64
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL, "--deny", "/admin/*")
+
+	conn.send(WSMessage{Type: "ws-open", ID: "1", Path: "/admin/console", Headers: HeaderMap{}})
+	if m := conn.next(1, time.After(edgeTimeout)); m.Type != "ws-close" || m.Reason != "forbidden" {
+		t.Errorf("got %q %q, want ws-close forbidden", m.Type, m.Reason)
+	}
+	if n := reached.Load(); n > 0 {
+		t.Errorf("the local app was reached %d times", n)
+	}
+}
+
+// Rules see the path the local app routes, however the client spelled it
+func TestFilterMatchesNormalizedPath(t *testing.T) {
+	filter, err := newRequestFilter([]string{"deny /admin/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path    string
+		allowed bool
+	}{
+		{"/admin/users", false},
+		{"/admin/", false},
+		{"/admin/users?tab=keys", false},
+		// Percent-encoded
+		{"/%61dmin/users", false},
+		{"/%41dmin/users", true}, // paths are case-sensitive
+		{"/admin%2Fusers", false},
+		{"/%2e%2e/admin/users", false},
+		{"/bad%zzescape", true},
+		// Empty segments
+		{"//admin/users", false},
+		{"/admin//users", false},
+		// Dot segments
+		{"/./admin/users", false},
+		{"/public/../admin/users", false},
+		{"/../../admin/users", false},
+		{"/admin/../public", true},
+		{"/administrators", true},
+		{"/public/admin/users", true},
+	} {
+		if ok, _ := filter.allows("GET", tc.path, HeaderMap{}); ok != tc.allowed {
+			t.Errorf("GET %s: allowed %v, want %v", tc.path, ok, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Ports "comzy run" watches for the command to start listening on when
+// neither --port nor PORT says which, most common dev servers first
+var runPortCandidates = []int{3000, 5173, 8080, 8000, 4200, 5000, 8888, 3001, 4000, 8081}
+
+// How long "comzy run" gives its command to exit after passing on an
+// interrupt, when the tunnel stopped for another reason
+const RunStopTimeout = 10 * time.Second
+
+// Ends a "comzy run" session when its command exits on its own. comzy
+// exits with the same code.
+type commandExitedError struct {
+	name string
+	code int
+}
+
+func (e *commandExitedError) Error() string {
+	if e.code == 0 {
+		return e.name + " exited"
+	}
+	return fmt.Sprintf("%s exited with code %d", e.name, e.code)
+}
+
+// The command of "comzy run" and its current process
+type commandRun struct {
+	args    []string
+	env     []string
+	restart bool
+	log     Logger
+
+	mu          sync.Mutex
+	cmd         *exec.Cmd
+	exited      chan error // receives the result of each process
+	interrupted chan struct{}
+	stopOnce    sync.Once
+}
+
+// Handle "comzy run [options] [--restart] -- command [args]": start the
+// command, wait for it to listen, tunnel to it, and exit when it does
+func handleRun(args []string) int {
+	restart, tunnelArgs, command, err := splitRunArgs(args)
+	if err != nil {
+		reportError(err)
+		return ExitUsage
+	}
+	opts, err := parseOptions(tunnelArgs, "")
+	if err != nil {
+		reportError(err)
+		return usageCode(err)
+	}
+	if opts.Daemon {
+		logError("--daemon can't be used with comzy run")
+		return ExitUsage
+	}
+	if err := setupLogging(opts); err != nil {
+		logError(err.Error())
+		return 1
+	}
+
+	run := &commandRun{
+		args:    command,
+		env:     os.Environ(),
+		restart: restart,
+		// Tagged like a tunnel, but not one in --log-format json
+		log:         Logger{prefix: "[" + filepath.Base(command[0]) + "] "},
+		exited:      make(chan error, 1),
+		interrupted: make(chan struct{}),
+	}
+	// Tell the command which port to use, as most dev servers read PORT
+	portGiven := opts.source("port") != SourceDefault || opts.Unix != "" || opts.Serve != ""
+	if port := os.Getenv("PORT"); port != "" && !portGiven {
+		if opts.Port, err = strconv.Atoi(port); err != nil || opts.Port < 1 || opts.Port > 65535 {
+			logError(fmt.Sprintf("PORT is not a valid port: %q", port))
+			return ExitUsage
+		}
+		portGiven = true
+	} else if port == "" && opts.source("port") != SourceDefault {
+		run.env = append(run.env, "PORT="+strconv.Itoa(opts.Port))
+	}
+
+	// Ports already taken aren't the command's
+	busy := map[int]bool{}
+	if !portGiven {
+		for _, port := range runPortCandidates {
+			busy[port] = portOpen(opts.Host, port)
+		}
+	}
+	if err := run.start(); err != nil {
+		logError(err.Error())
+		return 1
+	}
+	if !portGiven {
+		port, err := run.detectPort(opts.Host, busy)
+		if err != nil {
+			if !errors.Is(err, errInterrupted) {
+				logError(err.Error())
+			}
+			return exitCode(err)
+		}
+		opts.Port = port
+		opts.sources["port"] = SourceArgument
+		logInfo(fmt.Sprintf("%s is listening on port %d", run.name(), port))
+	}
+	// The tunnel registers once the command accepts connections
+	opts.Wait = true
+
+	group := newTunnelGroup()
+	group.onInterrupt = run.interrupt
+	go run.supervise(group)
+	err = startGroup(group, []*Options{opts})
+	run.stop(errors.Is(err, errForced))
+	printStats()
+
+	code := exitCode(err)
+	var exited *commandExitedError
+	switch {
+	case errors.As(err, &exited):
+		if code != 0 {
+			logWarning(err.Error())
+		} else {
+			logInfo(err.Error())
+		}
+	case code != 0 && code != ExitAnonymousExpired && code != ExitForced && code != ExitBudget:
+		logError(fmt.Sprintf("Fatal error: %v", err))
+	}
+	return code
+}
+
+// Split the arguments of "comzy run" at "--" into tunnel options and the
+// command, taking out --restart
+func splitRunArgs(args []string) (restart bool, tunnelArgs, command []string, err error) {
+	for i, arg := range args {
+		if arg == "--" {
+			command = args[i+1:]
+			break
+		}
+		if arg == "--restart" || arg == "-restart" {
+			restart = true
+			continue
+		}
+		tunnelArgs = append(tunnelArgs, arg)
+	}
+	if len(command) == 0 {
+		return false, nil, nil, fmt.Errorf("Usage: comzy run [options] -- <command> [args...], e.g. comzy run --port 3000 -- npm start")
+	}
+	return restart, tunnelArgs, command, nil
+}
+
+func (r *commandRun) name() string {
+	return filepath.Base(r.args[0])
+}
+
+// Start a process of the command, its output logged line by line
+func (r *commandRun) start() error {
+	cmd := exec.Command(r.args[0], r.args[1:]...)
+	cmd.Env = r.env
+	output := &lineLogger{log: r.log.Dim}
+	cmd.Stdout, cmd.Stderr = output, output
+	// Processes it started in the background may keep the output open
+	cmd.WaitDelay = time.Second
+	ownProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start %s: %v", r.name(), err)
+	}
+	r.log.Dim(fmt.Sprintf("Started %s (pid %d)", r.name(), cmd.Process.Pid))
+	go func() {
+		err := cmd.Wait()
+		// Nothing it left running in the background should outlive it
+		signalProcessGroup(cmd.Process, syscall.SIGTERM)
+		output.flush()
+		r.exited <- err
+	}()
+
+	r.mu.Lock()
+	r.cmd = cmd
+	r.mu.Unlock()
+	return nil
+}
+
+// Writer that logs each line written to it, for the command's stdout and
+// stderr together
+type lineLogger struct {
+	mu      sync.Mutex
+	log     func(string)
+	partial []byte
+}
+
+func (w *lineLogger) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		line, rest, found := bytes.Cut(w.partial, []byte("\n"))
+		if !found {
+			break
+		}
+		w.log(string(bytes.TrimSuffix(line, []byte("\r"))))
+		w.partial = rest
+	}
+	// A line this long is logged in pieces
+	if len(w.partial) >= 64<<10 {
+		w.log(string(w.partial))
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// Log what's left of a last line without a newline
+func (w *lineLogger) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.log(string(w.partial))
+		w.partial = nil
+	}
+}
+
+// Watch for the command to start listening on one of the candidate ports
+// that weren't already taken. Ctrl-C meanwhile is passed on to it.
+func (r *commandRun) detectPort(host string, busy map[int]bool) (int, error) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	logInfo(fmt.Sprintf("Waiting for %s to listen on a port (give --port to skip this)...", r.name()))
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	hint := time.After(30 * time.Second)
+	for {
+		select {
+		case err := <-r.exited:
+			select {
+			case <-r.interrupted:
+				return 0, errInterrupted
+			default:
+			}
+			return 0, &commandExitedError{r.name(), processExitCode(err)}
+		case sig := <-sigChan:
+			select {
+			case <-r.interrupted:
+				logWarning("Forced exit")
+				r.signal(os.Kill)
+			default:
+				r.interrupt(sig)
+			}
+		case <-hint:
+			logWarning(fmt.Sprintf("%s isn't listening on any of the usual ports yet; use --port if it listens elsewhere", r.name()))
+		case <-tick.C:
+			for _, port := range runPortCandidates {
+				if !busy[port] && portOpen(host, port) {
+					return port, nil
+				}
+			}
+		}
+	}
+}
+
+// Whether something accepts connections on host:port
+func portOpen(host string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), HealthDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Pass the first interrupt on to the command and keep the tunnel up
+// until it exits
+func (r *commandRun) interrupt(sig os.Signal) {
+	r.stopOnce.Do(func() { close(r.interrupted) })
+	logInfo(fmt.Sprintf("Stopping %s... (Ctrl-C again to force)", r.name()))
+	r.signal(sig)
+}
+
+func (r *commandRun) signal(sig os.Signal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd != nil {
+		signalProcessGroup(r.cmd.Process, sig)
+	}
+}
+
+// End the session when the command exits, or with --restart start it
+// again if it failed
+func (r *commandRun) supervise(group *tunnelGroup) {
+	delays := newBackoff(time.Second, 30*time.Second)
+	for {
+		startedAt := time.Now()
+		var err error
+		select {
+		case err = <-r.exited:
+		case <-group.done:
+			return
+		}
+		r.mu.Lock()
+		r.cmd = nil
+		r.mu.Unlock()
+		code := processExitCode(err)
+
+		select {
+		case <-r.interrupted:
+			group.shutdown(errInterrupted)
+			return
+		default:
+		}
+		if !r.restart || code == 0 {
+			group.shutdown(&commandExitedError{r.name(), code})
+			return
+		}
+
+		if time.Since(startedAt) >= StableConnection {
+			delays.Reset()
+		}
+		delay := delays.Next().Round(time.Second)
+		logWarning(fmt.Sprintf("%s exited with code %d, restarting in %s", r.name(), code, delay))
+		select {
+		case <-time.After(delay):
+		case <-r.interrupted:
+			group.shutdown(errInterrupted)
+			return
+		case <-group.done:
+			return
+		}
+		if err := r.start(); err != nil {
+			group.shutdown(err)
+			return
+		}
+	}
+}
+
+// Make sure the command isn't left running once the tunnel has stopped:
+// interrupt it and wait, or kill it right away when forced
+func (r *commandRun) stop(force bool) {
+	r.mu.Lock()
+	cmd := r.cmd
+	r.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	if !force {
+		signalProcessGroup(cmd.Process, os.Interrupt)
+		select {
+		case <-r.exited:
+			return
+		case <-time.After(RunStopTimeout):
+			logWarning(fmt.Sprintf("%s did not stop within %s", r.name(), RunStopTimeout))
+		}
+	}
+	signalProcessGroup(cmd.Process, os.Kill)
+}
+
+// Exit code of a finished process; 1 when it was killed by a signal
+func processExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code
+		}
+		return 1
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Environment variables naming the tunnel server and the portal. They win
+// over the config file and lose to --server and --portal.
+const (
+	ServerEnv = "COMZY_SERVER_URL"
+	PortalEnv = "COMZY_PORTAL_URL"
+)
+
+// Portal named in login hints, set from --portal once options are parsed
+var portalURL = LoginURL
+
+// Take the server and portal from the environment unless given as flags
+func (opts *Options) applyEnv() {
+	for _, env := range []struct {
+		name, key string
+		value     *string
+	}{
+		{ServerEnv, "server", &opts.Server},
+		{PortalEnv, "portal", &opts.Portal},
+	} {
+		value := strings.TrimSpace(os.Getenv(env.name))
+		if value == "" || opts.source(env.key) == SourceFlag {
+			continue
+		}
+		*env.value = value
+		opts.sources[env.key] = SourceEnv
+	}
+}
+
+// A tunnel server is reached over WebSocket
+func validateServerURL(server string) error {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("invalid --server %q (use ws://host:port or wss://host:port)", server)
+	}
+	return nil
+}
+
+func validatePortalURL(portal string) error {
+	u, err := url.Parse(portal)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid --portal %q (use an http:// or https:// URL)", portal)
+	}
+	return nil
+}
+
+// Server and portal in effect for commands that don't start a tunnel,
+// from the environment, config file or defaults. Also points login hints
+// at that portal.
+func effectiveServer() *Options {
+	opts, err := parseOptions(nil, "")
+	if err != nil {
+		opts = defaultOptions()
+		opts.applyEnv()
+	}
+	if validatePortalURL(opts.Portal) == nil {
+		portalURL = opts.Portal
+	}
+	return opts
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Process exit codes other than 0 (stopped by the user) and 1 (error)
+const (
+	ExitUsage            = 2 // invalid arguments or options
+	ExitAnonymousExpired = 3
+	ExitSoakFailed       = 4   // a soak test threshold was breached
+	ExitVerifyFailed     = 5   // a "comzy verify" check failed
+	ExitAuth             = 6   // the token or the registration was refused
+	ExitGaveUp           = 7   // --max-retries connection attempts failed
+	ExitBudget           = 8   // --budget was used up with --budget-action exit
+	ExitForced           = 130 // second Ctrl-C during shutdown
+)
+
+// How long shutdown waits for in-flight requests by default
+const DefaultDrainTimeout = 10 * time.Second
+
+// Reasons a tunnel session ends without an error
+var (
+	errInterrupted      = errors.New("stopped by user")
+	errAnonymousExpired = errors.New("anonymous session expired (1 hour limit)")
+	errSoakFinished     = errors.New("soak test finished")
+	errVerifyFinished   = errors.New("verification finished")
+	errCheckFinished    = errors.New("check finished")
+)
+
+// Reasons a tunnel session ends with an error of its own exit code
+var (
+	errForced = errors.New("forced exit")
+	errGaveUp = errors.New("giving up")
+)
+
+// Exit code for the error a session ended with
+func exitCode(err error) int {
+	switch {
+	case err == nil, errors.Is(err, errInterrupted), errors.Is(err, errSoakFinished),
+		errors.Is(err, errVerifyFinished), errors.Is(err, errCheckFinished), errors.Is(err, errHelpShown),
+		errors.Is(err, errStopped):
+		return 0
+	case errors.Is(err, errAnonymousExpired):
+		return ExitAnonymousExpired
+	case errors.Is(err, errForced):
+		return ExitForced
+	case errors.Is(err, errGaveUp):
+		return ExitGaveUp
+	case errors.Is(err, errBudgetExit):
+		return ExitBudget
+	}
+	var exited *commandExitedError
+	if errors.As(err, &exited) {
+		return exited.code
+	}
+	var rejected *tokenRejectedError
+	var refused *registerError
+	if errors.As(err, &rejected) || errors.As(err, &refused) {
+		return ExitAuth
+	}
+	var usage *usageError
+	if errors.As(err, &usage) {
+		return ExitUsage
+	}
+	return 1
+}
+
+// Summary of the last tunnel session, kept so "comzy status" can say
+// why it stopped
+type sessionRecord struct {
+	StartedAt time.Time `json:"startedAt"`
+	StoppedAt time.Time `json:"stoppedAt"`
+	Reason    string    `json:"reason"`
+	ExitCode  int       `json:"exitCode"`
+	Tunnels   []string  `json:"tunnels,omitempty"` // public URLs
+}
+
+func sessionFile() string {
+	return filepath.Join(comzyDir, "last-session.json")
+}
+
+// Record how a session ended
+func saveSession(record sessionRecord) error {
+	if err := ensureComzyDir(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sessionFile(), data, 0644)
+}
+
+// The last recorded session, nil if there is none
+func loadSession() *sessionRecord {
+	data, err := os.ReadFile(sessionFile())
+	if err != nil {
+		return nil
+	}
+	var record sessionRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil
+	}
+	return &record
+}
+
+// One-line description of a recorded session
+func (r *sessionRecord) String() string {
+	return fmt.Sprintf("stopped %s after %s: %s",
+		r.StoppedAt.Local().Format("2006-01-02 15:04:05"),
+		r.StoppedAt.Sub(r.StartedAt).Round(time.Second), r.Reason)
+}
+
+// Tunnels of the running session, kept in current-tunnel.json so another
+// terminal can ask for their URLs with "comzy url"
+type currentSession struct {
+	PID       int             `json:"pid"`
+	StartedAt time.Time       `json:"startedAt"`
+	Tunnels   []currentTunnel `json:"tunnels"`
+	Health    string          `json:"health,omitempty"` // URL of its /healthz
+}
+
+type currentTunnel struct {
+	Name  string `json:"name,omitempty"`
+	URL   string `json:"url"`
+	Local string `json:"local"`
+}
+
+func currentFile() string {
+	return filepath.Join(comzyDir, "current-tunnel.json")
+}
+
+// Record the registered tunnels of group, called on every registration
+// since a reconnect may change a URL
+func saveCurrent(group *tunnelGroup, startedAt time.Time) error {
+	current := currentSession{PID: os.Getpid(), StartedAt: startedAt, Health: group.healthURL}
+	for _, t := range group.tunnels {
+		if url := t.publicEndpoint(); url != "" {
+			current.Tunnels = append(current.Tunnels, currentTunnel{Name: t.opts.Name, URL: url, Local: forwardingTo(t.opts, t.target)})
+		}
+	}
+	if err := ensureComzyDir(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(currentFile(), data, 0644)
+}
+
+// Remove current-tunnel.json, unless a later session has replaced it
+func removeCurrent() {
+	if current := loadCurrent(); current != nil && current.PID == os.Getpid() {
+		os.Remove(currentFile())
+	}
+}
+
+// The running session, nil if there is none. A file left behind by a
+// process that was killed is ignored.
+func loadCurrent() *currentSession {
+	data, err := os.ReadFile(currentFile())
+	if err != nil {
+		return nil
+	}
+	var current currentSession
+	if err := json.Unmarshal(data, &current); err != nil || !processRunning(current.PID) {
+		return nil
+	}
+	return &current
+}
+
+// Handle "comzy url": print the public URL of each running tunnel
+func handleURL(args []string) error {
+	fs := flag.NewFlagSet("url", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	asJSON := fs.Bool("json", false, "Print the running session as JSON")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	current := loadCurrent()
+	if current == nil || len(current.Tunnels) == 0 {
+		return fmt.Errorf("no tunnel is running")
+	}
+	if *asJSON {
+		return printJSON(current)
+	}
+	for _, t := range current.Tunnels {
+		fmt.Println(t.URL)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delay added to each forwarded request by --latency, e.g. "200ms" or
+// "200ms±50ms" for a delay drawn evenly from 150ms to 250ms
+type Latency struct {
+	Base   time.Duration
+	Jitter time.Duration
+}
+
+func (l *Latency) String() string {
+	if l.Jitter > 0 {
+		return l.Base.String() + "±" + l.Jitter.String()
+	}
+	return l.Base.String()
+}
+
+func (l *Latency) Set(value string) error {
+	value = strings.TrimSpace(value)
+	base, jitter, found := strings.Cut(value, "±")
+	if !found {
+		base, jitter, found = strings.Cut(value, "+-")
+	}
+	var err error
+	var parsed Latency
+	if parsed.Base, err = time.ParseDuration(strings.TrimSpace(base)); err != nil || parsed.Base < 0 {
+		return fmt.Errorf("invalid latency %q (use e.g. 200ms or 200ms±50ms)", value)
+	}
+	if found {
+		if parsed.Jitter, err = time.ParseDuration(strings.TrimSpace(jitter)); err != nil || parsed.Jitter < 0 {
+			return fmt.Errorf("invalid latency %q (use e.g. 200ms or 200ms±50ms)", value)
+		}
+	}
+	*l = parsed
+	return nil
+}
+
+// Delay for one request, never negative
+func (l Latency) draw() time.Duration {
+	if l.Jitter <= 0 {
+		return l.Base
+	}
+	return max(0, l.Base-l.Jitter+rand.N(2*l.Jitter+1))
+}
+
+// Response bandwidth set by --bandwidth, in bytes per second. Given in
+// bits per second as network links are, e.g. "512kbps" or "2mbps", or in
+// bytes with a trailing /s, e.g. "64KB/s".
+type Bandwidth float64
+
+var bitRateUnits = []struct {
+	suffix string
+	bits   float64
+}{
+	{"gbps", 1e9},
+	{"mbps", 1e6},
+	{"kbps", 1e3},
+	{"bps", 1},
+}
+
+func (b *Bandwidth) String() string {
+	bits := float64(*b) * 8
+	for _, unit := range bitRateUnits {
+		if bits >= unit.bits && unit.bits > 1 {
+			return strconv.FormatFloat(bits/unit.bits, 'f', -1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatFloat(bits, 'f', -1, 64) + "bps"
+}
+
+func (b *Bandwidth) Set(value string) error {
+	s := strings.ToLower(strings.TrimSpace(value))
+	if bytes, ok := strings.CutSuffix(s, "/s"); ok {
+		var size ByteSize
+		if err := size.Set(bytes); err != nil {
+			return fmt.Errorf("invalid bandwidth %q (use e.g. 512kbps, 2mbps or 64KB/s)", value)
+		}
+		*b = Bandwidth(size)
+		return nil
+	}
+	multiplier := 0.0
+	for _, unit := range bitRateUnits {
+		if number, ok := strings.CutSuffix(s, unit.suffix); ok {
+			s, multiplier = strings.TrimSpace(number), unit.bits
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 || (multiplier == 0 && n != 0) {
+		return fmt.Errorf("invalid bandwidth %q (use e.g. 512kbps, 2mbps or 64KB/s)", value)
+	}
+	*b = Bandwidth(n * multiplier / 8)
+	return nil
+}
+
+// Network conditions simulated for a tunnel's requests: --latency before
+// each request is forwarded and --bandwidth on each response. Both can be
+// changed while running through the inspector API.
+type trafficShape struct {
+	mu        sync.Mutex
+	latency   Latency
+	bandwidth Bandwidth
+}
+
+func newTrafficShape(opts *Options) *trafficShape {
+	return &trafficShape{latency: opts.Latency, bandwidth: opts.Bandwidth}
+}
+
+func (s *trafficShape) get() (Latency, Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latency, s.bandwidth
+}
+
+func (s *trafficShape) set(latency Latency, bandwidth Bandwidth) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency, s.bandwidth = latency, bandwidth
+}
+
+// Sleep for --latency, or until the request is cancelled. Only this
+// request waits.
+func (s *trafficShape) delay(done <-chan struct{}) {
+	latency, _ := s.get()
+	d := latency.draw()
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+	}
+}
+
+// Response body released at --bandwidth, nil when unlimited. Each request
+// gets its own bucket, so a throttled download doesn't hold up others.
+func (s *trafficShape) throttle(body io.Reader) io.Reader {
+	_, bandwidth := s.get()
+	if bandwidth <= 0 {
+		return nil
+	}
+	rate := float64(bandwidth)
+	return &throttledReader{
+		Reader:  body,
+		limiter: &byteRateLimiter{rate: rate, last: time.Now()},
+		// Small reads so bytes trickle out about ten times a second
+		max: max(1, int(rate/10)),
+	}
+}
+
+type throttledReader struct {
+	io.Reader
+	limiter *byteRateLimiter
+	max     int
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > r.max {
+		p = p[:r.max]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// Current --latency and --bandwidth, as the inspector API reports and
+// takes them. Empty or "0" turns one off.
+type shapingSettings struct {
+	Latency   *string `json:"latency,omitempty"`
+	Bandwidth *string `json:"bandwidth,omitempty"`
+}
+
+func (in *Inspector) handleShaping(w http.ResponseWriter, r *http.Request) {
+	if len(in.control.tunnels) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "no tunnels"})
+		return
+	}
+	latency, bandwidth := in.control.tunnels[0].target.shape.get()
+	if r.Method != http.MethodGet {
+		var update shapingSettings
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON: " + err.Error()})
+			return
+		}
+		if update.Latency != nil {
+			latency = Latency{}
+			if value := *update.Latency; value != "" {
+				if err := latency.Set(value); err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+		}
+		if update.Bandwidth != nil {
+			bandwidth = 0
+			if value := *update.Bandwidth; value != "" {
+				if err := bandwidth.Set(value); err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+					return
+				}
+			}
+		}
+		for _, t := range in.control.tunnels {
+			t.target.shape.set(latency, bandwidth)
+		}
+		logInfo(fmt.Sprintf("Traffic shaping: latency %s, bandwidth %s", describeLatency(latency), describeBandwidth(bandwidth)))
+	}
+	l, b := latency.String(), bandwidth.String()
+	writeJSON(w, http.StatusOK, shapingSettings{Latency: &l, Bandwidth: &b})
+}
+
+func describeLatency(l Latency) string {
+	if l.Base == 0 && l.Jitter == 0 {
+		return "off"
+	}
+	return l.String()
+}
+
+func describeBandwidth(b Bandwidth) string {
+	if b <= 0 {
+		return "unlimited"
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// How long a clipboard tool may take before it's given up on
+const ClipboardTimeout = 2 * time.Second
+
+// Copy text to the clipboard with the first clipboard tool installed
+func copyToClipboard(text string) error {
+	var tried []string
+	for _, command := range clipboardCommands() {
+		path, err := exec.LookPath(command[0])
+		if err != nil {
+			tried = append(tried, command[0])
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ClipboardTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, path, command[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", command[0], err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no clipboard tool found (looked for %s)", strings.Join(tried, ", "))
+}
+
+// Hand out a newly registered URL as --copy and --qr ask. Clipboard
+// trouble is only noted, since the URL is printed anyway.
+func (t *tunnel) shareURL(url string) {
+	opts := t.opts
+	if opts.Copy && url != t.copied {
+		if err := copyToClipboard(url); err != nil {
+			t.log.Dim(fmt.Sprintf("Could not copy the URL to the clipboard: %v", err))
+		} else {
+			t.copied = url
+			t.log.Dim("Copied the URL to the clipboard")
+		}
+	}
+	if opts.QR && opts.Protocol != ProtocolTCP && showBanners() {
+		code, err := encodeQR(url)
+		if err != nil {
+			t.log.Dim(fmt.Sprintf("No QR code: %v", err))
+			return
+		}
+		fmt.Fprintln(console)
+		fmt.Fprint(console, code)
+	}
+}
@@ -0,0 +1,551 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Soak test tuning
+const (
+	SoakRequestTimeout  = 10 * time.Second
+	SoakRegisterTimeout = 2 * time.Minute
+	SoakProgressEvery   = time.Minute
+	SoakWindow          = time.Minute            // baseline and final latency windows
+	SoakCorrelation     = 30 * time.Second       // spikes this close to a disconnect are linked to it
+	SoakSpikeFactor     = 3                      // a spike is this many times the baseline median...
+	SoakSpikeMinimum    = 200 * time.Millisecond // ...and at least this much slower
+)
+
+// Settings of "comzy soak", parsed separately from the tunnel options
+type soakOptions struct {
+	Duration        time.Duration
+	RPS             float64
+	Path            string
+	MaxErrorRate    float64 // percent
+	MaxP95          time.Duration
+	MaxLatencyDrift float64
+	MaxReconnects   int
+	AllowURLChange  bool
+	Report          string
+}
+
+func (s *soakOptions) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("soak", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.DurationVar(&s.Duration, "duration", 30*time.Minute, "How long to run")
+	fs.Float64Var(&s.RPS, "rps", 2, "Requests per second")
+	fs.StringVar(&s.Path, "path", "/", "Path to request")
+	fs.Float64Var(&s.MaxErrorRate, "max-error-rate", 1, "Highest acceptable error percentage")
+	fs.DurationVar(&s.MaxP95, "max-p95", 2*time.Second, "Highest acceptable 95th percentile latency")
+	fs.Float64Var(&s.MaxLatencyDrift, "max-latency-drift", 3, "Highest acceptable ratio of final to baseline median latency")
+	fs.IntVar(&s.MaxReconnects, "max-reconnects", 3, "Highest acceptable number of reconnects")
+	fs.BoolVar(&s.AllowURLChange, "allow-url-change", false, "Don't fail when the public URL changes")
+	fs.StringVar(&s.Report, "report", "", "Write a JSON report to FILE")
+	return fs
+}
+
+// Split soak flags from tunnel options, which may be interspersed
+func splitSoakArgs(fs *flag.FlagSet, args []string) (soak, rest []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := fs.Lookup(name)
+		if !strings.HasPrefix(arg, "-") || f == nil {
+			rest = append(rest, arg)
+			continue
+		}
+		soak = append(soak, arg)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); hasValue || (ok && b.IsBoolFlag()) {
+			continue
+		}
+		if i+1 < len(args) {
+			i++
+			soak = append(soak, args[i])
+		}
+	}
+	return soak, rest
+}
+
+// One request made by the soak test
+type soakSample struct {
+	at      time.Time
+	latency time.Duration
+	status  int
+	err     string
+}
+
+func (s soakSample) failed() bool {
+	return s.err != "" || s.status >= 500
+}
+
+// Something that happened during the soak test
+type soakEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"` // connected, disconnected, url-changed or latency-spike
+	Detail string    `json:"detail,omitempty"`
+
+	// For latency spikes, the slowest request in the spike
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Requests  int     `json:"requests,omitempty"`
+
+	// For disconnects, what happened to requests around it
+	NearbySpikes int `json:"nearbySpikes,omitempty"`
+	NearbyErrors int `json:"nearbyErrors,omitempty"`
+}
+
+// Outcome of a soak test, written by --report
+type soakReport struct {
+	URL        string    `json:"url"`
+	Path       string    `json:"path"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Completed  bool      `json:"completed"` // false if stopped early
+
+	Requests     int            `json:"requests"`
+	Errors       int            `json:"errors"`
+	ErrorRate    float64        `json:"errorRate"` // percent
+	StatusCounts map[string]int `json:"statusCounts"`
+
+	P50Ms         float64 `json:"p50Ms"`
+	P95Ms         float64 `json:"p95Ms"`
+	P99Ms         float64 `json:"p99Ms"`
+	MaxMs         float64 `json:"maxMs"`
+	BaselineP50Ms float64 `json:"baselineP50Ms"`
+	FinalP50Ms    float64 `json:"finalP50Ms"`
+	LatencyDrift  float64 `json:"latencyDrift"`
+	Reconnects    int     `json:"reconnects"`
+	URLChanges    int     `json:"urlChanges"`
+
+	Passed   bool        `json:"passed"`
+	Breaches []string    `json:"breaches"`
+	Timeline []soakEvent `json:"timeline"`
+}
+
+// Running state of a soak test
+type soakRun struct {
+	mu         sync.Mutex
+	samples    []soakSample
+	events     []soakEvent
+	alias      string
+	connects   int
+	urlChanges int
+	registered chan struct{}
+}
+
+func (r *soakRun) observe(t *tunnel, event, detail string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	switch event {
+	case EventConnected:
+		r.connects++
+		if r.connects > 1 {
+			r.events = append(r.events, soakEvent{Time: now, Kind: event})
+		}
+	case EventDisconnected:
+		r.events = append(r.events, soakEvent{Time: now, Kind: event, Detail: detail})
+	case EventRegistered:
+		if r.alias == "" {
+			close(r.registered)
+		} else if detail != r.alias {
+			r.urlChanges++
+			r.events = append(r.events, soakEvent{
+				Time:   now,
+				Kind:   EventURLChanged,
+				Detail: fmt.Sprintf("%s -> %s", publicURL(r.alias), publicURL(detail)),
+			})
+		}
+		r.alias = detail
+	}
+}
+
+func (r *soakRun) url(path string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return publicURL(r.alias) + path
+}
+
+func (r *soakRun) record(s soakSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, s)
+}
+
+// Handle "comzy soak": run a tunnel, send steady traffic through its public
+// URL and check the results against the thresholds. Returns the exit code.
+func handleSoak(args []string) (int, error) {
+	soak := &soakOptions{}
+	fs := soak.flagSet()
+	soakArgs, rest := splitSoakArgs(fs, args)
+	if err := parseFlags(fs, soakArgs); err != nil {
+		return usageCode(err), err
+	}
+	if soak.Duration <= 0 {
+		return ExitUsage, fmt.Errorf("--duration must be positive")
+	}
+	if soak.RPS <= 0 {
+		return ExitUsage, fmt.Errorf("--rps must be positive")
+	}
+	if !strings.HasPrefix(soak.Path, "/") {
+		soak.Path = "/" + soak.Path
+	}
+
+	opts, err := parseOptions(rest, "")
+	if err != nil {
+		return usageCode(err), err
+	}
+
+	run := &soakRun{registered: make(chan struct{})}
+	group := newTunnelGroup()
+	group.observe = run.observe
+	if err := prepareGroup(group, []*Options{opts}); err != nil {
+		return 1, err
+	}
+	ctx, stop := interruptOnSignal(group)
+	defer stop()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- runGroup(ctx, group)
+	}()
+
+	select {
+	case <-run.registered:
+	case err := <-finished:
+		return exitCode(err), err
+	case <-time.After(SoakRegisterTimeout):
+		group.stop(fmt.Errorf("tunnel did not register"))
+		<-finished
+		return 1, fmt.Errorf("tunnel did not register within %s", SoakRegisterTimeout)
+	}
+
+	logInfo(fmt.Sprintf("Soak test: %.4g requests/s to %s for %s", soak.RPS, run.url(soak.Path), soak.Duration))
+	startedAt := time.Now()
+	completed := run.drive(soak, opts, group, finished)
+
+	group.shutdown(errSoakFinished)
+	select {
+	case <-finished:
+	case <-time.After(group.drainLimit() + 5*time.Second):
+	}
+
+	report := run.report(soak, startedAt, completed)
+	report.print()
+	if soak.Report != "" {
+		if err := report.write(soak.Report); err != nil {
+			return 1, err
+		}
+	}
+	if !report.Passed {
+		return ExitSoakFailed, nil
+	}
+	return 0, nil
+}
+
+// Send requests at the configured rate until the duration is up or the
+// tunnel stops. Reports whether the full duration ran.
+func (r *soakRun) drive(soak *soakOptions, opts *Options, group *tunnelGroup, finished chan error) bool {
+	client := &http.Client{
+		Timeout: SoakRequestTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var credential string
+	if len(opts.BasicAuth) > 0 {
+		credential = opts.BasicAuth[0]
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / soak.RPS))
+	defer ticker.Stop()
+	progress := time.NewTicker(SoakProgressEvery)
+	defer progress.Stop()
+	end := time.After(soak.Duration)
+	startedAt := time.Now()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		select {
+		case <-ticker.C:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.record(r.probe(client, r.url(soak.Path), credential))
+			}()
+		case <-progress.C:
+			r.printProgress(time.Since(startedAt), soak.Duration)
+		case <-end:
+			return true
+		case err := <-finished:
+			// Keep the result for handleSoak
+			finished <- err
+			return false
+		case <-group.done:
+			return false
+		}
+	}
+}
+
+// Make one request through the public URL
+func (r *soakRun) probe(client *http.Client, url, credential string) soakSample {
+	sample := soakSample{at: time.Now()}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		sample.err = err.Error()
+		return sample
+	}
+	if user, pass, ok := strings.Cut(credential, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	req.Header.Set("User-Agent", "comzy-soak")
+	resp, err := client.Do(req)
+	if err != nil {
+		sample.latency = time.Since(sample.at)
+		sample.err = err.Error()
+		return sample
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	sample.latency = time.Since(sample.at)
+	sample.status = resp.StatusCode
+	return sample
+}
+
+func (r *soakRun) printProgress(elapsed, total time.Duration) {
+	r.mu.Lock()
+	samples := append([]soakSample(nil), r.samples...)
+	reconnects := max(r.connects-1, 0)
+	r.mu.Unlock()
+
+	errs := 0
+	for _, s := range samples {
+		if s.failed() {
+			errs++
+		}
+	}
+	logDim(fmt.Sprintf("Soak %s/%s: %d requests, %d errors, p50 %s, %d reconnects",
+		elapsed.Round(time.Second), total, len(samples), errs,
+		percentile(latencies(samples), 50).Round(time.Millisecond), reconnects))
+}
+
+// Build the report and check it against the thresholds
+func (r *soakRun) report(soak *soakOptions, startedAt time.Time, completed bool) *soakReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &soakReport{
+		URL:          publicURL(r.alias),
+		Path:         soak.Path,
+		StartedAt:    startedAt,
+		FinishedAt:   time.Now(),
+		Completed:    completed,
+		Requests:     len(r.samples),
+		StatusCounts: map[string]int{},
+		Reconnects:   max(r.connects-1, 0),
+		URLChanges:   r.urlChanges,
+		Breaches:     []string{},
+	}
+
+	sort.Slice(r.samples, func(i, j int) bool { return r.samples[i].at.Before(r.samples[j].at) })
+	for _, s := range r.samples {
+		if s.failed() {
+			report.Errors++
+		}
+		if s.err != "" {
+			report.StatusCounts["error"]++
+		} else {
+			report.StatusCounts[fmt.Sprint(s.status)]++
+		}
+	}
+	if report.Requests > 0 {
+		report.ErrorRate = 100 * float64(report.Errors) / float64(report.Requests)
+	}
+
+	all := latencies(r.samples)
+	report.P50Ms = ms(percentile(all, 50))
+	report.P95Ms = ms(percentile(all, 95))
+	report.P99Ms = ms(percentile(all, 99))
+	report.MaxMs = ms(percentile(all, 100))
+
+	// Compare the first and last minute, ignoring failed requests
+	var first, last []soakSample
+	for _, s := range r.samples {
+		if s.failed() {
+			continue
+		}
+		if s.at.Sub(startedAt) < SoakWindow {
+			first = append(first, s)
+		}
+		if report.FinishedAt.Sub(s.at) < SoakWindow+SoakRequestTimeout {
+			last = append(last, s)
+		}
+	}
+	baseline := percentile(latencies(first), 50)
+	report.BaselineP50Ms = ms(baseline)
+	report.FinalP50Ms = ms(percentile(latencies(last), 50))
+	if baseline > 0 {
+		report.LatencyDrift = math.Round(100*report.FinalP50Ms/report.BaselineP50Ms) / 100
+	}
+
+	report.Timeline = append(report.Timeline, r.events...)
+	report.Timeline = append(report.Timeline, spikes(r.samples, baseline)...)
+	sort.SliceStable(report.Timeline, func(i, j int) bool { return report.Timeline[i].Time.Before(report.Timeline[j].Time) })
+	correlate(report.Timeline, r.samples, baseline)
+
+	breach := func(format string, args ...interface{}) {
+		report.Breaches = append(report.Breaches, fmt.Sprintf(format, args...))
+	}
+	if report.ErrorRate > soak.MaxErrorRate {
+		breach("error rate %.2f%% exceeds %.2f%%", report.ErrorRate, soak.MaxErrorRate)
+	}
+	if p95 := percentile(all, 95); p95 > soak.MaxP95 {
+		breach("p95 latency %s exceeds %s", p95.Round(time.Millisecond), soak.MaxP95)
+	}
+	if report.LatencyDrift > soak.MaxLatencyDrift {
+		breach("median latency drifted %.2fx (%.0fms to %.0fms), more than %.2fx",
+			report.LatencyDrift, report.BaselineP50Ms, report.FinalP50Ms, soak.MaxLatencyDrift)
+	}
+	if report.Reconnects > soak.MaxReconnects {
+		breach("%d reconnects, more than %d", report.Reconnects, soak.MaxReconnects)
+	}
+	if report.URLChanges > 0 && !soak.AllowURLChange {
+		breach("public URL changed %d times", report.URLChanges)
+	}
+	if !completed {
+		breach("stopped after %s of %s", report.FinishedAt.Sub(startedAt).Round(time.Second), soak.Duration)
+	}
+	report.Passed = len(report.Breaches) == 0
+	return report
+}
+
+// Runs of requests much slower than the baseline, one event per run
+func spikes(samples []soakSample, baseline time.Duration) []soakEvent {
+	if baseline == 0 {
+		return nil
+	}
+	var events []soakEvent
+	var current *soakEvent
+	for _, s := range samples {
+		if !isSpike(s, baseline) {
+			current = nil
+			continue
+		}
+		if current == nil {
+			events = append(events, soakEvent{Time: s.at, Kind: "latency-spike"})
+			current = &events[len(events)-1]
+		}
+		current.Requests++
+		current.LatencyMs = math.Max(current.LatencyMs, ms(s.latency))
+	}
+	for i := range events {
+		events[i].Detail = fmt.Sprintf("%d slow requests, up to %.0fms", events[i].Requests, events[i].LatencyMs)
+	}
+	return events
+}
+
+func isSpike(s soakSample, baseline time.Duration) bool {
+	return s.latency > SoakSpikeFactor*baseline && s.latency > baseline+SoakSpikeMinimum
+}
+
+// Count the spikes and errors around each disconnect
+func correlate(timeline []soakEvent, samples []soakSample, baseline time.Duration) {
+	for i := range timeline {
+		if timeline[i].Kind != EventDisconnected {
+			continue
+		}
+		for _, s := range samples {
+			d := s.at.Sub(timeline[i].Time)
+			if d < -SoakCorrelation || d > SoakCorrelation {
+				continue
+			}
+			if s.failed() {
+				timeline[i].NearbyErrors++
+			} else if baseline > 0 && isSpike(s, baseline) {
+				timeline[i].NearbySpikes++
+			}
+		}
+	}
+}
+
+func latencies(samples []soakSample) []time.Duration {
+	var out []time.Duration
+	for _, s := range samples {
+		if s.err == "" {
+			out = append(out, s.latency)
+		}
+	}
+	return out
+}
+
+// Nearest-rank percentile, 0 for no values
+func percentile(values []time.Duration, p float64) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[min(max(rank-1, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+}
+
+func (r *soakReport) print() {
+	fmt.Println()
+	if r.Passed {
+		logSuccess("Soak test passed")
+	} else {
+		logError("Soak test failed")
+	}
+	fmt.Printf("  URL:         %s%s\n", r.URL, r.Path)
+	fmt.Printf("  Duration:    %s\n", r.FinishedAt.Sub(r.StartedAt).Round(time.Second))
+	fmt.Printf("  Requests:    %d (%d errors, %.2f%%)\n", r.Requests, r.Errors, r.ErrorRate)
+	fmt.Printf("  Latency:     p50 %.0fms, p95 %.0fms, p99 %.0fms, max %.0fms\n", r.P50Ms, r.P95Ms, r.P99Ms, r.MaxMs)
+	fmt.Printf("  Drift:       %.0fms -> %.0fms (%.2fx)\n", r.BaselineP50Ms, r.FinalP50Ms, r.LatencyDrift)
+	fmt.Printf("  Reconnects:  %d\n", r.Reconnects)
+	fmt.Printf("  URL changes: %d\n", r.URLChanges)
+
+	if len(r.Timeline) > 0 {
+		fmt.Println()
+		logInfo("Timeline:")
+		for _, e := range r.Timeline {
+			line := fmt.Sprintf("  %s  %-14s %s", e.Time.Local().Format("15:04:05"), e.Kind, e.Detail)
+			if e.Kind == EventDisconnected {
+				line += fmt.Sprintf(" (%d errors, %d slow requests within %s)", e.NearbyErrors, e.NearbySpikes, SoakCorrelation)
+			}
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	}
+	for _, b := range r.Breaches {
+		logError(b)
+	}
+}
+
+// Write the report as JSON to path, or stdout for "-"
+func (r *soakReport) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing report: %v", err)
+	}
+	logDim(fmt.Sprintf("Report written to %s", path))
+	return nil
+}
@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Check a --serve directory, returning its absolute path
+func staticDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("--serve: %v", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("--serve: %s is not a directory", dir)
+	}
+	return abs, nil
+}
+
+// Serves files from a directory in place of a local app. Directories serve
+// their index.html, and with spa set, paths without an extension that
+// don't exist serve the root index.html so client-side routes load.
+type staticHandler struct {
+	root http.Dir
+	spa  bool
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		staticError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+
+	// Cleaning a rooted path drops every "..", and http.Dir refuses to
+	// leave the root, so requests can't reach files outside it
+	name := path.Clean("/" + r.URL.Path)
+	if hiddenPath(name) {
+		staticError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	f, info, err := h.open(name)
+	if err == nil && info.IsDir() {
+		// Relative links in the index resolve against the trailing slash
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			f.Close()
+			target := path.Base(name) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		f.Close()
+		name = path.Join(name, "index.html")
+		f, info, err = h.open(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) && h.spa && path.Ext(name) == "" {
+		name = "/index.html"
+		f, info, err = h.open(name)
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+			staticError(w, http.StatusNotFound, "Not Found")
+		} else {
+			staticError(w, http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+	defer f.Close()
+	if info.IsDir() {
+		staticError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	// Sets Content-Type from the extension and handles ranges and
+	// conditional requests
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (h *staticHandler) open(name string) (http.File, fs.FileInfo, error) {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, info, nil
+}
+
+// Dotfiles such as .env or .git are never served, though .well-known is
+func hiddenPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != ".well-known" {
+			return true
+		}
+	}
+	return false
+}
+
+func staticError(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<!doctype html>\n<title>%d %s</title>\n<h1>%d %s</h1>\n<p>Served by comzy</p>\n", status, text, status, text)
+}
+
+// RoundTripper that answers requests with a handler in this process. The
+// body is piped as the handler writes it, so large files are streamed
+// rather than held in memory.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{header: http.Header{}, body: pw, ready: make(chan struct{})}
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				pw.CloseWithError(fmt.Errorf("handler panic: %v", r))
+				w.writeHeader(http.StatusInternalServerError)
+				return
+			}
+			w.writeHeader(http.StatusOK)
+			pw.Close()
+		}()
+		t.handler.ServeHTTP(w, req)
+	}()
+
+	select {
+	case <-w.ready:
+	case <-req.Context().Done():
+		pr.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          pr,
+		ContentLength: contentLength(w.sent),
+		Request:       req,
+	}, nil
+}
+
+// ResponseWriter feeding handlerTransport: headers are handed over on the
+// first write, the body goes through the pipe
+type pipeResponseWriter struct {
+	header http.Header
+	sent   http.Header
+	status int
+	body   *io.PipeWriter
+	once   sync.Once
+	ready  chan struct{}
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.writeHeader(status)
+}
+
+func (w *pipeResponseWriter) writeHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sent = w.header.Clone()
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.writeHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+// Content-Length from headers, -1 when unknown
+func contentLength(h http.Header) int64 {
+	var n int64 = -1
+	if v := h.Get("Content-Length"); v != "" {
+		fmt.Sscan(v, &n)
+	}
+	return n
+}
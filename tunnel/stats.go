@@ -0,0 +1,239 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of recent latencies the percentiles are taken over
+const statsWindow = 1000
+
+// Running totals of the traffic through every tunnel, shown on exit and
+// served at /api/stats by the inspector
+type trafficStats struct {
+	mu        sync.Mutex
+	started   time.Time
+	requests  int64
+	statuses  map[int]int64 // 0 for requests that got no response
+	bytesIn   int64
+	bytesOut  int64
+	latencies []time.Duration // ring of the most recent local round trips
+	next      int
+
+	// Totals since startup for the metrics endpoint
+	byMethod     map[methodStatus]int64
+	latencyHist  *histogram // seconds
+	sizeHist     *histogram // response bytes
+	wsWriteFails atomic.Int64
+
+	// Requests with the local app now, and waiting for --max-concurrent
+	inFlight atomic.Int64
+	queued   atomic.Int64
+
+	// Requests answered 429 by --rate-limit or --rate-limit-global
+	rateLimited atomic.Int64
+
+	// Retries of idempotent requests the local app refused or reset, and
+	// requests that then got through
+	localRetries     atomic.Int64
+	retriesRecovered atomic.Int64
+
+	// Lookups in the --cache of cacheable requests
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+}
+
+type methodStatus struct {
+	method string
+	status int
+}
+
+var traffic = newTrafficStats()
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		started:     time.Now(),
+		statuses:    map[int]int64{},
+		byMethod:    map[methodStatus]int64{},
+		latencyHist: newHistogram(.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10),
+		sizeHist:    newHistogram(100, 1<<10, 10<<10, 100<<10, 1<<20, 10<<20, 100<<20),
+	}
+}
+
+// Count a finished request
+func (s *trafficStats) record(r *requestLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	s.statuses[r.status]++
+	s.byMethod[methodStatus{r.method, r.status}]++
+	s.bytesIn += r.bytesIn
+	s.bytesOut += r.bytesOut
+	// Only requests that reached the local app say how fast it is
+	if r.backend == "" {
+		return
+	}
+	latency := time.Since(r.start)
+	s.latencyHist.observe(latency.Seconds())
+	if r.status != 0 {
+		s.sizeHist.observe(float64(r.bytesOut))
+	}
+	if len(s.latencies) < statsWindow {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % statsWindow
+}
+
+// Copy of the counters at one moment
+type statsSnapshot struct {
+	Uptime      string           `json:"uptime"`
+	Requests    int64            `json:"requests"`
+	Statuses    map[string]int64 `json:"statuses"` // "none" when no response was sent
+	BytesIn     int64            `json:"bytesIn"`
+	BytesOut    int64            `json:"bytesOut"`
+	P50Ms       float64          `json:"p50Ms"`
+	P95Ms       float64          `json:"p95Ms"`
+	Window      int              `json:"latencyWindow"` // requests the percentiles cover
+	InFlight    int64            `json:"inFlight"`
+	Queued      int64            `json:"queued"`
+	RateLimited int64            `json:"rateLimited"`
+	Retries     int64            `json:"localRetries"`
+	Recovered   int64            `json:"retriesRecovered"`
+	CacheHits   int64            `json:"cacheHits"`
+	CacheMisses int64            `json:"cacheMisses"`
+	Paused      bool             `json:"paused,omitempty"` // set by the inspector
+
+	// Connected time left to an anonymous session, set by the inspector
+	AnonymousLeft *int64 `json:"anonymousSecondsLeft,omitempty"`
+}
+
+func (s *trafficStats) snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := statsSnapshot{
+		Uptime:      time.Since(s.started).Round(time.Second).String(),
+		Requests:    s.requests,
+		Statuses:    map[string]int64{},
+		BytesIn:     s.bytesIn,
+		BytesOut:    s.bytesOut,
+		P50Ms:       ms(percentile(s.latencies, 50)),
+		P95Ms:       ms(percentile(s.latencies, 95)),
+		Window:      len(s.latencies),
+		InFlight:    s.inFlight.Load(),
+		Queued:      s.queued.Load(),
+		RateLimited: s.rateLimited.Load(),
+		Retries:     s.localRetries.Load(),
+		Recovered:   s.retriesRecovered.Load(),
+		CacheHits:   s.cacheHits.Load(),
+		CacheMisses: s.cacheMisses.Load(),
+	}
+	for status, n := range s.statuses {
+		snap.Statuses[statusLabel(status)] = n
+	}
+	return snap
+}
+
+func statusLabel(status int) string {
+	if status == 0 {
+		return "none"
+	}
+	return strconv.Itoa(status)
+}
+
+// One line summary, e.g. "42 requests (40 × 200, 2 × 404), p50 12ms, ..."
+func (s statsSnapshot) summary() string {
+	labels := make([]string, 0, len(s.Statuses))
+	for label := range s.Statuses {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	counts := make([]string, len(labels))
+	for i, label := range labels {
+		counts[i] = fmt.Sprintf("%d × %s", s.Statuses[label], label)
+	}
+	summary := fmt.Sprintf("%d requests (%s) in %s, p50 %.0fms, p95 %.0fms, %s in, %s out",
+		s.Requests, strings.Join(counts, ", "), s.Uptime, s.P50Ms, s.P95Ms, formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+	if s.RateLimited > 0 {
+		summary += fmt.Sprintf(", %d rate-limited", s.RateLimited)
+	}
+	if s.Retries > 0 {
+		summary += fmt.Sprintf(", %d recovered by retrying (%d retries)", s.Recovered, s.Retries)
+	}
+	if lookups := s.CacheHits + s.CacheMisses; lookups > 0 {
+		summary += fmt.Sprintf(", cache hit ratio %.0f%% (%d of %d)", float64(s.CacheHits)*100/float64(lookups), s.CacheHits, lookups)
+	}
+	return summary
+}
+
+// Print the summary if anything went through the tunnel
+func printStats() {
+	if snap := traffic.snapshot(); snap.Requests > 0 {
+		logInfo("Stats: " + snap.summary())
+	}
+}
+
+func (in *Inspector) handleStats(w http.ResponseWriter, r *http.Request) {
+	snap := traffic.snapshot()
+	snap.Paused = in.control != nil && in.control.paused()
+	if in.control != nil && getToken() == "" {
+		left, _ := in.control.anonymous.remaining()
+		seconds := int64(left.Seconds())
+		snap.AnonymousLeft = &seconds
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// Size for people, e.g. "8.1 KB"
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n) / 1024
+	units := []string{"KB", "MB", "GB", "TB"}
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// Cumulative histogram in the Prometheus style
+type histogram struct {
+	bounds []float64
+	counts []int64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Reader that counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Frame of a chunked response: "response-start" carries status and headers,
+// each "response-chunk" carries base64 body bytes, "response-end" closes it.
+// When the server negotiated CapStreamChecksum, chunks are numbered from 1
+// and the end frame carries the chunk count and a CRC32C of the whole body.
+type ResponseFrame struct {
+	Type     string    `json:"type"`
+	ID       MessageID `json:"id"`
+	Status   int       `json:"status,omitempty"`
+	Headers  HeaderMap `json:"headers,omitempty"`
+	Seq      int       `json:"seq,omitempty"`
+	Data     string    `json:"data,omitempty"`
+	Chunks   int       `json:"chunks,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Streaming capabilities announced at registration
+const (
+	CapChunkedResponse = "chunked-response"
+	CapStreamChecksum  = "stream-checksum"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Check whether a response is an open-ended stream (SSE, chunked or of
+// unknown length) that must be forwarded as data arrives
+func isStreamingResponse(resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	for _, te := range resp.TransferEncoding {
+		if te == "chunked" {
+			return true
+		}
+	}
+	return resp.ContentLength < 0
+}
+
+// Stream a response body, counting responses dropped because the remote
+// side stopped reading. Returning early closes the local body read.
+func forwardStream(ws *tunnelConn, id MessageID, status int, headers HeaderMap, prefix []byte, body io.Reader, incremental bool) error {
+	err := streamResponse(ws, id, status, headers, prefix, body, incremental)
+	if err == errResponseExpired {
+		ws.abandon(id)
+		return nil
+	}
+	return err
+}
+
+// Stream a response body as a sequence of frames so memory stays bounded
+// by the chunk size regardless of the body size. prefix holds body bytes
+// already read while deciding whether to stream. In incremental mode each
+// read is forwarded as soon as it arrives instead of filling whole chunks.
+func streamResponse(ws *tunnelConn, id MessageID, status int, headers HeaderMap, prefix []byte, body io.Reader, incremental bool) error {
+	key := id.String()
+	if err := ws.writeJSON(key, ResponseFrame{
+		Type:    "response-start",
+		ID:      id,
+		Status:  status,
+		Headers: headers,
+	}); err != nil {
+		return err
+	}
+
+	source := &eofReader{Reader: body}
+	reader := io.MultiReader(bytes.NewReader(prefix), source)
+	buf := make([]byte, ws.chunkSize)
+	checksums := ws.checksums()
+	crc := crc32.New(castagnoli)
+	seq := 0
+	for {
+		var n int
+		var err error
+		if incremental {
+			n, err = reader.Read(buf)
+		} else {
+			n, err = io.ReadFull(reader, buf)
+		}
+		if n > 0 {
+			chunk := ResponseFrame{
+				Type: "response-chunk",
+				ID:   id,
+				Data: base64.StdEncoding.EncodeToString(buf[:n]),
+			}
+			if checksums {
+				seq++
+				chunk.Seq = seq
+				crc.Write(buf[:n])
+			}
+			if werr := ws.writeJSON(key, chunk); werr != nil {
+				return werr
+			}
+		}
+		// A short final read ends the body too, but only if the body
+		// itself ended: a truncated one also reports io.ErrUnexpectedEOF
+		if err == io.EOF || err == io.ErrUnexpectedEOF && source.eof {
+			break
+		}
+		if err != nil {
+			// Tell the server the body is incomplete rather than ending cleanly
+			ws.writeJSON(key, ResponseFrame{Type: "response-end", ID: id, Error: err.Error()})
+			return fmt.Errorf("reading response body: %v", err)
+		}
+	}
+
+	end := ResponseFrame{Type: "response-end", ID: id}
+	if checksums {
+		end.Chunks = seq
+		end.Checksum = fmt.Sprintf("crc32c:%08x", crc.Sum32())
+	}
+	return ws.writeJSON(key, end)
+}
+
+// Reader that records whether its source ended with io.EOF
+type eofReader struct {
+	io.Reader
+	eof bool
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
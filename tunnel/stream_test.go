@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A body of n bytes that is generated as it is read, so the local server
+// holds none of it
+type patternReader struct{ left int64 }
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if int64(n) > r.left {
+		n = int(r.left)
+	}
+	for i := range p[:n] {
+		p[i] = byte(i)
+	}
+	r.left -= int64(n)
+	return n, nil
+}
+
+// Highest heap use seen until the returned func is called, which reports it
+func sampleHeap() func() uint64 {
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	return func() uint64 {
+		close(stop)
+		<-done
+		return peak.Load()
+	}
+}
+
+func TestLargeResponseStreamsInBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("moves a 300 MB body")
+	}
+	const size = 300 << 20
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		io.Copy(w, &patternReader{left: size})
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := sampleHeap()
+
+	conn.request(1, "GET", "/movie.mp4", HeaderMap{}, nil)
+	resp, received := conn.response(1, true)
+	grown := int64(peak()) - int64(before.HeapInuse)
+
+	if !resp.Streamed || resp.Status != 200 || resp.Error != "" {
+		t.Fatalf("response: streamed %v, status %d, error %q", resp.Streamed, resp.Status, resp.Error)
+	}
+	if received != size {
+		t.Fatalf("received %d bytes, want %d", received, size)
+	}
+	// The test's own edge decodes every frame too, so this bounds both ends
+	if grown > 48<<20 {
+		t.Errorf("heap grew by %s while streaming %s", ByteSize(grown), ByteSize(size))
+	}
+	t.Logf("heap grew by %s while streaming %s", ByteSize(grown), ByteSize(size))
+}
+
+func TestServerSentEventsArriveAsSent(t *testing.T) {
+	const events = 4
+	var sentAt [events]time.Time
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			time.Sleep(300 * time.Millisecond)
+			sentAt[i] = time.Now()
+			fmt.Fprintf(w, "data: tick %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	conn.request(1, "GET", "/events", HeaderMap{}, nil)
+	resp, _ := conn.response(1, false)
+
+	if !resp.Streamed || resp.Error != "" {
+		t.Fatalf("response: streamed %v, error %q", resp.Streamed, resp.Error)
+	}
+	if len(resp.chunkTimes) != events {
+		t.Fatalf("got %d chunks for %d events: %q", len(resp.chunkTimes), events, resp.Body)
+	}
+	for i, at := range resp.chunkTimes {
+		if delay := at.Sub(sentAt[i]); delay > 100*time.Millisecond {
+			t.Errorf("event %d arrived %s after it was sent", i, delay)
+		}
+	}
+	if want := "data: tick 0\n\ndata: tick 1\n\ndata: tick 2\n\ndata: tick 3\n\n"; string(resp.Body) != want {
+		t.Errorf("body %q, want %q", resp.Body, want)
+	}
+}
+
+func TestTruncatedLocalBodyFailsTheStream(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if r.URL.Path == "/sized" {
+			// Promises 3 MB, sends 2 MB; streamed in whole chunks
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", 3<<20)
+			io.Copy(buf, &patternReader{left: 2 << 20})
+		} else {
+			// A chunk, then the connection drops before the last chunk;
+			// streamed as data arrives
+			fmt.Fprintf(buf, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		}
+		buf.Flush()
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	for i, path := range []string{"/sized", "/chunked"} {
+		id := i + 1
+		conn.request(id, "GET", path, HeaderMap{}, nil)
+		resp, _ := conn.response(id, true)
+		if !resp.Streamed {
+			t.Errorf("%s: not streamed", path)
+		}
+		if resp.Error == "" {
+			t.Errorf("%s: truncated body ended cleanly", path)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Short name of a tunnel on its log lines, metrics and inspector entries.
+// It comes from the options alone, so it stays the same across reconnects:
+// the config name, else the reserved subdomain, else the local target. A
+// random alias changes with each registration and is never used.
+func tunnelTag(opts *Options) string {
+	switch {
+	case opts.Name != "":
+		return opts.Name
+	case opts.Subdomain != "":
+		return opts.Subdomain
+	case opts.Serve != "":
+		if abs, err := filepath.Abs(opts.Serve); err == nil {
+			return filepath.Base(abs)
+		}
+		return filepath.Base(opts.Serve)
+	case opts.Unix != "":
+		return filepath.Base(opts.Unix)
+	case isLoopbackHost(opts.Host):
+		return strconv.Itoa(opts.Port)
+	}
+	return net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+}
+
+// Give each tunnel a tag, numbering the ones that would share it
+func assignTags(list []*Options) {
+	seen := map[string]bool{}
+	for _, opts := range list {
+		tag := tunnelTag(opts)
+		for n := 2; seen[tag]; n++ {
+			tag = fmt.Sprintf("%s-%d", tunnelTag(opts), n)
+		}
+		seen[tag] = true
+		opts.tag = tag
+	}
+}
+
+// Tag of a --route backend: its prefix without slashes, "api" for /api.
+// The catch-all route and the main target have none.
+func routeTag(route string) string {
+	return strings.Trim(strings.TrimSuffix(route, "/*"), "/")
+}
+
+// Parse --log-filter values, each tag=NAME, into the tags to keep
+func parseLogFilter(filters []string) ([]string, error) {
+	var tags []string
+	for _, filter := range filters {
+		key, value, ok := strings.Cut(filter, "=")
+		if !ok || strings.TrimSpace(key) != "tag" || strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("invalid --log-filter %q (expected tag=NAME, e.g. tag=api)", filter)
+		}
+		tags = append(tags, strings.TrimSpace(value))
+	}
+	return tags, nil
+}
+
+// Every tag lines of group may carry: its tunnels and their routes
+func groupTags(group *tunnelGroup) []string {
+	var tags []string
+	for _, t := range group.tunnels {
+		tags = append(tags, t.opts.tag)
+		for _, b := range t.target.backends() {
+			if tag := routeTag(b.routeName()); tag != "" && !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// Whether a line logged for tunnel, or for a request sent to route, passes
+// --log-filter. Lines of the whole process, such as the anonymous mode
+// notice, always do.
+func (s *logSink) shows(tunnel string, fields []logField) bool {
+	if len(s.tags) == 0 || tunnel == "" || slices.Contains(s.tags, tunnel) {
+		return true
+	}
+	for _, f := range fields {
+		if route, ok := f.value.(string); ok && f.key == "route" {
+			return slices.Contains(s.tags, routeTag(route))
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTunnelTagDerivedFromOptions(t *testing.T) {
+	for _, tc := range []struct {
+		opts *Options
+		want string
+	}{
+		{&Options{Name: "api", Subdomain: "shop", Host: "localhost", Port: 3000}, "api"},
+		{&Options{Subdomain: "shop", Host: "localhost", Port: 3000}, "shop"},
+		{&Options{Host: "localhost", Port: 3000}, "3000"},
+		{&Options{Host: "127.0.0.1", Port: 8080}, "8080"},
+		{&Options{Host: "10.0.0.5", Port: 80}, "10.0.0.5:80"},
+		{&Options{Unix: "/run/app/web.sock", Host: "localhost", Port: 80}, "web.sock"},
+		{&Options{Serve: "/srv/site", Host: "localhost", Port: 80}, "site"},
+	} {
+		if got := tunnelTag(tc.opts); got != tc.want {
+			t.Errorf("tunnelTag(%+v) = %q, want %q", *tc.opts, got, tc.want)
+		}
+	}
+}
+
+func TestAssignTagsNumbersDuplicates(t *testing.T) {
+	list := []*Options{
+		{Host: "localhost", Port: 3000},
+		{Host: "localhost", Port: 3000},
+		{Name: "3000"},
+	}
+	assignTags(list)
+	var got []string
+	for _, opts := range list {
+		got = append(got, opts.tag)
+	}
+	if strings.Join(got, " ") != "3000 3000-2 3000-3" {
+		t.Errorf("tags = %v", got)
+	}
+
+	// Derived from the options alone, so a reconnect can't change them
+	assignTags(list)
+	if list[1].tag != "3000-2" {
+		t.Errorf("tag changed to %q", list[1].tag)
+	}
+}
+
+func TestParseLogFilter(t *testing.T) {
+	tags, err := parseLogFilter([]string{"tag=api", " tag = web "})
+	if err != nil || strings.Join(tags, ",") != "api,web" {
+		t.Errorf("parseLogFilter = %v, %v", tags, err)
+	}
+	for _, bad := range []string{"api", "tag=", "name=api"} {
+		if _, err := parseLogFilter([]string{bad}); err == nil {
+			t.Errorf("parseLogFilter(%q) accepted", bad)
+		}
+	}
+}
+
+func TestLogFilterKeepsOneTunnel(t *testing.T) {
+	var out bytes.Buffer
+	sink := &logSink{level: LevelInfo, format: LogFormatJSON, file: &out, tags: []string{"api"}}
+
+	sink.write(LevelInfo, "api", "[api] ", "kept", "", nil)
+	sink.write(LevelInfo, "web", "[web] ", "dropped", "", nil)
+	sink.write(LevelInfo, "web", "[web] ", "routed", "", []logField{{"route", "/api/*"}})
+	sink.write(LevelInfo, "", "", "process", "", nil)
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad JSON line %q: %v", line, err)
+		}
+		got = append(got, entry["msg"].(string))
+		if entry["msg"] == "kept" && entry["tunnel"] != "api" {
+			t.Errorf("tunnel field = %v, want api", entry["tunnel"])
+		}
+	}
+	if strings.Join(got, " ") != "kept routed process" {
+		t.Errorf("lines logged: %v", got)
+	}
+}
@@ -0,0 +1,326 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection limits used when --max-conns-per-host is not set
+const (
+	LoopbackMaxConnsPerHost = 256
+	RemoteMaxConnsPerHost   = 16
+)
+
+// Local service that incoming requests are forwarded to
+type localTarget struct {
+	Name      string // tunnel name, "" unless started by name
+	Tag       string // tunnelTag of its options, in logs, metrics and the inspector
+	Scheme    string
+	Host      string
+	Port      int
+	Dir       string // directory served by --serve, "" when forwarding
+	Socket    string // Unix socket given to --unix, "" for a TCP port
+	client    *localClient
+	tlsConfig *tls.Config
+	log       Logger
+
+	// Credentials required of incoming requests, nil if open
+	auth *basicAuth
+
+	// Client IP policy, nil if every client is accepted
+	ipFilter *ipFilter
+
+	// --allow and --deny rules, nil if every request is forwarded
+	filter *requestFilter
+
+	// Portal identities let in, nil unless --oauth-allow or
+	// --oauth-allow-domain is set
+	identity *identityVerifier
+
+	// Request rate limits, nil unless --rate-limit or --rate-limit-global
+	// is set
+	rateLimit *requestRateLimit
+
+	// Cross-origin policy, nil unless --cors or --cors-origin is set
+	cors *corsPolicy
+
+	// Webhook signature check, nil unless --verify-webhook is set
+	webhook *webhookVerifier
+
+	// HTML page from --error-page for errors shown to browsers, "" for
+	// the built-in one
+	errorPage string
+
+	// Whether the target is accepting connections yet
+	health targetHealth
+
+	// Requests handed to the local app at once, per --max-concurrent
+	limiter *requestLimiter
+
+	// Responses kept for repeated GETs, nil unless --cache is set
+	cache *responseCache
+
+	// Set while the operator has paused the tunnel, see pause.go
+	paused atomic.Bool
+
+	// Simulated latency and bandwidth, see shaping.go
+	shape *trafficShape
+
+	// Requests refused for being older than --max-request-age
+	staleRequests atomic.Int64
+
+	// Traffic of the session, for "comzy history" and --budget
+	totals sessionTotals
+
+	// --budget on totals, nil if unlimited
+	budget *bandwidthBudget
+
+	// Header rewriting: --host-header, --request-header and --response-header
+	hostMode      string
+	requestRules  headerRules
+	responseRules headerRules
+
+	// Backends chosen by --route-method, nil when every method comes here
+	methodRoutes map[string]*localTarget
+	defaultRoute *localTarget
+
+	// Backends chosen by --route, longest prefix first. A backend made
+	// for a --route rule records its prefix and whether to strip it.
+	pathRoutes  []*localTarget
+	pathPrefix  string
+	stripPrefix bool
+
+	// Requests forwarded to this backend
+	served atomic.Int64
+}
+
+func newLocalTarget(opts *Options) *localTarget {
+	host := opts.Host
+	maxConns := opts.MaxConnsPerHost
+	if maxConns <= 0 {
+		maxConns = defaultMaxConnsPerHost(host)
+	}
+	// Only affects the local hop, never the tunnel connection
+	tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+	// Rules were validated when the options were parsed
+	ipFilter, _ := newIPFilter(opts.AllowCIDR, opts.DenyCIDR)
+	filter, _ := newRequestFilter(opts.Rules)
+	requestRules, _ := parseHeaderRules("request-header", opts.RequestHeader)
+	responseRules, _ := parseHeaderRules("response-header", opts.ResponseHeader)
+	webhook, _ := parseWebhookVerifier(opts.VerifyWebhook)
+	t := &localTarget{
+		Name:      opts.Name,
+		Tag:       opts.tag,
+		Scheme:    opts.Scheme,
+		Host:      host,
+		Port:      opts.Port,
+		Dir:       opts.Serve,
+		Socket:    opts.Unix,
+		client:    newLocalClient(maxConns, tlsConfig, opts),
+		tlsConfig: tlsConfig,
+		log:       opts.log,
+		auth:      newBasicAuth(opts.BasicAuth),
+		ipFilter:  ipFilter,
+		filter:    filter,
+		identity:  newIdentityVerifier(opts.OAuthAllow, opts.OAuthAllowDomain),
+		rateLimit: newRequestRateLimit(opts.RateLimit, opts.RateLimitGlobal, opts.RateBurst),
+		cors:      newCORSPolicy(opts.CORS, opts.CORSOrigin),
+		webhook:   webhook,
+		errorPage: opts.ErrorPage,
+		budget:    newBandwidthBudget(opts),
+		limiter:   newRequestLimiter(opts.MaxConcurrent, opts.QueueSize),
+		cache:     newResponseCache(opts),
+		shape:     newTrafficShape(opts),
+
+		hostMode:      opts.HostHeader,
+		requestRules:  requestRules,
+		responseRules: responseRules,
+	}
+	t.methodRoutes, t.defaultRoute = newMethodRoutes(opts)
+	t.pathRoutes = newPathRoutes(opts)
+	return t
+}
+
+// Where requests go, for logs: host:port or the served directory
+func (t *localTarget) Describe() string {
+	if t.Dir != "" {
+		return t.Dir
+	}
+	return t.Addr()
+}
+
+// Address of the target as host:port, or the path of its Unix socket
+func (t *localTarget) Addr() string {
+	if t.Socket != "" {
+		return t.Socket
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
+
+// Network to dial Addr on
+func (t *localTarget) network() string {
+	if t.Socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Host of the target's URLs. Behind a Unix socket it only names the
+// Host header; connections go to the socket.
+func (t *localTarget) urlHost() string {
+	if t.Socket != "" {
+		return (&url.URL{Host: t.Host}).Host
+	}
+	return t.Addr()
+}
+
+// URL of a path on the target
+func (t *localTarget) URL(path string) string {
+	return fmt.Sprintf("%s://%s%s", t.Scheme, t.urlHost(), path)
+}
+
+// WebSocket URL of a path on the target
+func (t *localTarget) WebSocketURL(path string) string {
+	scheme := "ws"
+	if t.Scheme == "https" {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, t.urlHost(), path)
+}
+
+// Check whether a host refers to this machine
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Generous limits for this machine, conservative ones for shared hosts
+func defaultMaxConnsPerHost(host string) int {
+	if isLoopbackHost(host) {
+		return LoopbackMaxConnsPerHost
+	}
+	return RemoteMaxConnsPerHost
+}
+
+// HTTP client shared by all forwarded requests. Requests beyond the
+// per-host connection limit wait in the transport for a free connection.
+type localClient struct {
+	*http.Client
+	maxConns int
+	inFlight int64
+	log      Logger
+
+	// Set from the first request that has to queue until the pool has a
+	// free connection again, so each episode is reported once
+	saturated atomic.Bool
+	queued    atomic.Int64 // requests that waited for a connection
+}
+
+// The local hop ignores HTTP_PROXY and friends unless --proxy-local is set:
+// requests to localhost must never be sent through a corporate proxy.
+func newLocalClient(maxConns int, tlsConfig *tls.Config, opts *Options) *localClient {
+	var proxy func(*http.Request) (*url.URL, error)
+	if opts.ProxyLocal {
+		proxy = http.ProxyFromEnvironment
+	}
+	maxIdle := opts.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = maxConns
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxConnsPerHost:     maxConns,
+		MaxIdleConns:        maxIdle,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		DisableKeepAlives:   opts.DisableKeepAlive,
+		TLSClientConfig:     tlsConfig,
+
+		// The --timeout the request deadline enforces, so the transport
+		// gives up on an app that accepts a request and never answers too
+		ResponseHeaderTimeout: opts.Timeout,
+
+		// Forward bodies exactly as the local app encoded them
+		DisableCompression: true,
+	}
+	if opts.Unix != "" {
+		transport.DialContext = unixDialer(opts.Unix)
+	}
+	var rt http.RoundTripper = transport
+	if opts.Serve != "" {
+		rt = &handlerTransport{handler: &staticHandler{root: http.Dir(opts.Serve), spa: opts.SPA}}
+	}
+	return &localClient{
+		Client: &http.Client{
+			Transport: rt,
+			// Redirects go back to the visitor as sent, Location and
+			// Set-Cookie included; rewriteResponse points local ones at
+			// the public URL
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		maxConns: maxConns,
+		log:      opts.log,
+	}
+}
+
+// Do sends a request, reporting when it has to queue for a connection
+// so pool saturation isn't mistaken for a slow backend
+func (c *localClient) Do(req *http.Request) (*http.Response, error) {
+	inFlight := atomic.AddInt64(&c.inFlight, 1)
+	if inFlight > int64(c.maxConns) {
+		c.queued.Add(1)
+		if c.saturated.CompareAndSwap(false, true) {
+			c.log.Warning(fmt.Sprintf("Connection pool to %s saturated (%d requests for %d connections), requests are queued",
+				req.URL.Host, inFlight, c.maxConns))
+		}
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		c.release(req)
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() { c.release(req) }}
+	return resp, nil
+}
+
+// Free a request's slot, ending a saturation episode once every request
+// has a connection
+func (c *localClient) release(req *http.Request) {
+	inFlight := atomic.AddInt64(&c.inFlight, -1)
+	if inFlight <= int64(c.maxConns) && c.saturated.CompareAndSwap(true, false) {
+		c.log.Dim(fmt.Sprintf("Connection pool to %s has free connections again", req.URL.Host))
+	}
+}
+
+// Body wrapper that frees the connection slot exactly once
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
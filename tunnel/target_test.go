@@ -0,0 +1,197 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Address of this machine other than loopback, which net/http never
+// proxies anyway; "" if it has none
+func nonLoopbackIP() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil && !ip.IP.IsLoopback() {
+			return ip.IP.String()
+		}
+	}
+	return ""
+}
+
+// net/http reads the proxy settings once per process, so the test runs
+// itself again with HTTP_PROXY pointing at a proxy that never answers
+func TestLocalHopIgnoresHTTPProxy(t *testing.T) {
+	if os.Getenv("COMZY_TEST_BLACKHOLE_PROXY") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLocalHopIgnoresHTTPProxy$", "-test.v")
+		cmd.Env = append(os.Environ(), "COMZY_TEST_BLACKHOLE_PROXY=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		t.Logf("%s", out)
+		return
+	}
+
+	ip := nonLoopbackIP()
+	if ip == "" {
+		t.Skip("no address other than loopback to serve the local app on")
+	}
+	// Accepts connections and never answers
+	blackhole, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { blackhole.Close() })
+	var proxied atomic.Int64
+	go func() {
+		for {
+			conn, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			proxied.Add(1)
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		t.Setenv(name, "http://"+blackhole.Addr().String())
+	}
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", ip, err)
+	}
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	}))
+	local.Listener.Close()
+	local.Listener = listener
+	local.Start()
+	t.Cleanup(local.Close)
+
+	t.Run("direct", func(t *testing.T) {
+		conn := startEdgeTunnel(t, newFakeEdge(t), local.URL)
+		conn.request(1, "GET", "/", HeaderMap{}, nil)
+		resp, _ := conn.response(1, false)
+		if resp.Status != 200 || string(resp.Body) != "direct" {
+			t.Errorf("response %d %q, want 200 \"direct\"", resp.Status, resp.Body)
+		}
+		if n := proxied.Load(); n > 0 {
+			t.Errorf("%d connections went to HTTP_PROXY", n)
+		}
+	})
+
+	// The same request with --proxy-local is lost in the black hole, so
+	// the test above would catch a local hop that honored HTTP_PROXY
+	t.Run("proxy-local", func(t *testing.T) {
+		conn := startEdgeTunnel(t, newFakeEdge(t), local.URL, "--proxy-local", "--timeout", "1s")
+		conn.request(1, "GET", "/", HeaderMap{}, nil)
+		resp, _ := conn.response(1, false)
+		if resp.Status != http.StatusGatewayTimeout {
+			t.Errorf("response %d %q, want 504 from the black hole", resp.Status, resp.Body)
+		}
+		if proxied.Load() == 0 {
+			t.Error("--proxy-local did not use HTTP_PROXY")
+		}
+	})
+}
+
+// Redirects reach the visitor as the local app sent them, not followed,
+// with only a Location at the local origin pointed at the public URL
+func TestRedirectsPassThrough(t *testing.T) {
+	var followed atomic.Int64
+	var local *httptest.Server
+	local = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logout":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "", Path: "/", MaxAge: -1})
+			http.SetCookie(w, &http.Cookie{Name: "flash", Value: "bye", Path: "/"})
+			w.Header().Set("Location", "/login?next=%2Fhome")
+		case "/oauth":
+			w.Header().Set("Location", local.URL+"/callback?code=a%2Fb&state=1")
+		default:
+			followed.Add(1)
+			return
+		}
+		w.WriteHeader(http.StatusFound)
+	}))
+	t.Cleanup(local.Close)
+	edge := newFakeEdge(t)
+	conn := startEdgeTunnel(t, edge, local.URL)
+
+	conn.request(1, "GET", "/logout", HeaderMap{}, nil)
+	resp, _ := conn.response(1, false)
+	if resp.Status != http.StatusFound || resp.Headers.Get("location") != "/login?next=%2Fhome" {
+		t.Errorf("/logout: %d to %q, want 302 to /login?next=%%2Fhome", resp.Status, resp.Headers.Get("location"))
+	}
+	want := []string{"session=; Path=/; Max-Age=0", "flash=bye; Path=/"}
+	if got := resp.Headers["set-cookie"]; len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("/logout: set-cookie %q, want %q", got, want)
+	}
+
+	conn.request(2, "GET", "/oauth", HeaderMap{}, nil)
+	resp, _ = conn.response(2, false)
+	location := resp.Headers.Get("location")
+	public := strings.HasPrefix(location, "https://") && !strings.Contains(location, local.Listener.Addr().String())
+	if resp.Status != http.StatusFound || !public || !strings.HasSuffix(location, "/callback?code=a%2Fb&state=1") {
+		t.Errorf("/oauth: %d to %q, want 302 to the public /callback?code=a%%2Fb&state=1", resp.Status, location)
+	}
+	if n := followed.Load(); n > 0 {
+		t.Errorf("the tunnel followed %d redirects", n)
+	}
+}
+
+// A burst of small requests through the local client, against the default
+// transport every request used before, which keeps only two idle
+// connections per host and so reconnects for most of a burst
+func BenchmarkLocalBurst(b *testing.B) {
+	const burst = 50
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer local.Close()
+	opts := defaultOptions()
+	opts.MaxConnsPerHost = burst
+
+	run := func(b *testing.B, client *http.Client) {
+		for b.Loop() {
+			var wg sync.WaitGroup
+			for range burst {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp, err := client.Get(local.URL)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}()
+			}
+			wg.Wait()
+		}
+		b.ReportMetric(float64(b.Elapsed().Microseconds())/float64(b.N*burst), "µs/request")
+	}
+	b.Run("local-client", func(b *testing.B) {
+		run(b, newLocalClient(burst, nil, opts).Client)
+	})
+	b.Run("default-transport", func(b *testing.B) {
+		transport := &http.Transport{DisableCompression: true}
+		defer transport.CloseIdleConnections()
+		run(b, &http.Client{Transport: transport})
+	})
+}
@@ -0,0 +1,346 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Tunnel protocols, chosen with --protocol or "comzy tcp"
+const (
+	ProtocolHTTP = "http"
+	ProtocolTCP  = "tcp"
+)
+
+func validateProtocol(protocol string) error {
+	if protocol != ProtocolHTTP && protocol != ProtocolTCP {
+		return fmt.Errorf("invalid --protocol %q (use http or tcp)", protocol)
+	}
+	return nil
+}
+
+// What a tunnel forwards to, for banners and tables
+func forwardingTo(opts *Options, target *localTarget) string {
+	if target.Socket != "" {
+		return "unix:" + target.Socket
+	}
+	if opts.Protocol == ProtocolTCP {
+		return "tcp://" + target.Addr()
+	}
+	if target.Dir != "" {
+		return target.Dir
+	}
+	return target.URL("")
+}
+
+// Flow control for relayed TCP connections
+const (
+	TCPWindow   = 1 << 20  // bytes the server may send before they are acknowledged
+	TCPReadSize = 32 << 10 // most bytes read from the local side per frame
+)
+
+// Message relaying a raw TCP connection, keyed by connection ID. The server
+// sends "tcp-open" when someone connects to the public port; the client
+// dials the local target and answers "tcp-opened" with its receive window,
+// or "tcp-close" if the dial fails. "tcp-data" carries base64 payload both
+// ways, and "tcp-ack" returns window: neither side may have more than the
+// other's window of data unacknowledged. "tcp-close" from either side ends
+// the connection.
+type TCPMessage struct {
+	Type       string    `json:"type"`
+	ID         MessageID `json:"id"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"` // tcp-open: the connecting client
+	Window     int       `json:"window,omitempty"`     // tcp-open, tcp-opened: receive window
+	Data       string    `json:"data,omitempty"`
+	Bytes      int       `json:"bytes,omitempty"` // tcp-ack: bytes delivered
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Local TCP connections opened through one tunnel connection
+type tcpProxy struct {
+	ws     *tunnelConn
+	target *localTarget
+
+	mu    sync.Mutex
+	conns map[string]*localTCPConn
+}
+
+// One relayed connection to the local service
+type localTCPConn struct {
+	id     MessageID
+	key    string
+	conn   net.Conn
+	opened time.Time
+
+	// Data from the server waiting to be written locally, and the bytes
+	// in it, which may not exceed TCPWindow
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	queued  int
+	closed  bool
+
+	// Bytes the server is still willing to receive; unlimited when it
+	// announced no window
+	credit  int
+	limited bool
+
+	bytesIn, bytesOut int64
+	once              sync.Once
+}
+
+func newTCPProxy(ws *tunnelConn, target *localTarget) *tcpProxy {
+	return &tcpProxy{ws: ws, target: target, conns: map[string]*localTCPConn{}}
+}
+
+// Writer queue for a relayed connection, separate from HTTP responses
+func tcpQueueKey(key string) string {
+	return "tcp:" + key
+}
+
+// Handle a tcp-* message from the tunnel server
+func (p *tcpProxy) handle(msg TCPMessage) {
+	key := msg.ID.String()
+	switch msg.Type {
+	case "tcp-open":
+		go p.open(msg)
+	case "tcp-data":
+		c := p.get(key)
+		if c == nil {
+			return
+		}
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			p.target.log.Error(fmt.Sprintf("Invalid TCP frame: %v", err))
+			go p.closeConn(c, "invalid frame", true)
+			return
+		}
+		if !c.push(data) {
+			// The server ignored our window; dropping the connection is
+			// the only way to keep memory bounded
+			go p.closeConn(c, "receive window exceeded", true)
+		}
+	case "tcp-ack":
+		if c := p.get(key); c != nil {
+			c.addCredit(msg.Bytes)
+		}
+	case "tcp-close":
+		if c := p.get(key); c != nil {
+			p.closeConn(c, msg.Reason, false)
+		}
+	}
+}
+
+func (p *tcpProxy) get(key string) *localTCPConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[key]
+}
+
+// Refuse a tcp-open, e.g. while draining
+func (p *tcpProxy) refuse(id MessageID, reason string) {
+	p.ws.writeJSON(tcpQueueKey(id.String()), TCPMessage{Type: "tcp-close", ID: id, Reason: reason})
+}
+
+// Dial the local service and start relaying in both directions
+func (p *tcpProxy) open(msg TCPMessage) {
+	if msg.RemoteAddr != "" {
+		host, _, err := net.SplitHostPort(msg.RemoteAddr)
+		if err != nil {
+			host = msg.RemoteAddr
+		}
+		ip, err := netip.ParseAddr(host)
+		ok := err == nil
+		if !p.target.ipFilter.allows(ip.Unmap(), ok) {
+			p.target.log.Dim(fmt.Sprintf("TCP %s -> rejected (%s not allowed)", msg.RemoteAddr, describeIP(ip, ok)))
+			p.refuse(msg.ID, "forbidden")
+			return
+		}
+	}
+
+	conn, err := net.DialTimeout(p.target.network(), p.target.Addr(), 10*time.Second)
+	if err != nil {
+		p.target.log.Error(fmt.Sprintf("TCP proxy error: %v", err))
+		p.refuse(msg.ID, "local connection failed")
+		return
+	}
+
+	key := msg.ID.String()
+	c := &localTCPConn{
+		id:      msg.ID,
+		key:     key,
+		conn:    conn,
+		opened:  time.Now(),
+		credit:  msg.Window,
+		limited: msg.Window > 0,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	p.mu.Lock()
+	p.conns[key] = c
+	p.mu.Unlock()
+
+	from := msg.RemoteAddr
+	if from == "" {
+		from = "remote client"
+	}
+	p.target.log.Dim(fmt.Sprintf("TCP %v from %s -> %s", msg.ID, from, p.target.Addr()))
+
+	if err := p.ws.writeJSON(tcpQueueKey(key), TCPMessage{Type: "tcp-opened", ID: msg.ID, Window: TCPWindow}); err != nil {
+		p.closeConn(c, "", false)
+		return
+	}
+	go p.writeLoop(c)
+	go p.readLoop(c)
+}
+
+// Relay bytes from the local service to the tunnel, waiting for window
+// credit so a slow remote reader holds the local sender back
+func (p *tcpProxy) readLoop(c *localTCPConn) {
+	size := TCPReadSize
+	if c.limited {
+		// A frame must fit in the window or it could never be sent
+		size = min(size, c.credit)
+	}
+	buf := make([]byte, size)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			if !c.takeCredit(n) {
+				return
+			}
+			c.mu.Lock()
+			c.bytesOut += int64(n)
+			c.mu.Unlock()
+			msg := TCPMessage{Type: "tcp-data", ID: c.id, Data: base64.StdEncoding.EncodeToString(buf[:n])}
+			if werr := p.ws.writeJSON(tcpQueueKey(c.key), msg); werr != nil {
+				p.closeConn(c, "", false)
+				return
+			}
+		}
+		if err != nil {
+			p.closeConn(c, "local connection closed", true)
+			return
+		}
+	}
+}
+
+// Write data from the tunnel to the local service in order, acknowledging
+// each write so the server can send more
+func (p *tcpProxy) writeLoop(c *localTCPConn) {
+	for {
+		data, ok := c.pop()
+		if !ok {
+			return
+		}
+		if _, err := c.conn.Write(data); err != nil {
+			p.closeConn(c, "local connection closed", true)
+			return
+		}
+		c.mu.Lock()
+		c.queued -= len(data)
+		c.bytesIn += int64(len(data))
+		c.mu.Unlock()
+		if err := p.ws.writeJSON(tcpQueueKey(c.key), TCPMessage{Type: "tcp-ack", ID: c.id, Bytes: len(data)}); err != nil {
+			p.closeConn(c, "", false)
+			return
+		}
+	}
+}
+
+// Queue data from the server, false if it overruns the window
+func (c *localTCPConn) push(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	if c.queued+len(data) > TCPWindow {
+		return false
+	}
+	c.pending = append(c.pending, data)
+	c.queued += len(data)
+	c.cond.Broadcast()
+	return true
+}
+
+// Next data to write locally; false once the connection is closed
+func (c *localTCPConn) pop() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.pending) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return nil, false
+	}
+	data := c.pending[0]
+	c.pending = c.pending[1:]
+	return data, true
+}
+
+// Wait until the server can take n more bytes; false once closed
+func (c *localTCPConn) takeCredit(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.limited {
+		return !c.closed
+	}
+	for c.credit < n && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.credit -= n
+	return true
+}
+
+func (c *localTCPConn) addCredit(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.credit += n
+	c.cond.Broadcast()
+}
+
+// Close a relayed connection, telling the server when the close started
+// on this side
+func (p *tcpProxy) closeConn(c *localTCPConn, reason string, notify bool) {
+	c.once.Do(func() {
+		p.mu.Lock()
+		if p.conns[c.key] == c {
+			delete(p.conns, c.key)
+		}
+		p.mu.Unlock()
+
+		c.mu.Lock()
+		c.closed = true
+		c.pending = nil
+		in, out := c.bytesIn, c.bytesOut
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		c.conn.Close()
+
+		if notify {
+			p.ws.writeJSON(tcpQueueKey(c.key), TCPMessage{Type: "tcp-close", ID: c.id, Reason: reason})
+		}
+		p.target.log.Dim(fmt.Sprintf("TCP %v closed after %s (%s in, %s out)",
+			c.id, time.Since(c.opened).Round(time.Millisecond), formatBytes(in), formatBytes(out)))
+	})
+}
+
+// Close every relayed connection, used when the tunnel drops
+func (p *tcpProxy) closeAll() {
+	p.mu.Lock()
+	conns := make([]*localTCPConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		p.closeConn(c, "", false)
+	}
+}
@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+)
+
+// Bounded copy of a body on its way through the tunnel. The reader it is
+// teed from passes every byte on untouched; the tee keeps the first limit
+// of them for the inspector and counts the rest.
+type bodyTee struct {
+	mu     sync.Mutex
+	limit  int
+	prefix []byte
+	size   int
+}
+
+func (t *bodyTee) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size += len(p)
+	if room := t.limit - len(t.prefix); room > 0 {
+		t.prefix = append(t.prefix, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// Bytes kept so far and the size seen so far
+func (t *bodyTee) snapshot() ([]byte, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.prefix, t.size
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// TeeRequest records a bounded copy of a request body streamed to the
+// local app as it is read. The returned body must be sent in its place.
+func (c *Capture) TeeRequest(body io.ReadCloser) io.ReadCloser {
+	if c == nil || body == nil {
+		return body
+	}
+	tee := &bodyTee{limit: c.inspector.bodyLimit}
+	c.inspector.mu.Lock()
+	c.requestTee = tee
+	c.inspector.mu.Unlock()
+	return teeReadCloser{Reader: io.TeeReader(body, tee), Closer: body}
+}
+
+// TeeResponse records a bounded copy of a response body streamed back,
+// starting with the prefix already read. The returned reader must be
+// streamed in place of body, and EndStream called once it is done.
+func (c *Capture) TeeResponse(prefix []byte, body io.Reader) io.Reader {
+	if c == nil {
+		return body
+	}
+	tee := &bodyTee{limit: c.inspector.bodyLimit}
+	tee.Write(prefix)
+	c.inspector.mu.Lock()
+	c.responseTee = tee
+	c.inspector.mu.Unlock()
+	return io.TeeReader(body, tee)
+}
+
+// EndStream records what was kept of a streamed response body
+func (c *Capture) EndStream() {
+	if c == nil || c.responseTee == nil {
+		return
+	}
+	prefix, size := c.responseTee.snapshot()
+	c.inspector.mu.Lock()
+	defer c.inspector.mu.Unlock()
+
+	c.ResponseBody = c.inspector.captureBody(prefix, size, c.ResponseHeaders.Get("content-type"))
+}
@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Default limit on how long the local app may take to respond
+const DefaultLocalTimeout = 30 * time.Second
+
+// Deadline for one request to the local app. Streamed responses lift it
+// once they start, so long downloads and SSE aren't cut off.
+type hopTimer struct {
+	timer   *time.Timer
+	fired   atomic.Bool
+	started time.Time
+	limit   time.Duration
+}
+
+// Cancel the request d after it arrived; zero disables the deadline
+func startHopTimer(arrived time.Time, d time.Duration, cancel context.CancelFunc) *hopTimer {
+	h := &hopTimer{started: arrived, limit: d}
+	if d > 0 {
+		h.timer = time.AfterFunc(d-time.Since(arrived), func() {
+			h.fired.Store(true)
+			cancel()
+		})
+	}
+	return h
+}
+
+// Lift the deadline
+func (h *hopTimer) stop() {
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// Replace an error caused by the deadline with a timeoutError. The local
+// client's header timeout is the same limit, so an error once the limit
+// has passed is the deadline's too, whichever fired first.
+func (h *hopTimer) check(target *localTarget, err error) error {
+	if !h.fired.Load() && (h.limit <= 0 || time.Since(h.started) < h.limit) {
+		return err
+	}
+	return &timeoutError{target: target.URL(""), limit: h.limit, elapsed: time.Since(h.started)}
+}
+
+// The local app didn't respond within --timeout
+type timeoutError struct {
+	target  string
+	limit   time.Duration
+	elapsed time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("local target %s did not respond within %s", e.target, e.limit)
+}
+
+// The request spent longer than --max-request-age reaching this client,
+// e.g. queued at the edge while the machine was asleep
+type staleError struct {
+	age    time.Duration
+	maxAge time.Duration
+}
+
+func (e *staleError) Error() string {
+	return fmt.Sprintf("request is %s old, more than --max-request-age %s", e.age.Round(time.Millisecond), e.maxAge)
+}
+
+// Check a request's age against maxAge; zero disables the check, as does a
+// request without an arrival timestamp
+func checkRequestAge(ws *tunnelConn, receivedAt int64, maxAge time.Duration) error {
+	if maxAge <= 0 {
+		return nil
+	}
+	if age, ok := ws.edgeDelay(receivedAt); ok && age > maxAge {
+		return &staleError{age: age, maxAge: maxAge}
+	}
+	return nil
+}
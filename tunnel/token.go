@@ -0,0 +1,254 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Shortest and longest token accepted from a file
+const (
+	minTokenLength = 16
+	maxTokenLength = 4096
+)
+
+// A token with the details of its account, as written by "comzy token
+// export" for "comzy token import" on another machine
+type exportedToken struct {
+	Token      string    `json:"token"`
+	Email      string    `json:"email,omitempty"`
+	Plan       string    `json:"plan,omitempty"`
+	ExpiresAt  time.Time `json:"expiresAt,omitzero"`
+	Host       string    `json:"host,omitempty"` // machine it was exported on
+	ExportedAt time.Time `json:"exportedAt,omitzero"`
+}
+
+// Where the saved token was imported from, kept for "comzy status" until
+// the token is replaced
+type tokenImport struct {
+	From       string    `json:"from"` // file path, or "stdin"
+	Host       string    `json:"host,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+func tokenImportFile() string {
+	return filepath.Join(comzyDir, "token-import.json")
+}
+
+// Import record of the saved token, nil if it was entered with "comzy login"
+func loadTokenImport() *tokenImport {
+	data, err := os.ReadFile(tokenImportFile())
+	if err != nil {
+		return nil
+	}
+	var record tokenImport
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil
+	}
+	return &record
+}
+
+func (r *tokenImport) String() string {
+	s := fmt.Sprintf("imported from %s on %s", r.From, r.ImportedAt.Local().Format("2006-01-02 15:04"))
+	if r.Host != "" {
+		s += fmt.Sprintf(", exported on %s", r.Host)
+	}
+	return s
+}
+
+// Check that a token looks like one the portal issues, so a file of
+// something else isn't saved in its place
+func validateTokenShape(token string) error {
+	switch {
+	case token == "":
+		return fmt.Errorf("no token found")
+	case len(token) < minTokenLength:
+		return fmt.Errorf("token is too short (%d characters) to be a comzy token", len(token))
+	case len(token) > maxTokenLength:
+		return fmt.Errorf("token is too long (%d characters) to be a comzy token", len(token))
+	}
+	for _, r := range token {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || strings.ContainsRune("-._~+/=", r)) {
+			return fmt.Errorf("token contains %q, which comzy tokens don't", r)
+		}
+	}
+	return nil
+}
+
+// Read a token from a file written by "comzy token export", or holding
+// the token alone like ~/.comzy/.user. "-" reads stdin.
+func readTokenFile(path string) (*exportedToken, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(io.LimitReader(os.Stdin, 1<<20))
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(strings.TrimSpace(string(data)))
+
+	var exported exportedToken
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &exported); err != nil {
+			return nil, fmt.Errorf("%s is not a token file: %v", path, err)
+		}
+		exported.Token = strings.TrimSpace(exported.Token)
+	} else {
+		exported.Token = string(data)
+	}
+	if err := validateTokenShape(exported.Token); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if !exported.ExpiresAt.IsZero() && exported.ExpiresAt.Before(time.Now()) {
+		return nil, fmt.Errorf("the token in %s expired on %s", path, exported.ExpiresAt.Local().Format("2006-01-02"))
+	}
+	return &exported, nil
+}
+
+// Save the token in a file as the login. A different saved token is only
+// replaced with force.
+func importToken(path string, force, offline bool) error {
+	exported, err := readTokenFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(userFile); err == nil {
+		switch saved := strings.TrimSpace(string(data)); {
+		case saved == exported.Token:
+			logSuccess("This token is already saved")
+			return nil
+		case saved != "" && !force:
+			return fmt.Errorf("a different token (%s) is already saved, use --force to replace it", maskSecret(saved))
+		}
+	}
+	// Verifying prints the account otherwise
+	if offline && exported.Email != "" {
+		account := accountInfo{Email: exported.Email, Plan: exported.Plan, ExpiresAt: exported.ExpiresAt}
+		logDim(fmt.Sprintf("Token for %s", &account))
+	}
+	if err := saveLogin(exported.Token, offline); err != nil {
+		return err
+	}
+
+	from := "stdin"
+	if path != "-" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		from = path
+	}
+	data, err := json.Marshal(tokenImport{From: from, Host: exported.Host, Email: exported.Email, ImportedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(tokenImportFile(), data, 0600)
+}
+
+// Write the token in use and its account details to path, or stdout
+func exportToken(path string, force bool) error {
+	token, source := activeToken()
+	if token == "" {
+		return fmt.Errorf("no token to export, use \"comzy login\" first")
+	}
+	exported := exportedToken{Token: token, ExportedAt: time.Now()}
+	exported.Host, _ = os.Hostname()
+	// With --stdout the output is the token file, piped somewhere
+	warn := logWarning
+	if path == "" {
+		warn = func(message string) { fmt.Fprintf(os.Stderr, "%s%s%s\n", ColorYellow, message, ColorReset) }
+	}
+	account, err := verifyToken(token)
+	var rejected *tokenRejectedError
+	switch {
+	case errors.As(err, &rejected):
+		return fmt.Errorf("the portal says the %v (from %s), so it's not worth exporting", err, source)
+	case err != nil:
+		warn(fmt.Sprintf("Could not verify token, exporting it without account details: %v", err))
+	default:
+		exported.Email, exported.Plan, exported.ExpiresAt = account.Email, account.Plan, account.ExpiresAt
+	}
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	// An existing file keeps its mode otherwise
+	if err := f.Chmod(0600); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	logSuccess(fmt.Sprintf("Token exported to %s, keep it as safe as a password", path))
+	logDim(fmt.Sprintf("On the other machine: comzy token import %s", filepath.Base(path)))
+	return nil
+}
+
+// Handle "comzy token export|import": move a login to a machine where it
+// can't be typed in
+func handleToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	output := fs.String("output", "", "File to export the token to")
+	toStdout := fs.Bool("stdout", false, "Print the exported token instead of writing a file")
+	force := fs.Bool("force", false, "Overwrite an existing file, or replace a different saved token")
+	offline := fs.Bool("offline", false, "Import the token without verifying it")
+	// Flags may come after the action, as in "comzy token import t.json --force"
+	var words []string
+	for {
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	usage := &usageError{fmt.Errorf("Usage: comzy token export --output FILE, comzy token export --stdout or comzy token import FILE"), fs}
+
+	switch {
+	case len(words) == 1 && words[0] == "export":
+		if (*output == "") == !*toStdout {
+			return usage
+		}
+		return exportToken(*output, *force)
+	case len(words) == 2 && words[0] == "import":
+		if *output != "" || *toStdout {
+			return usage
+		}
+		return importToken(words[1], *force, *offline)
+	}
+	return usage
+}
@@ -0,0 +1,334 @@
+package tunnel
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels started together by one invocation
+type tunnelGroup struct {
+	tunnels    []*tunnel
+	inspectURL string
+	healthURL  string // /healthz on the inspector or metrics listener
+
+	stopOnce sync.Once
+	done     chan struct{} // closed once the session should end
+	reason   error
+
+	// Cancelled on stop, aborting connection attempts in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Set while shutting down: new requests are refused with 503
+	draining atomic.Bool
+
+	// Longest shutdown waits for in-flight requests. Set while preparing
+	// the group, then only lowered through limitDrain, which may happen
+	// while a shutdown is already waiting.
+	drainMu      sync.Mutex
+	drainTimeout time.Duration
+	drainTimer   *time.Timer // running while shutdown waits
+	drainStarted time.Time
+
+	// Connected time left while registered anonymously
+	anonymous *anonymousClock
+
+	// Called on connection lifecycle events, if set
+	observe func(t *tunnel, event, detail string)
+
+	// Called on the first interrupt instead of shutting down, if set.
+	// "comzy run" passes it on to its command, whose exit then ends the
+	// session.
+	onInterrupt func(sig os.Signal)
+}
+
+// Connection lifecycle events passed to tunnelGroup.observe, and with
+// EventRequest to Config.OnEvent
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected" // detail is why
+	EventReconnecting = "reconnecting" // detail is the wait before the next attempt
+	EventRegistered   = "registered"   // detail is the public alias
+	EventURLChanged   = "url-changed"  // detail is the previous alias
+	EventRequest      = "request"
+)
+
+func (g *tunnelGroup) notify(t *tunnel, event, detail string) {
+	if t.notifier != nil {
+		t.notifier.event(event, detail)
+	}
+	if g.observe != nil {
+		g.observe(t, event, detail)
+	}
+}
+
+func newTunnelGroup() *tunnelGroup {
+	g := &tunnelGroup{done: make(chan struct{})}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.anonymous = newAnonymousClock(g.anonymousExpired, g.anonymousEnding)
+	return g
+}
+
+// End the session for every tunnel. The first reason given wins.
+func (g *tunnelGroup) stop(reason error) {
+	g.stopOnce.Do(func() {
+		g.reason = reason
+		close(g.done)
+		g.cancel()
+		for _, t := range g.tunnels {
+			t.close()
+		}
+	})
+}
+
+// Refuse new requests, give in-flight ones up to the drain timeout to
+// send their responses, then stop. Safe to call more than once.
+func (g *tunnelGroup) shutdown(reason error) {
+	if g.draining.Swap(true) {
+		return
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, t := range g.tunnels {
+			t.inflight.Wait()
+		}
+		close(drained)
+	}()
+
+	g.drainMu.Lock()
+	timeout := g.drainTimeout
+	g.drainStarted = time.Now()
+	timer := time.NewTimer(timeout)
+	g.drainTimer = timer
+	g.drainMu.Unlock()
+	defer timer.Stop()
+
+	if g.activeRequests() > 0 {
+		logInfo(fmt.Sprintf("Waiting up to %s for %d in-flight requests...", timeout, g.activeRequests()))
+	}
+	select {
+	case <-drained:
+	case <-timer.C:
+		logWarning(fmt.Sprintf("Drain timeout reached, abandoning %d in-flight requests", g.activeRequests()))
+	case <-g.done:
+	}
+	g.stop(reason)
+}
+
+// Wait no longer than limit for in-flight requests, including in a
+// shutdown already waiting
+func (g *tunnelGroup) limitDrain(limit time.Duration) {
+	g.drainMu.Lock()
+	defer g.drainMu.Unlock()
+	if limit >= g.drainTimeout {
+		return
+	}
+	g.drainTimeout = limit
+	if g.drainTimer != nil {
+		g.drainTimer.Reset(time.Until(g.drainStarted.Add(limit)))
+	}
+}
+
+// Longest shutdown waits for in-flight requests
+func (g *tunnelGroup) drainLimit() time.Duration {
+	g.drainMu.Lock()
+	defer g.drainMu.Unlock()
+	return g.drainTimeout
+}
+
+// Requests being handled across all tunnels
+func (g *tunnelGroup) activeRequests() int64 {
+	var n int64
+	for _, t := range g.tunnels {
+		n += t.active.Load()
+	}
+	return n
+}
+
+// Whether stop has been called
+func (g *tunnelGroup) stopped() bool {
+	select {
+	case <-g.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Public URLs of the tunnels that have registered
+func (g *tunnelGroup) publicURLs() []string {
+	var urls []string
+	for _, t := range g.tunnels {
+		if endpoint := t.publicEndpoint(); endpoint != "" {
+			urls = append(urls, endpoint)
+		}
+	}
+	return urls
+}
+
+// Print the alias to local target mapping once every tunnel has registered.
+// Printed again whenever a tunnel re-registers, since its alias may change.
+func (g *tunnelGroup) printTable(isAnonymous bool) {
+	for _, t := range g.tunnels {
+		if t.publicAlias() == "" {
+			return
+		}
+	}
+
+	fmt.Fprintln(console)
+	table := newListing("tunnel", "public url", "forwarding to")
+	for _, t := range g.tunnels {
+		table.add(t.opts.Name, t.publicEndpoint(), forwardingTo(t.opts, t.target))
+	}
+	table.write(console, &listOptions{Format: FormatTable})
+	if g.inspectURL != "" {
+		fmt.Fprintf(console, "\n%sInspector:      %s%s%s\n", ColorBright, ColorCyan, g.inspectURL, ColorReset)
+	}
+	if isAnonymous {
+		logDim(fmt.Sprintf("Anonymous session will expire in %s of connected time", g.anonymous))
+	}
+	fmt.Fprintln(console)
+	logDim("Waiting for connections...")
+	fmt.Fprintln(console)
+}
+
+// Parse "comzy start NAME... [options]" or "comzy start --all [options]".
+// Options given on the command line apply to every named tunnel.
+func parseStart(args []string) ([]*Options, error) {
+	all := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "--all" || arg == "-all" {
+			all = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+
+	// Separate tunnel names from options, which may be interspersed
+	scratch := defaultOptions()
+	fs := scratch.flagSet()
+	var names, flags []string
+	for {
+		if err := parseFlags(fs, rest); err != nil {
+			return nil, err
+		}
+		flags = append(flags, rest[:len(rest)-fs.NArg()]...)
+		if fs.NArg() == 0 {
+			break
+		}
+		names = append(names, fs.Arg(0))
+		rest = fs.Args()[1:]
+	}
+
+	if all {
+		if len(names) > 0 {
+			return nil, fmt.Errorf("--all can't be combined with tunnel names")
+		}
+		var err error
+		explicit := false
+		fs.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
+		if names, err = configTunnelNames(scratch.ConfigFile, explicit); err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no tunnels are defined in %s", strings.Join(configFiles(scratch.ConfigFile, explicit), " or "))
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("Usage: comzy start <name|port>... [options] or comzy start --all")
+	}
+
+	seen := map[string]bool{}
+	var list []*Options
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("tunnel %q given twice", name)
+		}
+		seen[name] = true
+		// A port starts an unnamed tunnel, as in "comzy start 3000 --daemon"
+		if _, err := strconv.Atoi(name); err == nil && len(names) == 1 {
+			opts, err := parseOptions(append(flags, name), "")
+			if err != nil {
+				return nil, err
+			}
+			return []*Options{opts}, nil
+		}
+		opts, err := parseOptions(flags, name)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, opts)
+	}
+	return list, nil
+}
+
+// Handle the tunnels command: list the named tunnels in the config file
+func handleTunnels(args []string) error {
+	fs := flag.NewFlagSet("tunnels", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", defaultConfigFile(), "Config file to list tunnels from")
+	format := addListFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument: %s", fs.Arg(0))
+	}
+
+	var configArgs []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configArgs = []string{"--config", *configFile}
+		}
+	})
+
+	table := newListing("name", "target", "subdomain", "basic-auth")
+	names, err := configTunnelNames(*configFile, configArgs != nil)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		opts, err := parseOptions(configArgs, name)
+		if err != nil {
+			return err
+		}
+		auth := "no"
+		if len(opts.BasicAuth) > 0 {
+			auth = "yes"
+		}
+		table.add(name, newLocalTarget(opts).URL(""), opts.Subdomain, auth)
+	}
+	return table.write(os.Stdout, format)
+}
+
+// Names under tunnels: in the config files, in file order
+func configTunnelNames(path string, explicit bool) ([]string, error) {
+	docs, err := readConfigDocs(path, explicit)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var names []string
+	for _, doc := range docs {
+		if doc.tunnels == nil {
+			continue
+		}
+		for i := 0; i < len(doc.tunnels.Content); i += 2 {
+			if name := doc.tunnels.Content[i].Value; !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
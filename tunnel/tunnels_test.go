@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimitDrainShortensShutdownInProgress(t *testing.T) {
+	group := newTunnelGroup()
+	group.drainTimeout = time.Minute
+	stuck := &tunnel{}
+	stuck.inflight.Add(1)
+	stuck.active.Add(1)
+	t.Cleanup(stuck.inflight.Done)
+	group.tunnels = []*tunnel{stuck}
+
+	reason := errors.New("expired")
+	go group.shutdown(reason)
+	time.Sleep(50 * time.Millisecond)
+	// As the console closing does while an expiry is draining
+	group.limitDrain(200 * time.Millisecond)
+
+	select {
+	case <-group.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("still draining after the limit, up to %s", group.drainLimit())
+	}
+	if group.reason != reason {
+		t.Errorf("stopped with %v, want %v", group.reason, reason)
+	}
+	if group.drainLimit() != 200*time.Millisecond {
+		t.Errorf("drain limit %s", group.drainLimit())
+	}
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Time allowed to connect to a --unix socket when checking it at startup
+const unixCheckTimeout = 2 * time.Second
+
+// Resolve the socket given to --unix and make sure something accepts
+// connections on it. With --wait the app may not have created it yet, so
+// only a path that exists but isn't a socket is refused.
+func checkUnixSocket(path string, wait bool) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if errors.Is(err, fs.ErrNotExist) {
+		if wait {
+			return abs, nil
+		}
+		return "", fmt.Errorf("--unix: %s does not exist; is the app running?", abs)
+	}
+	if err != nil {
+		return "", fmt.Errorf("--unix: %v", err)
+	}
+	if info.IsDir() || info.Mode().IsRegular() {
+		return "", fmt.Errorf("--unix: %s is not a Unix socket", abs)
+	}
+	if wait {
+		return abs, nil
+	}
+	conn, err := net.DialTimeout("unix", abs, unixCheckTimeout)
+	if err != nil {
+		return "", fmt.Errorf("--unix: nothing accepts connections on %s (%v)", abs, err)
+	}
+	conn.Close()
+	return abs, nil
+}
+
+// Dial func that connects to the socket at path whatever address it is
+// asked for, so requests keep an ordinary http:// URL
+func unixDialer(path string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,472 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default for --max-body-size
+const DefaultMaxBodySize = 100 << 20
+
+// Capability under which the server may send a large request body after
+// the request itself, in "request-chunk" frames of base64 data closed by
+// "request-end", instead of inline
+const CapChunkedRequest = "chunked-request"
+
+// Frames of a chunked request body
+const (
+	MsgRequestChunk = "request-chunk"
+	MsgRequestEnd   = "request-end"
+)
+
+// Bytes of one upload the read loop queues while the local app catches up,
+// chunks of it held for the local app to read, and how long the upload
+// waits for the local app to take a chunk. An upload over its queue, or
+// whose local app stalls, is given up on; other traffic never waits.
+const (
+	uploadQueueLimit   = 16 << 20
+	uploadBuffer       = 16
+	uploadStallTimeout = 10 * time.Second
+)
+
+// Room in a message for everything but the body: JSON, headers and the
+// growth of base64
+const frameOverhead = 1 << 20
+
+// The request body is over --max-body-size
+type bodyTooLargeError struct {
+	size  int64 // -1 when the body was cut off once over the limit
+	limit int64
+}
+
+func (e *bodyTooLargeError) Error() string {
+	if e.size < 0 {
+		return fmt.Sprintf("request body is over --max-body-size %s", ByteSize(e.limit))
+	}
+	return fmt.Sprintf("request body of %s is over --max-body-size %s", ByteSize(e.size), ByteSize(e.limit))
+}
+
+var (
+	errUploadStalled = errors.New("local app stopped reading the request body")
+	errUploadBacklog = errors.New("local app fell behind reading the request body")
+)
+
+// Largest message worth reading for a body limit; zero for no limit
+func maxFrameSize(maxBody ByteSize) int64 {
+	if maxBody <= 0 {
+		return 0
+	}
+	return int64(base64.StdEncoding.EncodedLen(int(maxBody))) + frameOverhead
+}
+
+// A message over the frame limit, drained without being kept. fields
+// holds the short top-level values seen on the way, enough to tell whose
+// request it was.
+type oversizeMessage struct {
+	fields *topLevelFields
+	size   int64
+}
+
+func (e *oversizeMessage) Error() string {
+	return fmt.Sprintf("message of %s is too large", ByteSize(e.size))
+}
+
+// Read the next message, holding at most maxFrame bytes of it in memory
+func (c *tunnelConn) readFrame() (int, []byte, error) {
+	messageType, r, err := c.Conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	if c.maxFrame <= 0 {
+		data, err := io.ReadAll(r)
+		return messageType, data, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, c.maxFrame+1))
+	if err != nil || int64(len(data)) <= c.maxFrame {
+		return messageType, data, err
+	}
+	fields := &topLevelFields{values: map[string][]byte{}}
+	fields.Write(data)
+	rest, err := io.Copy(fields, r)
+	if err != nil {
+		return messageType, nil, err
+	}
+	return messageType, nil, &oversizeMessage{fields: fields, size: int64(len(data)) + rest}
+}
+
+// Longest top-level value kept by topLevelFields
+const maxFieldValue = 256
+
+// Picks the short top-level values out of a JSON object written to it,
+// however large the object and wherever in it they are, without keeping
+// the rest
+type topLevelFields struct {
+	values   map[string][]byte // raw JSON of each value
+	depth    int
+	inString bool
+	escaped  bool
+	inKey    bool
+	inValue  bool
+	key      []byte
+	value    []byte
+}
+
+func (f *topLevelFields) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if f.inValue && (f.depth > 1 || f.inString || !strings.ContainsRune(",}", rune(c))) {
+			if len(f.value) <= maxFieldValue {
+				f.value = append(f.value, c)
+			}
+		}
+		if f.inString {
+			switch {
+			case f.escaped:
+				f.escaped = false
+			case c == '\\':
+				f.escaped = true
+			case c == '"':
+				f.inString, f.inKey = false, false
+				continue
+			}
+			if f.inKey && len(f.key) < maxFieldValue {
+				f.key = append(f.key, c)
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			f.inString = true
+			if f.depth == 1 && !f.inValue {
+				f.inKey, f.key = true, f.key[:0]
+			}
+		case ':':
+			if f.depth == 1 && !f.inValue {
+				f.inValue, f.value = true, f.value[:0]
+			}
+		case '{', '[':
+			f.depth++
+		case '}', ']':
+			f.depth--
+			if f.depth == 0 {
+				f.endValue()
+			}
+		case ',':
+			if f.depth == 1 {
+				f.endValue()
+			}
+		}
+	}
+	return len(p), nil
+}
+
+func (f *topLevelFields) endValue() {
+	if f.inValue && len(f.value) <= maxFieldValue {
+		f.values[string(f.key)] = bytes.Clone(bytes.TrimSpace(f.value))
+	}
+	f.inValue = false
+}
+
+// Type and ID of the message; ok is false without an ID
+func (e *oversizeMessage) request() (messageType string, id MessageID, ok bool) {
+	json.Unmarshal(e.fields.values["type"], &messageType)
+	raw, found := e.fields.values["id"]
+	if !found {
+		return messageType, "", false
+	}
+	return messageType, id, json.Unmarshal(raw, &id) == nil && id != ""
+}
+
+// Answer a request whose message was too large to read with 413
+func (c *tunnelConn) refuseOversize(e *oversizeMessage, maxBody ByteSize) {
+	messageType, id, ok := e.request()
+	if !ok || messageKind(messageType) != MsgRequest {
+		c.log.Warning(fmt.Sprintf("Dropped a %s message from the tunnel server, over --max-body-size %s", ByteSize(e.size), maxBody))
+		return
+	}
+	c.log.Warning(fmt.Sprintf("Request %v refused: message of %s is over --max-body-size %s", id, ByteSize(e.size), maxBody))
+	traffic.record(&requestLog{id: id, status: 413, start: time.Now()})
+	sendRejection(c, id, 413, "Payload Too Large", nil)
+}
+
+// Size of a request body once decoded, without decoding it. Parsed
+// bodies aren't counted, and a chunked body counts its Content-Length.
+func (r *IncomingRequest) bodySize() int64 {
+	var size int64
+	if r.RawBody != nil {
+		size += decodedLen(*r.RawBody)
+	}
+	for _, file := range r.Files {
+		size += file.Buffer.Data.size()
+	}
+	if r.Chunked {
+		n, _ := strconv.ParseInt(r.Headers.Get("content-length"), 10, 64)
+		size += n
+	}
+	return size
+}
+
+// Length of base64 data once decoded
+func decodedLen(s string) int64 {
+	n := len(s)
+	for n > 0 && s[n-1] == '=' {
+		n--
+	}
+	return int64(n) * 3 / 4
+}
+
+// File contents, left base64 encoded until they are written to the local
+// app so a large upload isn't held both encoded and decoded
+type base64Data struct {
+	encoded string
+	decoded []byte // contents sent as an array of byte values instead
+}
+
+func (d *base64Data) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		return json.Unmarshal(data, &d.decoded)
+	}
+	return json.Unmarshal(data, &d.encoded)
+}
+
+func (d base64Data) size() int64 {
+	if d.decoded != nil {
+		return int64(len(d.decoded))
+	}
+	return decodedLen(d.encoded)
+}
+
+func (d base64Data) reader() io.Reader {
+	if d.decoded != nil {
+		return bytes.NewReader(d.decoded)
+	}
+	return base64.NewDecoder(base64.StdEncoding, bytes.NewBufferString(d.encoded))
+}
+
+// Body of a chunked request. The read loop queues "request-chunk" frames
+// without waiting, and a goroutine of the upload's own passes them on as
+// the local app reads them.
+type requestUpload struct {
+	mu        sync.Mutex
+	queue     [][]byte
+	queued    int64 // bytes in queue
+	allQueued bool
+	ready     chan struct{} // signalled when the queue changes
+
+	chunks   chan []byte
+	received int64 // bytes read by the local request so far
+	limit    int64
+	buf      []byte
+
+	// Closed at the end of the body, with err set if it was cut short
+	ended  chan struct{}
+	err    error
+	finish sync.Once
+
+	// Closed once the request handler no longer reads the body
+	stopped chan struct{}
+	release func()
+	once    sync.Once
+}
+
+func (u *requestUpload) Read(p []byte) (int, error) {
+	for len(u.buf) == 0 {
+		select {
+		case u.buf = <-u.chunks:
+		case <-u.stopped:
+			return 0, io.ErrClosedPipe
+		case <-u.ended:
+			// Chunks queued before the end still count
+			select {
+			case u.buf = <-u.chunks:
+				continue
+			default:
+			}
+			if u.err != nil {
+				return 0, u.err
+			}
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	u.received += int64(n)
+	if u.limit > 0 && u.received > u.limit {
+		return n, &bodyTooLargeError{size: -1, limit: u.limit}
+	}
+	return n, nil
+}
+
+// End the body, with err if it was cut short
+func (u *requestUpload) end(err error) {
+	u.finish.Do(func() {
+		u.err = err
+		close(u.ended)
+	})
+}
+
+// Called by the request handler once it no longer reads the body
+func (u *requestUpload) stop() {
+	u.once.Do(func() {
+		close(u.stopped)
+		u.release()
+	})
+}
+
+// Pass queued chunks on to the local request until the body ends or the
+// handler stops reading it
+func (u *requestUpload) feed() {
+	for {
+		u.mu.Lock()
+		var chunk []byte
+		if len(u.queue) > 0 {
+			chunk = u.queue[0]
+			u.queue[0] = nil
+			u.queue = u.queue[1:]
+			u.queued -= int64(len(chunk))
+		}
+		last := len(u.queue) == 0 && u.allQueued
+		u.mu.Unlock()
+
+		switch {
+		case chunk != nil:
+			if !u.deliver(chunk) {
+				return
+			}
+		case last:
+			u.end(nil)
+			return
+		default:
+			select {
+			case <-u.ready:
+			case <-u.ended:
+				return
+			case <-u.stopped:
+				return
+			}
+		}
+	}
+}
+
+// Wake the feed goroutine
+func (u *requestUpload) signal() {
+	select {
+	case u.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Hand a chunk to the local request, waiting up to uploadStallTimeout for
+// it to be taken; false once the upload is over
+func (u *requestUpload) deliver(chunk []byte) bool {
+	select {
+	case u.chunks <- chunk:
+		return true
+	case <-u.ended:
+		return false
+	case <-u.stopped:
+		return false
+	default:
+	}
+	stall := time.NewTimer(uploadStallTimeout)
+	defer stall.Stop()
+	select {
+	case u.chunks <- chunk:
+		return true
+	case <-u.ended:
+	case <-u.stopped:
+	case <-stall.C:
+		u.end(errUploadStalled)
+	}
+	return false
+}
+
+// Start receiving the body of a chunked request
+func (c *tunnelConn) openUpload(id MessageID, limit ByteSize) *requestUpload {
+	key := id.String()
+	u := &requestUpload{
+		ready:   make(chan struct{}, 1),
+		chunks:  make(chan []byte, uploadBuffer),
+		limit:   int64(limit),
+		ended:   make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	u.release = func() {
+		c.cancelMu.Lock()
+		if c.uploads[key] == u {
+			delete(c.uploads, key)
+		}
+		c.cancelMu.Unlock()
+	}
+	c.cancelMu.Lock()
+	c.uploads[key] = u
+	c.cancelMu.Unlock()
+	go u.feed()
+	return u
+}
+
+func (c *tunnelConn) upload(id MessageID) *requestUpload {
+	c.cancelMu.Lock()
+	defer c.cancelMu.Unlock()
+	return c.uploads[id.String()]
+}
+
+// Queue a "request-chunk" frame for its request without waiting, so one
+// slow local app holds up no other traffic. An upload over
+// uploadQueueLimit is ended instead. Chunks of requests that are finished
+// or unknown are dropped.
+func (c *tunnelConn) uploadChunk(id MessageID, data string) {
+	u := c.upload(id)
+	if u == nil {
+		return
+	}
+	chunk, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		u.end(fmt.Errorf("invalid request chunk: %v", err))
+		return
+	}
+	select {
+	case <-u.ended:
+		return
+	case <-u.stopped:
+		return
+	default:
+	}
+	u.mu.Lock()
+	full := u.queued+int64(len(chunk)) > uploadQueueLimit
+	if !full {
+		u.queue = append(u.queue, chunk)
+		u.queued += int64(len(chunk))
+	}
+	u.mu.Unlock()
+	if full {
+		u.end(errUploadBacklog)
+		return
+	}
+	u.signal()
+}
+
+// Handle "request-end": the body is complete, or was cut short when
+// message is set
+func (c *tunnelConn) endUpload(id MessageID, message string) {
+	u := c.upload(id)
+	if u == nil {
+		return
+	}
+	if message != "" {
+		u.end(fmt.Errorf("request body cut short: %s", message))
+		return
+	}
+	// The body ends once the chunks queued before it are passed on
+	u.mu.Lock()
+	u.allQueued = true
+	u.mu.Unlock()
+	u.signal()
+}
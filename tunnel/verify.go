@@ -0,0 +1,585 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conformance check tuning
+const (
+	VerifyRequestTimeout = time.Minute
+	VerifyPrefix         = "/comzy-verify"
+)
+
+// Settings of "comzy verify", parsed separately from the tunnel options
+type verifyOptions struct {
+	Large  ByteSize
+	Burst  int
+	Report string
+}
+
+func (v *verifyOptions) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	v.Large = 8 << 20
+	fs.Var(&v.Large, "large", "Size of the large upload and download")
+	fs.IntVar(&v.Burst, "burst", 20, "Requests sent at once by the concurrency check")
+	fs.StringVar(&v.Report, "report", "", "Write a JSON report to FILE")
+	return fs
+}
+
+// Outcome of one check
+type verifyResult struct {
+	Name       string  `json:"name"`
+	Passed     bool    `json:"passed"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+// Outcome of "comzy verify", written by --report
+type verifyReport struct {
+	URL    string         `json:"url"`
+	Passed bool           `json:"passed"`
+	Checks []verifyResult `json:"checks"`
+}
+
+// Handle "comzy verify": tunnel a built-in handler, request it through the
+// public URL and compare what it received and sent with what came back.
+// Returns the exit code.
+func handleVerify(args []string) (int, error) {
+	verify := &verifyOptions{}
+	fs := verify.flagSet()
+	verifyArgs, rest := splitSoakArgs(fs, args)
+	if err := parseFlags(fs, verifyArgs); err != nil {
+		return usageCode(err), err
+	}
+	if verify.Large <= 0 {
+		return ExitUsage, fmt.Errorf("--large must be positive")
+	}
+	if verify.Burst <= 0 {
+		return ExitUsage, fmt.Errorf("--burst must be positive")
+	}
+
+	opts, err := parseOptions(rest, "")
+	if err != nil {
+		return usageCode(err), err
+	}
+	if opts.source("port") == SourceArgument {
+		return ExitUsage, fmt.Errorf("comzy verify tunnels a handler of its own and takes no port")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 1, err
+	}
+	defer listener.Close()
+	go http.Serve(listener, verifyHandler())
+
+	// Point the tunnel at the handler, without policies that would get in
+	// the way of the checks
+	opts.Scheme, opts.Host, opts.Port = "http", "127.0.0.1", listener.Addr().(*net.TCPAddr).Port
+	opts.BasicAuth, opts.AllowCIDR, opts.DenyCIDR, opts.RouteMethod, opts.Rules = nil, nil, nil, nil, nil
+	opts.OAuthAllow, opts.OAuthAllowDomain, opts.Budget = nil, nil, 0
+	opts.FixMIME, opts.NoInspect = false, true
+	opts.Notify, opts.NotifyWebhook = false, ""
+	if opts.source("log-level") == SourceDefault {
+		opts.LogLevel = LevelWarn.String()
+	}
+	if err := setupLogging(opts); err != nil {
+		return 1, err
+	}
+
+	run := &soakRun{registered: make(chan struct{})}
+	group := newTunnelGroup()
+	group.observe = run.observe
+	if err := prepareGroup(group, []*Options{opts}); err != nil {
+		return 1, err
+	}
+	ctx, stop := interruptOnSignal(group)
+	defer stop()
+	finished := make(chan error, 1)
+	go func() {
+		finished <- runGroup(ctx, group)
+	}()
+
+	select {
+	case <-run.registered:
+	case err := <-finished:
+		return exitCode(err), err
+	case <-time.After(SoakRegisterTimeout):
+		group.stop(fmt.Errorf("tunnel did not register"))
+		<-finished
+		return 1, fmt.Errorf("tunnel did not register within %s", SoakRegisterTimeout)
+	}
+
+	base := run.url(VerifyPrefix)
+	fmt.Printf("Verifying %s\n\n", base)
+	report := &verifyReport{URL: base, Passed: true}
+	client := &http.Client{
+		Timeout: VerifyRequestTimeout,
+		// Redirects and compressed bodies are checked as sent
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, DisableCompression: true},
+	}
+	for _, check := range verifyChecks(verify) {
+		started := time.Now()
+		err := check.run(client, base)
+		result := verifyResult{Name: check.name, Passed: err == nil, DurationMs: ms(time.Since(started))}
+		if err != nil {
+			result.Detail = err.Error()
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, result)
+		result.print()
+	}
+
+	group.shutdown(errVerifyFinished)
+	select {
+	case <-finished:
+	case <-time.After(group.drainLimit() + 5*time.Second):
+	}
+
+	fmt.Println()
+	passed := 0
+	for _, c := range report.Checks {
+		if c.Passed {
+			passed++
+		}
+	}
+	if report.Passed {
+		fmt.Printf("%s%d of %d checks passed%s\n", ColorGreen, passed, len(report.Checks), ColorReset)
+	} else {
+		fmt.Printf("%s%d of %d checks failed%s\n", ColorRed, len(report.Checks)-passed, len(report.Checks), ColorReset)
+	}
+	if verify.Report != "" {
+		if err := report.write(verify.Report); err != nil {
+			return 1, err
+		}
+	}
+	if !report.Passed {
+		return ExitVerifyFailed, nil
+	}
+	return 0, nil
+}
+
+func (r verifyResult) print() {
+	mark, color := "PASS", ColorGreen
+	if !r.Passed {
+		mark, color = "FAIL", ColorRed
+	}
+	line := fmt.Sprintf("  %s%s%s  %-18s %6.0fms", color, mark, ColorReset, r.Name, r.DurationMs)
+	if r.Detail != "" {
+		line += "  " + r.Detail
+	}
+	fmt.Println(line)
+}
+
+// Write the report as JSON to path, or stdout for "-"
+func (r *verifyReport) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("writing report: %v", err)
+	}
+	fmt.Printf("Report written to %s\n", path)
+	return nil
+}
+
+// Text the handler compresses for the compressed body check
+const verifyGzipText = "comzy verify: this body is sent gzip-encoded and must arrive byte for byte\n"
+
+// Deterministic pseudo-random bytes, so both ends can hash the same blob
+func verifyBlob(size int64, seed int64) []byte {
+	blob := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(blob)
+	return blob
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func gzipped(text string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(text))
+	w.Close()
+	return buf.Bytes()
+}
+
+// The tunneled handler. It reports what it received in X-Verify-* headers.
+func verifyHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	// Echo the body back, with what arrived described in headers
+	mux.HandleFunc(VerifyPrefix+"/echo/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h := w.Header()
+		h.Set("X-Verify-Method", r.Method)
+		h.Set("X-Verify-Path", r.URL.EscapedPath())
+		h.Set("X-Verify-Query", r.URL.RawQuery)
+		h.Set("X-Verify-Multi", strings.Join(r.Header.Values("X-Verify-Multi"), ", "))
+		h.Set("X-Verify-Length", strconv.Itoa(len(body)))
+		h.Set("X-Verify-SHA256", sha256Hex(body))
+		if r.URL.Query().Get("discard") != "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			h.Set("Content-Type", ct)
+		}
+		w.Write(body)
+	})
+
+	mux.HandleFunc(VerifyPrefix+"/blob", func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		seed, _ := strconv.ParseInt(r.URL.Query().Get("seed"), 10, 64)
+		blob := verifyBlob(size, seed)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Verify-SHA256", sha256Hex(blob))
+		w.Write(blob)
+	})
+
+	mux.HandleFunc(VerifyPrefix+"/cookies", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2", Path: "/", HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "c", Value: "3", Path: "/", Expires: time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc(VerifyPrefix+"/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, VerifyPrefix+"/echo/?from=redirect", http.StatusFound)
+	})
+
+	mux.HandleFunc(VerifyPrefix+"/status", func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "status %d\n", code)
+	})
+
+	mux.HandleFunc(VerifyPrefix+"/gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gzipped(verifyGzipText))
+	})
+
+	return mux
+}
+
+// One conformance check against the public URL
+type verifyCheck struct {
+	name string
+	run  func(client *http.Client, base string) error
+}
+
+func verifyChecks(v *verifyOptions) []verifyCheck {
+	return []verifyCheck{
+		{"unicode body", checkEcho("text/plain; charset=utf-8", []byte("héllo wörld ✓ 日本語 🚀 \u0000 end"))},
+		{"json body", checkJSON},
+		{"unicode path", checkUnicodePath},
+		{"repeated headers", checkRepeatedHeaders},
+		{"binary upload", checkEcho("application/octet-stream", verifyBlob(256<<10, 1))},
+		{"binary download", checkDownload(256<<10, 2)},
+		{"multiple cookies", checkCookies},
+		{"redirect", checkRedirect},
+		{"status codes", checkStatusCodes},
+		{"compressed body", checkCompressed},
+		{"large upload", checkUpload(int64(v.Large), 3)},
+		{"large download", checkDownload(int64(v.Large), 4)},
+		{"concurrent burst", checkBurst(v.Burst)},
+	}
+}
+
+// Send a request and read the whole response
+func verifyDo(client *http.Client, method, url, contentType string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("User-Agent", "comzy-verify")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+// Check the handler's report of what it received
+func checkReceived(resp *http.Response, body []byte) error {
+	if got := resp.Header.Get("X-Verify-Length"); got != strconv.Itoa(len(body)) {
+		return fmt.Errorf("handler received %s bytes, sent %d", got, len(body))
+	}
+	if resp.Header.Get("X-Verify-SHA256") != sha256Hex(body) {
+		return fmt.Errorf("handler received a different body (sha256 mismatch)")
+	}
+	return nil
+}
+
+func expectStatus(resp *http.Response, status int) error {
+	if resp.StatusCode != status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, status)
+	}
+	return nil
+}
+
+// Post body and expect it back unchanged
+func checkEcho(contentType string, body []byte) func(*http.Client, string) error {
+	return func(client *http.Client, base string) error {
+		resp, got, err := verifyDo(client, "POST", base+"/echo/", contentType, body, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, 200); err != nil {
+			return err
+		}
+		if err := checkReceived(resp, body); err != nil {
+			return err
+		}
+		if !bytes.Equal(got, body) {
+			return fmt.Errorf("echoed body differs: got %d bytes (sha256 %.12s), sent %d (sha256 %.12s)",
+				len(got), sha256Hex(got), len(body), sha256Hex(body))
+		}
+		return nil
+	}
+}
+
+// JSON may be re-encoded in transit, so compare values rather than bytes
+func checkJSON(client *http.Client, base string) error {
+	body := []byte(`{"text":"ünïcödé ✓","numbers":[1,2.5,-3e10],"nested":{"null":null,"bool":true},"empty":""}`)
+	resp, got, err := verifyDo(client, "POST", base+"/echo/", "application/json", body, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 200); err != nil {
+		return err
+	}
+	if err := checkReceived(resp, body); err != nil {
+		return err
+	}
+	var sent, echoed interface{}
+	json.Unmarshal(body, &sent)
+	if err := json.Unmarshal(got, &echoed); err != nil {
+		return fmt.Errorf("echoed body is not JSON: %v", err)
+	}
+	if !reflect.DeepEqual(sent, echoed) {
+		return fmt.Errorf("echoed JSON differs: %s", got)
+	}
+	return nil
+}
+
+func checkUnicodePath(client *http.Client, base string) error {
+	path, query := "/echo/caf%C3%A9/%E6%97%A5%E6%9C%AC/a%20b", "q=%E2%9C%93&q=2&empty="
+	resp, _, err := verifyDo(client, "GET", base+path+"?"+query, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 200); err != nil {
+		return err
+	}
+	want, _ := url.PathUnescape(VerifyPrefix + path)
+	got, err := url.PathUnescape(resp.Header.Get("X-Verify-Path"))
+	if err != nil || got != want {
+		return fmt.Errorf("handler saw path %q, expected %q", resp.Header.Get("X-Verify-Path"), want)
+	}
+	wantQuery, _ := url.ParseQuery(query)
+	gotQuery, err := url.ParseQuery(resp.Header.Get("X-Verify-Query"))
+	if err != nil || !reflect.DeepEqual(gotQuery, wantQuery) {
+		return fmt.Errorf("handler saw query %q, expected %q", resp.Header.Get("X-Verify-Query"), query)
+	}
+	return nil
+}
+
+func checkRepeatedHeaders(client *http.Client, base string) error {
+	header := http.Header{"X-Verify-Multi": {"one", "two", "three"}}
+	resp, _, err := verifyDo(client, "GET", base+"/echo/", "", nil, header)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 200); err != nil {
+		return err
+	}
+	if got := resp.Header.Get("X-Verify-Multi"); got != "one, two, three" {
+		return fmt.Errorf("handler saw %q, expected all three values", got)
+	}
+	return nil
+}
+
+func checkDownload(size, seed int64) func(*http.Client, string) error {
+	return func(client *http.Client, base string) error {
+		resp, got, err := verifyDo(client, "GET", fmt.Sprintf("%s/blob?size=%d&seed=%d", base, size, seed), "", nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, 200); err != nil {
+			return err
+		}
+		if int64(len(got)) != size {
+			return fmt.Errorf("received %d bytes, handler sent %d", len(got), size)
+		}
+		if sha256Hex(got) != resp.Header.Get("X-Verify-SHA256") {
+			return fmt.Errorf("received a different body (sha256 mismatch)")
+		}
+		return nil
+	}
+}
+
+// Upload without an echo, so only the request direction is measured
+func checkUpload(size, seed int64) func(*http.Client, string) error {
+	return func(client *http.Client, base string) error {
+		body := verifyBlob(size, seed)
+		resp, _, err := verifyDo(client, "POST", base+"/echo/?discard=1", "application/octet-stream", body, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, 204); err != nil {
+			return err
+		}
+		return checkReceived(resp, body)
+	}
+}
+
+func checkCookies(client *http.Client, base string) error {
+	resp, _, err := verifyDo(client, "GET", base+"/cookies", "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 204); err != nil {
+		return err
+	}
+	var names []string
+	for _, c := range resp.Cookies() {
+		names = append(names, c.Name+"="+c.Value)
+	}
+	if strings.Join(names, " ") != "a=1 b=2 c=3" {
+		return fmt.Errorf("received cookies %v, expected a=1 b=2 c=3", names)
+	}
+	return nil
+}
+
+func checkRedirect(client *http.Client, base string) error {
+	resp, _, err := verifyDo(client, "GET", base+"/redirect", "", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 302); err != nil {
+		return err
+	}
+	location := resp.Header.Get("Location")
+	if !strings.HasSuffix(location, VerifyPrefix+"/echo/?from=redirect") {
+		return fmt.Errorf("Location %q, expected %s/echo/?from=redirect", location, VerifyPrefix)
+	}
+	return nil
+}
+
+func checkStatusCodes(client *http.Client, base string) error {
+	for _, code := range []int{201, 404, 418, 422} {
+		resp, body, err := verifyDo(client, "GET", fmt.Sprintf("%s/status?code=%d", base, code), "", nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, code); err != nil {
+			return err
+		}
+		if want := fmt.Sprintf("status %d\n", code); string(body) != want {
+			return fmt.Errorf("body of %d was %q, expected %q", code, body, want)
+		}
+	}
+	return nil
+}
+
+func checkCompressed(client *http.Client, base string) error {
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	resp, got, err := verifyDo(client, "GET", base+"/gzip", "", nil, header)
+	if err != nil {
+		return err
+	}
+	if err := expectStatus(resp, 200); err != nil {
+		return err
+	}
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return fmt.Errorf("Content-Encoding %q, expected gzip", resp.Header.Get("Content-Encoding"))
+	}
+	if !bytes.Equal(got, gzipped(verifyGzipText)) {
+		return fmt.Errorf("compressed body differs (%d bytes)", len(got))
+	}
+	return nil
+}
+
+// Send n requests at once and check each gets its own response
+func checkBurst(n int) func(*http.Client, string) error {
+	return func(client *http.Client, base string) error {
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := []byte(fmt.Sprintf("burst request %d", i))
+				resp, got, err := verifyDo(client, "POST", fmt.Sprintf("%s/echo/%d", base, i), "text/plain", body, nil)
+				switch {
+				case err != nil:
+					errs[i] = err
+				case resp.StatusCode != 200:
+					errs[i] = fmt.Errorf("status %d", resp.StatusCode)
+				case !bytes.Equal(got, body):
+					errs[i] = fmt.Errorf("got %q", got)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		failed := 0
+		var first error
+		for i, err := range errs {
+			if err != nil {
+				if first == nil {
+					first = fmt.Errorf("request %d: %v", i, err)
+				}
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d failed, first: %v", failed, n, first)
+		}
+		return nil
+	}
+}
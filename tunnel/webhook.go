@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capability under which the server sends each request body as received,
+// base64 encoded in rawBody, besides the parsed body
+const CapRawBody = "raw-body"
+
+// Exact bytes of a request body, if the server sent them
+func rawRequestBody(request IncomingRequest) ([]byte, bool, error) {
+	if request.RawBody == nil {
+		return nil, false, nil
+	}
+	body, err := base64.StdEncoding.DecodeString(*request.RawBody)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid raw body: %v", err)
+	}
+	return body, true, nil
+}
+
+// Webhook providers accepted by --verify-webhook
+const (
+	WebhookGitHub = "github"
+	WebhookStripe = "stripe"
+	WebhookHMAC   = "hmac"
+)
+
+// Default for Stripe's tolerance between its timestamp and our clock
+const DefaultWebhookTolerance = 5 * time.Minute
+
+// Signature check from --verify-webhook, nil when off
+type webhookVerifier struct {
+	provider  string
+	secret    []byte
+	header    string        // hmac: header carrying the signature
+	prefix    string        // hmac: text before the signature, e.g. "sha256="
+	encoding  string        // hmac: hex or base64
+	tolerance time.Duration // stripe: accepted timestamp age
+}
+
+// Parse --verify-webhook, a list of key=value pairs separated by commas or
+// spaces: provider=github|stripe|hmac and secret=VALUE or secret-env=NAME,
+// plus header=, prefix= and encoding=hex|base64 for hmac and tolerance=
+// for stripe
+func parseWebhookVerifier(spec string) (*webhookVerifier, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	v := &webhookVerifier{header: "X-Signature", encoding: "hex", tolerance: DefaultWebhookTolerance}
+	fields := strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' })
+	for _, field := range fields {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid --verify-webhook field %q (expected key=value)", field)
+		}
+		switch strings.ToLower(key) {
+		case "provider":
+			v.provider = strings.ToLower(value)
+		case "secret":
+			v.secret = []byte(value)
+		case "secret-env":
+			secret := os.Getenv(value)
+			if secret == "" {
+				return nil, fmt.Errorf("--verify-webhook: %s is not set", value)
+			}
+			v.secret = []byte(secret)
+		case "header":
+			v.header = value
+		case "prefix":
+			v.prefix = value
+		case "encoding":
+			v.encoding = strings.ToLower(value)
+		case "tolerance":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid --verify-webhook tolerance %q", value)
+			}
+			v.tolerance = d
+		default:
+			return nil, fmt.Errorf("unknown --verify-webhook field %q", key)
+		}
+	}
+
+	switch v.provider {
+	case WebhookGitHub, WebhookStripe:
+	case WebhookHMAC:
+		if !validHeaderName(v.header) {
+			return nil, fmt.Errorf("invalid --verify-webhook header %q", v.header)
+		}
+		if v.encoding != "hex" && v.encoding != "base64" {
+			return nil, fmt.Errorf("invalid --verify-webhook encoding %q (use hex or base64)", v.encoding)
+		}
+	case "":
+		return nil, fmt.Errorf("--verify-webhook needs provider=github, stripe or hmac")
+	default:
+		return nil, fmt.Errorf("unknown --verify-webhook provider %q (use github, stripe or hmac)", v.provider)
+	}
+	if len(v.secret) == 0 {
+		return nil, fmt.Errorf("--verify-webhook needs secret= or secret-env=")
+	}
+	return v, nil
+}
+
+// The value with any secret masked, for print-config
+func maskWebhookSpec(spec string) string {
+	fields := strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' })
+	for i, field := range fields {
+		if key, value, ok := strings.Cut(field, "="); ok && strings.EqualFold(key, "secret") {
+			fields[i] = key + "=" + maskSecret(value)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Check a request's signature over its body, returning why it failed
+func (v *webhookVerifier) verify(headers HeaderMap, body []byte, now time.Time) error {
+	switch v.provider {
+	case WebhookGitHub:
+		signature, ok := strings.CutPrefix(headers.Get("x-hub-signature-256"), "sha256=")
+		if !ok {
+			return fmt.Errorf("missing X-Hub-Signature-256")
+		}
+		return checkHexMAC(v.secret, body, signature)
+	case WebhookStripe:
+		return v.verifyStripe(headers.Get("stripe-signature"), body, now)
+	default:
+		value := headers.Get(v.header)
+		if value == "" {
+			return fmt.Errorf("missing %s", v.header)
+		}
+		signature, ok := strings.CutPrefix(value, v.prefix)
+		if !ok {
+			return fmt.Errorf("%s doesn't start with %q", v.header, v.prefix)
+		}
+		if v.encoding == "hex" {
+			return checkHexMAC(v.secret, body, signature)
+		}
+		got, err := base64.StdEncoding.DecodeString(signature)
+		if err != nil || !hmac.Equal(got, computeMAC(v.secret, body)) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	}
+}
+
+// Stripe-Signature is "t=TIMESTAMP,v1=SIG[,v1=SIG...]", each v1 an HMAC of
+// "TIMESTAMP.BODY"; several appear while a secret is being rolled
+func (v *webhookVerifier) verifyStripe(header string, body []byte, now time.Time) error {
+	if header == "" {
+		return fmt.Errorf("missing Stripe-Signature")
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return fmt.Errorf("malformed Stripe-Signature")
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > v.tolerance || age < -v.tolerance {
+		return fmt.Errorf("timestamp outside the %s tolerance", v.tolerance)
+	}
+	payload := append([]byte(timestamp+"."), body...)
+	for _, signature := range signatures {
+		if checkHexMAC(v.secret, payload, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("signature mismatch")
+}
+
+func computeMAC(secret, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func checkHexMAC(secret, body []byte, signature string) error {
+	got, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !hmac.Equal(got, computeMAC(secret, body)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
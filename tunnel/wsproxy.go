@@ -0,0 +1,311 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message relaying a tunneled WebSocket connection, keyed by connection ID.
+// The server sends "ws-open" to start one; "ws-data" and "ws-close" flow in
+// both directions, and the client answers a successful open with "ws-opened".
+type WSMessage struct {
+	Type     string    `json:"type"`
+	ID       MessageID `json:"id"`
+	Path     string    `json:"path,omitempty"`
+	Headers  HeaderMap `json:"headers,omitempty"`
+	Protocol string    `json:"protocol,omitempty"`
+	Binary   bool      `json:"binary,omitempty"`
+	Data     string    `json:"data,omitempty"`
+	Code     int       `json:"code,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// Headers the local dial negotiates itself and must not be copied
+var wsHandshakeHeaders = map[string]bool{
+	"upgrade":                  true,
+	"connection":               true,
+	"sec-websocket-key":        true,
+	"sec-websocket-version":    true,
+	"sec-websocket-extensions": true,
+	"sec-websocket-protocol":   true,
+	"host":                     true,
+	"content-length":           true,
+}
+
+// Local WebSocket connections opened through one tunnel connection
+type wsProxy struct {
+	ws     *tunnelConn
+	target *localTarget
+
+	mu    sync.Mutex
+	conns map[string]*localWebSocket
+}
+
+// One relayed connection to the local app
+type localWebSocket struct {
+	id   MessageID
+	conn *websocket.Conn
+	out  chan WSMessage
+	done chan struct{}
+	once sync.Once
+	log  Logger
+}
+
+func newWSProxy(ws *tunnelConn, target *localTarget) *wsProxy {
+	return &wsProxy{ws: ws, target: target, conns: map[string]*localWebSocket{}}
+}
+
+// Handle a ws-* message from the tunnel server
+func (p *wsProxy) handle(msg WSMessage) {
+	key := msg.ID.String()
+	switch msg.Type {
+	case "ws-open":
+		go p.open(msg)
+	case "ws-data":
+		if c := p.get(key); c != nil {
+			select {
+			case c.out <- msg:
+			case <-c.done:
+			}
+		}
+	case "ws-close":
+		if c := p.get(key); c != nil {
+			p.remove(key)
+			code := msg.Code
+			if code == 0 {
+				code = websocket.CloseNormalClosure
+			}
+			c.close(code, msg.Reason)
+		}
+	}
+}
+
+// Close an upgrade the local app never sees with code and reason, logging
+// why
+func (p *wsProxy) refuse(msg WSMessage, code int, reason, why string) {
+	p.target.log.Dim(fmt.Sprintf("WS %s -> rejected (%s)", msg.Path, why))
+	p.ws.writeJSON(wsQueueKey(msg.ID.String()), WSMessage{
+		Type:   "ws-close",
+		ID:     msg.ID,
+		Code:   code,
+		Reason: reason,
+	})
+}
+
+func (p *wsProxy) get(key string) *localWebSocket {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[key]
+}
+
+func (p *wsProxy) remove(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, key)
+}
+
+// Dial the local app and start relaying in both directions. Upgrades go
+// through the same gates as requests, in the same order.
+func (p *wsProxy) open(msg WSMessage) {
+	key := msg.ID.String()
+	ip, hasIP := clientIP(msg.Headers)
+	if !p.target.ipFilter.allows(ip, hasIP) {
+		p.refuse(msg, websocket.ClosePolicyViolation, "forbidden", describeIP(ip, hasIP)+" not allowed")
+		return
+	}
+	// Upgrades are GET requests, so --allow and --deny see them as such
+	if ok, rule := p.target.filter.allows(http.MethodGet, msg.Path, msg.Headers); !ok {
+		p.refuse(msg, websocket.ClosePolicyViolation, "forbidden", describeDenial(rule))
+		return
+	}
+	by := ""
+	if p.target.identity != nil {
+		email, err := p.target.identity.verify(msg.Headers, p.ws.getPublicHost())
+		if err != nil {
+			p.refuse(msg, websocket.ClosePolicyViolation, "forbidden", err.Error())
+			return
+		}
+		by = " by " + email
+		msg.Headers.Set(ForwardedEmailHeader, email)
+	}
+	if _, ok := p.target.rateLimit.allow(ip, hasIP); !ok {
+		traffic.rateLimited.Add(1)
+		p.refuse(msg, websocket.CloseTryAgainLater, "rate limited", describeIP(ip, hasIP)+" over the rate limit")
+		return
+	}
+	if !p.target.auth.allows(msg.Headers.Get("authorization")) {
+		p.refuse(msg, websocket.ClosePolicyViolation, "unauthorized", "basic auth required")
+		return
+	}
+	if p.target.paused.Load() {
+		p.refuse(msg, websocket.CloseTryAgainLater, "paused", errPaused.Error())
+		return
+	}
+	if p.target.budget.exhausted() {
+		p.refuse(msg, websocket.CloseTryAgainLater, "budget used up", errBudgetSpent.Error())
+		return
+	}
+
+	// Upgrades are GET requests, so they follow the GET route
+	backend := p.target.route(http.MethodGet, msg.Path)
+	if backend.Dir != "" {
+		p.refuse(msg, websocket.CloseUnsupportedData, "not supported by a static site", "serving files")
+		return
+	}
+	backend.served.Add(1)
+	p.target.log.Dim(fmt.Sprintf("WS %s -> %s%s", msg.Path, backend.Addr(), by))
+
+	header := http.Header{}
+	for name, values := range msg.Headers {
+		if !wsHandshakeHeaders[name] {
+			for _, v := range values {
+				header.Add(name, v)
+			}
+		}
+	}
+	// The dialer takes the Host header as the request's host
+	if host := backend.hostHeader(msg.Headers, p.ws.getPublicHost()); host != "" {
+		header.Set("Host", host)
+	}
+	backend.requestRules.apply(header)
+
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:  backend.tlsConfig,
+	}
+	if backend.Socket != "" {
+		dialer.NetDialContext = unixDialer(backend.Socket)
+	}
+	if protocols := msg.Headers.Get("sec-websocket-protocol"); protocols != "" {
+		for _, proto := range strings.Split(protocols, ",") {
+			dialer.Subprotocols = append(dialer.Subprotocols, strings.TrimSpace(proto))
+		}
+	}
+
+	conn, _, err := dialer.Dial(backend.WebSocketURL(backend.localPath(msg.Path)), header)
+	if err != nil {
+		p.target.log.Error(fmt.Sprintf("WebSocket proxy error: %v", err))
+		p.ws.writeJSON(wsQueueKey(key), WSMessage{
+			Type:   "ws-close",
+			ID:     msg.ID,
+			Code:   websocket.CloseInternalServerErr,
+			Reason: "local connection failed",
+		})
+		return
+	}
+
+	c := &localWebSocket{
+		id:   msg.ID,
+		conn: conn,
+		out:  make(chan WSMessage, 64),
+		done: make(chan struct{}),
+		log:  p.target.log,
+	}
+	p.mu.Lock()
+	p.conns[key] = c
+	p.mu.Unlock()
+
+	if err := p.ws.writeJSON(wsQueueKey(key), WSMessage{
+		Type:     "ws-opened",
+		ID:       msg.ID,
+		Protocol: conn.Subprotocol(),
+	}); err != nil {
+		p.remove(key)
+		c.close(websocket.CloseGoingAway, "")
+		return
+	}
+
+	go c.writeLoop()
+	go p.readLoop(key, c)
+}
+
+// Relay frames from the local app to the tunnel until either side closes
+func (p *wsProxy) readLoop(key string, c *localWebSocket) {
+	for {
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			// Report the local side going away so the remote client sees a close
+			code, reason := websocket.CloseAbnormalClosure, "local connection dropped"
+			if ce, ok := err.(*websocket.CloseError); ok {
+				code, reason = ce.Code, ce.Text
+			}
+			if p.get(key) == c {
+				p.remove(key)
+				p.ws.writeJSON(wsQueueKey(key), WSMessage{Type: "ws-close", ID: c.id, Code: code, Reason: reason})
+			}
+			c.close(code, reason)
+			return
+		}
+
+		msg := WSMessage{Type: "ws-data", ID: c.id}
+		if messageType == websocket.BinaryMessage {
+			msg.Binary = true
+			msg.Data = base64.StdEncoding.EncodeToString(data)
+		} else {
+			msg.Data = string(data)
+		}
+		if err := p.ws.writeJSON(wsQueueKey(key), msg); err != nil {
+			c.close(websocket.CloseGoingAway, "")
+			return
+		}
+	}
+}
+
+// Close every relayed connection, used when the tunnel drops
+func (p *wsProxy) closeAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = map[string]*localWebSocket{}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.close(websocket.CloseGoingAway, "tunnel disconnected")
+	}
+}
+
+// Write frames from the tunnel to the local app in order
+func (c *localWebSocket) writeLoop() {
+	for {
+		select {
+		case msg := <-c.out:
+			messageType, data := websocket.TextMessage, []byte(msg.Data)
+			if msg.Binary {
+				decoded, err := base64.StdEncoding.DecodeString(msg.Data)
+				if err != nil {
+					c.log.Error(fmt.Sprintf("Invalid WebSocket frame: %v", err))
+					continue
+				}
+				messageType, data = websocket.BinaryMessage, decoded
+			}
+			if err := c.conn.WriteMessage(messageType, data); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Send a close frame to the local app and release the connection
+func (c *localWebSocket) close(code int, reason string) {
+	c.once.Do(func() {
+		close(c.done)
+		if code != websocket.CloseAbnormalClosure {
+			deadline := time.Now().Add(time.Second)
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+		}
+		c.conn.Close()
+	})
+}
+
+// Writer queue for a relayed connection, separate from HTTP response queues
+func wsQueueKey(key string) string {
+	return "ws:" + key
+}